@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
+	"time"
+
 	"github.com/teejays/clog"
 
 	"github.com/teejays/n-factor-vault/backend/library/env"
 	"github.com/teejays/n-factor-vault/backend/library/orm"
 
+	"github.com/teejays/n-factor-vault/backend/src/audit"
+	"github.com/teejays/n-factor-vault/backend/src/auth"
+	"github.com/teejays/n-factor-vault/backend/src/org"
 	"github.com/teejays/n-factor-vault/backend/src/secret"
 	"github.com/teejays/n-factor-vault/backend/src/server"
 	"github.com/teejays/n-factor-vault/backend/src/totp"
@@ -42,12 +48,30 @@ func mainWithError() error {
 	}
 
 	// Initialize the services: the order should be important ideally, so dependent services are initialized later
+	clog.Info("Initializing Audit Service...")
+	err = audit.Init()
+	if err != nil {
+		return err
+	}
+
+	clog.Info("Initializing Auth Service...")
+	err = auth.Init()
+	if err != nil {
+		return err
+	}
+
 	clog.Info("Initializing User Service...")
 	err = user.Init()
 	if err != nil {
 		return err
 	}
 
+	clog.Info("Initializing Org Service...")
+	err = org.Init()
+	if err != nil {
+		return err
+	}
+
 	clog.Info("Initializing Vault Service...")
 	err = vault.Init()
 	if err != nil {
@@ -66,6 +90,10 @@ func mainWithError() error {
 		return err
 	}
 
+	// Start the background jobs
+	clog.Info("Starting the vault purger...")
+	go vault.RunPurger(context.Background(), time.Hour)
+
 	// Start the webserver
 	clog.Info("Initializing the server...")
 	err = server.StartServer("", port)
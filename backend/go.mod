@@ -13,10 +13,10 @@ require (
 	github.com/jinzhu/gorm v1.9.10
 	github.com/leodido/go-urn v1.1.0 // indirect
 	github.com/lib/pq v1.1.1
+	github.com/makiuchi-d/gozxing v0.1.1
 	github.com/pkg/errors v0.8.1
 	github.com/stretchr/testify v1.3.0
 	github.com/teejays/clog v0.0.0-20181107215916-71000d459f17
-	github.com/teejays/go-jwt v0.0.0-20190706230638-0b0c25b6a8f9
 	golang.org/x/crypto v0.0.0-20190701094942-4def268fd1a4
 	gopkg.in/go-playground/assert.v1 v1.2.1 // indirect
 	gopkg.in/go-playground/validator.v9 v9.29.1
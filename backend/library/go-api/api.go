@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 
@@ -43,10 +44,13 @@ func GetHandler(routes []Route, authMiddlewareFunc MiddlewareFunc, preMiddleware
 		m.Use(mux.MiddlewareFunc(mw))
 	}
 
-	// Create an authenticated subrouter
+	// Create an authenticated subrouter. The scope of the route is added to the request context before the
+	// authentication middleware is called.
+	scopes := make(map[*mux.Route]string)
 	var a *mux.Router
 	if authMiddlewareFunc != nil {
 		a = m.PathPrefix("").Subrouter()
+		a.Use(routeScopeMiddleware(scopes))
 		a.Use(mux.MiddlewareFunc(authMiddlewareFunc))
 	}
 
@@ -62,8 +66,11 @@ func GetHandler(routes []Route, authMiddlewareFunc MiddlewareFunc, preMiddleware
 			r = a
 		}
 		// Register the route
-		r.HandleFunc(route.GetPattern(), route.HandlerFunc).
+		mr := r.HandleFunc(route.GetPattern(), route.HandlerFunc).
 			Methods(route.Method)
+		if route.Scope != "" {
+			scopes[mr] = route.Scope
+		}
 	}
 
 	// Set up pre handler middlewares
@@ -76,7 +83,7 @@ func GetHandler(routes []Route, authMiddlewareFunc MiddlewareFunc, preMiddleware
 	// as long as we're just developing. This shouldn't really go on prod.
 	originsOk := handlers.AllowedOrigins([]string{"*"})
 	headersOk := handlers.AllowedHeaders([]string{"content-type"})
-	methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "OPTIONS"})
+	methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"})
 	h := handlers.CORS(originsOk, headersOk, methodsOk)(m)
 
 	return h, nil
@@ -85,6 +92,29 @@ func GetHandler(routes []Route, authMiddlewareFunc MiddlewareFunc, preMiddleware
 // MiddlewareFunc can be inserted in a server for processing
 type MiddlewareFunc mux.MiddlewareFunc
 
+type contextKey string
+
+const gCtxKeyRouteScope = contextKey("route_scope")
+
+// GetRouteScope returns the scope of the route that the request was matched to, or an empty string if the route has
+// no scope
+func GetRouteScope(r *http.Request) string {
+	scope, _ := r.Context().Value(gCtxKeyRouteScope).(string)
+	return scope
+}
+
+// routeScopeMiddleware adds the scope of the matched route to the request context
+func routeScopeMiddleware(scopes map[*mux.Route]string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if scope, ok := scopes[mux.CurrentRoute(r)]; ok {
+				r = r.WithContext(context.WithValue(r.Context(), gCtxKeyRouteScope, scope))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 // LoggerMiddleware is a http.Handler middleware function that logs any request received
 func LoggerMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetRouteScope(t *testing.T) {
+	var got string
+	h := func(w http.ResponseWriter, r *http.Request) {
+		got = GetRouteScope(r)
+	}
+	auth := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if GetRouteScope(r) == "" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	routes := []Route{
+		{Method: http.MethodGet, Version: 1, Path: "secret", HandlerFunc: h, Authenticate: true, Scope: "secret.reveal"},
+		{Method: http.MethodGet, Version: 1, Path: "vault", HandlerFunc: h, Authenticate: true},
+	}
+	m, err := GetHandler(routes, auth, nil, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/secret", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "secret.reveal", got)
+
+	w = httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/vault", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
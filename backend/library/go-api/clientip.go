@@ -0,0 +1,108 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// HeaderForwardedFor is the header that reverse proxies use to pass on the IP of the client (and of any proxies before
+// them)
+const HeaderForwardedFor = "X-Forwarded-For"
+
+var gTrustedProxies []*net.IPNet
+var gTrustedProxiesLock sync.RWMutex
+
+// SetTrustedProxies sets the IPs, or CIDR ranges, of the reverse proxies that we trust to set the X-Forwarded-For
+// header. The header is ignored for requests that don't come from a trusted proxy, since anyone can set it.
+func SetTrustedProxies(proxies []string) error {
+	var nets []*net.IPNet
+	for _, p := range proxies {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		n, err := ParseCIDR(p)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy: %v", err)
+		}
+		nets = append(nets, n)
+	}
+
+	gTrustedProxiesLock.Lock()
+	defer gTrustedProxiesLock.Unlock()
+	gTrustedProxies = nets
+	return nil
+}
+
+// GetClientIP returns the IP of the client that made the request. If the request came through trusted proxies, the
+// client IP is the right-most IP in the X-Forwarded-For header that isn't a trusted proxy. It returns an empty string
+// if the IP cannot be determined.
+func GetClientIP(r *http.Request) string {
+	ip := parseIP(r.RemoteAddr)
+	if ip == nil {
+		return ""
+	}
+
+	// The forwarded IPs are appended by each proxy, so we walk them from the right, as long as they are added by a
+	// proxy that we trust
+	if isTrustedProxy(ip) {
+		forwarded := strings.Split(strings.Join(r.Header[http.CanonicalHeaderKey(HeaderForwardedFor)], ","), ",")
+		for i := len(forwarded) - 1; i >= 0; i-- {
+			fip := parseIP(forwarded[i])
+			if fip == nil {
+				break
+			}
+			ip = fip
+			if !isTrustedProxy(fip) {
+				break
+			}
+		}
+	}
+
+	return ip.String()
+}
+
+// ParseCIDR parses a CIDR range, e.g. 10.0.0.0/8. A single IP is parsed as a range with only that IP.
+func ParseCIDR(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("'%s' is not a valid IP or CIDR range", s)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("'%s' is not a valid IP or CIDR range", s)
+	}
+	return n, nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	gTrustedProxiesLock.RLock()
+	defer gTrustedProxiesLock.RUnlock()
+	for _, n := range gTrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIP parses an IP which may have a port, e.g. the RemoteAddr of a request
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(s)
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetClientIP(t *testing.T) {
+	err := SetTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetTrustedProxies(nil)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{
+			name:       "remote address if there's no proxy",
+			remoteAddr: "203.0.113.7:51234",
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "forwarded header is ignored if the request is not from a trusted proxy",
+			remoteAddr: "203.0.113.7:51234",
+			forwarded:  []string{"198.51.100.1"},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "forwarded IP if the request is from a trusted proxy",
+			remoteAddr: "10.1.2.3:443",
+			forwarded:  []string{"198.51.100.1"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "right-most untrusted IP through a chain of trusted proxies",
+			remoteAddr: "10.1.2.3:443",
+			forwarded:  []string{"1.1.1.1, 198.51.100.1, 192.168.1.1"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "multiple forwarded headers are combined",
+			remoteAddr: "10.1.2.3:443",
+			forwarded:  []string{"1.1.1.1", "198.51.100.1"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "spoofed left-most IP is not trusted",
+			remoteAddr: "10.1.2.3:443",
+			forwarded:  []string{"10.9.9.9, 198.51.100.1"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "proxy IP if the forwarded header is garbage",
+			remoteAddr: "10.1.2.3:443",
+			forwarded:  []string{"not-an-ip"},
+			want:       "10.1.2.3",
+		},
+		{
+			name:       "IPv6 remote address",
+			remoteAddr: "[2001:db8::1]:443",
+			want:       "2001:db8::1",
+		},
+		{
+			name:       "empty if the remote address is invalid",
+			remoteAddr: "pipe",
+			want:       "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, f := range tt.forwarded {
+				r.Header.Add(HeaderForwardedFor, f)
+			}
+			assert.Equal(t, tt.want, GetClientIP(r))
+		})
+	}
+}
+
+func TestParseCIDR(t *testing.T) {
+	n, err := ParseCIDR("10.0.0.0/8")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.0/8", n.String())
+
+	n, err = ParseCIDR("203.0.113.7")
+	assert.NoError(t, err)
+	assert.Equal(t, "203.0.113.7/32", n.String())
+
+	n, err = ParseCIDR("2001:db8::1")
+	assert.NoError(t, err)
+	assert.Equal(t, "2001:db8::1/128", n.String())
+
+	_, err = ParseCIDR("10.0.0.0/33")
+	assert.Error(t, err)
+	_, err = ParseCIDR("office")
+	assert.Error(t, err)
+}
@@ -37,6 +37,33 @@ func GetQueryParamInt(r *http.Request, name string, defaultVal int) (int, error)
 	return val, nil
 }
 
+// GetQueryParamStr extracts the param value with given name out of the URL query. It returns the defaultVal if the
+// param is not present.
+func GetQueryParamStr(r *http.Request, name string, defaultVal string) (string, error) {
+	values, err := GetQueryParamStrs(r, name)
+	if err != nil {
+		return defaultVal, err
+	}
+	if len(values) < 1 {
+		return defaultVal, nil
+	}
+	if len(values) > 1 {
+		return defaultVal, fmt.Errorf("multiple URL form values found for %s", name)
+	}
+	return values[0], nil
+}
+
+// GetQueryParamStrs extracts all the values of the param with given name out of the URL query e.g. ?tag=a&tag=b
+func GetQueryParamStrs(r *http.Request, name string) ([]string, error) {
+	err := r.ParseForm()
+	if err != nil {
+		return nil, err
+	}
+	values := r.Form[name]
+	clog.Debugf("URL values for %s: %+v", name, values)
+	return values, nil
+}
+
 // GetMuxParamInt extracts the param with given name out of the route path
 func GetMuxParamInt(r *http.Request, name string) (int64, error) {
 
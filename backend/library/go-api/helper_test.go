@@ -0,0 +1,27 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetQueryParamStr(t *testing.T) {
+	r := httptest.NewRequest("GET", "/v1/vaults?q=facebook&tag=prod&tag=infra", nil)
+
+	got, err := GetQueryParamStr(r, "q", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "facebook", got)
+
+	got, err = GetQueryParamStr(r, "sort", "name")
+	assert.NoError(t, err)
+	assert.Equal(t, "name", got)
+
+	_, err = GetQueryParamStr(r, "tag", "")
+	assert.Error(t, err)
+
+	tags, err := GetQueryParamStrs(r, "tag")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"prod", "infra"}, tags)
+}
@@ -12,6 +12,9 @@ type Route struct {
 	Path         string
 	HandlerFunc  http.HandlerFunc
 	Authenticate bool
+	// Scope is what the route does, e.g. secret.request. Authentication middlewares can get it with GetRouteScope, to
+	// decide whether a token that is limited to some scopes can be used for the route.
+	Scope string
 }
 
 // GetPattern returns the url match pattern for the route
@@ -0,0 +1,245 @@
+// Package jwt creates and verifies JSON Web Tokens (RFC 7519) signed with asymmetric keys. Tokens carry the ID of the
+// key that signed them in the kid header, so the signing key can be rotated while the tokens signed with the previous
+// key are still accepted. The public keys can be shared as a JSON Web Key Set, so that other services can verify the
+// tokens without sharing a secret.
+package jwt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/teejays/clog"
+)
+
+const gHeaderTyp = "JWT"
+
+// gEncoding is the base64url encoding, without padding, that the parts of the token are encoded with
+var gEncoding = base64.RawURLEncoding
+
+// ErrInvalidToken is returned when a token is malformed, or signed by a key that we don't know of
+var ErrInvalidToken = fmt.Errorf("JWT is invalid")
+
+// ErrInvalidSignature is returned when the signature of a token doesn't match its content
+var ErrInvalidSignature = fmt.Errorf("JWT signature verification failed")
+
+// Header represents the header part of a JWT
+type Header struct {
+	Type      string    `json:"typ"`
+	Algorithm Algorithm `json:"alg"`
+	KeyID     string    `json:"kid,omitempty"`
+}
+
+// Claim represents the claim part of JWT. Since we want to allow use of custom claim types,
+// this is an interface with just one requirement - we should be able to get the basic/minimum
+// required fields for a JWT claim.
+type Claim interface {
+	GetBaseClaim() *BaseClaim
+	VerifyTimestamps() error
+}
+
+// BaseClaim represents all the minimum required fields for a JWT claim, as per RFC 7519 standard. The timestamps are
+// unix times in seconds.
+type BaseClaim struct {
+	// Issuer is the authority that generated the JWT
+	Issuer string `json:"iss,omitempty"`
+	// Subject is the main entity which is using the JWT, e.g. user
+	Subject   string `json:"sub,omitempty"`
+	Audience  string `json:"aud,omitempty"`
+	ExpireAt  int64  `json:"exp"`
+	NotBefore int64  `json:"nbf"`
+	IssuedAt  int64  `json:"iat"`
+	// UniqueID is a unique identifier for the JWT
+	UniqueID string `json:"jti,omitempty"`
+}
+
+// GetBaseClaim returns the BaseClaim type, which should contain all the
+// minimum required JWT claim fields
+func (bc *BaseClaim) GetBaseClaim() *BaseClaim {
+	return bc
+}
+
+// VerifyTimestamps verifies that the claim is valid i.e. not expired and not too early
+func (bc *BaseClaim) VerifyTimestamps() error {
+	now := time.Now().Unix()
+
+	// Make sure that the JWT token has not expired
+	clog.Debugf("JWT: token expiry: %v", bc.ExpireAt)
+	if bc.ExpireAt <= now {
+		return fmt.Errorf("JWT has expired")
+	}
+
+	clog.Debugf("JWT: token valid not before: %v", bc.NotBefore)
+	if bc.NotBefore > now {
+		return fmt.Errorf("JWT is not valid yet")
+	}
+
+	return nil
+}
+
+// Client signs tokens with one key, and verifies tokens signed with any of its keys
+type Client struct {
+	signingKey *Key
+	keys       map[string]*Key
+	lifespan   time.Duration
+}
+
+// NewClient returns a client that signs tokens with the signing key, which should be a private key. Tokens signed by
+// the signing key or by any of the verification keys are accepted, e.g. the previous signing key during a rotation.
+func NewClient(signingKey *Key, verificationKeys []*Key, lifespan time.Duration) (*Client, error) {
+	if signingKey == nil || !signingKey.CanSign() {
+		return nil, fmt.Errorf("signing key should be a private key")
+	}
+	if lifespan <= 0 {
+		return nil, fmt.Errorf("lifespan should be positive")
+	}
+
+	c := Client{signingKey: signingKey, keys: map[string]*Key{signingKey.ID: signingKey}, lifespan: lifespan}
+	for _, k := range verificationKeys {
+		if _, exists := c.keys[k.ID]; exists {
+			continue
+		}
+		c.keys[k.ID] = k
+	}
+	return &c, nil
+}
+
+// CreateToken sets the timestamps of the claim, and returns it as a token signed by the signing key
+func (c *Client) CreateToken(claim Claim) (string, error) {
+
+	baseClaim := claim.GetBaseClaim()
+
+	now := time.Now()
+	baseClaim.ExpireAt = now.Add(c.lifespan).Unix()
+	baseClaim.IssuedAt = now.Unix()
+	baseClaim.NotBefore = now.Unix()
+
+	clog.Debugf("JWT: Creating Token: Lifespan: %v", c.lifespan)
+	clog.Debugf("JWT: Creating Token: Expiry: %v", baseClaim.ExpireAt)
+
+	var header = Header{
+		Type:      gHeaderTyp,
+		Algorithm: c.signingKey.Algorithm,
+		KeyID:     c.signingKey.ID,
+	}
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	claimJSON, err := json.Marshal(claim)
+	if err != nil {
+		return "", err
+	}
+
+	data := gEncoding.EncodeToString(headerJSON) + "." + gEncoding.EncodeToString(claimJSON)
+	signature, err := c.signingKey.sign([]byte(data))
+	if err != nil {
+		return "", fmt.Errorf("signing JWT: %v", err)
+	}
+
+	return data + "." + gEncoding.EncodeToString(signature), nil
+}
+
+// VerifyAndDecode verifies the signature and the timestamps of the token, and decodes its claim into claim
+func (c *Client) VerifyAndDecode(token string, claim Claim) error {
+	return verifyAndDecode(c.keys, token, claim)
+}
+
+// JWKS returns the public keys that tokens are verified with, as a JSON Web Key Set
+func (c *Client) JWKS() JWKSet {
+	var ids []string
+	for id := range c.keys {
+		if id != c.signingKey.ID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	var set = JWKSet{Keys: []JWK{c.signingKey.JWK()}}
+	for _, id := range ids {
+		set.Keys = append(set.Keys, c.keys[id].JWK())
+	}
+	return set
+}
+
+// Verifier verifies tokens signed by another party, e.g. the ID tokens of an OpenID provider, with the public keys
+// that it shares as a JSON Web Key Set
+type Verifier struct {
+	keys map[string]*Key
+}
+
+// NewVerifier returns a verifier for the tokens signed by the keys of the set. Keys that aren't for signatures, or
+// whose type we don't support, are skipped.
+func NewVerifier(set JWKSet) (*Verifier, error) {
+	v := Verifier{keys: make(map[string]*Key)}
+	for _, j := range set.Keys {
+		if j.Use != "" && j.Use != "sig" {
+			continue
+		}
+		k, err := ParseJWK(j)
+		if err != nil {
+			clog.Warnf("JWT: skipping key %q of the key set: %v", j.KeyID, err)
+			continue
+		}
+		v.keys[k.ID] = k
+	}
+	if len(v.keys) == 0 {
+		return nil, fmt.Errorf("no supported keys in the key set")
+	}
+	return &v, nil
+}
+
+// VerifyAndDecode verifies the signature and the timestamps of the token, and decodes its claim into claim
+func (v *Verifier) VerifyAndDecode(token string, claim Claim) error {
+	return verifyAndDecode(v.keys, token, claim)
+}
+
+// verifyAndDecode verifies the token with the key of its kid header, and decodes its claim. A token without a kid is
+// verified with the only key, if there is only one.
+func verifyAndDecode(keys map[string]*Key, token string, claim Claim) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrInvalidToken
+	}
+
+	headerJSON, err := gEncoding.DecodeString(parts[0])
+	if err != nil {
+		return ErrInvalidToken
+	}
+	var header Header
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return ErrInvalidToken
+	}
+
+	// The key is picked by its ID, and the algorithm of the token should be the key's, so a token can never make us
+	// verify it with a different algorithm than the key was meant for
+	k, ok := keys[header.KeyID]
+	if header.KeyID == "" && len(keys) == 1 {
+		for _, k = range keys {
+			ok = true
+		}
+	}
+	if !ok || header.Algorithm != k.Algorithm {
+		return ErrInvalidToken
+	}
+	signature, err := gEncoding.DecodeString(parts[2])
+	if err != nil {
+		return ErrInvalidToken
+	}
+	if !k.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return ErrInvalidSignature
+	}
+
+	claimJSON, err := gEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ErrInvalidToken
+	}
+	if err := json.Unmarshal(claimJSON, claim); err != nil {
+		return fmt.Errorf("jwt: could not decode the claim: %v", err)
+	}
+
+	return claim.VerifyTimestamps()
+}
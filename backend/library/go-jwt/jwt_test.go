@@ -0,0 +1,238 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+)
+
+type testClaim struct {
+	BaseClaim
+	UserID string `json:"uid"`
+}
+
+func TestCreateAndVerifyToken(t *testing.T) {
+	for _, k := range newTestKeys(t) {
+		t.Run(string(k.Algorithm), func(t *testing.T) {
+			c, err := NewClient(k, nil, time.Hour)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			token, err := c.CreateToken(&testClaim{UserID: "jon"})
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			var got testClaim
+			assert.NoError(t, c.VerifyAndDecode(token, &got))
+			assert.Equal(t, "jon", got.UserID)
+			assert.InDelta(t, time.Now().Add(time.Hour).Unix(), got.ExpireAt, 2)
+
+			// The content can't be changed without the key
+			parts := strings.Split(token, ".")
+			other, err := c.CreateToken(&testClaim{UserID: "jane"})
+			if !assert.NoError(t, err) {
+				return
+			}
+			tampered := parts[0] + "." + strings.Split(other, ".")[1] + "." + parts[2]
+			assert.Equal(t, ErrInvalidSignature, c.VerifyAndDecode(tampered, &got))
+
+			// Nor can the algorithm
+			header := gEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"HS256","kid":"` + k.ID + `"}`))
+			assert.Equal(t, ErrInvalidToken, c.VerifyAndDecode(header+"."+parts[1]+"."+parts[2], &got))
+
+			assert.Equal(t, ErrInvalidToken, c.VerifyAndDecode("not a token", &got))
+		})
+	}
+}
+
+func TestRotation(t *testing.T) {
+	keys := newTestKeys(t)
+	previous, current := keys[0], keys[1]
+
+	old, err := NewClient(previous, nil, time.Hour)
+	if !assert.NoError(t, err) {
+		return
+	}
+	token, err := old.CreateToken(&testClaim{UserID: "jon"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// During the overlap, the tokens signed with the previous key are still accepted
+	c, err := NewClient(current, []*Key{previous}, time.Hour)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var got testClaim
+	assert.NoError(t, c.VerifyAndDecode(token, &got))
+	assert.Equal(t, []string{current.ID, previous.ID}, []string{c.JWKS().Keys[0].KeyID, c.JWKS().Keys[1].KeyID})
+
+	// And not after it
+	c, err = NewClient(current, nil, time.Hour)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, ErrInvalidToken, c.VerifyAndDecode(token, &got))
+}
+
+func TestExpiredToken(t *testing.T) {
+	k := newTestKeys(t)[2]
+	c, err := NewClient(k, nil, time.Nanosecond)
+	if !assert.NoError(t, err) {
+		return
+	}
+	token, err := c.CreateToken(&testClaim{UserID: "jon"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	var got testClaim
+	assert.Error(t, c.VerifyAndDecode(token, &got))
+}
+
+func TestParsePEMKeys(t *testing.T) {
+	var data []byte
+	for _, k := range newTestKeys(t) {
+		b, err := x509.MarshalPKCS8PrivateKey(k.private)
+		if !assert.NoError(t, err) {
+			return
+		}
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b})...)
+
+		b, err = x509.MarshalPKIXPublicKey(k.public)
+		if !assert.NoError(t, err) {
+			return
+		}
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b})...)
+	}
+
+	keys, err := ParsePEMKeys(data)
+	if !assert.NoError(t, err) || !assert.Len(t, keys, 6) {
+		return
+	}
+	for i, want := range []Algorithm{AlgorithmRS256, AlgorithmES256, AlgorithmEdDSA} {
+		private, public := keys[2*i], keys[2*i+1]
+		assert.Equal(t, want, private.Algorithm)
+		assert.True(t, private.CanSign())
+		assert.False(t, public.CanSign())
+		assert.Equal(t, private.ID, public.ID)
+	}
+
+	_, err = ParsePEMKeys([]byte("not a key"))
+	assert.Error(t, err)
+
+	// Weak keys are not accepted
+	weak, err := rsa.GenerateKey(rand.Reader, 1024)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = NewKey(weak)
+	assert.Error(t, err)
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = NewKey(p384)
+	assert.Error(t, err)
+}
+
+func TestThumbprint(t *testing.T) {
+	// The example of RFC 7638, section 3.1
+	n, err := gEncoding.DecodeString("0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw")
+	if !assert.NoError(t, err) {
+		return
+	}
+	k, err := NewKey(&rsa.PublicKey{N: new(big.Int).SetBytes(n), E: 65537})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", k.ID)
+	assert.Equal(t, "AQAB", k.JWK().E)
+}
+
+// newTestKeys returns an RS256, an ES256 and an EdDSA key
+func newTestKeys(t *testing.T) []*Key {
+	r, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, d, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []*Key
+	for _, private := range []interface{}{r, e, d} {
+		k, err := NewKey(private)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func TestVerifier(t *testing.T) {
+	for _, k := range newTestKeys(t) {
+		t.Run(string(k.Algorithm), func(t *testing.T) {
+			c, err := NewClient(k, nil, time.Hour)
+			if !assert.NoError(t, err) {
+				return
+			}
+			token, err := c.CreateToken(&testClaim{UserID: "jon"})
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			// The verifier only has the public key, as shared in the key set
+			v, err := NewVerifier(c.JWKS())
+			if !assert.NoError(t, err) {
+				return
+			}
+			var got testClaim
+			assert.NoError(t, v.VerifyAndDecode(token, &got))
+			assert.Equal(t, "jon", got.UserID)
+
+			parts := strings.Split(token, ".")
+			assert.Equal(t, ErrInvalidSignature, v.VerifyAndDecode(parts[0]+"."+parts[1]+"."+gEncoding.EncodeToString([]byte("forged")), &got))
+		})
+	}
+}
+
+func TestParseJWK(t *testing.T) {
+	k := newTestKeys(t)[1]
+
+	j := k.JWK()
+	j.KeyID = "provider-key"
+	parsed, err := ParseJWK(j)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "provider-key", parsed.ID)
+	assert.False(t, parsed.CanSign())
+
+	j.Algorithm = "RS256"
+	_, err = ParseJWK(j)
+	assert.Error(t, err)
+
+	_, err = ParseJWK(JWK{KeyType: "oct"})
+	assert.Error(t, err)
+
+	_, err = NewVerifier(JWKSet{Keys: []JWK{{KeyType: "oct"}}})
+	assert.Error(t, err)
+}
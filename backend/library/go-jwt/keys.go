@@ -0,0 +1,303 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// Algorithm is the algorithm that a token is signed with, as in the alg header
+type Algorithm string
+
+const (
+	// AlgorithmRS256 is RSASSA-PKCS1-v1_5 with SHA-256
+	AlgorithmRS256 Algorithm = "RS256"
+	// AlgorithmES256 is ECDSA with the P-256 curve and SHA-256
+	AlgorithmES256 Algorithm = "ES256"
+	// AlgorithmEdDSA is Ed25519
+	AlgorithmEdDSA Algorithm = "EdDSA"
+)
+
+// gMinRSABits is the smallest RSA key that we accept
+const gMinRSABits = 2048
+
+// Key is a key that tokens are signed, or verified, with. Its algorithm follows from the type of the key.
+type Key struct {
+	// ID is the JWK thumbprint (RFC 7638) of the public key, which tokens carry in their kid header
+	ID        string
+	Algorithm Algorithm
+	public    crypto.PublicKey
+	private   crypto.Signer // nil if the key can only verify
+}
+
+// JWK is a public key in the JSON Web Key format (RFC 7517)
+type JWK struct {
+	KeyType   string    `json:"kty"`
+	Use       string    `json:"use,omitempty"`
+	Algorithm Algorithm `json:"alg,omitempty"`
+	KeyID     string    `json:"kid,omitempty"`
+	// RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC and OKP keys
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	Y     string `json:"y,omitempty"`
+}
+
+// JWKSet is a set of public keys in the JSON Web Key Set format, as served at a jwks_uri
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// NewKey returns a key for the private (*rsa.PrivateKey, *ecdsa.PrivateKey or ed25519.PrivateKey) or the public
+// (*rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey) key. A key made from a public key can only verify tokens.
+func NewKey(key interface{}) (*Key, error) {
+	var k Key
+
+	if signer, ok := key.(crypto.Signer); ok {
+		k.private = signer
+		key = signer.Public()
+	}
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < gMinRSABits {
+			return nil, fmt.Errorf("RSA key should be at least %d bits, but it is %d bits", gMinRSABits, pub.N.BitLen())
+		}
+		k.Algorithm = AlgorithmRS256
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("EC key should use the P-256 curve, but it uses %s", pub.Curve.Params().Name)
+		}
+		k.Algorithm = AlgorithmES256
+	case ed25519.PublicKey:
+		k.Algorithm = AlgorithmEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %T: should be an RSA, P-256 EC or Ed25519 key", key)
+	}
+	k.public = key
+
+	thumbprint, err := k.thumbprint()
+	if err != nil {
+		return nil, err
+	}
+	k.ID = thumbprint
+
+	return &k, nil
+}
+
+// ParsePEMKeys parses all the PEM encoded keys in data. Private keys can be PKCS #8, PKCS #1 (RSA) or SEC 1 (EC) keys,
+// and public keys should be PKIX keys.
+func ParsePEMKeys(data []byte) ([]*Key, error) {
+	var keys []*Key
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		var key interface{}
+		var err error
+		switch block.Type {
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		default:
+			return nil, fmt.Errorf("unsupported PEM block type '%s'", block.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %v", block.Type, err)
+		}
+
+		// Ed25519 keys are parsed as values by some Go versions, and as pointers by others
+		if p, ok := key.(*ed25519.PrivateKey); ok {
+			key = *p
+		}
+
+		k, err := NewKey(key)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no PEM encoded keys found")
+	}
+	return keys, nil
+}
+
+// ParseJWK returns a key, which can only verify tokens, for the public key in the JSON Web Key format. The ID of the
+// key is the kid of the JWK, if it has one, since that's what the tokens signed by it carry.
+func ParseJWK(j JWK) (*Key, error) {
+	var pub interface{}
+	switch {
+	case j.KeyType == "RSA":
+		n, err1 := gEncoding.DecodeString(j.N)
+		e, err2 := gEncoding.DecodeString(j.E)
+		if err1 != nil || err2 != nil || len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("RSA key has an invalid modulus or exponent")
+		}
+		pub = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	case j.KeyType == "EC" && j.Curve == "P-256":
+		x, err1 := gEncoding.DecodeString(j.X)
+		y, err2 := gEncoding.DecodeString(j.Y)
+		if err1 != nil || err2 != nil || len(x) != 32 || len(y) != 32 {
+			return nil, fmt.Errorf("EC key has invalid coordinates")
+		}
+		ec := ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !ec.Curve.IsOnCurve(ec.X, ec.Y) {
+			return nil, fmt.Errorf("EC key is not on the P-256 curve")
+		}
+		pub = &ec
+	case j.KeyType == "OKP" && j.Curve == "Ed25519":
+		x, err := gEncoding.DecodeString(j.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("Ed25519 key is invalid")
+		}
+		pub = ed25519.PublicKey(x)
+	default:
+		return nil, fmt.Errorf("unsupported key type '%s' (curve '%s')", j.KeyType, j.Curve)
+	}
+
+	k, err := NewKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	if j.Algorithm != "" && j.Algorithm != k.Algorithm {
+		return nil, fmt.Errorf("unsupported algorithm '%s' for a %s key", j.Algorithm, j.KeyType)
+	}
+	if j.KeyID != "" {
+		k.ID = j.KeyID
+	}
+	return k, nil
+}
+
+// CanSign returns true if the key has a private key, which tokens can be signed with
+func (k *Key) CanSign() bool {
+	return k.private != nil
+}
+
+// JWK returns the public key in the JSON Web Key format
+func (k *Key) JWK() JWK {
+	var j = JWK{Use: "sig", Algorithm: k.Algorithm, KeyID: k.ID}
+	switch pub := k.public.(type) {
+	case *rsa.PublicKey:
+		j.KeyType = "RSA"
+		j.N = gEncoding.EncodeToString(pub.N.Bytes())
+		j.E = gEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		j.KeyType = "EC"
+		j.Curve = "P-256"
+		j.X = gEncoding.EncodeToString(padBytes(pub.X.Bytes(), 32))
+		j.Y = gEncoding.EncodeToString(padBytes(pub.Y.Bytes(), 32))
+	case ed25519.PublicKey:
+		j.KeyType = "OKP"
+		j.Curve = "Ed25519"
+		j.X = gEncoding.EncodeToString(pub)
+	}
+	return j
+}
+
+// thumbprint returns the JWK thumbprint of the public key, as defined in RFC 7638: the SHA-256 hash of the required
+// members of the JWK, in lexicographic order
+func (k *Key) thumbprint() (string, error) {
+	j := k.JWK()
+
+	var members interface{}
+	switch j.KeyType {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{j.E, j.KeyType, j.N}
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{j.Curve, j.KeyType, j.X, j.Y}
+	default:
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{j.Curve, j.KeyType, j.X}
+	}
+
+	b, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return gEncoding.EncodeToString(sum[:]), nil
+}
+
+// sign signs the data with the private key
+func (k *Key) sign(data []byte) ([]byte, error) {
+	if k.private == nil {
+		return nil, fmt.Errorf("key %s can only verify", k.ID)
+	}
+
+	switch k.Algorithm {
+	case AlgorithmRS256:
+		hash := sha256.Sum256(data)
+		return rsa.SignPKCS1v15(rand.Reader, k.private.(*rsa.PrivateKey), crypto.SHA256, hash[:])
+	case AlgorithmES256:
+		// The signature is r and s, each as 32 bytes, rather than the ASN.1 encoding
+		hash := sha256.Sum256(data)
+		r, s, err := ecdsa.Sign(rand.Reader, k.private.(*ecdsa.PrivateKey), hash[:])
+		if err != nil {
+			return nil, err
+		}
+		return append(padBytes(r.Bytes(), 32), padBytes(s.Bytes(), 32)...), nil
+	case AlgorithmEdDSA:
+		return ed25519.Sign(k.private.(ed25519.PrivateKey), data), nil
+	}
+	return nil, fmt.Errorf("unsupported algorithm '%s'", k.Algorithm)
+}
+
+// verify returns true if signature is a valid signature of the data by the key
+func (k *Key) verify(data, signature []byte) bool {
+	switch k.Algorithm {
+	case AlgorithmRS256:
+		hash := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(k.public.(*rsa.PublicKey), crypto.SHA256, hash[:], signature) == nil
+	case AlgorithmES256:
+		if len(signature) != 64 {
+			return false
+		}
+		hash := sha256.Sum256(data)
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(k.public.(*ecdsa.PublicKey), hash[:], r, s)
+	case AlgorithmEdDSA:
+		return ed25519.Verify(k.public.(ed25519.PublicKey), data, signature)
+	}
+	return false
+}
+
+// padBytes left pads b with zeros to n bytes
+func padBytes(b []byte, n int) []byte {
+	if len(b) >= n {
+		return b
+	}
+	return append(make([]byte, n-len(b)), b...)
+}
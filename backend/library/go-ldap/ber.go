@@ -0,0 +1,196 @@
+package ldap
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// LDAP messages are encoded with the Basic Encoding Rules of ASN.1 (X.690), as a tree of tag-length-value elements.
+// LDAP only needs single byte tags, and definite lengths.
+
+// The classes and forms of the tags
+const (
+	classUniversal   = 0x00
+	classApplication = 0x40
+	classContext     = 0x80
+	formConstructed  = 0x20
+)
+
+// The universal tags that LDAP uses
+const (
+	tagBoolean     = 0x01
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagEnumerated  = 0x0a
+	tagSequence    = formConstructed | 0x10
+	tagSet         = formConstructed | 0x11
+)
+
+// gMaxMessageSize is the largest message we read from a server
+const gMaxMessageSize = 16 << 20
+
+// element is a decoded BER element. The children of constructed elements are decoded too.
+type element struct {
+	tag      byte
+	value    []byte
+	children []element
+}
+
+func (e element) isConstructed() bool {
+	return e.tag&formConstructed != 0
+}
+
+// str returns the value of a primitive element as a string
+func (e element) str() string {
+	return string(e.value)
+}
+
+// int returns the value of an INTEGER or ENUMERATED element
+func (e element) int() int64 {
+	var n int64
+	for i, b := range e.value {
+		if i == 0 && b&0x80 != 0 {
+			n = -1
+		}
+		n = n<<8 | int64(b)
+	}
+	return n
+}
+
+// encode returns the element with the tag and the content
+func encode(tag byte, content []byte) []byte {
+	b := []byte{tag}
+	b = append(b, encodeLength(len(content))...)
+	return append(b, content...)
+}
+
+// encodeConstructed returns the constructed element with the tag, whose content is the elements
+func encodeConstructed(tag byte, elements ...[]byte) []byte {
+	var content []byte
+	for _, e := range elements {
+		content = append(content, e...)
+	}
+	return encode(tag, content)
+}
+
+func encodeString(tag byte, s string) []byte {
+	return encode(tag, []byte(s))
+}
+
+func encodeInt(tag byte, n int64) []byte {
+	// The shortest two's complement encoding
+	var b []byte
+	for {
+		b = append([]byte{byte(n)}, b...)
+		if (n < 0x80 && n >= -0x80) || len(b) == 8 {
+			break
+		}
+		n >>= 8
+	}
+	return encode(tag, b)
+}
+
+func encodeBool(tag byte, v bool) []byte {
+	if v {
+		return encode(tag, []byte{0xff})
+	}
+	return encode(tag, []byte{0x00})
+}
+
+func encodeLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+// readElement reads one whole element from r, and decodes it
+func readElement(r *bufio.Reader) (element, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return element{}, err
+	}
+	length, err := readLength(r)
+	if err != nil {
+		return element{}, err
+	}
+	content := make([]byte, length)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return element{}, err
+	}
+	return decodeContent(tag, content)
+}
+
+func readLength(r *bufio.Reader) (int, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b < 0x80 {
+		return int(b), nil
+	}
+	n := int(b & 0x7f)
+	if n == 0 || n > 4 {
+		return 0, fmt.Errorf("ldap: unsupported length of %d bytes", n)
+	}
+	var length int
+	for i := 0; i < n; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		length = length<<8 | int(b)
+	}
+	if length > gMaxMessageSize {
+		return 0, fmt.Errorf("ldap: message of %d bytes is too large", length)
+	}
+	return length, nil
+}
+
+// decode decodes one element from the start of b, and returns the rest of b
+func decode(b []byte) (element, []byte, error) {
+	if len(b) < 2 {
+		return element{}, nil, fmt.Errorf("ldap: truncated element")
+	}
+	tag, b := b[0], b[1:]
+	length := int(b[0])
+	b = b[1:]
+	if length >= 0x80 {
+		n := length & 0x7f
+		if n == 0 || n > 4 || len(b) < n {
+			return element{}, nil, fmt.Errorf("ldap: invalid length")
+		}
+		length = 0
+		for _, c := range b[:n] {
+			length = length<<8 | int(c)
+		}
+		b = b[n:]
+	}
+	if length > len(b) {
+		return element{}, nil, fmt.Errorf("ldap: truncated element")
+	}
+	e, err := decodeContent(tag, b[:length])
+	return e, b[length:], err
+}
+
+func decodeContent(tag byte, content []byte) (element, error) {
+	e := element{tag: tag}
+	if !e.isConstructed() {
+		e.value = content
+		return e, nil
+	}
+	for len(content) > 0 {
+		child, rest, err := decode(content)
+		if err != nil {
+			return e, err
+		}
+		e.children = append(e.children, child)
+		content = rest
+	}
+	return e, nil
+}
@@ -0,0 +1,194 @@
+package ldap
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// The context tags of the filter choices (RFC 4511, section 4.5.1)
+const (
+	filterAnd            = classContext | formConstructed | 0
+	filterOr             = classContext | formConstructed | 1
+	filterNot            = classContext | formConstructed | 2
+	filterEqualityMatch  = classContext | formConstructed | 3
+	filterSubstrings     = classContext | formConstructed | 4
+	filterGreaterOrEqual = classContext | formConstructed | 5
+	filterLessOrEqual    = classContext | formConstructed | 6
+	filterPresent        = classContext | 7
+	filterApproxMatch    = classContext | formConstructed | 8
+
+	substringInitial = classContext | 0
+	substringAny     = classContext | 1
+	substringFinal   = classContext | 2
+)
+
+// EscapeFilter escapes the special characters of a value, so that it can be put in a filter (RFC 4515, section 3).
+// Values that come from users, e.g. the login, should always be escaped.
+func EscapeFilter(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\', '*', '(', ')', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// compileFilter encodes the string representation of a filter, e.g. (&(objectClass=person)(mail=jon@example.com))
+func compileFilter(s string) ([]byte, error) {
+	f, rest, err := compileFilterAt(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("ldap: invalid filter %q: %v", s, err)
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("ldap: invalid filter %q: unexpected %q", s, rest)
+	}
+	return f, nil
+}
+
+// compileFilterAt encodes the filter at the start of s, and returns the rest of s
+func compileFilterAt(s string) ([]byte, string, error) {
+	if !strings.HasPrefix(s, "(") {
+		return nil, s, fmt.Errorf("filter should start with '('")
+	}
+	s = s[1:]
+	if s == "" {
+		return nil, s, fmt.Errorf("unexpected end")
+	}
+
+	var f []byte
+	switch s[0] {
+	case '&', '|':
+		tag := byte(filterAnd)
+		if s[0] == '|' {
+			tag = filterOr
+		}
+		s = s[1:]
+		var subs [][]byte
+		for strings.HasPrefix(s, "(") {
+			sub, rest, err := compileFilterAt(s)
+			if err != nil {
+				return nil, s, err
+			}
+			subs = append(subs, sub)
+			s = rest
+		}
+		if len(subs) == 0 {
+			return nil, s, fmt.Errorf("empty filter list")
+		}
+		f = encodeConstructed(tag, subs...)
+	case '!':
+		sub, rest, err := compileFilterAt(s[1:])
+		if err != nil {
+			return nil, s, err
+		}
+		f = encodeConstructed(filterNot, sub)
+		s = rest
+	default:
+		end := strings.Index(s, ")")
+		if end < 0 {
+			return nil, s, fmt.Errorf("missing ')'")
+		}
+		item, err := compileItem(s[:end])
+		if err != nil {
+			return nil, s, err
+		}
+		f = item
+		s = s[end:]
+	}
+
+	if !strings.HasPrefix(s, ")") {
+		return nil, s, fmt.Errorf("missing ')'")
+	}
+	return f, s[1:], nil
+}
+
+// compileItem encodes a simple filter, e.g. mail=jon@example.com, cn=jo*n or mail=*
+func compileItem(s string) ([]byte, error) {
+	eq := strings.Index(s, "=")
+	if eq < 1 {
+		return nil, fmt.Errorf("missing '=' in %q", s)
+	}
+	attr, value := s[:eq], s[eq+1:]
+
+	var tag byte = filterEqualityMatch
+	switch attr[len(attr)-1] {
+	case '~':
+		tag = filterApproxMatch
+	case '>':
+		tag = filterGreaterOrEqual
+	case '<':
+		tag = filterLessOrEqual
+	}
+	if tag != filterEqualityMatch {
+		attr = attr[:len(attr)-1]
+		if attr == "" {
+			return nil, fmt.Errorf("missing attribute in %q", s)
+		}
+		v, err := unescapeFilter(value)
+		if err != nil {
+			return nil, err
+		}
+		return encodeConstructed(tag, encodeString(tagOctetString, attr), encodeString(tagOctetString, v)), nil
+	}
+
+	if value == "*" {
+		return encodeString(filterPresent, attr), nil
+	}
+	if !strings.Contains(value, "*") {
+		v, err := unescapeFilter(value)
+		if err != nil {
+			return nil, err
+		}
+		return encodeConstructed(filterEqualityMatch, encodeString(tagOctetString, attr), encodeString(tagOctetString, v)), nil
+	}
+
+	// Substrings: the parts between the stars are the initial, any and final substrings
+	parts := strings.Split(value, "*")
+	var subs [][]byte
+	for i, p := range parts {
+		if p == "" {
+			continue
+		}
+		v, err := unescapeFilter(p)
+		if err != nil {
+			return nil, err
+		}
+		tag := byte(substringAny)
+		if i == 0 {
+			tag = substringInitial
+		} else if i == len(parts)-1 {
+			tag = substringFinal
+		}
+		subs = append(subs, encodeString(tag, v))
+	}
+	return encodeConstructed(filterSubstrings, encodeString(tagOctetString, attr), encodeConstructed(tagSequence, subs...)), nil
+}
+
+// unescapeFilter decodes the \XX escapes of a value in a filter
+func unescapeFilter(s string) (string, error) {
+	if !strings.Contains(s, "\\") {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+3 > len(s) {
+			return "", fmt.Errorf("truncated escape in %q", s)
+		}
+		c, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in %q", s)
+		}
+		b.Write(c)
+		i += 2
+	}
+	return b.String(), nil
+}
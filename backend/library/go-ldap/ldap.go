@@ -0,0 +1,354 @@
+// Package ldap is a minimal LDAP v3 client (RFC 4511), with what is needed to authenticate users against a directory,
+// e.g. OpenLDAP or Active Directory: simple binds, and searches. The usual way to authenticate is to bind as a service
+// account, search for the user's entry by their login, and then bind as the user's DN with their password.
+package ldap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The application tags of the protocol operations
+const (
+	opBindRequest       = classApplication | formConstructed | 0
+	opBindResponse      = classApplication | formConstructed | 1
+	opUnbindRequest     = classApplication | 2
+	opSearchRequest     = classApplication | formConstructed | 3
+	opSearchResultEntry = classApplication | formConstructed | 4
+	opSearchResultDone  = classApplication | formConstructed | 5
+	opSearchResultRef   = classApplication | formConstructed | 19
+	opExtendedRequest   = classApplication | formConstructed | 23
+	opExtendedResponse  = classApplication | formConstructed | 24
+
+	authSimple          = classContext | 0
+	extendedRequestName = classContext | 0
+)
+
+const gProtocolVersion = 3
+
+// gStartTLSOID is the name of the extended operation that starts TLS (RFC 4511, section 4.14)
+const gStartTLSOID = "1.3.6.1.4.1.1466.20037"
+
+const gDefaultPort = "389"
+const gDefaultTLSPort = "636"
+
+// gDefaultTimeout is how long we wait to connect, and for each operation
+const gDefaultTimeout = 10 * time.Second
+
+// gSearchTimeLimit is the time limit, in seconds, that the server has for a search
+const gSearchTimeLimit = 10
+
+// The result codes that callers may need to tell apart (RFC 4511, appendix A)
+const (
+	ResultSuccess            = 0
+	ResultSizeLimitExceeded  = 4
+	ResultInvalidCredentials = 49
+)
+
+// Scope is how far below the base DN a search goes
+type Scope int
+
+const (
+	// ScopeBaseObject only searches the base DN itself
+	ScopeBaseObject Scope = 0
+	// ScopeSingleLevel searches the entries right below the base DN
+	ScopeSingleLevel Scope = 1
+	// ScopeWholeSubtree searches the base DN and everything below it
+	ScopeWholeSubtree Scope = 2
+)
+
+// ErrEmptyPassword is returned when binding as a DN with an empty password. Servers treat such a bind as an
+// unauthenticated bind, which succeeds, so it must never be used to check a user's password.
+var ErrEmptyPassword = fmt.Errorf("ldap: bind with an empty password")
+
+// Error is an unsuccessful result of an operation
+type Error struct {
+	Code    int64
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("ldap: result code %d: %s", e.Code, e.Message)
+}
+
+// IsInvalidCredentials returns true if the error is the result of a bind with the wrong DN or password
+func IsInvalidCredentials(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.Code == ResultInvalidCredentials
+}
+
+// Config is how to connect to the server
+type Config struct {
+	// URL is ldap://host:port or ldaps://host:port
+	URL string
+	// StartTLS upgrades an ldap:// connection to TLS before anything is sent
+	StartTLS bool
+	// TLSConfig is used for ldaps:// and StartTLS, if set
+	TLSConfig *tls.Config
+	// Timeout of the connection, and of every operation. It defaults to 10 seconds.
+	Timeout time.Duration
+}
+
+// Conn is a connection to a server. It can only be used by one goroutine at a time.
+type Conn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	timeout   time.Duration
+	messageID int64
+}
+
+// Dial connects to the server
+func Dial(config Config) (*Conn, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("ldap: invalid URL: %v", err)
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = gDefaultTimeout
+	}
+	tlsConfig := config.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{ServerName: u.Hostname()}
+	}
+
+	var conn net.Conn
+	dialer := net.Dialer{Timeout: timeout}
+	switch u.Scheme {
+	case "ldap":
+		conn, err = dialer.Dial("tcp", hostPort(u, gDefaultPort))
+	case "ldaps":
+		conn, err = tls.DialWithDialer(&dialer, "tcp", hostPort(u, gDefaultTLSPort), tlsConfig)
+	default:
+		return nil, fmt.Errorf("ldap: unsupported URL scheme '%s'", u.Scheme)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ldap: connecting to %s: %v", u.Host, err)
+	}
+
+	c := Conn{conn: conn, reader: bufio.NewReader(conn), timeout: timeout}
+	if config.StartTLS && u.Scheme == "ldap" {
+		if err := c.startTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return &c, nil
+}
+
+// Close unbinds, and closes the connection
+func (c *Conn) Close() error {
+	c.messageID++
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	c.conn.Write(encodeConstructed(tagSequence, encodeInt(tagInteger, c.messageID), encode(opUnbindRequest, nil)))
+	return c.conn.Close()
+}
+
+// Bind authenticates the connection as the DN, with a simple bind. An empty DN and password is an anonymous bind.
+func (c *Conn) Bind(dn, password string) error {
+	if dn != "" && password == "" {
+		return ErrEmptyPassword
+	}
+	op := encodeConstructed(opBindRequest,
+		encodeInt(tagInteger, gProtocolVersion),
+		encodeString(tagOctetString, dn),
+		encodeString(authSimple, password),
+	)
+	resp, err := c.roundTrip(op, opBindResponse)
+	if err != nil {
+		return err
+	}
+	return resultError(resp)
+}
+
+// SearchRequest are the parameters of a search
+type SearchRequest struct {
+	BaseDN string
+	Scope  Scope
+	// Filter is the string representation of the filter (RFC 4515). Values from users should be escaped with
+	// EscapeFilter.
+	Filter string
+	// Attributes are the attributes to return. All the user attributes are returned if it is empty.
+	Attributes []string
+	// SizeLimit is the most entries to return, or 0 for the server's limit
+	SizeLimit int
+}
+
+// Entry is an entry that a search found
+type Entry struct {
+	DN string
+	// Attributes by their lower case names, since attribute names are case insensitive
+	Attributes map[string][]string
+}
+
+// Get returns the first value of the attribute, or an empty string
+func (e Entry) Get(attr string) string {
+	vs := e.Attributes[strings.ToLower(attr)]
+	if len(vs) == 0 {
+		return ""
+	}
+	return vs[0]
+}
+
+// GetAll returns all the values of the attribute
+func (e Entry) GetAll(attr string) []string {
+	return e.Attributes[strings.ToLower(attr)]
+}
+
+// Search returns the entries that match the request. Referrals to other servers are not followed.
+func (c *Conn) Search(req SearchRequest) ([]Entry, error) {
+	filter, err := compileFilter(req.Filter)
+	if err != nil {
+		return nil, err
+	}
+	var attrs [][]byte
+	for _, a := range req.Attributes {
+		attrs = append(attrs, encodeString(tagOctetString, a))
+	}
+	op := encodeConstructed(opSearchRequest,
+		encodeString(tagOctetString, req.BaseDN),
+		encodeInt(tagEnumerated, int64(req.Scope)),
+		encodeInt(tagEnumerated, 0), // never dereference aliases
+		encodeInt(tagInteger, int64(req.SizeLimit)),
+		encodeInt(tagInteger, gSearchTimeLimit),
+		encodeBool(tagBoolean, false),
+		filter,
+		encodeConstructed(tagSequence, attrs...),
+	)
+
+	id, err := c.send(op)
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	for {
+		resp, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch resp.tag {
+		case opSearchResultEntry:
+			e, err := parseEntry(resp)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, e)
+		case opSearchResultRef:
+			continue
+		case opSearchResultDone:
+			return entries, resultError(resp)
+		default:
+			return nil, fmt.Errorf("ldap: unexpected response 0x%x to a search", resp.tag)
+		}
+	}
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* H E L P E R S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+func hostPort(u *url.URL, defaultPort string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), defaultPort)
+}
+
+// startTLS asks the server to start TLS on the connection, and does the handshake
+func (c *Conn) startTLS(tlsConfig *tls.Config) error {
+	op := encodeConstructed(opExtendedRequest, encodeString(extendedRequestName, gStartTLSOID))
+	resp, err := c.roundTrip(op, opExtendedResponse)
+	if err != nil {
+		return err
+	}
+	if err := resultError(resp); err != nil {
+		return err
+	}
+	tlsConn := tls.Client(c.conn, tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(c.timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("ldap: starting TLS: %v", err)
+	}
+	c.conn = tlsConn
+	c.reader = bufio.NewReader(tlsConn)
+	return nil
+}
+
+// roundTrip sends the operation, and returns its response, which should be of the tag
+func (c *Conn) roundTrip(op []byte, tag byte) (element, error) {
+	id, err := c.send(op)
+	if err != nil {
+		return element{}, err
+	}
+	resp, err := c.receive(id)
+	if err != nil {
+		return element{}, err
+	}
+	if resp.tag != tag {
+		return element{}, fmt.Errorf("ldap: unexpected response 0x%x, instead of 0x%x", resp.tag, tag)
+	}
+	return resp, nil
+}
+
+// send sends the operation in a new message, and returns the message's ID
+func (c *Conn) send(op []byte) (int64, error) {
+	c.messageID++
+	msg := encodeConstructed(tagSequence, encodeInt(tagInteger, c.messageID), op)
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := c.conn.Write(msg); err != nil {
+		return 0, fmt.Errorf("ldap: sending request: %v", err)
+	}
+	return c.messageID, nil
+}
+
+// receive reads the next message, which should be a response to the message ID, and returns its operation
+func (c *Conn) receive(id int64) (element, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	msg, err := readElement(c.reader)
+	if err != nil {
+		return element{}, fmt.Errorf("ldap: reading response: %v", err)
+	}
+	if msg.tag != tagSequence || len(msg.children) < 2 || msg.children[0].tag != tagInteger {
+		return element{}, fmt.Errorf("ldap: malformed response")
+	}
+	if msg.children[0].int() != id {
+		return element{}, fmt.Errorf("ldap: response to message %d, instead of %d", msg.children[0].int(), id)
+	}
+	return msg.children[1], nil
+}
+
+// resultError returns the error of the LDAPResult of a response, if it's not a success
+func resultError(resp element) error {
+	if len(resp.children) < 3 || resp.children[0].tag != tagEnumerated {
+		return fmt.Errorf("ldap: malformed result")
+	}
+	code := resp.children[0].int()
+	if code == ResultSuccess {
+		return nil
+	}
+	return &Error{Code: code, Message: resp.children[2].str()}
+}
+
+// parseEntry parses a SearchResultEntry
+func parseEntry(resp element) (Entry, error) {
+	e := Entry{Attributes: make(map[string][]string)}
+	if len(resp.children) != 2 || resp.children[1].tag != tagSequence {
+		return e, fmt.Errorf("ldap: malformed search result entry")
+	}
+	e.DN = resp.children[0].str()
+	for _, attr := range resp.children[1].children {
+		if len(attr.children) != 2 {
+			return e, fmt.Errorf("ldap: malformed attribute of %s", e.DN)
+		}
+		name := strings.ToLower(attr.children[0].str())
+		for _, v := range attr.children[1].children {
+			e.Attributes[name] = append(e.Attributes[name], v.str())
+		}
+	}
+	return e, nil
+}
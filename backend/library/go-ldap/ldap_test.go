@@ -0,0 +1,231 @@
+package ldap
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeServer is a directory with a few entries, which supports simple binds and searches with and, or, not, equality
+// and presence filters
+type fakeServer struct {
+	listener  net.Listener
+	passwords map[string]string
+	entries   []Entry
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := fakeServer{
+		listener:  l,
+		passwords: map[string]string{"cn=admin,dc=example,dc=org": "admin", "uid=jon,ou=people,dc=example,dc=org": "jons_secret"},
+		entries: []Entry{
+			{DN: "uid=jon,ou=people,dc=example,dc=org", Attributes: map[string][]string{
+				"objectclass": {"inetOrgPerson"},
+				"uid":         {"jon"},
+				"mail":        {"jon@example.org"},
+				"cn":          {"Jon Snow"},
+				"memberof":    {"cn=sre,ou=groups,dc=example,dc=org"},
+			}},
+			{DN: "uid=jane,ou=people,dc=example,dc=org", Attributes: map[string][]string{
+				"objectclass": {"inetOrgPerson"},
+				"uid":         {"jane"},
+				"mail":        {"jane@example.org"},
+			}},
+		},
+	}
+	go s.serve()
+	return &s
+}
+
+func (s *fakeServer) URL() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+func (s *fakeServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		msg, err := readElement(r)
+		if err != nil {
+			return
+		}
+		id, op := msg.children[0].int(), msg.children[1]
+		reply := func(ops ...[]byte) {
+			for _, op := range ops {
+				conn.Write(encodeConstructed(tagSequence, encodeInt(tagInteger, id), op))
+			}
+		}
+		switch op.tag {
+		case opBindRequest:
+			dn, password := op.children[1].str(), op.children[2].str()
+			code := int64(ResultSuccess)
+			if want, ok := s.passwords[dn]; !ok || want != password {
+				code = ResultInvalidCredentials
+			}
+			reply(result(opBindResponse, code))
+		case opSearchRequest:
+			var ops [][]byte
+			for _, e := range s.entries {
+				if !strings.HasSuffix(e.DN, op.children[0].str()) || !matches(op.children[6], e) {
+					continue
+				}
+				var attrs [][]byte
+				for name, vs := range e.Attributes {
+					var vals [][]byte
+					for _, v := range vs {
+						vals = append(vals, encodeString(tagOctetString, v))
+					}
+					attrs = append(attrs, encodeConstructed(tagSequence, encodeString(tagOctetString, name), encodeConstructed(tagSet, vals...)))
+				}
+				ops = append(ops, encodeConstructed(opSearchResultEntry, encodeString(tagOctetString, e.DN), encodeConstructed(tagSequence, attrs...)))
+			}
+			reply(append(ops, result(opSearchResultDone, ResultSuccess))...)
+		case opUnbindRequest:
+			return
+		}
+	}
+}
+
+func result(tag byte, code int64) []byte {
+	return encodeConstructed(tag, encodeInt(tagEnumerated, code), encodeString(tagOctetString, ""), encodeString(tagOctetString, ""))
+}
+
+func matches(f element, e Entry) bool {
+	switch f.tag {
+	case filterAnd, filterOr:
+		for _, sub := range f.children {
+			if m := matches(sub, e); m == (f.tag == filterOr) {
+				return m
+			}
+		}
+		return f.tag == filterAnd
+	case filterNot:
+		return !matches(f.children[0], e)
+	case filterEqualityMatch:
+		for _, v := range e.GetAll(f.children[0].str()) {
+			if strings.EqualFold(v, f.children[1].str()) {
+				return true
+			}
+		}
+	case filterPresent:
+		return len(e.GetAll(f.str())) > 0
+	}
+	return false
+}
+
+func TestBindAndSearch(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.listener.Close()
+
+	c, err := Dial(Config{URL: s.URL()})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer c.Close()
+
+	assert.True(t, IsInvalidCredentials(c.Bind("cn=admin,dc=example,dc=org", "wrong")))
+	assert.Equal(t, ErrEmptyPassword, c.Bind("cn=admin,dc=example,dc=org", ""))
+	if !assert.NoError(t, c.Bind("cn=admin,dc=example,dc=org", "admin")) {
+		return
+	}
+
+	entries, err := c.Search(SearchRequest{
+		BaseDN: "dc=example,dc=org",
+		Scope:  ScopeWholeSubtree,
+		Filter: "(&(objectClass=inetOrgPerson)(|(mail=" + EscapeFilter("JON@example.org") + ")(uid=nobody))(!(uid=jane)))",
+	})
+	if !assert.NoError(t, err) || !assert.Len(t, entries, 1) {
+		return
+	}
+	assert.Equal(t, "uid=jon,ou=people,dc=example,dc=org", entries[0].DN)
+	assert.Equal(t, "Jon Snow", entries[0].Get("CN"))
+	assert.Equal(t, []string{"cn=sre,ou=groups,dc=example,dc=org"}, entries[0].GetAll("memberOf"))
+
+	// The user's own bind checks their password
+	assert.NoError(t, c.Bind(entries[0].DN, "jons_secret"))
+	assert.True(t, IsInvalidCredentials(c.Bind(entries[0].DN, "wrong")))
+}
+
+func TestCompileFilter(t *testing.T) {
+	// (cn=a*b*) is a substrings filter, with an initial and an any substring
+	f, err := compileFilter("(cn=a*b*)")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte{0xa4, 0x0c, 0x04, 0x02, 'c', 'n', 0x30, 0x06, 0x80, 0x01, 'a', 0x81, 0x01, 'b'}, f)
+	}
+	f, err = compileFilter("(mail=*)")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte{0x87, 0x04, 'm', 'a', 'i', 'l'}, f)
+	}
+
+	for _, s := range []string{"", "mail=jon", "(mail=jon", "(&)", "(mail=jon))", "(=jon)", "(mail=\\2)"} {
+		_, err := compileFilter(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestEscapeFilter(t *testing.T) {
+	assert.Equal(t, `jon\2a\29\28\5c`, EscapeFilter(`jon*)(\`))
+
+	// An escaped value matches only itself
+	f, err := compileFilter("(uid=" + EscapeFilter("*") + ")")
+	if assert.NoError(t, err) {
+		assert.Equal(t, byte(filterEqualityMatch), f[0])
+	}
+}
+
+// TestDirectory runs against the OpenLDAP server of docker-compose, seeded with ldap/seed.ldif, when LDAP_TEST_URL is
+// set
+func TestDirectory(t *testing.T) {
+	url := os.Getenv("LDAP_TEST_URL")
+	if url == "" {
+		t.Skip("LDAP_TEST_URL is not set")
+	}
+
+	c, err := Dial(Config{URL: url})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer c.Close()
+
+	if !assert.NoError(t, c.Bind("cn=admin,dc=example,dc=org", "admin")) {
+		return
+	}
+	entries, err := c.Search(SearchRequest{
+		BaseDN:     "ou=people,dc=example,dc=org",
+		Scope:      ScopeWholeSubtree,
+		Filter:     "(&(objectClass=inetOrgPerson)(mail=" + EscapeFilter("arya.stark@example.org") + "))",
+		Attributes: []string{"mail", "cn"},
+	})
+	if !assert.NoError(t, err) || !assert.Len(t, entries, 1) {
+		return
+	}
+	assert.Equal(t, "Arya Stark", entries[0].Get("cn"))
+	assert.NoError(t, c.Bind(entries[0].DN, "aryas_secret"))
+
+	groups, err := c.Search(SearchRequest{
+		BaseDN: "ou=groups,dc=example,dc=org",
+		Scope:  ScopeWholeSubtree,
+		Filter: "(&(objectClass=groupOfNames)(member=" + EscapeFilter(entries[0].DN) + "))",
+	})
+	if assert.NoError(t, err) && assert.Len(t, groups, 1) {
+		assert.Equal(t, "cn=sre,ou=groups,dc=example,dc=org", groups[0].DN)
+	}
+}
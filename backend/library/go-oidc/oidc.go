@@ -0,0 +1,392 @@
+// Package oidc implements the relying party side of the OpenID Connect authorization code flow
+// (https://openid.net/specs/openid-connect-core-1_0.html), with PKCE (RFC 7636). The user is sent to the provider's
+// authorization endpoint, and comes back with a code, which is exchanged at the token endpoint for an ID token. The ID
+// token is verified with the keys that the provider publishes, found through its discovery document.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/teejays/n-factor-vault/backend/library/go-jwt"
+)
+
+// gEncoding is the base64url encoding, without padding, of the PKCE verifier and challenge
+var gEncoding = base64.RawURLEncoding
+
+// gVerifierSize is the number of random bytes in a PKCE code verifier, or in a state or nonce
+const gVerifierSize = 32
+
+// gHTTPTimeout is how long we wait for the provider's endpoints
+const gHTTPTimeout = 10 * time.Second
+
+// gMaxResponseSize is the most we read from a response of the provider
+const gMaxResponseSize = 1 << 20
+
+// gDiscoveryPath is where the discovery document is, relative to the issuer
+const gDiscoveryPath = "/.well-known/openid-configuration"
+
+// ErrInvalidIDToken is returned when the ID token is not signed by the provider, or is not meant for us
+var ErrInvalidIDToken = fmt.Errorf("ID token is invalid")
+
+// Config is what we're registered with at the provider as
+type Config struct {
+	// Issuer is the URL of the provider, which is also the iss claim of its ID tokens
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is where the provider sends the user back to, with the code
+	RedirectURL string
+	// Scopes are requested on top of openid, e.g. email, profile and groups
+	Scopes []string
+	// HTTPClient is used for the calls to the provider, if set
+	HTTPClient *http.Client
+}
+
+// Discovery is the part of the provider's discovery document that we use
+type Discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider is an OpenID provider that we let users log in with
+type Provider struct {
+	config    Config
+	discovery Discovery
+	client    *http.Client
+
+	// verifier has the keys of the provider. They are fetched again when a token is signed by a key we don't have,
+	// since providers rotate their keys.
+	lock     sync.Mutex
+	verifier *jwt.Verifier
+}
+
+// NewProvider fetches the discovery document of the issuer, and returns the provider
+func NewProvider(ctx context.Context, config Config) (*Provider, error) {
+	config.Issuer = strings.TrimSuffix(config.Issuer, "/")
+	if config.Issuer == "" || config.ClientID == "" || config.RedirectURL == "" {
+		return nil, fmt.Errorf("issuer, client ID and redirect URL are required")
+	}
+
+	p := Provider{config: config, client: config.HTTPClient}
+	if p.client == nil {
+		p.client = &http.Client{Timeout: gHTTPTimeout}
+	}
+
+	if err := p.getJSON(ctx, config.Issuer+gDiscoveryPath, &p.discovery); err != nil {
+		return nil, fmt.Errorf("fetching the discovery document: %v", err)
+	}
+	// The document should be the issuer's own, or it could send us to someone else's endpoints
+	if strings.TrimSuffix(p.discovery.Issuer, "/") != config.Issuer {
+		return nil, fmt.Errorf("discovery document is for issuer '%s', and not '%s'", p.discovery.Issuer, config.Issuer)
+	}
+	if p.discovery.AuthorizationEndpoint == "" || p.discovery.TokenEndpoint == "" || p.discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document is missing an endpoint")
+	}
+
+	return &p, nil
+}
+
+// PKCE is the code verifier of a login, which we keep, and its challenge, which is sent to the provider
+type PKCE struct {
+	Verifier  string
+	Challenge string
+}
+
+// NewPKCE returns a new random code verifier, with its S256 challenge
+func NewPKCE() (PKCE, error) {
+	verifier, err := NewRandomString()
+	if err != nil {
+		return PKCE{}, err
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return PKCE{Verifier: verifier, Challenge: gEncoding.EncodeToString(sum[:])}, nil
+}
+
+// NewRandomString returns a random string, for a state or a nonce
+func NewRandomString() (string, error) {
+	b := make([]byte, gVerifierSize)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", fmt.Errorf("generating random string: %v", err)
+	}
+	return gEncoding.EncodeToString(b), nil
+}
+
+// AuthCodeURL returns the URL of the provider that the user should be sent to, to log in
+func (p *Provider) AuthCodeURL(state, nonce, challenge string) string {
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.config.ClientID)
+	v.Set("redirect_uri", p.config.RedirectURL)
+	v.Set("scope", strings.Join(append([]string{"openid"}, p.config.Scopes...), " "))
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	v.Set("code_challenge", challenge)
+	v.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(p.discovery.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return p.discovery.AuthorizationEndpoint + sep + v.Encode()
+}
+
+// IDToken has the claims of a verified ID token. Claims has all of them, for the ones that differ between providers,
+// e.g. groups.
+type IDToken struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Claims        map[string]interface{}
+}
+
+// Exchange exchanges the code, which the provider sent the user back with, for an ID token, and verifies it. The
+// verifier is the PKCE code verifier of the login, and the nonce is the one that was sent in the authorization URL.
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (IDToken, error) {
+	var tok IDToken
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("code_verifier", verifier)
+	// Public clients, which have no secret, identify themselves in the form
+	if p.config.ClientSecret == "" {
+		form.Set("client_id", p.config.ClientID)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return tok, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	var resp struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := p.doJSON(req.WithContext(ctx), &resp); err != nil {
+		return tok, fmt.Errorf("exchanging the code: %v", err)
+	}
+	if resp.Error != "" {
+		return tok, fmt.Errorf("exchanging the code: %s: %s", resp.Error, resp.ErrorDescription)
+	}
+	if resp.IDToken == "" {
+		return tok, fmt.Errorf("exchanging the code: no ID token in the response")
+	}
+
+	return p.Verify(ctx, resp.IDToken, nonce)
+}
+
+// Verify verifies the signature of the ID token, that it was issued by the provider for us, that it hasn't expired,
+// and that it has the nonce of the login
+func (p *Provider) Verify(ctx context.Context, token, nonce string) (IDToken, error) {
+	var tok IDToken
+
+	var claim idTokenClaim
+	err := p.verifyAndDecode(ctx, token, &claim)
+	if err != nil {
+		return tok, err
+	}
+	if strings.TrimSuffix(claim.Issuer, "/") != p.config.Issuer {
+		return tok, ErrInvalidIDToken
+	}
+	if !claim.Audience.contains(p.config.ClientID) {
+		return tok, ErrInvalidIDToken
+	}
+	if claim.Nonce != nonce {
+		return tok, ErrInvalidIDToken
+	}
+	if claim.Subject == "" {
+		return tok, ErrInvalidIDToken
+	}
+
+	// The claims are decoded again into a map, for the ones we don't know of
+	parts := strings.Split(token, ".")
+	b, err := gEncoding.DecodeString(parts[1])
+	if err != nil {
+		return tok, ErrInvalidIDToken
+	}
+	if err := json.Unmarshal(b, &tok.Claims); err != nil {
+		return tok, ErrInvalidIDToken
+	}
+
+	tok.Subject = claim.Subject
+	tok.Email = claim.Email
+	tok.EmailVerified = bool(claim.EmailVerified)
+	tok.Name = claim.Name
+	return tok, nil
+}
+
+// GetStrings returns a claim of the token that is a list of strings, e.g. groups. A single string is a list of one.
+func (t IDToken) GetStrings(name string) []string {
+	switch v := t.Claims[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var strs []string
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				strs = append(strs, s)
+			}
+		}
+		return strs
+	}
+	return nil
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* H E L P E R S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// idTokenClaim is the claim of an ID token. The aud of an ID token can be a list, so it replaces the one of the base
+// claim.
+type idTokenClaim struct {
+	Issuer        string      `json:"iss"`
+	Subject       string      `json:"sub"`
+	Audience      audience    `json:"aud"`
+	ExpireAt      int64       `json:"exp"`
+	NotBefore     int64       `json:"nbf"`
+	Nonce         string      `json:"nonce"`
+	Email         string      `json:"email"`
+	EmailVerified lenientBool `json:"email_verified"`
+	Name          string      `json:"name"`
+}
+
+// GetBaseClaim implements jwt.Claim
+func (c *idTokenClaim) GetBaseClaim() *jwt.BaseClaim {
+	return &jwt.BaseClaim{Issuer: c.Issuer, Subject: c.Subject, ExpireAt: c.ExpireAt, NotBefore: c.NotBefore}
+}
+
+// VerifyTimestamps implements jwt.Claim
+func (c *idTokenClaim) VerifyTimestamps() error {
+	return c.GetBaseClaim().VerifyTimestamps()
+}
+
+// audience is the aud claim, which is either a string or a list of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var l []string
+	if err := json.Unmarshal(b, &l); err != nil {
+		return err
+	}
+	*a = l
+	return nil
+}
+
+func (a audience) contains(s string) bool {
+	for _, e := range a {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// lenientBool is a boolean claim, which some providers send as a string
+type lenientBool bool
+
+func (b *lenientBool) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*b = s == "true"
+		return nil
+	}
+	var v bool
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*b = lenientBool(v)
+	return nil
+}
+
+// verifyAndDecode verifies the token with the provider's keys. If it's signed by a key that we don't have, the keys are
+// fetched again, in case the provider has rotated them.
+func (p *Provider) verifyAndDecode(ctx context.Context, token string, claim jwt.Claim) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.verifier != nil {
+		err := p.verifier.VerifyAndDecode(token, claim)
+		if err != jwt.ErrInvalidToken {
+			return mapVerifyError(err)
+		}
+	}
+
+	var set jwt.JWKSet
+	if err := p.getJSON(ctx, p.discovery.JWKSURI, &set); err != nil {
+		return fmt.Errorf("fetching the keys of the provider: %v", err)
+	}
+	v, err := jwt.NewVerifier(set)
+	if err != nil {
+		return fmt.Errorf("keys of the provider: %v", err)
+	}
+	p.verifier = v
+
+	return mapVerifyError(p.verifier.VerifyAndDecode(token, claim))
+}
+
+// mapVerifyError returns ErrInvalidIDToken for any reason the token was rejected for
+func mapVerifyError(err error) error {
+	if err != nil {
+		return ErrInvalidIDToken
+	}
+	return nil
+}
+
+// getJSON gets the URL, and decodes its JSON response into v
+func (p *Provider) getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	return p.doJSON(req.WithContext(ctx), v)
+}
+
+// doJSON makes the request, and decodes its JSON response into v. Error responses of the token endpoint have a JSON
+// body too, so they are decoded for 400s.
+func (p *Provider) doJSON(req *http.Request, v interface{}) error {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, gMaxResponseSize))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusBadRequest {
+		return fmt.Errorf("%s returned status %d", req.URL.Host, resp.StatusCode)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("decoding response of %s: %v", req.URL.Host, err)
+	}
+	return nil
+}
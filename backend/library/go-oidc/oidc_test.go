@@ -0,0 +1,204 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	jwt "github.com/teejays/n-factor-vault/backend/library/go-jwt"
+)
+
+const testClientID = "n-factor-vault"
+const testClientSecret = "s3cret"
+const testRedirectURL = "http://localhost:8080/v1/login/oidc/callback"
+
+type testIDTokenClaim struct {
+	jwt.BaseClaim
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Groups        []string `json:"groups"`
+}
+
+// mockProvider is an OpenID provider, which gives out one code for the claim
+type mockProvider struct {
+	*httptest.Server
+	client    *jwt.Client
+	claim     testIDTokenClaim
+	challenge string
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := jwt.NewKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := jwt.NewClient(k, nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := mockProvider{client: c}
+	mux := http.NewServeMux()
+	mux.HandleFunc(gDiscoveryPath, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Discovery{
+			Issuer:                m.URL,
+			AuthorizationEndpoint: m.URL + "/authorize",
+			TokenEndpoint:         m.URL + "/token",
+			JWKSURI:               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(m.client.JWKS())
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if id != testClientID || secret != testClientSecret || r.PostFormValue("code") != "the-code" ||
+			gEncoding.EncodeToString(sum[:]) != m.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		claim := m.claim
+		token, err := m.client.CreateToken(&claim)
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "at", "token_type": "Bearer", "id_token": token})
+	})
+	m.Server = httptest.NewServer(mux)
+	m.claim = testIDTokenClaim{
+		BaseClaim:     jwt.BaseClaim{Issuer: m.URL, Subject: "jon", Audience: testClientID},
+		Email:         "jon@example.com",
+		EmailVerified: true,
+		Groups:        []string{"engineering", "oncall"},
+	}
+	return &m
+}
+
+func newTestProvider(t *testing.T, m *mockProvider) *Provider {
+	p, err := NewProvider(context.Background(), Config{
+		Issuer:       m.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		RedirectURL:  testRedirectURL,
+		Scopes:       []string{"email", "groups"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLogin(t *testing.T) {
+	m := newMockProvider(t)
+	defer m.Close()
+	p := newTestProvider(t, m)
+
+	pkce, err := NewPKCE()
+	if !assert.NoError(t, err) {
+		return
+	}
+	u, err := url.Parse(p.AuthCodeURL("the-state", "the-nonce", pkce.Challenge))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, m.URL+"/authorize", u.Scheme+"://"+u.Host+u.Path)
+	assert.Equal(t, "openid email groups", u.Query().Get("scope"))
+	assert.Equal(t, "S256", u.Query().Get("code_challenge_method"))
+	assert.Equal(t, testRedirectURL, u.Query().Get("redirect_uri"))
+
+	// The provider sends the user back with the code
+	m.challenge = u.Query().Get("code_challenge")
+	m.claim.Nonce = u.Query().Get("nonce")
+	tok, err := p.Exchange(context.Background(), "the-code", pkce.Verifier, "the-nonce")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "jon", tok.Subject)
+	assert.Equal(t, "jon@example.com", tok.Email)
+	assert.True(t, tok.EmailVerified)
+	assert.Equal(t, []string{"engineering", "oncall"}, tok.GetStrings("groups"))
+
+	// Without the verifier, the code is useless
+	_, err = p.Exchange(context.Background(), "the-code", "another-verifier", "the-nonce")
+	assert.Error(t, err)
+}
+
+func TestExchangeRejectsInvalidIDTokens(t *testing.T) {
+	m := newMockProvider(t)
+	defer m.Close()
+	p := newTestProvider(t, m)
+
+	pkce, err := NewPKCE()
+	if !assert.NoError(t, err) {
+		return
+	}
+	m.challenge = pkce.Challenge
+	m.claim.Nonce = "the-nonce"
+
+	tests := []struct {
+		name   string
+		modify func(c *testIDTokenClaim)
+		nonce  string
+	}{
+		{name: "replayed with another nonce", nonce: "another-nonce"},
+		{name: "for another client", nonce: "the-nonce", modify: func(c *testIDTokenClaim) { c.Audience = "someone-else" }},
+		{name: "from another issuer", nonce: "the-nonce", modify: func(c *testIDTokenClaim) { c.Issuer = "https://evil.example.com" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claim := m.claim
+			defer func() { m.claim = claim }()
+			if tt.modify != nil {
+				tt.modify(&m.claim)
+			}
+			_, err := p.Exchange(context.Background(), "the-code", pkce.Verifier, tt.nonce)
+			assert.Equal(t, ErrInvalidIDToken, err)
+		})
+	}
+
+	// Tokens signed by a key that the provider doesn't publish are rejected
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if !assert.NoError(t, err) {
+		return
+	}
+	k, err := jwt.NewKey(private)
+	if !assert.NoError(t, err) {
+		return
+	}
+	forger, err := jwt.NewClient(k, nil, time.Minute)
+	if !assert.NoError(t, err) {
+		return
+	}
+	claim := m.claim
+	token, err := forger.CreateToken(&claim)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = p.Verify(context.Background(), token, "the-nonce")
+	assert.Equal(t, ErrInvalidIDToken, err)
+}
+
+func TestNewProviderChecksIssuer(t *testing.T) {
+	m := newMockProvider(t)
+	defer m.Close()
+
+	_, err := NewProvider(context.Background(), Config{Issuer: m.URL + "/other", ClientID: testClientID, RedirectURL: testRedirectURL})
+	assert.Error(t, err)
+}
@@ -0,0 +1,124 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// gMaxCBORDepth is how deeply the arrays and maps of a CBOR item can be nested
+const gMaxCBORDepth = 16
+
+// decodeCBOR decodes the first CBOR (RFC 7049) item of b, and returns it along with the bytes after it. It only
+// supports what authenticators use: integers (as int64), byte strings ([]byte), text strings (string), arrays
+// ([]interface{}), maps (map[interface{}]interface{}, with int64 or string keys), booleans and null. Indefinite
+// lengths and floats are not supported.
+func decodeCBOR(b []byte) (interface{}, []byte, error) {
+	return decodeCBORItem(b, 0)
+}
+
+func decodeCBORItem(b []byte, depth int) (interface{}, []byte, error) {
+	if depth > gMaxCBORDepth {
+		return nil, nil, fmt.Errorf("cbor: nested too deeply")
+	}
+	if len(b) < 1 {
+		return nil, nil, fmt.Errorf("cbor: unexpected end of data")
+	}
+
+	major, info := b[0]>>5, b[0]&0x1f
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, b[1:], nil
+		case 21:
+			return true, b[1:], nil
+		case 22:
+			return nil, b[1:], nil
+		}
+		return nil, nil, fmt.Errorf("cbor: unsupported simple value or float %d", info)
+	}
+
+	n, rest, err := decodeCBORLength(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		if n > 1<<63-1 {
+			return nil, nil, fmt.Errorf("cbor: integer overflows int64")
+		}
+		return int64(n), rest, nil
+	case 1:
+		if n > 1<<63-1 {
+			return nil, nil, fmt.Errorf("cbor: integer overflows int64")
+		}
+		return -1 - int64(n), rest, nil
+	case 2, 3:
+		if uint64(len(rest)) < n {
+			return nil, nil, fmt.Errorf("cbor: unexpected end of data")
+		}
+		if major == 2 {
+			return rest[:n], rest[n:], nil
+		}
+		return string(rest[:n]), rest[n:], nil
+	case 4:
+		if uint64(len(rest)) < n {
+			return nil, nil, fmt.Errorf("cbor: unexpected end of data")
+		}
+		var items []interface{}
+		for i := uint64(0); i < n; i++ {
+			var item interface{}
+			item, rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, rest, nil
+	case 5:
+		if uint64(len(rest)) < n {
+			return nil, nil, fmt.Errorf("cbor: unexpected end of data")
+		}
+		m := make(map[interface{}]interface{})
+		for i := uint64(0); i < n; i++ {
+			var k, v interface{}
+			k, rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("cbor: unsupported map key type %T", k)
+			}
+			v, rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[k] = v
+		}
+		return m, rest, nil
+	}
+	return nil, nil, fmt.Errorf("cbor: unsupported major type %d", major)
+}
+
+// decodeCBORLength decodes the argument of the CBOR item at the start of b: its value, or its length
+func decodeCBORLength(b []byte) (uint64, []byte, error) {
+	info := b[0] & 0x1f
+	b = b[1:]
+	switch {
+	case info < 24:
+		return uint64(info), b, nil
+	case info == 24 && len(b) >= 1:
+		return uint64(b[0]), b[1:], nil
+	case info == 25 && len(b) >= 2:
+		return uint64(binary.BigEndian.Uint16(b)), b[2:], nil
+	case info == 26 && len(b) >= 4:
+		return uint64(binary.BigEndian.Uint32(b)), b[4:], nil
+	case info == 27 && len(b) >= 8:
+		return binary.BigEndian.Uint64(b), b[8:], nil
+	case info >= 28:
+		return 0, nil, fmt.Errorf("cbor: indefinite lengths are not supported")
+	}
+	return 0, nil, fmt.Errorf("cbor: unexpected end of data")
+}
@@ -0,0 +1,131 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// Algorithm is a COSE algorithm identifier (RFC 8152), as used in the pubKeyCredParams of the options
+type Algorithm int64
+
+// The algorithms that credentials can use
+const (
+	// AlgorithmES256 is ECDSA with the P-256 curve and SHA-256
+	AlgorithmES256 Algorithm = -7
+	// AlgorithmEdDSA is Ed25519
+	AlgorithmEdDSA Algorithm = -8
+	// AlgorithmRS256 is RSASSA-PKCS1-v1_5 with SHA-256
+	AlgorithmRS256 Algorithm = -257
+)
+
+// gAlgorithms are the algorithms that we accept, in order of preference
+var gAlgorithms = []Algorithm{AlgorithmES256, AlgorithmEdDSA, AlgorithmRS256}
+
+// The COSE key parameters and values that we use
+const (
+	coseKeyType      = 1
+	coseKeyAlgorithm = 3
+	coseCurve        = -1 // EC2 and OKP keys
+	coseX            = -2 // EC2 and OKP keys
+	coseY            = -3 // EC2 keys
+	coseN            = -1 // RSA keys
+	coseE            = -2 // RSA keys
+
+	coseKeyTypeOKP = 1
+	coseKeyTypeEC2 = 2
+	coseKeyTypeRSA = 3
+
+	coseCurveP256    = 1
+	coseCurveEd25519 = 6
+)
+
+// gMinRSABits is the smallest RSA key that we accept
+const gMinRSABits = 2048
+
+// publicKey is the public key of a credential, parsed from its COSE encoding
+type publicKey struct {
+	Algorithm Algorithm
+	key       crypto.PublicKey
+}
+
+// parsePublicKey parses a COSE encoded public key. It returns the bytes after the key as well, since the key is
+// followed by the extensions in the authenticator data.
+func parsePublicKey(b []byte) (*publicKey, []byte, error) {
+	v, rest, err := decodeCBOR(b)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding public key: %v", err)
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("public key is not a COSE key")
+	}
+
+	kty, _ := m[int64(coseKeyType)].(int64)
+	alg, _ := m[int64(coseKeyAlgorithm)].(int64)
+	var k = publicKey{Algorithm: Algorithm(alg)}
+
+	switch {
+	case kty == coseKeyTypeEC2 && k.Algorithm == AlgorithmES256:
+		crv, _ := m[int64(coseCurve)].(int64)
+		x, _ := m[int64(coseX)].([]byte)
+		y, _ := m[int64(coseY)].([]byte)
+		if crv != coseCurveP256 || len(x) != 32 || len(y) != 32 {
+			return nil, nil, fmt.Errorf("ES256 public key should be a point on the P-256 curve")
+		}
+		pub := ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, nil, fmt.Errorf("ES256 public key is not on the P-256 curve")
+		}
+		k.key = &pub
+	case kty == coseKeyTypeOKP && k.Algorithm == AlgorithmEdDSA:
+		crv, _ := m[int64(coseCurve)].(int64)
+		x, _ := m[int64(coseX)].([]byte)
+		if crv != coseCurveEd25519 || len(x) != ed25519.PublicKeySize {
+			return nil, nil, fmt.Errorf("EdDSA public key should be an Ed25519 key")
+		}
+		k.key = ed25519.PublicKey(x)
+	case kty == coseKeyTypeRSA && k.Algorithm == AlgorithmRS256:
+		n, _ := m[int64(coseN)].([]byte)
+		e, _ := m[int64(coseE)].([]byte)
+		if len(e) == 0 || len(e) > 4 {
+			return nil, nil, fmt.Errorf("RS256 public key has an invalid exponent")
+		}
+		pub := rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if pub.N.BitLen() < gMinRSABits {
+			return nil, nil, fmt.Errorf("RSA key should be at least %d bits, but it is %d bits", gMinRSABits, pub.N.BitLen())
+		}
+		k.key = &pub
+	default:
+		return nil, nil, fmt.Errorf("unsupported public key: key type %d with algorithm %d", kty, alg)
+	}
+
+	return &k, rest, nil
+}
+
+// verify returns true if signature is a valid signature of the data by the key. ECDSA signatures are ASN.1 encoded.
+func (k *publicKey) verify(data, signature []byte) bool {
+	switch pub := k.key.(type) {
+	case *ecdsa.PublicKey:
+		var sig struct{ R, S *big.Int }
+		rest, err := asn1.Unmarshal(signature, &sig)
+		if err != nil || len(rest) > 0 || sig.R == nil || sig.S == nil {
+			return false
+		}
+		hash := sha256.Sum256(data)
+		return ecdsa.Verify(pub, hash[:], sig.R, sig.S)
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, data, signature)
+	case *rsa.PublicKey:
+		hash := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], signature) == nil
+	}
+	return false
+}
@@ -0,0 +1,353 @@
+// Package webauthn implements the relying party side of Web Authentication (https://www.w3.org/TR/webauthn-2/): the
+// registration ceremony, which creates a credential on an authenticator (a security key, or a passkey on a phone or
+// laptop), and the authentication ceremony, which proves that the user holds it. Credentials are bound to the relying
+// party ID and to the origins of the site, which makes them phishing resistant.
+//
+// Only the "none" attestation is accepted: we don't check the make and model of the authenticators.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// gEncoding is the base64url encoding, without padding, of the binary fields of the options and the client data
+var gEncoding = base64.RawURLEncoding
+
+// gChallengeSize is the number of random bytes in a challenge
+const gChallengeSize = 32
+
+// gTimeout is how long the browser waits for the user, as a hint
+const gTimeout = 2 * time.Minute
+
+// The flags of the authenticator data
+const (
+	flagUserPresent        = 0x01
+	flagUserVerified       = 0x04
+	flagAttestedCredential = 0x40
+)
+
+// UserVerification is whether the authenticator should verify the user, e.g. with a PIN or a fingerprint, on top of
+// checking that they're present
+type UserVerification string
+
+// The user verification requirements
+const (
+	UserVerificationRequired    UserVerification = "required"
+	UserVerificationPreferred   UserVerification = "preferred"
+	UserVerificationDiscouraged UserVerification = "discouraged"
+)
+
+var (
+	// ErrChallengeMismatch is returned when a response is for a different challenge or ceremony than we expected
+	ErrChallengeMismatch = fmt.Errorf("webauthn: response is not for this challenge")
+	// ErrOriginNotAllowed is returned when a response was made on an origin, or for a relying party, that isn't ours
+	ErrOriginNotAllowed = fmt.Errorf("webauthn: response was made for another site")
+	// ErrUserNotPresent is returned when the authenticator didn't check that the user is present
+	ErrUserNotPresent = fmt.Errorf("webauthn: user was not present")
+	// ErrUserNotVerified is returned when user verification is required, but the authenticator didn't do it
+	ErrUserNotVerified = fmt.Errorf("webauthn: user was not verified")
+	// ErrInvalidSignature is returned when the signature of an assertion doesn't match the credential's public key
+	ErrInvalidSignature = fmt.Errorf("webauthn: signature verification failed")
+	// ErrSignCountNotIncreased is returned when the signature counter of an assertion is not greater than the last
+	// one we saw, which means that the credential might have been cloned
+	ErrSignCountNotIncreased = fmt.Errorf("webauthn: signature counter did not increase: the credential might be cloned")
+)
+
+// RelyingParty is the site that credentials are created for
+type RelyingParty struct {
+	// ID is the domain of the site, e.g. vault.example.com, which credentials are scoped to
+	ID string
+	// Name is the name of the site that authenticators show to the user
+	Name string
+	// Origins are the origins that the ceremonies can be done on, e.g. https://vault.example.com
+	Origins []string
+}
+
+// User is the account that a credential is created for
+type User struct {
+	// ID is the user handle, which should not contain personal information
+	ID          []byte
+	Name        string
+	DisplayName string
+}
+
+// Credential is a credential created by an authenticator, which should be stored for the user
+type Credential struct {
+	ID []byte
+	// PublicKey is the COSE encoded public key of the credential
+	PublicKey []byte
+	// SignCount is the last signature counter that the authenticator reported
+	SignCount uint32
+}
+
+// CredentialDescriptor identifies a credential in the options
+type CredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// CredentialParameters is an algorithm that the relying party accepts for new credentials
+type CredentialParameters struct {
+	Type      string    `json:"type"`
+	Algorithm Algorithm `json:"alg"`
+}
+
+// CreationOptions are the options for navigator.credentials.create(), with the binary fields base64url encoded
+type CreationOptions struct {
+	Challenge string `json:"challenge"`
+	RP        struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"rp"`
+	User struct {
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	} `json:"user"`
+	PubKeyCredParams       []CredentialParameters `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection struct {
+		ResidentKey      string           `json:"residentKey"`
+		UserVerification UserVerification `json:"userVerification"`
+	} `json:"authenticatorSelection"`
+	Attestation string `json:"attestation"`
+}
+
+// RequestOptions are the options for navigator.credentials.get(), with the binary fields base64url encoded
+type RequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	Timeout          int64                  `json:"timeout"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification UserVerification       `json:"userVerification"`
+}
+
+// AttestationResponse is the response of the authenticator to navigator.credentials.create()
+type AttestationResponse struct {
+	ClientDataJSON    []byte
+	AttestationObject []byte
+}
+
+// AssertionResponse is the response of the authenticator to navigator.credentials.get()
+type AssertionResponse struct {
+	ClientDataJSON    []byte
+	AuthenticatorData []byte
+	Signature         []byte
+}
+
+// clientData is the data that the browser signs over, along with the authenticator data
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// authenticatorData is the data that the authenticator signs over
+type authenticatorData struct {
+	RPIDHash  []byte
+	Flags     byte
+	SignCount uint32
+	// The attested credential data, which is only there when a credential is created
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+// NewChallenge returns a new random challenge, which should be used for one ceremony only
+func NewChallenge() ([]byte, error) {
+	b := make([]byte, gChallengeSize)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return nil, fmt.Errorf("webauthn: generating challenge: %v", err)
+	}
+	return b, nil
+}
+
+// NewCreationOptions returns the options to create a credential for the user. The credentials that the user has
+// already are excluded, so the same authenticator isn't registered twice.
+func (rp *RelyingParty) NewCreationOptions(challenge []byte, u User, exclude [][]byte, uv UserVerification) CreationOptions {
+	var o CreationOptions
+	o.Challenge = gEncoding.EncodeToString(challenge)
+	o.RP.ID = rp.ID
+	o.RP.Name = rp.Name
+	o.User.ID = gEncoding.EncodeToString(u.ID)
+	o.User.Name = u.Name
+	o.User.DisplayName = u.DisplayName
+	for _, alg := range gAlgorithms {
+		o.PubKeyCredParams = append(o.PubKeyCredParams, CredentialParameters{Type: "public-key", Algorithm: alg})
+	}
+	o.Timeout = int64(gTimeout / time.Millisecond)
+	o.ExcludeCredentials = newDescriptors(exclude)
+	// Passkeys are discoverable, so the user can log in without typing their email
+	o.AuthenticatorSelection.ResidentKey = "preferred"
+	o.AuthenticatorSelection.UserVerification = uv
+	o.Attestation = "none"
+	return o
+}
+
+// NewRequestOptions returns the options to authenticate with one of the allowed credentials. If none are given, any
+// discoverable credential for the relying party can be used.
+func (rp *RelyingParty) NewRequestOptions(challenge []byte, allow [][]byte, uv UserVerification) RequestOptions {
+	return RequestOptions{
+		Challenge:        gEncoding.EncodeToString(challenge),
+		Timeout:          int64(gTimeout / time.Millisecond),
+		RPID:             rp.ID,
+		AllowCredentials: newDescriptors(allow),
+		UserVerification: uv,
+	}
+}
+
+// VerifyRegistration verifies the response of the authenticator to the creation options with the challenge, and
+// returns the new credential
+func (rp *RelyingParty) VerifyRegistration(challenge []byte, resp AttestationResponse, uv UserVerification) (*Credential, error) {
+	if err := rp.verifyClientData(resp.ClientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+
+	v, _, err := decodeCBOR(resp.AttestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("webauthn: decoding attestation object: %v", err)
+	}
+	obj, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("webauthn: attestation object is not a map")
+	}
+	if format, _ := obj["fmt"].(string); format != "none" {
+		return nil, fmt.Errorf("webauthn: unsupported attestation format '%s': only 'none' is accepted", format)
+	}
+	rawAuthData, ok := obj["authData"].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("webauthn: attestation object has no authenticator data")
+	}
+
+	ad, err := rp.verifyAuthenticatorData(rawAuthData, uv)
+	if err != nil {
+		return nil, err
+	}
+	if ad.Flags&flagAttestedCredential == 0 {
+		return nil, fmt.Errorf("webauthn: authenticator data has no credential")
+	}
+
+	return &Credential{ID: ad.CredentialID, PublicKey: ad.PublicKey, SignCount: ad.SignCount}, nil
+}
+
+// VerifyAssertion verifies the response of the authenticator to the request options with the challenge, signed by
+// the credential. It returns the new signature counter of the credential, which should be stored. With
+// ErrSignCountNotIncreased, it returns the counter that the authenticator reported, which should not be.
+func (rp *RelyingParty) VerifyAssertion(challenge []byte, cred Credential, resp AssertionResponse, uv UserVerification) (uint32, error) {
+	if err := rp.verifyClientData(resp.ClientDataJSON, "webauthn.get", challenge); err != nil {
+		return 0, err
+	}
+	ad, err := rp.verifyAuthenticatorData(resp.AuthenticatorData, uv)
+	if err != nil {
+		return 0, err
+	}
+
+	pub, _, err := parsePublicKey(cred.PublicKey)
+	if err != nil {
+		return 0, fmt.Errorf("webauthn: %v", err)
+	}
+	clientDataHash := sha256.Sum256(resp.ClientDataJSON)
+	signed := append(append([]byte{}, resp.AuthenticatorData...), clientDataHash[:]...)
+	if !pub.verify(signed, resp.Signature) {
+		return 0, ErrInvalidSignature
+	}
+
+	// Authenticators that don't keep a counter always report zero. Otherwise, the counter should go up with every
+	// assertion: if it doesn't, two authenticators have the same credential.
+	if (ad.SignCount != 0 || cred.SignCount != 0) && ad.SignCount <= cred.SignCount {
+		return ad.SignCount, ErrSignCountNotIncreased
+	}
+
+	return ad.SignCount, nil
+}
+
+// verifyClientData checks that the client data is for the ceremony and the challenge, and was made on our origin
+func (rp *RelyingParty) verifyClientData(raw []byte, ceremony string, challenge []byte) error {
+	var cd clientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return fmt.Errorf("webauthn: decoding client data: %v", err)
+	}
+	if cd.Type != ceremony {
+		return ErrChallengeMismatch
+	}
+	got, err := gEncoding.DecodeString(cd.Challenge)
+	if err != nil || !bytes.Equal(got, challenge) {
+		return ErrChallengeMismatch
+	}
+	for _, o := range rp.Origins {
+		if cd.Origin == o {
+			return nil
+		}
+	}
+	return ErrOriginNotAllowed
+}
+
+// verifyAuthenticatorData parses the authenticator data, and checks that it's for our relying party ID and that the
+// user was present, and verified if that's required
+func (rp *RelyingParty) verifyAuthenticatorData(raw []byte, uv UserVerification) (*authenticatorData, error) {
+	ad, err := parseAuthenticatorData(raw)
+	if err != nil {
+		return nil, err
+	}
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(ad.RPIDHash, rpIDHash[:]) {
+		return nil, ErrOriginNotAllowed
+	}
+	if ad.Flags&flagUserPresent == 0 {
+		return nil, ErrUserNotPresent
+	}
+	if uv == UserVerificationRequired && ad.Flags&flagUserVerified == 0 {
+		return nil, ErrUserNotVerified
+	}
+	return ad, nil
+}
+
+// parseAuthenticatorData parses the authenticator data: the hash of the relying party ID, the flags, the signature
+// counter and, when a credential is created, the attested credential data
+func parseAuthenticatorData(b []byte) (*authenticatorData, error) {
+	if len(b) < 37 {
+		return nil, fmt.Errorf("webauthn: authenticator data is too short")
+	}
+	ad := authenticatorData{RPIDHash: b[:32], Flags: b[32], SignCount: binary.BigEndian.Uint32(b[33:37])}
+	if ad.Flags&flagAttestedCredential == 0 {
+		return &ad, nil
+	}
+
+	// The attested credential data: the AAGUID of the authenticator, the length of the credential ID, the credential
+	// ID, and the COSE encoded public key
+	rest := b[37:]
+	if len(rest) < 18 {
+		return nil, fmt.Errorf("webauthn: attested credential data is too short")
+	}
+	n := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if n == 0 || len(rest) < n {
+		return nil, fmt.Errorf("webauthn: attested credential data has an invalid credential ID")
+	}
+	ad.CredentialID, rest = rest[:n], rest[n:]
+
+	_, after, err := parsePublicKey(rest)
+	if err != nil {
+		return nil, fmt.Errorf("webauthn: %v", err)
+	}
+	ad.PublicKey = rest[:len(rest)-len(after)]
+
+	return &ad, nil
+}
+
+// newDescriptors returns the descriptors of the credentials with the IDs
+func newDescriptors(ids [][]byte) []CredentialDescriptor {
+	var ds = []CredentialDescriptor{}
+	for _, id := range ids {
+		ds = append(ds, CredentialDescriptor{Type: "public-key", ID: gEncoding.EncodeToString(id)})
+	}
+	return ds
+}
@@ -0,0 +1,245 @@
+package webauthn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+)
+
+var testRP = RelyingParty{ID: "vault.example.com", Name: "n-factor-vault", Origins: []string{"https://vault.example.com"}}
+
+func TestDecodeCBOR(t *testing.T) {
+	// Examples from RFC 7049, appendix A
+	tests := []struct {
+		hex  string
+		want interface{}
+	}{
+		{"00", int64(0)},
+		{"1818", int64(24)},
+		{"1903e8", int64(1000)},
+		{"3903e7", int64(-1000)},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"6449455446", "IETF"},
+		{"83010203", []interface{}{int64(1), int64(2), int64(3)}},
+		{"a201020304", map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(4)}},
+		{"f5", true},
+		{"f6", nil},
+	}
+	for _, tt := range tests {
+		b, _ := hex.DecodeString(tt.hex)
+		got, rest, err := decodeCBOR(b)
+		assert.NoError(t, err, tt.hex)
+		assert.Equal(t, tt.want, got, tt.hex)
+		assert.Empty(t, rest, tt.hex)
+	}
+
+	for _, bad := range []string{"", "5f", "44010203", "fb3ff199999999999a", "a1830102030405"} {
+		b, _ := hex.DecodeString(bad)
+		_, _, err := decodeCBOR(b)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestCeremonies(t *testing.T) {
+	for name, alg := range map[string]Algorithm{"ES256": AlgorithmES256, "EdDSA": AlgorithmEdDSA} {
+		a := newSoftAuthenticator(t, alg)
+		t.Run(name, func(t *testing.T) {
+			challenge, err := NewChallenge()
+			if !assert.NoError(t, err) {
+				return
+			}
+			cred, err := testRP.VerifyRegistration(challenge, a.create(t, challenge, "https://vault.example.com"), UserVerificationRequired)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, a.id, cred.ID)
+
+			// Log in twice: the counter goes up every time
+			for i := 0; i < 2; i++ {
+				challenge, _ = NewChallenge()
+				count, err := testRP.VerifyAssertion(challenge, *cred, a.get(t, challenge, "https://vault.example.com"), UserVerificationRequired)
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.True(t, count > cred.SignCount)
+				cred.SignCount = count
+			}
+
+			// An assertion from a clone, whose counter is behind
+			a.count -= 2
+			count, err := testRP.VerifyAssertion(challenge, *cred, a.get(t, challenge, "https://vault.example.com"), UserVerificationRequired)
+			assert.Equal(t, ErrSignCountNotIncreased, err)
+			assert.Equal(t, cred.SignCount-1, count) // the counter the clone reported
+			a.count += 2
+
+			// An assertion for another challenge, or made on a phishing site
+			other, _ := NewChallenge()
+			_, err = testRP.VerifyAssertion(challenge, *cred, a.get(t, other, "https://vault.example.com"), UserVerificationRequired)
+			assert.Equal(t, ErrChallengeMismatch, err)
+			_, err = testRP.VerifyAssertion(challenge, *cred, a.get(t, challenge, "https://vault.example.com.evil.com"), UserVerificationRequired)
+			assert.Equal(t, ErrOriginNotAllowed, err)
+
+			// An assertion whose signature doesn't match
+			resp := a.get(t, challenge, "https://vault.example.com")
+			resp.Signature[len(resp.Signature)-1] ^= 0xff
+			_, err = testRP.VerifyAssertion(challenge, *cred, resp, UserVerificationRequired)
+			assert.Equal(t, ErrInvalidSignature, err)
+
+			// An authenticator that doesn't verify the user
+			a.skipUV = true
+			_, err = testRP.VerifyAssertion(challenge, *cred, a.get(t, challenge, "https://vault.example.com"), UserVerificationRequired)
+			assert.Equal(t, ErrUserNotVerified, err)
+			_, err = testRP.VerifyAssertion(challenge, *cred, a.get(t, challenge, "https://vault.example.com"), UserVerificationPreferred)
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestCreationOptions(t *testing.T) {
+	o := testRP.NewCreationOptions([]byte{1, 2, 3}, User{ID: []byte("u1"), Name: "jon@email.com", DisplayName: "Jon"}, [][]byte{{4, 5}}, UserVerificationPreferred)
+	assert.Equal(t, "AQID", o.Challenge)
+	assert.Equal(t, "dTE", o.User.ID)
+	assert.Equal(t, "vault.example.com", o.RP.ID)
+	assert.Equal(t, []CredentialDescriptor{{Type: "public-key", ID: "BAU"}}, o.ExcludeCredentials)
+	assert.Equal(t, AlgorithmES256, o.PubKeyCredParams[0].Algorithm)
+
+	r := testRP.NewRequestOptions([]byte{1, 2, 3}, nil, UserVerificationRequired)
+	assert.Equal(t, []CredentialDescriptor{}, r.AllowCredentials)
+}
+
+// softAuthenticator is an authenticator in software, which creates one credential
+type softAuthenticator struct {
+	alg    Algorithm
+	id     []byte
+	ec     *ecdsa.PrivateKey
+	ed     ed25519.PrivateKey
+	count  uint32
+	skipUV bool
+}
+
+func newSoftAuthenticator(t *testing.T, alg Algorithm) *softAuthenticator {
+	a := softAuthenticator{alg: alg, id: make([]byte, 16)}
+	rand.Read(a.id)
+	var err error
+	if alg == AlgorithmES256 {
+		a.ec, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	} else {
+		_, a.ed, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &a
+}
+
+// create responds to the creation options, with the "none" attestation
+func (a *softAuthenticator) create(t *testing.T, challenge []byte, origin string) AttestationResponse {
+	var cose cborMap
+	if a.alg == AlgorithmES256 {
+		cose = cborMap{{int64(1), int64(2)}, {int64(3), int64(-7)}, {int64(-1), int64(1)}, {int64(-2), padTo32(a.ec.X.Bytes())}, {int64(-3), padTo32(a.ec.Y.Bytes())}}
+	} else {
+		cose = cborMap{{int64(1), int64(1)}, {int64(3), int64(-8)}, {int64(-1), int64(6)}, {int64(-2), []byte(a.ed.Public().(ed25519.PublicKey))}}
+	}
+
+	authData := a.authData(flagAttestedCredential)
+	authData = append(authData, make([]byte, 16)...) // AAGUID
+	authData = append(authData, byte(len(a.id)>>8), byte(len(a.id)))
+	authData = append(authData, a.id...)
+	authData = append(authData, encodeCBOR(cose)...)
+
+	obj := cborMap{{"fmt", "none"}, {"attStmt", cborMap{}}, {"authData", authData}}
+	return AttestationResponse{ClientDataJSON: clientDataJSON(t, "webauthn.create", challenge, origin), AttestationObject: encodeCBOR(obj)}
+}
+
+// get responds to the request options, signing with the credential
+func (a *softAuthenticator) get(t *testing.T, challenge []byte, origin string) AssertionResponse {
+	a.count++
+	resp := AssertionResponse{ClientDataJSON: clientDataJSON(t, "webauthn.get", challenge, origin), AuthenticatorData: a.authData(0)}
+
+	hash := sha256.Sum256(resp.ClientDataJSON)
+	signed := append(append([]byte{}, resp.AuthenticatorData...), hash[:]...)
+	if a.alg == AlgorithmEdDSA {
+		resp.Signature = ed25519.Sign(a.ed, signed)
+		return resp
+	}
+	digest := sha256.Sum256(signed)
+	r, s, err := ecdsa.Sign(rand.Reader, a.ec, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Signature, err = asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func (a *softAuthenticator) authData(flags byte) []byte {
+	flags |= flagUserPresent
+	if !a.skipUV {
+		flags |= flagUserVerified
+	}
+	hash := sha256.Sum256([]byte(testRP.ID))
+	b := append(hash[:], flags)
+	count := make([]byte, 4)
+	binary.BigEndian.PutUint32(count, a.count)
+	return append(b, count...)
+}
+
+func clientDataJSON(t *testing.T, typ string, challenge []byte, origin string) []byte {
+	b, err := json.Marshal(clientData{Type: typ, Challenge: gEncoding.EncodeToString(challenge), Origin: origin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func padTo32(b []byte) []byte {
+	return append(make([]byte, 32-len(b)), b...)
+}
+
+// cborMap is a CBOR map whose keys are encoded in order
+type cborMap [][2]interface{}
+
+// encodeCBOR encodes the values that authenticators use: int64, []byte, string and cborMap
+func encodeCBOR(v interface{}) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 1<<8:
+			return []byte{major<<5 | 24, byte(n)}
+		default:
+			return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+		}
+	}
+	switch v := v.(type) {
+	case int64:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case cborMap:
+		b := head(5, uint64(len(v)))
+		for _, kv := range v {
+			b = append(b, encodeCBOR(kv[0])...)
+			b = append(b, encodeCBOR(kv[1])...)
+		}
+		return b
+	}
+	panic("unsupported type")
+}
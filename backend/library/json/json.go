@@ -19,7 +19,8 @@ func Marshal(v interface{}) ([]byte, error) {
 
 }
 
-// Unmarshal deencodes JSON bytes into the provided struct
+// Unmarshal deencodes JSON bytes into the provided struct. The snake_case keys are converted to camelCase before they're
+// matched with the fields, so json tags should be camelCase e.g. `json:"userId"`, which Marshal turns back into user_id.
 func Unmarshal(src []byte, v interface{}) error {
 
 	unmarshaler := conjson.NewUnmarshaler(v, transform.ConventionalKeys())
@@ -0,0 +1,32 @@
+package json
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnmarshal(t *testing.T) {
+	type request struct {
+		UserID       string
+		RefreshToken string `json:"refreshToken"`
+		Code         string `json:"code"`
+		ClientIP     string `json:"-"`
+	}
+
+	var got request
+	err := Unmarshal([]byte(`{"user_id":"u1", "refresh_token":"t1", "code":"123456", "client_ip":"1.2.3.4"}`), &got)
+	assert.NoError(t, err)
+	assert.Equal(t, request{UserID: "u1", RefreshToken: "t1", Code: "123456"}, got)
+
+	assert.Error(t, Unmarshal([]byte(`not json`), &got))
+}
+
+func TestMarshal(t *testing.T) {
+	b, err := Marshal(struct {
+		UserID       string
+		RefreshToken string `json:"refreshToken"`
+	}{"u1", "t1"})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"user_id":"u1", "refresh_token":"t1"}`, string(b))
+}
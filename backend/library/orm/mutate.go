@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"reflect"
 
+	"github.com/jinzhu/gorm"
+
 	"github.com/teejays/n-factor-vault/backend/library/validator"
 )
 
@@ -13,6 +15,10 @@ import (
 
 // InsertOne inserts an entity into the DB
 func InsertOne(v Entity) error {
+	return insertOne(gDB, v)
+}
+
+func insertOne(db *gorm.DB, v Entity) error {
 	var err error
 
 	if v == nil {
@@ -48,7 +54,7 @@ func InsertOne(v Entity) error {
 	}
 
 	// Add to the DB
-	err = gDB.Create(v).Error
+	err = db.Create(v).Error
 	if err != nil {
 		return err
 	}
@@ -71,6 +77,10 @@ func InsertOne(v Entity) error {
 
 // Save save an entity into the DB
 func Save(v Entity) error {
+	return save(gDB, v)
+}
+
+func save(db *gorm.DB, v Entity) error {
 	var err error
 
 	// Run the validate struct based on validation tags
@@ -92,7 +102,7 @@ func Save(v Entity) error {
 	}
 
 	// Save the entity in DB
-	err = gDB.Save(v).Error
+	err = db.Save(v).Error
 	if err != nil {
 		return err
 	}
@@ -104,16 +114,35 @@ func Save(v Entity) error {
 // TODO: Refactor this function so we explicitly first fetch all the entities, mutate them,
 // run all the Entity funcs, and then save.
 func UpdateByColumn(conditions map[string]interface{}, v Entity) error {
+	return updateByColumn(gDB, conditions, v)
+}
 
-	db := gDB
+func updateByColumn(db *gorm.DB, conditions map[string]interface{}, v Entity) error {
 	for col, val := range conditions {
 		db = db.Where(fmt.Sprintf("%s = ?", col), val)
 	}
 	return db.Model(v).Updates(v).Error
 }
 
+// UpdateColumnsByConditions sets the provided columns on all the rows of v's table where the conditions match.
+// Unlike UpdateByColumn, zero values (e.g. false) in columns are also written to the DB.
+func UpdateColumnsByConditions(conditions map[string]interface{}, columns map[string]interface{}, v Entity) error {
+	return updateColumnsByConditions(gDB, conditions, columns, v)
+}
+
+func updateColumnsByConditions(db *gorm.DB, conditions map[string]interface{}, columns map[string]interface{}, v Entity) error {
+	for col, val := range conditions {
+		db = db.Where(fmt.Sprintf("%s = ?", col), val)
+	}
+	return db.Model(v).Updates(columns).Error
+}
+
 // Delete soft deletes the entity v from  the DB
 func Delete(v Entity) error {
+	return deleteEntity(gDB, v)
+}
+
+func deleteEntity(db *gorm.DB, v Entity) error {
 	var err error
 
 	// Run BeforeDelete func
@@ -122,7 +151,7 @@ func Delete(v Entity) error {
 		return err
 	}
 
-	err = gDB.Delete(v).Error
+	err = db.Delete(v).Error
 	if err != nil {
 		return err
 	}
@@ -135,3 +164,27 @@ func Delete(v Entity) error {
 
 	return nil
 }
+
+// HardDeleteByConditions permanently deletes all the rows of v's table where the conditions match, including
+// rows that have already been soft deleted.
+func HardDeleteByConditions(conditions map[string]interface{}, v Entity) (int64, error) {
+	return hardDeleteByConditions(gDB, conditions, v)
+}
+
+func hardDeleteByConditions(db *gorm.DB, conditions map[string]interface{}, v Entity) (int64, error) {
+	if len(conditions) < 1 {
+		return 0, fmt.Errorf("attempted to hard delete %s without any conditions", reflect.TypeOf(v))
+	}
+	db = db.Unscoped()
+	for col, val := range conditions {
+		db = db.Where(fmt.Sprintf("%s = ?", col), val)
+	}
+	db = db.Delete(v)
+	return db.RowsAffected, db.Error
+}
+
+// Exec runs the raw SQL statement against the DB. It should only be used for things that cannot be expressed with the
+// other helpers, e.g. creating specialized indexes.
+func Exec(statement string, args ...interface{}) error {
+	return gDB.Exec(statement, args...).Error
+}
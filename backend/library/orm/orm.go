@@ -130,6 +130,12 @@ func RegisterModel(v Entity) error {
 	return gDB.AutoMigrate(v).Error
 }
 
+// HasColumn returns whether the table of the model exists and has the column. Services can use it before registering a
+// model, to tell whether a column is about to be added, e.g. so they can backfill it for the existing rows.
+func HasColumn(v Entity, column string) bool {
+	return gDB.HasTable(v) && gDB.Dialect().HasColumn(gDB.NewScope(v).TableName(), column)
+}
+
 // RegisterModels register's multiple models in one go.
 func RegisterModels(models ...Entity) error {
 	for _, v := range models {
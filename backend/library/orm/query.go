@@ -12,7 +12,11 @@ import (
 * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
 
 func FindByID(id id.ID, v Entity) (bool, error) {
-	err := gDB.Where("id = ?", id).First(v).Error
+	return findByID(gDB, id, v)
+}
+
+func findByID(db *gorm.DB, id id.ID, v Entity) (bool, error) {
+	err := db.Where("id = ?", id).First(v).Error
 	if err != nil {
 		if gorm.IsRecordNotFoundError(err) {
 			return false, nil
@@ -23,7 +27,11 @@ func FindByID(id id.ID, v Entity) (bool, error) {
 }
 
 func FindByColumn(colName string, colVal interface{}, v interface{}) (bool, error) {
-	err := gDB.Where(map[string]interface{}{colName: colVal}).Find(v).Error
+	return findByColumn(gDB, colName, colVal, v)
+}
+
+func findByColumn(db *gorm.DB, colName string, colVal interface{}, v interface{}) (bool, error) {
+	err := db.Where(map[string]interface{}{colName: colVal}).Find(v).Error
 	if err != nil {
 		if gorm.IsRecordNotFoundError(err) {
 			return false, nil
@@ -45,7 +53,10 @@ func FindOneByColumn(colName string, colVal interface{}, v Entity) (bool, error)
 }
 
 func FindOne(conditions map[string]interface{}, v Entity) (bool, error) {
-	db := gDB
+	return findOne(gDB, conditions, v)
+}
+
+func findOne(db *gorm.DB, conditions map[string]interface{}, v Entity) (bool, error) {
 	for col, val := range conditions {
 		db = db.Where(fmt.Sprintf("%s = ?", col), val)
 	}
@@ -60,7 +71,10 @@ func FindOne(conditions map[string]interface{}, v Entity) (bool, error) {
 }
 
 func Find(conditions map[string]interface{}, v interface{}) (bool, error) {
-	db := gDB
+	return find(gDB, conditions, v)
+}
+
+func find(db *gorm.DB, conditions map[string]interface{}, v interface{}) (bool, error) {
 	for col, val := range conditions {
 		db = db.Where(fmt.Sprintf("%s = ?", col), val)
 	}
@@ -73,3 +87,30 @@ func Find(conditions map[string]interface{}, v interface{}) (bool, error) {
 	}
 	return true, nil
 }
+
+// FindWhere populates v with all the entities that satisfy the SQL where clause query, e.g. "purge_at <= ?".
+// It should be used for conditions that cannot be expressed as column equality.
+func FindWhere(v interface{}, query string, args ...interface{}) (bool, error) {
+	return findWhere(gDB, v, query, args...)
+}
+
+func findWhere(db *gorm.DB, v interface{}, query string, args ...interface{}) (bool, error) {
+	err := db.Where(query, args...).Find(v).Error
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// ScanRaw runs the raw SQL query and scans the resulting rows into v, which should be a pointer to a slice of structs.
+// It should only be used for queries that cannot be expressed with the other helpers, e.g. joins across tables.
+func ScanRaw(v interface{}, query string, args ...interface{}) error {
+	return scanRaw(gDB, v, query, args...)
+}
+
+func scanRaw(db *gorm.DB, v interface{}, query string, args ...interface{}) error {
+	return db.Raw(query, args...).Scan(v).Error
+}
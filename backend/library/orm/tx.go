@@ -0,0 +1,130 @@
+package orm
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+	"github.com/teejays/clog"
+	"github.com/teejays/n-factor-vault/backend/library/id"
+)
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* T R A N S A C T I O N S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// Tx represents an open database transaction. It provides the same query and mutate helpers
+// as the package level functions, but all of them run inside the transaction.
+type Tx struct {
+	db *gorm.DB
+}
+
+// WithTx runs fn inside a single database transaction. If fn returns an error (or panics), the
+// transaction is rolled back, otherwise it is committed.
+func WithTx(ctx context.Context, fn func(tx *Tx) error) (err error) {
+	if gDB == nil {
+		return fmt.Errorf("orm: cannot begin transaction: orm has not been initialized")
+	}
+
+	db := gDB.BeginTx(ctx, nil)
+	if db.Error != nil {
+		return fmt.Errorf("orm: beginning transaction: %v", db.Error)
+	}
+	tx := &Tx{db: db}
+
+	defer func() {
+		if r := recover(); r != nil {
+			clog.Errorf("orm: rolling back transaction after panic: %v", r)
+			tx.db.Rollback()
+			panic(r)
+		}
+	}()
+
+	err = fn(tx)
+	if err != nil {
+		if rbErr := tx.db.Rollback().Error; rbErr != nil {
+			clog.Errorf("orm: rolling back transaction: %v", rbErr)
+		}
+		return err
+	}
+
+	err = tx.db.Commit().Error
+	if err != nil {
+		return fmt.Errorf("orm: committing transaction: %v", err)
+	}
+
+	return nil
+}
+
+// InsertOne inserts an entity into the DB as part of the transaction
+func (tx *Tx) InsertOne(v Entity) error {
+	return insertOne(tx.db, v)
+}
+
+// Save saves an entity into the DB as part of the transaction
+func (tx *Tx) Save(v Entity) error {
+	return save(tx.db, v)
+}
+
+// UpdateByColumn updates all the entities where the condition matches as part of the transaction
+func (tx *Tx) UpdateByColumn(conditions map[string]interface{}, v Entity) error {
+	return updateByColumn(tx.db, conditions, v)
+}
+
+// UpdateColumnsByConditions sets the provided columns on all rows of v's table that match the conditions,
+// as part of the transaction
+func (tx *Tx) UpdateColumnsByConditions(conditions map[string]interface{}, columns map[string]interface{}, v Entity) error {
+	return updateColumnsByConditions(tx.db, conditions, columns, v)
+}
+
+// Delete soft deletes the entity v from the DB as part of the transaction
+func (tx *Tx) Delete(v Entity) error {
+	return deleteEntity(tx.db, v)
+}
+
+// HardDeleteByConditions permanently deletes all the rows of v's table where the conditions match, as part of the transaction
+func (tx *Tx) HardDeleteByConditions(conditions map[string]interface{}, v Entity) (int64, error) {
+	return hardDeleteByConditions(tx.db, conditions, v)
+}
+
+// FindByID populates v with the entity with the given id, as part of the transaction
+func (tx *Tx) FindByID(id id.ID, v Entity) (bool, error) {
+	return findByID(tx.db, id, v)
+}
+
+// FindByIDForUpdate populates v with the entity with the given id, and locks its row (SELECT ... FOR UPDATE) for the
+// rest of the transaction, so that concurrent transactions that lock it too wait for this one to finish
+func (tx *Tx) FindByIDForUpdate(id id.ID, v Entity) (bool, error) {
+	return findByID(tx.db.Set("gorm:query_option", "FOR UPDATE"), id, v)
+}
+
+// FindOne populates v with the first entity matching the conditions, as part of the transaction
+func (tx *Tx) FindOne(conditions map[string]interface{}, v Entity) (bool, error) {
+	return findOne(tx.db, conditions, v)
+}
+
+// Find populates v with all the entities matching the conditions, as part of the transaction
+func (tx *Tx) Find(conditions map[string]interface{}, v interface{}) (bool, error) {
+	return find(tx.db, conditions, v)
+}
+
+// FindByColumn populates v with all the entities where column colName is colVal, as part of the transaction
+func (tx *Tx) FindByColumn(colName string, colVal interface{}, v interface{}) (bool, error) {
+	return findByColumn(tx.db, colName, colVal, v)
+}
+
+// FindWhere populates v with all the entities that satisfy the SQL where clause query, as part of the transaction
+func (tx *Tx) FindWhere(v interface{}, query string, args ...interface{}) (bool, error) {
+	return findWhere(tx.db, v, query, args...)
+}
+
+// Exec runs the raw SQL statement as part of the transaction. It should only be used for things that cannot be
+// expressed with the other helpers, e.g. migrations.
+func (tx *Tx) Exec(statement string, args ...interface{}) error {
+	return tx.db.Exec(statement, args...).Error
+}
+
+// ScanRaw runs the raw SQL query and scans the resulting rows into v, as part of the transaction
+func (tx *Tx) ScanRaw(v interface{}, query string, args ...interface{}) error {
+	return scanRaw(tx.db, v, query, args...)
+}
@@ -0,0 +1,105 @@
+// Package audit keeps a record of the sensitive actions taken by users across all the services, e.g. archiving
+// a vault. Services record events as part of the same transaction as the action itself, so an action never
+// happens without being audited.
+package audit
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/teejays/clog"
+
+	"github.com/teejays/n-factor-vault/backend/library/id"
+	"github.com/teejays/n-factor-vault/backend/library/orm"
+)
+
+var gServiceName = "Audit Service"
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* O R M   M O D E L S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// Event represents one audited action
+type Event struct {
+	orm.BaseModel `gorm:"embedded"`
+	ActorUserID   id.ID  `gorm:"index" json:"actor_user_id"`
+	Action        string `gorm:"index" json:"action"`
+	EntityType    string `gorm:"index:idx_entity" json:"entity_type"`
+	EntityID      id.ID  `gorm:"index:idx_entity" json:"entity_id"`
+	Details       string `json:"details"`
+	ClientIP      string `json:"client_ip"`
+	Security      bool   `gorm:"index" json:"security"` // true for events about security violations e.g. denied access
+}
+
+// TableName overrides the SQL table name of Event struct
+func (e Event) TableName() string {
+	return "audit_events"
+}
+
+// Init initializes the service so it can connect with the ORM
+func Init() error {
+	return orm.RegisterModels(&Event{})
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* M E T H O D S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// RecordRequest are the parameters for recording a new audit event
+type RecordRequest struct {
+	ActorUserID id.ID
+	Action      string
+	EntityType  string
+	EntityID    id.ID
+	Details     string
+	ClientIP    string
+}
+
+// Record saves a new audit event as part of the transaction tx
+func Record(ctx context.Context, tx *orm.Tx, req RecordRequest) error {
+	clog.Debugf("%s: recording %s on %s %v by %v", gServiceName, req.Action, req.EntityType, req.EntityID, req.ActorUserID)
+	return record(ctx, tx, req, false)
+}
+
+// RecordSecurityEvent saves a new security event, e.g. an attempt to access a vault from an IP that is not allowed.
+// Unlike Record, it uses its own transaction, since the event should be kept even though the action it is about fails.
+func RecordSecurityEvent(ctx context.Context, req RecordRequest) error {
+	clog.Warnf("%s: recording security event %s on %s %v by %v from %q: %s", gServiceName, req.Action, req.EntityType, req.EntityID, req.ActorUserID, req.ClientIP, req.Details)
+	return orm.WithTx(ctx, func(tx *orm.Tx) error {
+		return record(ctx, tx, req, true)
+	})
+}
+
+// GetEventsByEntity returns all the audit events recorded against the given entity
+func GetEventsByEntity(ctx context.Context, entityType string, entityID id.ID) ([]Event, error) {
+	var events []Event
+	_, err := orm.Find(map[string]interface{}{"entity_type": entityType, "entity_id": entityID}, &events)
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* H E L P E R S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+func record(ctx context.Context, tx *orm.Tx, req RecordRequest, security bool) error {
+	if req.Action == "" {
+		return fmt.Errorf("audit action is empty")
+	}
+	if req.EntityType == "" || req.EntityID.IsEmpty() {
+		return fmt.Errorf("audit entity is empty")
+	}
+
+	e := Event{
+		ActorUserID: req.ActorUserID,
+		Action:      req.Action,
+		EntityType:  req.EntityType,
+		EntityID:    req.EntityID,
+		Details:     req.Details,
+		ClientIP:    req.ClientIP,
+		Security:    security,
+	}
+	return tx.InsertOne(&e)
+}
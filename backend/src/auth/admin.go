@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/teejays/clog"
+
+	"github.com/teejays/n-factor-vault/backend/library/env"
+	"github.com/teejays/n-factor-vault/backend/library/id"
+
+	"github.com/teejays/n-factor-vault/backend/src/user"
+)
+
+/* Admins
+
+Admins of the instance can act on the accounts of any user, e.g. to revoke a compromised session during an incident.
+They are configured by the operator (ADMIN_USER_IDS, a comma separated list of user IDs), rather than granted through
+the API, so that taking over an account with the API can't make anyone else an admin.
+
+*/
+
+// envAdminUserIDs is the env variable with the comma separated IDs of the users who are admins of the instance
+const envAdminUserIDs = "ADMIN_USER_IDS"
+
+// gAdminUserIDs are the admins of the instance. It is set up by Init.
+var gAdminUserIDs = make(map[id.ID]bool)
+
+// ErrNotAdmin is returned when a user who isn't an admin of the instance uses an admin method
+var ErrNotAdmin = fmt.Errorf("user is not an admin")
+
+// requireAdmin returns the authenticated user, or ErrNotAdmin if they aren't an admin of the instance
+func requireAdmin(ctx context.Context) (*user.User, error) {
+	u, err := GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !gAdminUserIDs[u.ID] {
+		return nil, ErrNotAdmin
+	}
+	return u, nil
+}
+
+// loadAdminUserIDs returns the admins of the instance, from the configuration
+func loadAdminUserIDs() map[id.ID]bool {
+	admins := make(map[id.ID]bool)
+	s, err := env.GetEnvVar(envAdminUserIDs)
+	if err != nil {
+		return admins
+	}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			admins[id.ID(v)] = true
+		}
+	}
+	clog.Infof("auth: %d admins of the instance", len(admins))
+	return admins
+}
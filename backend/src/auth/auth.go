@@ -8,16 +8,19 @@ import (
 	"time"
 
 	"github.com/teejays/clog"
-	jwt "github.com/teejays/go-jwt"
 
 	"github.com/teejays/n-factor-vault/backend/library/go-api"
-	pwd "github.com/teejays/n-factor-vault/backend/library/go-pwd"
+	jwt "github.com/teejays/n-factor-vault/backend/library/go-jwt"
 	"github.com/teejays/n-factor-vault/backend/library/id"
+	"github.com/teejays/n-factor-vault/backend/library/orm"
+	"github.com/teejays/n-factor-vault/backend/src/secret"
 	"github.com/teejays/n-factor-vault/backend/src/user"
+	"github.com/teejays/n-factor-vault/backend/src/vault"
 )
 
-const sampleSecretKey = "I am a secret key"
-const authExpiryDuration = 48 * time.Hour
+// accessTokenLifespan is how long an access token is valid. It is short, since the token is only checked against
+// the revoked tokens, and not the user's password, until it expires.
+const accessTokenLifespan = 15 * time.Minute
 
 // Keys for storing auth information in http.Request context
 type contextKey string
@@ -25,29 +28,76 @@ type contextKey string
 const gCtxKeyToken = contextKey("jwt_token")
 const gCtxKeyUserID = contextKey("jwt_userid")
 const gCtxKeyIsAuthenticated = contextKey("is_authenticated")
+const gCtxKeyClaim = contextKey("jwt_claim")
+const gCtxKeyAPIKey = contextKey("api_key")
 
-// init initializes the JWT client
-func init() {
-	// Get the JWT client and create a token
-	if jwt.IsClientInitialized() {
-		return
+// gClient signs and verifies the tokens. It is set up by Init.
+var gClient *jwt.Client
+
+// ErrNotInitialized is returned when tokens are created or verified before the service is initialized
+var ErrNotInitialized = fmt.Errorf("auth service is not initialized")
+
+// Init initializes the JWT client with the signing key and the verification keys from the configuration
+func Init() error {
+	signingKey, err := loadSigningKey()
+	if err != nil {
+		return err
+	}
+	verificationKeys, err := loadVerificationKeys()
+	if err != nil {
+		return err
+	}
+
+	cl, err := jwt.NewClient(signingKey, verificationKeys, accessTokenLifespan)
+	if err != nil {
+		return fmt.Errorf("initializing the JWT client: %v", err)
 	}
+	gClient = cl
+	clog.Infof("auth: signing tokens with key %s (%s)", signingKey.ID, signingKey.Algorithm)
 
-	err := jwt.InitClient(sampleSecretKey, authExpiryDuration)
+	gRelyingParty = loadRelyingParty()
+	gOIDCRedirectURL = loadOIDCRedirectURL()
+	gAdminUserIDs = loadAdminUserIDs()
+	directory, err := loadLDAPAuthenticator()
 	if err != nil {
-		clog.Fatalf("Could not initialize the JWT Client: %v", err)
+		return err
+	}
+	if directory != nil {
+		gLDAPAuthenticator = directory
+		RegisterAuthenticator(directory)
 	}
+	secret.RegisterApprovalHook(requireApprovalStepUp)
+	vault.RegisterAccessHook(requireAPIKeyVault)
+
+	return orm.RegisterModels(&Session{}, &RefreshToken{}, &RevokedToken{}, &TOTPFactor{}, &RecoveryCode{}, &MFAChallenge{}, &WebAuthnCredential{}, &WebAuthnChallenge{}, &StepUp{},
+		&ServiceAccount{}, &APIKey{}, &OIDCProvider{}, &OIDCLoginState{}, &OIDCIdentity{}, &LDAPIdentity{})
+}
+
+// GetJWKS returns the public keys that tokens are verified with, as a JSON Web Key Set
+func GetJWKS() (jwt.JWKSet, error) {
+	if gClient == nil {
+		return jwt.JWKSet{}, ErrNotInitialized
+	}
+	return gClient.JWKS(), nil
 }
 
 // LoginCredentials represents user creds for logging in
 type LoginCredentials struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email     string `json:"email"`
+	Password  string `json:"password"`
+	ClientIP  string `json:"-"`
+	UserAgent string `json:"-"`
 }
 
-// LoginResponse is the structure of how a successful login request repoonse will look like
+// LoginResponse is the structure of how a successful login request repoonse will look like. JWT is the access token,
+// which expires at ExpireAt, and RefreshToken can be exchanged for a new pair of tokens once. If the user has a second
+// factor, MFARequired is set and the response only has the MFAToken, which expires at ExpireAt, for VerifyMFA.
 type LoginResponse struct {
-	JWT string
+	JWT          string    `json:"jwt,omitempty"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	MFARequired  bool      `json:"mfa_required"`
+	MFAToken     string    `json:"mfa_token,omitempty"`
+	ExpireAt     time.Time `json:"expire_at"`
 }
 
 // ErrNotAuthenticated is returned when a request or context is not authenticated
@@ -56,8 +106,9 @@ var ErrNotAuthenticated = fmt.Errorf("not authenticated")
 // ErrInvalidCredentails means that login credentials are invalid
 var ErrInvalidCredentails = fmt.Errorf("login credentials are invalid")
 
-// Login authenticates user login credentials and returns an auth token if login is successful
-func Login(creds LoginCredentials) (LoginResponse, error) {
+// Login authenticates user login credentials with the authenticators, and returns an auth token if login is
+// successful. Users with a second factor get an MFA challenge token instead.
+func Login(ctx context.Context, creds LoginCredentials) (LoginResponse, error) {
 	var resp LoginResponse
 
 	if strings.TrimSpace(creds.Email) == "" {
@@ -67,68 +118,55 @@ func Login(creds LoginCredentials) (LoginResponse, error) {
 		return resp, fmt.Errorf("no password provided")
 	}
 
-	// Get user by email
-	u, err := user.GetUserByEmail(creds.Email)
+	// Check the credentials against the password, or the other backends
+	u, err := authenticate(ctx, creds)
 	if err != nil {
 		return resp, err
 	}
-	if u.ID.IsEmpty() {
-		clog.Warnf("auth: no user found with email %s", creds.Email)
-		return resp, ErrInvalidCredentails
-	}
 
-	// Get User Password
-	pass, err := user.GetPasswordForUser(u)
-	if err != nil {
-		return resp, fmt.Errorf("fetching password hash: %v", err)
-	}
-
-	// Validate password
-	isValid := pwd.ValidatePassword(pass.SecurePassword, creds.Password)
-	if !isValid {
-		return resp, ErrInvalidCredentails
-	}
-
-	// Generate the JWT Token
-	token, err := generateToken(u)
+	// Users with a second factor aren't logged in until they enter a code
+	enabled, err := isMFAEnabled(u.ID)
 	if err != nil {
 		return resp, err
 	}
+	if enabled {
+		return startMFAChallenge(ctx, u, creds.ClientIP)
+	}
 
-	resp.JWT = token
-	return resp, nil
+	// Start a session, and generate its tokens
+	return completeLogin(ctx, u, creds.ClientIP, creds.UserAgent)
 
 }
 
 // JWTClaim is the data that will be stored in the JWT token
 type JWTClaim struct {
 	jwt.BaseClaim
-	UserID id.ID `json:"uid"`
+	UserID    id.ID `json:"uid"`
+	SessionID id.ID `json:"sid"`
 }
 
-// generateToken creates and returns an authentication token for the user
-func generateToken(u user.User) (string, error) {
+// generateToken creates and returns an access token for the session
+func generateToken(s Session) (JWTClaim, string, error) {
 
-	// Get the JWT client and create a token
-	cl, err := jwt.GetClient()
-	if err != nil {
-		return "", err
+	claim := JWTClaim{UserID: s.UserID, SessionID: s.ID}
+	if gClient == nil {
+		return claim, "", ErrNotInitialized
 	}
+	claim.Subject = string(s.UserID)
+	claim.UniqueID = string(id.GetNewID())
 
-	claim := JWTClaim{UserID: u.ID}
-
-	token, err := cl.CreateToken(&claim)
+	token, err := gClient.CreateToken(&claim)
 	if err != nil {
-		return "", fmt.Errorf("error creating JWT token: %v", err)
+		return claim, "", fmt.Errorf("error creating JWT token: %v", err)
 	}
 
-	return token, err
+	return claim, token, err
 
 }
 
-// AuthenticateRequestMiddleware should implement the authentication logic. It should should at the auth token
-// and figure out what user context. Currently, this is not implemented and it only relies on
-// and explicitly passed userID in the route.
+// AuthenticateRequestMiddleware authenticates the request by its bearer token, and adds the user to the context.
+// Tokens that have been revoked, or whose session has been, are rejected. The token can also be the API key of a
+// service account, if the key has the scope of the route.
 func AuthenticateRequestMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
@@ -141,6 +179,31 @@ func AuthenticateRequestMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
+		if isAPIKey(token) {
+			k, err := authenticateAPIKey(token, api.GetRouteScope(r))
+			if err == ErrInvalidAPIKey {
+				api.WriteError(w, http.StatusUnauthorized, err, false, nil)
+				return
+			}
+			if err == ErrAPIKeyScope {
+				api.WriteError(w, http.StatusForbidden, err, false, nil)
+				return
+			}
+			if err != nil {
+				clog.Errorf("auth: middleware: authenticating the api key: %v", err)
+				api.WriteError(w, http.StatusInternalServerError, fmt.Errorf(api.ErrMessageClean), false, nil)
+				return
+			}
+
+			ctx := r.Context()
+			ctx = context.WithValue(ctx, gCtxKeyIsAuthenticated, true)
+			ctx = context.WithValue(ctx, gCtxKeyToken, token)
+			ctx = context.WithValue(ctx, gCtxKeyUserID, k.UserID)
+			ctx = context.WithValue(ctx, gCtxKeyAPIKey, k)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
 		// Get the claim from the token (this verifies the token as well)
 		claim, err := getJWTClaimFromToken(token)
 		if err != nil {
@@ -153,12 +216,30 @@ func AuthenticateRequestMiddleware(next http.Handler) http.Handler {
 			api.WriteError(w, http.StatusInternalServerError, fmt.Errorf(api.ErrMessageClean), false, nil)
 			return
 		}
+
+		// Tokens issued before sessions existed have no session, and can't be logged out of
+		if claim.SessionID.IsEmpty() || claim.UniqueID == "" {
+			api.WriteError(w, http.StatusUnauthorized, ErrTokenRevoked, false, nil)
+			return
+		}
+		err = checkRevoked(claim)
+		if err == ErrTokenRevoked {
+			api.WriteError(w, http.StatusUnauthorized, err, false, nil)
+			return
+		}
+		if err != nil {
+			clog.Errorf("auth: middleware: checking if the token is revoked: %v", err)
+			api.WriteError(w, http.StatusInternalServerError, fmt.Errorf(api.ErrMessageClean), false, nil)
+			return
+		}
+
 		// Authentication successful
 		// Add the authentication payload to the context
 		ctx := r.Context()
 		ctx = context.WithValue(ctx, gCtxKeyIsAuthenticated, true)
 		ctx = context.WithValue(ctx, gCtxKeyToken, token)
 		ctx = context.WithValue(ctx, gCtxKeyUserID, claim.UserID)
+		ctx = context.WithValue(ctx, gCtxKeyClaim, claim)
 
 		// Add the updated context to http.Request
 		r = r.WithContext(ctx)
@@ -172,7 +253,6 @@ func getBearerHeaderToken(r *http.Request) (string, error) {
 
 	// Get the authentication header
 	val := r.Header.Get("Authorization")
-	clog.Debugf("Authenticate Header: %v", val)
 	// In JWT, we're looking for the Bearer type token
 	// This means that the val should be like: Bearer <token>
 	if strings.TrimSpace(val) == "" {
@@ -194,13 +274,11 @@ func getBearerHeaderToken(r *http.Request) (string, error) {
 func getJWTClaimFromToken(token string) (JWTClaim, error) {
 	var claim JWTClaim
 
-	// Get the JWT client and create a token
-	cl, err := jwt.GetClient()
-	if err != nil {
-		return claim, err
+	if gClient == nil {
+		return claim, ErrNotInitialized
 	}
 
-	err = cl.VerifyAndDecode(token, &claim)
+	err := gClient.VerifyAndDecode(token, &claim)
 	if err != nil {
 		return claim, err
 	}
@@ -242,6 +320,18 @@ func GetUserFromContext(ctx context.Context) (*user.User, error) {
 
 }
 
+// getClaimFromContext returns the claim of the token that the context was authenticated with
+func getClaimFromContext(ctx context.Context) (JWTClaim, error) {
+	if !IsContextAuthenticated(ctx) {
+		return JWTClaim{}, ErrNotAuthenticated
+	}
+	claim, ok := ctx.Value(gCtxKeyClaim).(JWTClaim)
+	if !ok {
+		return JWTClaim{}, ErrNotAuthenticated
+	}
+	return claim, nil
+}
+
 // IsContextAuthenticated takes a context and returns true if it is authenticated
 func IsContextAuthenticated(ctx context.Context) bool {
 
@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/teejays/clog"
+
+	pwd "github.com/teejays/n-factor-vault/backend/library/go-pwd"
+	"github.com/teejays/n-factor-vault/backend/library/orm"
+
+	"github.com/teejays/n-factor-vault/backend/src/audit"
+	"github.com/teejays/n-factor-vault/backend/src/user"
+)
+
+/* Authenticators
+
+Login checks the credentials against a list of authenticators, which are the backends that users can log in with. The
+first one is always our own passwords. Others, e.g. a directory over LDAP, are registered by Init depending on the
+configuration. The authenticators are tried in order, until one of them knows the credentials: an authenticator that
+doesn't returns ErrInvalidCredentails, and the next one is tried. Any other error stops the login.
+
+The second factor of the user, if any, is checked after the authenticator, whichever it was.
+
+*/
+
+// Authenticator checks login credentials against a backend
+type Authenticator interface {
+	// Name of the backend, for logs
+	Name() string
+	// Authenticate returns the user that the credentials belong to, or ErrInvalidCredentails if the backend doesn't
+	// know them
+	Authenticate(ctx context.Context, creds LoginCredentials) (user.User, error)
+}
+
+var gAuthenticators = []Authenticator{passwordAuthenticator{}}
+
+// RegisterAuthenticator adds a to the authenticators that Login tries, after the ones that are already registered
+func RegisterAuthenticator(a Authenticator) {
+	gAuthenticators = append(gAuthenticators, a)
+}
+
+// passwordAuthenticator checks the credentials against the passwords that users set with us
+type passwordAuthenticator struct{}
+
+func (passwordAuthenticator) Name() string {
+	return "password"
+}
+
+func (passwordAuthenticator) Authenticate(ctx context.Context, creds LoginCredentials) (user.User, error) {
+	// Get user by email
+	u, err := user.GetUserByEmail(creds.Email)
+	if err != nil {
+		return u, err
+	}
+	if u.ID.IsEmpty() {
+		clog.Warnf("auth: no user found with email %s", creds.Email)
+		return u, ErrInvalidCredentails
+	}
+
+	// Get User Password
+	pass, err := user.GetPasswordForUser(u)
+	if err == user.ErrNoPassword {
+		return u, ErrInvalidCredentails
+	}
+	if err != nil {
+		return u, fmt.Errorf("fetching password hash: %v", err)
+	}
+
+	// Validate password
+	isValid := pwd.ValidatePassword(pass.SecurePassword, creds.Password)
+	if !isValid {
+		return u, ErrInvalidCredentails
+	}
+
+	// Organizations can require their members to log in through single sign-on
+	err = requirePasswordLogin(ctx, u)
+	if err != nil {
+		return u, err
+	}
+	return u, nil
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* H E L P E R S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// authenticate returns the user of the credentials, from the first authenticator that knows them
+func authenticate(ctx context.Context, creds LoginCredentials) (user.User, error) {
+	for _, a := range gAuthenticators {
+		u, err := a.Authenticate(ctx, creds)
+		if err == ErrInvalidCredentails {
+			continue
+		}
+		if err != nil {
+			clog.Warnf("auth: %s authenticator: %v", a.Name(), err)
+			return u, err
+		}
+		return u, nil
+	}
+	return user.User{}, ErrInvalidCredentails
+}
+
+// findOrCreateExternalUserTx returns the user with the email, which an external directory has vouched for, as part of
+// the transaction tx. Users who don't exist yet are created without a password, which is audited along with the details
+// of the directory. It also returns whether the user was created. An existing user should only be logged in if they
+// have linked their account to the directory, since the directory can't be trusted with the emails of our users.
+func findOrCreateExternalUserTx(ctx context.Context, tx *orm.Tx, name, email, clientIP, details string) (user.User, bool, error) {
+	var u user.User
+	found, err := tx.FindOne(map[string]interface{}{"email": email}, &u)
+	if err != nil {
+		return u, false, err
+	}
+	if found {
+		return u, false, nil
+	}
+
+	nu, err := user.CreateExternalUserTx(ctx, tx, name, email)
+	if err != nil {
+		return u, false, err
+	}
+	err = audit.Record(ctx, tx, audit.RecordRequest{
+		ActorUserID: nu.ID,
+		Action:      AuditActionUserProvisioned,
+		EntityType:  auditEntityUser,
+		EntityID:    nu.ID,
+		ClientIP:    clientIP,
+		Details:     details,
+	})
+	if err != nil {
+		return u, false, err
+	}
+	return *nu, true, nil
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/teejays/clog"
+
+	"github.com/teejays/n-factor-vault/backend/library/env"
+	jwt "github.com/teejays/n-factor-vault/backend/library/go-jwt"
+)
+
+/* Signing Keys
+
+Tokens are signed with a private key (RS256, ES256 or EdDSA, depending on the type of the key) loaded from the
+configuration (JWT_SIGNING_KEY) or a keyfile (JWT_SIGNING_KEY_FILE). Each token carries the ID of its signing key in
+the kid header, which is the JWK thumbprint of the key.
+
+To rotate the signing key without logging everyone out, the previous key is moved to the verification keys
+(JWT_VERIFICATION_KEYS or JWT_VERIFICATION_KEYS_FILE) when the new key is configured. Tokens signed by either key are
+accepted, and the previous key can be removed once its tokens have expired. The verification keys can be public keys.
+
+The public keys are served as a JSON Web Key Set, so other services can verify our tokens without sharing a secret.
+
+*/
+
+const (
+	// envSigningKey is the env variable with the PEM encoded private key that tokens are signed with
+	envSigningKey = "JWT_SIGNING_KEY"
+	// envSigningKeyFile is the env variable with the path to a file that has the PEM encoded signing key
+	envSigningKeyFile = "JWT_SIGNING_KEY_FILE"
+	// envVerificationKeys is the env variable with more PEM encoded keys that tokens are verified with
+	envVerificationKeys = "JWT_VERIFICATION_KEYS"
+	// envVerificationKeysFile is the env variable with the path to a file that has more PEM encoded verification keys
+	envVerificationKeysFile = "JWT_VERIFICATION_KEYS_FILE"
+)
+
+// ErrSigningKeyNotConfigured is returned when neither the signing key nor a keyfile has been configured
+var ErrSigningKeyNotConfigured = fmt.Errorf("jwt signing key is not configured: set %s or %s", envSigningKey, envSigningKeyFile)
+
+// loadSigningKey loads the signing key from the env variable, or from the keyfile if the variable isn't set
+func loadSigningKey() (*jwt.Key, error) {
+	data, err := loadPEM(envSigningKey, envSigningKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, ErrSigningKeyNotConfigured
+	}
+
+	keys, err := jwt.ParsePEMKeys(data)
+	if err != nil {
+		return nil, fmt.Errorf("jwt signing key: %v", err)
+	}
+	if len(keys) != 1 {
+		return nil, fmt.Errorf("jwt signing key: expected 1 key, but got %d", len(keys))
+	}
+	if !keys[0].CanSign() {
+		return nil, fmt.Errorf("jwt signing key should be a private key")
+	}
+	return keys[0], nil
+}
+
+// loadVerificationKeys loads the additional verification keys, if any, from the env variable or the keyfile
+func loadVerificationKeys() ([]*jwt.Key, error) {
+	data, err := loadPEM(envVerificationKeys, envVerificationKeysFile)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, nil
+	}
+
+	keys, err := jwt.ParsePEMKeys(data)
+	if err != nil {
+		return nil, fmt.Errorf("jwt verification keys: %v", err)
+	}
+	for _, k := range keys {
+		clog.Infof("auth: accepting tokens signed by verification key %s (%s)", k.ID, k.Algorithm)
+	}
+	return keys, nil
+}
+
+// loadPEM returns the content of the env variable, or of the file at the path in the file variable. Since PEM keys
+// span multiple lines, the variable can have literal \n sequences instead of new lines. It returns nil if neither
+// is set.
+func loadPEM(envVar, fileEnvVar string) ([]byte, error) {
+	if s, err := env.GetEnvVar(envVar); err == nil {
+		return []byte(strings.Replace(s, `\n`, "\n", -1)), nil
+	}
+	if path, err := env.GetEnvVar(fileEnvVar); err == nil {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", fileEnvVar, err)
+		}
+		return b, nil
+	}
+	return nil, nil
+}
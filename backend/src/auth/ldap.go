@@ -0,0 +1,415 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/teejays/clog"
+
+	"github.com/teejays/n-factor-vault/backend/library/env"
+	ldap "github.com/teejays/n-factor-vault/backend/library/go-ldap"
+	"github.com/teejays/n-factor-vault/backend/library/id"
+	"github.com/teejays/n-factor-vault/backend/library/json"
+	"github.com/teejays/n-factor-vault/backend/library/orm"
+
+	"github.com/teejays/n-factor-vault/backend/src/audit"
+	"github.com/teejays/n-factor-vault/backend/src/org"
+	"github.com/teejays/n-factor-vault/backend/src/user"
+)
+
+/* LDAP
+
+Users can log in with the password of a directory, e.g. OpenLDAP or Active Directory, if one is configured (LDAP_URL).
+The directory is configured by the operator, and not by an organization, since users' passwords are sent to it.
+
+The login binds as a service account (LDAP_BIND_DN), searches the directory for the user's entry by their login with
+LDAP_USER_FILTER, and then binds as the entry with the user's password. An entry logs in as the user that its DN is
+linked to. An entry that isn't linked yet is for a new user, who is created (without a password) by the email of the
+entry. Their groups are the values of LDAP_GROUP_ATTRIBUTE (memberOf), or the
+entries that LDAP_GROUP_FILTER finds, if it is set, for directories without memberOf.
+
+If the directory belongs to an organization (LDAP_ORG_ID), its users are added to the organization, and the teams
+that the groups are mapped to (LDAP_GROUP_TEAMS) are synced with the user's groups on every login. Groups are
+compared by their DNs, without regard to case.
+
+The directory can't log in as a user who already exists by the email of an entry alone, since users can often edit
+their own mail attribute. Existing users link their account themselves with LinkLDAPIdentity, while they're logged
+in, by logging in to the directory.
+
+*/
+
+const (
+	// envLDAPURL is the env variable with the URL of the directory, e.g. ldaps://ldap.example.com
+	envLDAPURL = "LDAP_URL"
+	// envLDAPStartTLS is the env variable that upgrades an ldap:// connection to TLS
+	envLDAPStartTLS = "LDAP_START_TLS"
+	// envLDAPBindDN is the env variable with the DN of the service account that searches the directory
+	envLDAPBindDN = "LDAP_BIND_DN"
+	// envLDAPBindPassword is the env variable with the password of the service account
+	envLDAPBindPassword = "LDAP_BIND_PASSWORD"
+	// envLDAPBindPasswordFile is the env variable with the path to a file that has the password of the service account
+	envLDAPBindPasswordFile = "LDAP_BIND_PASSWORD_FILE"
+	// envLDAPBaseDN is the env variable with the DN that users are searched under
+	envLDAPBaseDN = "LDAP_BASE_DN"
+	// envLDAPUserFilter is the env variable with the filter that finds a user's entry, where %s is their login
+	envLDAPUserFilter = "LDAP_USER_FILTER"
+	// envLDAPEmailAttribute is the env variable with the attribute that has the user's email
+	envLDAPEmailAttribute = "LDAP_EMAIL_ATTRIBUTE"
+	// envLDAPNameAttribute is the env variable with the attribute that has the user's name
+	envLDAPNameAttribute = "LDAP_NAME_ATTRIBUTE"
+	// envLDAPGroupAttribute is the env variable with the attribute of the user's entry that has the DNs of their groups
+	envLDAPGroupAttribute = "LDAP_GROUP_ATTRIBUTE"
+	// envLDAPGroupBaseDN is the env variable with the DN that groups are searched under, if it isn't the base DN
+	envLDAPGroupBaseDN = "LDAP_GROUP_BASE_DN"
+	// envLDAPGroupFilter is the env variable with the filter that finds the groups of a user, where %s is their DN
+	envLDAPGroupFilter = "LDAP_GROUP_FILTER"
+	// envLDAPOrgID is the env variable with the organization that the users of the directory are members of
+	envLDAPOrgID = "LDAP_ORG_ID"
+	// envLDAPGroupTeams is the env variable with the JSON list of groups and the teams that they are mapped to
+	envLDAPGroupTeams = "LDAP_GROUP_TEAMS"
+)
+
+// AuditActionLDAPIdentityLinked is recorded against a user when they link their account to an entry of the directory
+const AuditActionLDAPIdentityLinked = "auth.ldap_identity_linked"
+
+// ErrLDAPNotConfigured is returned when linking an account to the directory, but no directory is configured
+var ErrLDAPNotConfigured = fmt.Errorf("no ldap directory is configured")
+
+// ErrLDAPIdentityNotLinked is returned when a directory login is for the email of an existing user, who hasn't linked
+// their account to the directory
+var ErrLDAPIdentityNotLinked = fmt.Errorf("an account with this email exists: log in to it, and link it to the directory first")
+
+// ErrLDAPIdentityLinked is returned when a user links their account to an entry of the directory that is linked to
+// another user
+var ErrLDAPIdentityLinked = fmt.Errorf("this directory entry is already linked to another account")
+
+const gDefaultLDAPUserFilter = "(&(objectClass=person)(mail=%s))"
+const gDefaultLDAPEmailAttribute = "mail"
+const gDefaultLDAPNameAttribute = "cn"
+const gDefaultLDAPGroupAttribute = "memberOf"
+
+// gLDAPAuthenticator is the authenticator of the directory, or nil if no directory is configured. It is set up by Init.
+var gLDAPAuthenticator *ldapAuthenticator
+
+// LDAPIdentity links an entry of the directory to the user that it logs in as
+type LDAPIdentity struct {
+	orm.BaseModel `gorm:"embedded"`
+	DN            string `gorm:"unique_index" json:"dn"` // lower case
+	UserID        id.ID  `gorm:"index" json:"user_id"`
+}
+
+// TableName overrides the SQL table name of LDAPIdentity struct
+func (i LDAPIdentity) TableName() string {
+	return "auth_ldap_identities"
+}
+
+// ldapAuthenticator checks the credentials against the password of the user's entry in a directory
+type ldapAuthenticator struct {
+	connection     ldap.Config
+	bindDN         string
+	bindPassword   string
+	baseDN         string
+	userFilter     string
+	emailAttribute string
+	nameAttribute  string
+	groupAttribute string
+	groupBaseDN    string
+	groupFilter    string
+	orgID          id.ID
+	groupTeams     GroupTeams
+}
+
+func (a *ldapAuthenticator) Name() string {
+	return "ldap"
+}
+
+func (a *ldapAuthenticator) Authenticate(ctx context.Context, creds LoginCredentials) (user.User, error) {
+	var u user.User
+
+	entry, groups, err := a.bind(creds)
+	if err != nil {
+		return u, err
+	}
+
+	email := strings.TrimSpace(entry.Get(a.emailAttribute))
+	if email == "" {
+		return u, fmt.Errorf("ldap entry %s has no %s", entry.DN, a.emailAttribute)
+	}
+
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		var err error
+		u, err = findOrCreateLDAPUserTx(ctx, tx, entry.DN, entry.Get(a.nameAttribute), email, creds.ClientIP)
+		if err != nil {
+			return err
+		}
+		return a.syncOrgTx(ctx, tx, u, groups)
+	})
+	if err != nil {
+		return u, err
+	}
+	return u, nil
+}
+
+// bind finds the entry of the login in the directory, and binds as it with the password. It returns the entry, and the
+// lower case DNs of its groups.
+func (a *ldapAuthenticator) bind(creds LoginCredentials) (ldap.Entry, []string, error) {
+	var entry ldap.Entry
+
+	conn, err := ldap.Dial(a.connection)
+	if err != nil {
+		return entry, nil, err
+	}
+	defer conn.Close()
+
+	err = conn.Bind(a.bindDN, a.bindPassword)
+	if err != nil {
+		return entry, nil, fmt.Errorf("binding as the ldap service account: %v", err)
+	}
+
+	entries, err := conn.Search(ldap.SearchRequest{
+		BaseDN:     a.baseDN,
+		Scope:      ldap.ScopeWholeSubtree,
+		Filter:     strings.Replace(a.userFilter, "%s", ldap.EscapeFilter(creds.Email), -1),
+		Attributes: []string{a.emailAttribute, a.nameAttribute, a.groupAttribute},
+		SizeLimit:  2,
+	})
+	if e, ok := err.(*ldap.Error); ok && e.Code == ldap.ResultSizeLimitExceeded || len(entries) > 1 {
+		return entry, nil, fmt.Errorf("more than one ldap entry matches the login %s", creds.Email)
+	}
+	if err != nil {
+		return entry, nil, err
+	}
+	if len(entries) == 0 {
+		clog.Warnf("auth: no ldap entry found for login %s", creds.Email)
+		return entry, nil, ErrInvalidCredentails
+	}
+	entry = entries[0]
+
+	groups, err := a.getGroups(conn, entry)
+	if err != nil {
+		return entry, nil, err
+	}
+
+	// The user's own bind is last, since they may not be allowed to search the groups
+	err = conn.Bind(entry.DN, creds.Password)
+	if ldap.IsInvalidCredentials(err) || err == ldap.ErrEmptyPassword {
+		return entry, nil, ErrInvalidCredentails
+	}
+	if err != nil {
+		return entry, nil, err
+	}
+	return entry, groups, nil
+}
+
+// syncOrgTx adds the user to the organization of the directory, if there is one, and syncs their teams with their
+// groups, as part of the transaction tx
+func (a *ldapAuthenticator) syncOrgTx(ctx context.Context, tx *orm.Tx, u user.User, groups []string) error {
+	if a.orgID.IsEmpty() {
+		return nil
+	}
+	err := org.EnsureMemberTx(ctx, tx, a.orgID, u)
+	if err != nil {
+		return err
+	}
+	return org.SyncTeamsTx(ctx, tx, a.groupTeams.SyncRequest(a.orgID, u.ID, groups))
+}
+
+// getGroups returns the lower case DNs of the groups of the entry
+func (a *ldapAuthenticator) getGroups(conn *ldap.Conn, entry ldap.Entry) ([]string, error) {
+	dns := entry.GetAll(a.groupAttribute)
+	if a.groupFilter != "" {
+		groups, err := conn.Search(ldap.SearchRequest{
+			BaseDN:     a.groupBaseDN,
+			Scope:      ldap.ScopeWholeSubtree,
+			Filter:     strings.Replace(a.groupFilter, "%s", ldap.EscapeFilter(entry.DN), -1),
+			Attributes: []string{"1.1"}, // no attributes, only the DNs
+		})
+		if err != nil {
+			return nil, fmt.Errorf("searching the ldap groups of %s: %v", entry.DN, err)
+		}
+		dns = nil
+		for _, g := range groups {
+			dns = append(dns, g.DN)
+		}
+	}
+
+	var lower []string
+	for _, dn := range dns {
+		lower = append(lower, strings.ToLower(dn))
+	}
+	return lower, nil
+}
+
+// LinkLDAPIdentityRequest are the parameters for linking the account of a user to their entry of the directory. Email and
+// Password are the user's directory login.
+type LinkLDAPIdentityRequest struct {
+	UserID   id.ID  `json:"-"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	ClientIP string `json:"-"`
+}
+
+// LinkLDAPIdentity links the account of the user to the entry of the directory login, so that they can log in with it.
+// The user proves that the entry is theirs by logging in to the directory.
+func LinkLDAPIdentity(ctx context.Context, req LinkLDAPIdentityRequest) error {
+	a := gLDAPAuthenticator
+	if a == nil {
+		return ErrLDAPNotConfigured
+	}
+
+	entry, groups, err := a.bind(LoginCredentials{Email: req.Email, Password: req.Password})
+	if err != nil {
+		return err
+	}
+
+	return orm.WithTx(ctx, func(tx *orm.Tx) error {
+		var u user.User
+		found, err := tx.FindByID(req.UserID, &u)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("user %s not found", req.UserID)
+		}
+
+		var ident LDAPIdentity
+		linked, err := tx.FindOne(map[string]interface{}{"dn": strings.ToLower(entry.DN)}, &ident)
+		if err != nil {
+			return err
+		}
+		if linked && ident.UserID != u.ID {
+			return ErrLDAPIdentityLinked
+		}
+		if !linked {
+			err = tx.InsertOne(&LDAPIdentity{DN: strings.ToLower(entry.DN), UserID: u.ID})
+			if err != nil {
+				return err
+			}
+			err = audit.Record(ctx, tx, audit.RecordRequest{
+				ActorUserID: u.ID,
+				Action:      AuditActionLDAPIdentityLinked,
+				EntityType:  auditEntityUser,
+				EntityID:    u.ID,
+				ClientIP:    req.ClientIP,
+				Details:     fmt.Sprintf("ldap: %s", entry.DN),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return a.syncOrgTx(ctx, tx, u, groups)
+	})
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* H E L P E R S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// findOrCreateLDAPUserTx returns the user that the entry with the DN is linked to, as part of the transaction tx. An
+// entry that isn't linked yet is linked to a new user, who is created by the email of the entry. If a user with the email
+// exists already, they have to link the entry themselves.
+func findOrCreateLDAPUserTx(ctx context.Context, tx *orm.Tx, dn, name, email, clientIP string) (user.User, error) {
+	var u user.User
+
+	var ident LDAPIdentity
+	linked, err := tx.FindOne(map[string]interface{}{"dn": strings.ToLower(dn)}, &ident)
+	if err != nil {
+		return u, err
+	}
+	if linked {
+		found, err := tx.FindByID(ident.UserID, &u)
+		if err != nil {
+			return u, err
+		}
+		if !found {
+			return u, fmt.Errorf("user %s of ldap entry %s not found", ident.UserID, dn)
+		}
+		return u, nil
+	}
+
+	u, created, err := findOrCreateExternalUserTx(ctx, tx, name, email, clientIP, fmt.Sprintf("ldap: %s", dn))
+	if err != nil {
+		return u, err
+	}
+	if !created {
+		return u, ErrLDAPIdentityNotLinked
+	}
+	return u, tx.InsertOne(&LDAPIdentity{DN: strings.ToLower(dn), UserID: u.ID})
+}
+
+// loadLDAPAuthenticator returns the authenticator of the directory from the configuration, or nil if no directory is
+// configured
+func loadLDAPAuthenticator() (*ldapAuthenticator, error) {
+	url, err := env.GetEnvVar(envLDAPURL)
+	if err != nil || strings.TrimSpace(url) == "" {
+		return nil, nil
+	}
+
+	a := ldapAuthenticator{
+		connection:     ldap.Config{URL: strings.TrimSpace(url)},
+		userFilter:     getEnvVarOrDefault(envLDAPUserFilter, gDefaultLDAPUserFilter),
+		emailAttribute: getEnvVarOrDefault(envLDAPEmailAttribute, gDefaultLDAPEmailAttribute),
+		nameAttribute:  getEnvVarOrDefault(envLDAPNameAttribute, gDefaultLDAPNameAttribute),
+		groupAttribute: getEnvVarOrDefault(envLDAPGroupAttribute, gDefaultLDAPGroupAttribute),
+		groupFilter:    getEnvVarOrDefault(envLDAPGroupFilter, ""),
+	}
+	if s, err := env.GetEnvVar(envLDAPStartTLS); err == nil {
+		if a.connection.StartTLS, err = strconv.ParseBool(strings.TrimSpace(s)); err != nil {
+			return nil, fmt.Errorf("%s: %v", envLDAPStartTLS, err)
+		}
+	}
+
+	a.baseDN = getEnvVarOrDefault(envLDAPBaseDN, "")
+	if a.baseDN == "" {
+		return nil, fmt.Errorf("%s is set, but %s isn't", envLDAPURL, envLDAPBaseDN)
+	}
+	a.groupBaseDN = getEnvVarOrDefault(envLDAPGroupBaseDN, a.baseDN)
+	if !strings.Contains(a.userFilter, "%s") {
+		return nil, fmt.Errorf("%s should have %%s where the login goes", envLDAPUserFilter)
+	}
+
+	a.bindDN = getEnvVarOrDefault(envLDAPBindDN, "")
+	if s, err := env.GetEnvVar(envLDAPBindPassword); err == nil {
+		a.bindPassword = s
+	} else if path, err := env.GetEnvVar(envLDAPBindPasswordFile); err == nil {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", envLDAPBindPasswordFile, err)
+		}
+		a.bindPassword = strings.TrimSpace(string(b))
+	}
+
+	if s := getEnvVarOrDefault(envLDAPOrgID, ""); s != "" {
+		if a.orgID, err = id.StrToID(s); err != nil {
+			return nil, fmt.Errorf("%s: %v", envLDAPOrgID, err)
+		}
+	}
+	if s := getEnvVarOrDefault(envLDAPGroupTeams, ""); s != "" {
+		if a.orgID.IsEmpty() {
+			return nil, fmt.Errorf("%s is set, but %s isn't", envLDAPGroupTeams, envLDAPOrgID)
+		}
+		if err := json.Unmarshal([]byte(s), &a.groupTeams); err != nil {
+			return nil, fmt.Errorf("%s: %v", envLDAPGroupTeams, err)
+		}
+		for i, gt := range a.groupTeams {
+			if strings.TrimSpace(gt.Group) == "" || gt.TeamID.IsEmpty() {
+				return nil, fmt.Errorf("%s: group mappings should have a group and a team", envLDAPGroupTeams)
+			}
+			a.groupTeams[i].Group = strings.ToLower(strings.TrimSpace(gt.Group))
+		}
+	}
+
+	clog.Infof("auth: logging in users of ldap directory %s, under %s", a.connection.URL, a.baseDN)
+	return &a, nil
+}
+
+// getEnvVarOrDefault returns the trimmed value of the env variable, or the default if it isn't set or is blank
+func getEnvVarOrDefault(name, defaultValue string) string {
+	if s, err := env.GetEnvVar(name); err == nil && strings.TrimSpace(s) != "" {
+		return strings.TrimSpace(s)
+	}
+	return defaultValue
+}
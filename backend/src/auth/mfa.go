@@ -0,0 +1,485 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/teejays/clog"
+
+	"github.com/teejays/n-factor-vault/backend/library/id"
+	"github.com/teejays/n-factor-vault/backend/library/orm"
+
+	"github.com/teejays/n-factor-vault/backend/src/audit"
+	"github.com/teejays/n-factor-vault/backend/src/totp"
+	"github.com/teejays/n-factor-vault/backend/src/user"
+)
+
+/* Second Factor
+
+Users can protect their login with an authenticator app. Enrolling generates a TOTP key, shown as an otpauth URI and a
+QR code, which is only enabled once the user confirms it with a code from the app. Confirming it also issues recovery
+codes, each of which can be used once instead of a code, e.g. when the phone is lost. The key is encrypted with the
+TOTP master key, and only hashes of the recovery codes are stored.
+
+Once enabled, a correct password no longer logs the user in: Login returns an MFA challenge token instead, which is
+exchanged for the tokens of a new session with a code (VerifyMFA). The challenge is short-lived and allows a few
+attempts. Codes are accepted a time step before or after the current one, for clocks that drift, and each time step
+can only be used once, so an intercepted code can't be replayed.
+
+*/
+
+// gMFAIssuer is the issuer that authenticator apps show next to the user's email
+const gMFAIssuer = "n-factor-vault"
+
+// mfaChallengeLifespan is how long the user has to enter a code after entering their password
+const mfaChallengeLifespan = 5 * time.Minute
+
+// gMaxMFAAttempts is how many wrong codes a challenge allows, before the user has to log in again
+const gMaxMFAAttempts = 5
+
+// gMFASkew is how many time steps before and after the current one a code is accepted for
+const gMFASkew = 1
+
+// gRecoveryCodeCount is the number of recovery codes issued when the second factor is enabled
+const gRecoveryCodeCount = 10
+
+// gRecoveryCodeSize is the number of random bytes in a recovery code
+const gRecoveryCodeSize = 10
+
+const (
+	// AuditActionMFAEnabled is recorded against a user when they enable their second factor
+	AuditActionMFAEnabled = "auth.mfa_enabled"
+	// AuditActionRecoveryCodeUsed is recorded against a user when they log in with a recovery code
+	AuditActionRecoveryCodeUsed = "auth.recovery_code_used"
+)
+
+// ErrMFAAlreadyEnabled is returned when a user enrolls a second factor while they have one already
+var ErrMFAAlreadyEnabled = fmt.Errorf("second factor is already enabled")
+
+// ErrMFANotEnrolled is returned when a user confirms a second factor without enrolling it first
+var ErrMFANotEnrolled = fmt.Errorf("no second factor is waiting to be confirmed: enroll first")
+
+// ErrInvalidMFAToken is returned when an MFA challenge token doesn't exist, has expired, or is out of attempts
+var ErrInvalidMFAToken = fmt.Errorf("mfa token is invalid or has expired")
+
+// ErrInvalidMFACode is returned when neither the code nor the recovery code is valid
+var ErrInvalidMFACode = fmt.Errorf("mfa code is invalid")
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* O R M   M O D E L S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// TOTPFactor is the authenticator app that a user logs in with, besides their password
+type TOTPFactor struct {
+	orm.BaseModel       `gorm:"embedded"`
+	UserID              id.ID `gorm:"unique_index"`
+	EncryptedPrivateKey []byte
+	WrappedDataKey      []byte
+	KeyID               string
+	ConfirmedAt         *time.Time // nil until the user confirms it with a code
+	LastTimeStep        int64      // the time step of the last code accepted, so it can't be used again
+}
+
+// TableName overrides the SQL table name of TOTPFactor struct
+func (f TOTPFactor) TableName() string {
+	return "auth_totp_factors"
+}
+
+// RecoveryCode is the hash of a code that a user can log in with once, instead of a code of their authenticator app
+type RecoveryCode struct {
+	orm.BaseModel `gorm:"embedded"`
+	UserID        id.ID  `gorm:"index"`
+	CodeHash      string `gorm:"index"`
+	UsedAt        *time.Time
+}
+
+// TableName overrides the SQL table name of RecoveryCode struct
+func (c RecoveryCode) TableName() string {
+	return "auth_recovery_codes"
+}
+
+// MFAChallenge is a login whose password was correct, waiting for a code
+type MFAChallenge struct {
+	orm.BaseModel `gorm:"embedded"`
+	UserID        id.ID
+	TokenHash     string `gorm:"unique_index"`
+	ClientIP      string
+	ExpireAt      time.Time
+	Attempts      int // the number of wrong codes entered
+}
+
+// TableName overrides the SQL table name of MFAChallenge struct
+func (c MFAChallenge) TableName() string {
+	return "auth_mfa_challenges"
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* M E T H O D S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// TOTPEnrollment is what the user needs to add the key to their authenticator app
+type TOTPEnrollment struct {
+	URI    string `json:"uri"`
+	Secret string `json:"secret"`  // for apps that can't scan the QR code
+	QRCode []byte `json:"qr_code"` // a PNG image of the URI
+}
+
+// EnrollTOTP generates a new TOTP key for the authenticated user. It replaces any key that wasn't confirmed yet, and
+// only takes effect once it is confirmed by ConfirmTOTP.
+func EnrollTOTP(ctx context.Context) (TOTPEnrollment, error) {
+	var e TOTPEnrollment
+
+	u, err := GetUserFromContext(ctx)
+	if err != nil {
+		return e, err
+	}
+
+	privateKey, err := totp.GenerateKey()
+	if err != nil {
+		return e, err
+	}
+	sealed, err := totp.SealKey(privateKey)
+	if err != nil {
+		return e, err
+	}
+
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		var f TOTPFactor
+		found, err := tx.FindOne(map[string]interface{}{"user_id": u.ID}, &f)
+		if err != nil {
+			return err
+		}
+		if found && f.ConfirmedAt != nil {
+			return ErrMFAAlreadyEnabled
+		}
+		if found {
+			if _, err := tx.HardDeleteByConditions(map[string]interface{}{"id": f.ID}, &TOTPFactor{}); err != nil {
+				return err
+			}
+		}
+		return tx.InsertOne(&TOTPFactor{
+			UserID:              u.ID,
+			EncryptedPrivateKey: sealed.EncryptedPrivateKey,
+			WrappedDataKey:      sealed.WrappedDataKey,
+			KeyID:               sealed.KeyID,
+		})
+	})
+	if err != nil {
+		return e, err
+	}
+
+	k := totp.KeyURI{Type: totp.AccountTypeTOTP, Issuer: gMFAIssuer, Label: u.Email, Secret: privateKey}
+	e.URI = k.String()
+	e.Secret = strings.TrimRight(string(privateKey), "=")
+	e.QRCode, err = totp.EncodeQRCode(e.URI)
+	if err != nil {
+		return e, err
+	}
+
+	return e, nil
+}
+
+// ConfirmTOTPRequest is the data required to confirm a TOTP key
+type ConfirmTOTPRequest struct {
+	Code     string `json:"code"`
+	ClientIP string `json:"-"`
+}
+
+// ConfirmTOTP enables the TOTP key of the authenticated user, if the code is from it. It returns the recovery codes,
+// which are not shown again.
+func ConfirmTOTP(ctx context.Context, req ConfirmTOTPRequest) ([]string, error) {
+	u, err := GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var codes []string
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		f, found, err := findTOTPFactor(tx, u.ID)
+		if err != nil {
+			return err
+		}
+		if !found || f.ConfirmedAt != nil {
+			return ErrMFANotEnrolled
+		}
+
+		if err := verifyTOTPCode(tx, f, req.Code); err != nil {
+			return err
+		}
+		now := time.Now()
+		err = tx.UpdateColumnsByConditions(map[string]interface{}{"id": f.ID}, map[string]interface{}{"confirmed_at": now}, &TOTPFactor{})
+		if err != nil {
+			return err
+		}
+
+		codes, err = issueRecoveryCodes(tx, u.ID)
+		if err != nil {
+			return err
+		}
+
+		return audit.Record(ctx, tx, audit.RecordRequest{
+			ActorUserID: u.ID,
+			Action:      AuditActionMFAEnabled,
+			EntityType:  auditEntityUser,
+			EntityID:    u.ID,
+			ClientIP:    req.ClientIP,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// VerifyMFARequest is the data required to complete a login with a second factor. Either the code or a recovery code
+// should be given.
+type VerifyMFARequest struct {
+	MFAToken     string `json:"mfaToken"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+	ClientIP     string `json:"-"`
+	UserAgent    string `json:"-"`
+}
+
+// VerifyMFA completes the login of an MFA challenge, and starts a session if the code is valid
+func VerifyMFA(ctx context.Context, req VerifyMFARequest) (LoginResponse, error) {
+	var resp LoginResponse
+	if req.MFAToken == "" {
+		return resp, ErrInvalidMFAToken
+	}
+	if req.Code == "" && req.RecoveryCode == "" {
+		return resp, fmt.Errorf("no code provided")
+	}
+
+	var userID id.ID
+	var codeErr error
+	err := orm.WithTx(ctx, func(tx *orm.Tx) error {
+		var c MFAChallenge
+		found, err := tx.FindOne(map[string]interface{}{"token_hash": hashToken(req.MFAToken)}, &c)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return ErrInvalidMFAToken
+		}
+		// Lock the challenge, so its attempts are counted one at a time
+		if _, err = tx.FindByIDForUpdate(c.ID, &c); err != nil {
+			return err
+		}
+		if c.Attempts >= gMaxMFAAttempts || !time.Now().Before(c.ExpireAt) {
+			return ErrInvalidMFAToken
+		}
+
+		codeErr = verifySecondFactor(ctx, tx, c.UserID, req)
+		if codeErr != nil {
+			// The failed attempt is counted, so the error is returned after the transaction
+			return tx.UpdateColumnsByConditions(map[string]interface{}{"id": c.ID}, map[string]interface{}{"attempts": c.Attempts + 1}, &MFAChallenge{})
+		}
+
+		userID = c.UserID
+		_, err = tx.HardDeleteByConditions(map[string]interface{}{"id": c.ID}, &MFAChallenge{})
+		return err
+	})
+	if err != nil {
+		return resp, err
+	}
+	if codeErr != nil {
+		return resp, codeErr
+	}
+
+	u, err := user.GetUser(userID)
+	if err != nil {
+		return resp, err
+	}
+	return completeLogin(ctx, u, req.ClientIP, req.UserAgent)
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* H E L P E R S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// isMFAEnabled returns true if the user has a confirmed second factor
+func isMFAEnabled(userID id.ID) (bool, error) {
+	var f TOTPFactor
+	found, err := orm.FindOne(map[string]interface{}{"user_id": userID}, &f)
+	if err != nil {
+		return false, err
+	}
+	return found && f.ConfirmedAt != nil, nil
+}
+
+// startMFAChallenge creates a challenge for the user, who has entered their password, and returns its token
+func startMFAChallenge(ctx context.Context, u user.User, clientIP string) (LoginResponse, error) {
+	var resp LoginResponse
+
+	token, err := newRandomToken()
+	if err != nil {
+		return resp, err
+	}
+	c := MFAChallenge{UserID: u.ID, TokenHash: hashToken(token), ClientIP: clientIP, ExpireAt: time.Now().Add(mfaChallengeLifespan)}
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		return tx.InsertOne(&c)
+	})
+	if err != nil {
+		return resp, err
+	}
+
+	resp.MFARequired = true
+	resp.MFAToken = token
+	resp.ExpireAt = c.ExpireAt
+	return resp, nil
+}
+
+// verifySecondFactor checks the code, or the recovery code, of the request for the user
+func verifySecondFactor(ctx context.Context, tx *orm.Tx, userID id.ID, req VerifyMFARequest) error {
+	if req.RecoveryCode != "" {
+		return useRecoveryCode(ctx, tx, userID, req)
+	}
+
+	f, found, err := findTOTPFactor(tx, userID)
+	if err != nil {
+		return err
+	}
+	if !found || f.ConfirmedAt == nil {
+		return ErrInvalidMFACode
+	}
+	return verifyTOTPCode(tx, f, req.Code)
+}
+
+// findTOTPFactor returns the TOTP factor of the user, locked for the rest of the transaction
+func findTOTPFactor(tx *orm.Tx, userID id.ID) (TOTPFactor, bool, error) {
+	var f TOTPFactor
+	found, err := tx.FindOne(map[string]interface{}{"user_id": userID}, &f)
+	if err != nil || !found {
+		return f, found, err
+	}
+	found, err = tx.FindByIDForUpdate(f.ID, &f)
+	return f, found, err
+}
+
+// verifyTOTPCode checks the code against the key of the factor, and stores its time step so it can't be used again
+func verifyTOTPCode(tx *orm.Tx, f TOTPFactor, code string) error {
+	privateKey, err := totp.OpenKey(totp.SealedKey{EncryptedPrivateKey: f.EncryptedPrivateKey, WrappedDataKey: f.WrappedDataKey, KeyID: f.KeyID})
+	if err != nil {
+		return err
+	}
+
+	step, err := totp.VerifyCode(privateKey, strings.TrimSpace(code), time.Now(), gMFASkew, f.LastTimeStep)
+	if err == totp.ErrInvalidCode {
+		return ErrInvalidMFACode
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.UpdateColumnsByConditions(map[string]interface{}{"id": f.ID}, map[string]interface{}{"last_time_step": step}, &TOTPFactor{})
+}
+
+// useRecoveryCode marks the recovery code of the request as used, if it's one of the user's unused codes
+func useRecoveryCode(ctx context.Context, tx *orm.Tx, userID id.ID, req VerifyMFARequest) error {
+	var codes []RecoveryCode
+	_, err := tx.FindWhere(&codes, "user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hashRecoveryCode(req.RecoveryCode))
+	if err != nil {
+		return err
+	}
+	if len(codes) == 0 {
+		return ErrInvalidMFACode
+	}
+
+	// Lock the code, and make sure that it hasn't been used in the meantime, e.g. with the challenge of another login
+	var locked RecoveryCode
+	if _, err := tx.FindByIDForUpdate(codes[0].ID, &locked); err != nil {
+		return err
+	}
+	if locked.UsedAt != nil {
+		return ErrInvalidMFACode
+	}
+
+	now := time.Now()
+	err = tx.UpdateColumnsByConditions(map[string]interface{}{"id": locked.ID}, map[string]interface{}{"used_at": now}, &RecoveryCode{})
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.FindWhere(&codes, "user_id = ? AND used_at IS NULL", userID); err != nil {
+		return err
+	}
+	return audit.Record(ctx, tx, audit.RecordRequest{
+		ActorUserID: userID,
+		Action:      AuditActionRecoveryCodeUsed,
+		EntityType:  auditEntityUser,
+		EntityID:    userID,
+		ClientIP:    req.ClientIP,
+		Details:     fmt.Sprintf("%d recovery codes left", len(codes)),
+	})
+}
+
+// issueRecoveryCodes replaces the recovery codes of the user with new ones, and returns them
+func issueRecoveryCodes(tx *orm.Tx, userID id.ID) ([]string, error) {
+	if _, err := tx.HardDeleteByConditions(map[string]interface{}{"user_id": userID}, &RecoveryCode{}); err != nil {
+		return nil, err
+	}
+
+	var codes []string
+	for i := 0; i < gRecoveryCodeCount; i++ {
+		b := make([]byte, gRecoveryCodeSize)
+		if _, err := io.ReadFull(rand.Reader, b); err != nil {
+			return nil, fmt.Errorf("generating recovery code: %v", err)
+		}
+		// 16 characters, shown in groups of four so they're easier to copy
+		s := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		code := strings.Join([]string{s[:4], s[4:8], s[8:12], s[12:]}, "-")
+
+		err := tx.InsertOne(&RecoveryCode{UserID: userID, CodeHash: hashRecoveryCode(code)})
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// completeLogin starts a session for the user, who has been authenticated, and records the login
+func completeLogin(ctx context.Context, u user.User, clientIP, userAgent string) (LoginResponse, error) {
+	resp, err := startSession(ctx, u, clientIP, userAgent)
+	if err != nil {
+		return resp, err
+	}
+
+	// Not being able to record the login shouldn't stop the user from logging in
+	if err := user.RecordLogin(u); err != nil {
+		clog.Errorf("auth: could not record login of user %v: %v", u.ID, err)
+	}
+
+	return resp, nil
+}
+
+// newRandomToken returns a random token, for refresh tokens and challenge tokens
+func newRandomToken() (string, error) {
+	b := make([]byte, gRandomTokenSize)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", fmt.Errorf("generating token: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the hash of a random token, which is what is stored
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// hashRecoveryCode returns the hash of a recovery code, ignoring its case and dashes
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	return hashToken(code)
+}
@@ -0,0 +1,628 @@
+package auth
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/teejays/clog"
+
+	"github.com/teejays/n-factor-vault/backend/library/env"
+	oidc "github.com/teejays/n-factor-vault/backend/library/go-oidc"
+	"github.com/teejays/n-factor-vault/backend/library/id"
+	"github.com/teejays/n-factor-vault/backend/library/json"
+	"github.com/teejays/n-factor-vault/backend/library/orm"
+
+	"github.com/teejays/n-factor-vault/backend/src/audit"
+	"github.com/teejays/n-factor-vault/backend/src/org"
+	"github.com/teejays/n-factor-vault/backend/src/totp"
+	"github.com/teejays/n-factor-vault/backend/src/user"
+)
+
+/* Single Sign-On
+
+Organizations can let their members log in through their own identity provider, with OpenID Connect. An org admin
+registers the provider (its issuer, and the client that we are registered as), and maps the groups of the provider to
+teams of the organization.
+
+Logging in starts with BeginOIDCLogin, which returns the URL of the provider that the user should be sent to. The login
+is bound to a random state, which the provider sends back along with a code, and to a PKCE code verifier and a nonce,
+so that a code or an ID token can't be used by anyone else. FinishOIDCLogin exchanges the code for an ID token, and
+logs in the user that its subject is linked to. A subject that isn't linked yet is for a new user, who is created
+(without a password) by the email of the ID token, which the provider should have verified, and added to the
+organization. The teams that the provider's groups are mapped to are synced with the groups in the ID token, every time
+the user logs in.
+
+An organization's provider can't log in as a user who already exists by their email alone, since anyone who runs a
+provider can put any email in it. Existing users link their account themselves: they start the login with
+BeginOIDCLink while they're logged in, and the subject that comes back is linked to them. Either way, the user should be
+a member of the organization, having accepted its invitation.
+
+Organizations can disable password login for their members, so that they can only log in through single sign-on.
+
+*/
+
+// envOIDCRedirectURL is the env variable with our callback URL, that providers send the user back to
+const envOIDCRedirectURL = "OIDC_REDIRECT_URL"
+
+const gDefaultOIDCRedirectURL = "http://localhost:8080/v1/login/oidc/callback"
+
+// gDefaultGroupsClaim is the claim of the ID token that has the user's groups, unless the provider sets another one
+const gDefaultGroupsClaim = "groups"
+
+// oidcLoginLifespan is how long the user has to log in at the provider
+const oidcLoginLifespan = 10 * time.Minute
+
+const auditEntityOIDCProvider = "oidc_provider"
+
+const (
+	// AuditActionOIDCProviderCreated is recorded against a provider when an org admin registers it
+	AuditActionOIDCProviderCreated = "auth.oidc_provider_created"
+	// AuditActionUserProvisioned is recorded against a user when they are created on their first single sign-on
+	AuditActionUserProvisioned = "auth.user_provisioned"
+	// AuditActionOIDCIdentityLinked is recorded against a user when they link their account to a provider
+	AuditActionOIDCIdentityLinked = "auth.oidc_identity_linked"
+)
+
+// gOIDCRedirectURL is our callback URL. It is set up by Init.
+var gOIDCRedirectURL string
+
+// gOIDCProviders caches the discovered providers by their ID, so that discovery and the provider's keys aren't
+// fetched on every login
+var gOIDCProviders = make(map[id.ID]*oidc.Provider)
+var gOIDCProvidersLock sync.Mutex
+
+// ErrOIDCProviderNotFound is returned when a provider doesn't exist
+var ErrOIDCProviderNotFound = fmt.Errorf("oidc provider not found")
+
+// ErrInvalidOIDCState is returned when the state of a login is unknown, has expired, or has been used already
+var ErrInvalidOIDCState = fmt.Errorf("oidc login state is invalid or has expired")
+
+// ErrEmailNotVerified is returned when the provider hasn't verified the email of the user who logged in
+var ErrEmailNotVerified = fmt.Errorf("email has not been verified by the identity provider")
+
+// ErrNotOrgMember is returned when a sign-on of an organization is for a user who isn't a member of it. The
+// organization's identity provider can't log in users that the organization doesn't own.
+var ErrNotOrgMember = fmt.Errorf("user is not a member of the organization")
+
+// ErrOIDCIdentityNotLinked is returned when a sign-on is for the email of an existing user, who hasn't linked their
+// account to the provider
+var ErrOIDCIdentityNotLinked = fmt.Errorf("an account with this email exists: log in to it, and link it to the identity provider first")
+
+// ErrOIDCIdentityLinked is returned when a user links their account to a subject of the provider that is linked to
+// another user
+var ErrOIDCIdentityLinked = fmt.Errorf("this identity is already linked to another account")
+
+// ErrPasswordLoginDisabled is returned when a user logs in with a password, but an organization of theirs only allows
+// single sign-on
+var ErrPasswordLoginDisabled = fmt.Errorf("password login is disabled by your organization, log in with single sign-on")
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* O R M   M O D E L S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// OIDCProvider is an OpenID provider that the members of an organization log in with
+type OIDCProvider struct {
+	orm.BaseModel         `gorm:"embedded"`
+	OrgID                 id.ID          `gorm:"index" json:"org_id"`
+	Name                  string         `json:"name"`
+	Issuer                string         `json:"issuer"`
+	ClientID              string         `json:"client_id"`
+	EncryptedClientSecret []byte         `json:"-"` // sealed under the master key
+	WrappedDataKey        []byte         `json:"-"`
+	KeyID                 string         `json:"-"`
+	Scopes                pq.StringArray `gorm:"type:text[]" json:"scopes"`
+	GroupsClaim           string         `json:"groups_claim"`
+	GroupTeams            GroupTeams     `gorm:"type:jsonb" json:"group_teams"`
+	CreatedByUserID       id.ID          `json:"created_by_user_id"`
+}
+
+// TableName overrides the SQL table name of OIDCProvider struct
+func (p OIDCProvider) TableName() string {
+	return "auth_oidc_providers"
+}
+
+// OIDCLoginState is a login that is waiting for the user to come back from the provider
+type OIDCLoginState struct {
+	orm.BaseModel `gorm:"embedded"`
+	StateHash     string    `gorm:"unique_index" json:"-"`
+	ProviderID    id.ID     `json:"provider_id"`
+	Nonce         string    `json:"-"`
+	CodeVerifier  string    `json:"-"`
+	LinkUserID    id.ID     `json:"-"` // for a login that links the account of this user to the provider
+	ExpireAt      time.Time `json:"expire_at"`
+}
+
+// TableName overrides the SQL table name of OIDCLoginState struct
+func (s OIDCLoginState) TableName() string {
+	return "auth_oidc_states"
+}
+
+// OIDCIdentity links a subject of a provider to the user that it logs in as
+type OIDCIdentity struct {
+	orm.BaseModel `gorm:"embedded"`
+	ProviderID    id.ID  `gorm:"unique_index:idx_oidc_identity" json:"provider_id"`
+	Subject       string `gorm:"unique_index:idx_oidc_identity" json:"subject"`
+	UserID        id.ID  `gorm:"index" json:"user_id"`
+}
+
+// TableName overrides the SQL table name of OIDCIdentity struct
+func (i OIDCIdentity) TableName() string {
+	return "auth_oidc_identities"
+}
+
+// GroupTeam maps a group of an external directory to a team of the organization
+type GroupTeam struct {
+	Group  string `json:"group"`
+	TeamID id.ID  `json:"teamId"`
+}
+
+// GroupTeams are the teams that the groups of an external directory are mapped to. A group can be mapped to several
+// teams, and several groups to the same team.
+type GroupTeams []GroupTeam
+
+// Value implements the driver.Valuer interface, so the mappings are stored as JSON
+func (gts GroupTeams) Value() (driver.Value, error) {
+	if gts == nil {
+		gts = GroupTeams{}
+	}
+	data, err := json.Marshal(gts)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// Scan implements the sql.Scanner interface, so the mappings can be read from their JSON column
+func (gts *GroupTeams) Scan(src interface{}) error {
+	switch s := src.(type) {
+	case nil:
+		*gts = GroupTeams{}
+		return nil
+	case []byte:
+		return json.Unmarshal(s, gts)
+	case string:
+		return json.Unmarshal([]byte(s), gts)
+	default:
+		return fmt.Errorf("cannot scan %T into %T", src, gts)
+	}
+}
+
+// SyncRequest returns the request that syncs the user's teams with their groups: the mapped teams are managed, and
+// the user should be a member of the ones that their groups are mapped to
+func (gts GroupTeams) SyncRequest(orgID, userID id.ID, groups []string) org.SyncTeamsRequest {
+	req := org.SyncTeamsRequest{OrgID: orgID, UserID: userID}
+	var managed, member = make(map[id.ID]bool), make(map[id.ID]bool)
+	for _, gt := range gts {
+		if !managed[gt.TeamID] {
+			managed[gt.TeamID] = true
+			req.ManagedTeamIDs = append(req.ManagedTeamIDs, gt.TeamID)
+		}
+		if !member[gt.TeamID] && containsString(groups, gt.Group) {
+			member[gt.TeamID] = true
+			req.TeamIDs = append(req.TeamIDs, gt.TeamID)
+		}
+	}
+	return req
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* M E T H O D S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// CreateOIDCProviderRequest are the parameters to register an OpenID provider for an organization
+type CreateOIDCProviderRequest struct {
+	OrgID        id.ID `json:"-"`
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	GroupsClaim  string
+	GroupTeams   GroupTeams
+	ClientIP     string `json:"-"`
+}
+
+// FinishOIDCLoginRequest are the parameters that the provider sends the user back with
+type FinishOIDCLoginRequest struct {
+	State     string
+	Code      string
+	ClientIP  string
+	UserAgent string
+}
+
+// OIDCLoginStart is where the user should be sent to log in at the provider
+type OIDCLoginStart struct {
+	AuthorizationURL string    `json:"authorization_url"`
+	ExpireAt         time.Time `json:"expire_at"`
+}
+
+// CreateOIDCProvider registers an OpenID provider for the organization. The authenticated user should be an admin of the
+// organization. The provider's discovery document is fetched, to make sure the issuer is right.
+func CreateOIDCProvider(ctx context.Context, req CreateOIDCProviderRequest) (*OIDCProvider, error) {
+	u, err := GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return nil, fmt.Errorf("no name provided for the provider")
+	}
+	if strings.TrimSpace(req.GroupsClaim) == "" {
+		req.GroupsClaim = gDefaultGroupsClaim
+	}
+	for _, gt := range req.GroupTeams {
+		if strings.TrimSpace(gt.Group) == "" || gt.TeamID.IsEmpty() {
+			return nil, fmt.Errorf("group mappings should have a group and a team")
+		}
+	}
+
+	p := OIDCProvider{
+		OrgID:           req.OrgID,
+		Name:            req.Name,
+		Issuer:          strings.TrimSuffix(strings.TrimSpace(req.Issuer), "/"),
+		ClientID:        strings.TrimSpace(req.ClientID),
+		Scopes:          pq.StringArray(req.Scopes),
+		GroupsClaim:     strings.TrimSpace(req.GroupsClaim),
+		GroupTeams:      req.GroupTeams,
+		CreatedByUserID: u.ID,
+	}
+	if p.Scopes == nil {
+		p.Scopes = pq.StringArray{"email", "profile"}
+	}
+
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		err := org.RequireRoleTx(ctx, tx, req.OrgID, u.ID, org.RoleAdmin)
+		if err != nil {
+			return err
+		}
+		for _, gt := range p.GroupTeams {
+			var t org.Team
+			found, err := tx.FindByID(gt.TeamID, &t)
+			if err != nil {
+				return err
+			}
+			if !found || t.OrgID != req.OrgID {
+				return org.ErrTeamNotFound
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Discovery is done before the provider is saved, so a wrong issuer is caught now rather than on the first login
+	_, err = oidc.NewProvider(ctx, oidcConfig(p, req.ClientSecret))
+	if err != nil {
+		return nil, err
+	}
+	if req.ClientSecret != "" {
+		sealed, err := totp.SealKey([]byte(req.ClientSecret))
+		if err != nil {
+			return nil, err
+		}
+		p.EncryptedClientSecret, p.WrappedDataKey, p.KeyID = sealed.EncryptedPrivateKey, sealed.WrappedDataKey, sealed.KeyID
+	}
+
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		if err := tx.InsertOne(&p); err != nil {
+			return err
+		}
+		return audit.Record(ctx, tx, audit.RecordRequest{
+			ActorUserID: u.ID,
+			Action:      AuditActionOIDCProviderCreated,
+			EntityType:  auditEntityOIDCProvider,
+			EntityID:    p.ID,
+			ClientIP:    req.ClientIP,
+			Details:     fmt.Sprintf("org: %s; issuer: %s", p.OrgID, p.Issuer),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// GetOIDCProviders returns the OpenID providers of the organization. The authenticated user should be an admin of the
+// organization.
+func GetOIDCProviders(ctx context.Context, orgID id.ID) ([]OIDCProvider, error) {
+	u, err := GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var ps []OIDCProvider
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		if err := org.RequireRoleTx(ctx, tx, orgID, u.ID, org.RoleAdmin); err != nil {
+			return err
+		}
+		_, err := tx.Find(map[string]interface{}{"org_id": orgID}, &ps)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+// BeginOIDCLogin starts a login with the provider, and returns the URL that the user should be sent to
+func BeginOIDCLogin(ctx context.Context, providerID id.ID) (OIDCLoginStart, error) {
+	return beginOIDCLogin(ctx, providerID, "")
+}
+
+// BeginOIDCLink starts a login with the provider that links the account of the authenticated user to it, and returns
+// the URL that the user should be sent to. The user should be a member of the provider's organization.
+func BeginOIDCLink(ctx context.Context, providerID id.ID) (OIDCLoginStart, error) {
+	u, err := GetUserFromContext(ctx)
+	if err != nil {
+		return OIDCLoginStart{}, err
+	}
+	return beginOIDCLogin(ctx, providerID, u.ID)
+}
+
+// beginOIDCLogin starts a login with the provider, which links the subject to the user if linkUserID is set
+func beginOIDCLogin(ctx context.Context, providerID, linkUserID id.ID) (OIDCLoginStart, error) {
+	var start OIDCLoginStart
+
+	p, op, err := getOIDCProvider(ctx, providerID)
+	if err != nil {
+		return start, err
+	}
+	if !linkUserID.IsEmpty() {
+		err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+			return requireOrgMemberTx(ctx, tx, p.OrgID, linkUserID)
+		})
+		if err != nil {
+			return start, err
+		}
+	}
+
+	state, err := newRandomToken()
+	if err != nil {
+		return start, err
+	}
+	nonce, err := oidc.NewRandomString()
+	if err != nil {
+		return start, err
+	}
+	pkce, err := oidc.NewPKCE()
+	if err != nil {
+		return start, err
+	}
+
+	s := OIDCLoginState{StateHash: hashToken(state), ProviderID: p.ID, Nonce: nonce, CodeVerifier: pkce.Verifier, LinkUserID: linkUserID, ExpireAt: time.Now().Add(oidcLoginLifespan)}
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		return tx.InsertOne(&s)
+	})
+	if err != nil {
+		return start, err
+	}
+
+	start.AuthorizationURL = op.AuthCodeURL(state, nonce, pkce.Challenge)
+	start.ExpireAt = s.ExpireAt
+	return start, nil
+}
+
+// FinishOIDCLogin exchanges the code that the provider sent the user back with for their ID token, and logs them in.
+// Users who don't exist yet are created, and the teams that are mapped to the provider's groups are synced. If the
+// login was started by BeginOIDCLink, the subject is linked to the user who started it.
+func FinishOIDCLogin(ctx context.Context, req FinishOIDCLoginRequest) (LoginResponse, error) {
+	var resp LoginResponse
+
+	if req.State == "" || req.Code == "" {
+		return resp, ErrInvalidOIDCState
+	}
+
+	// The state is used up first, in its own transaction, so a failed exchange can't be retried with it
+	var s OIDCLoginState
+	err := orm.WithTx(ctx, func(tx *orm.Tx) error {
+		found, err := tx.FindOne(map[string]interface{}{"state_hash": hashToken(req.State)}, &s)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return ErrInvalidOIDCState
+		}
+		_, err = tx.HardDeleteByConditions(map[string]interface{}{"id": s.ID}, &OIDCLoginState{})
+		return err
+	})
+	if err != nil {
+		return resp, err
+	}
+	if !time.Now().Before(s.ExpireAt) {
+		return resp, ErrInvalidOIDCState
+	}
+
+	p, op, err := getOIDCProvider(ctx, s.ProviderID)
+	if err != nil {
+		return resp, err
+	}
+	tok, err := op.Exchange(ctx, req.Code, s.CodeVerifier, s.Nonce)
+	if err != nil {
+		clog.Warnf("auth: oidc login with provider %v failed: %v", p.ID, err)
+		return resp, err
+	}
+	if tok.Subject == "" {
+		return resp, oidc.ErrInvalidIDToken
+	}
+
+	var u user.User
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		var err error
+		u, err = findOrCreateOIDCUserTx(ctx, tx, p, s, tok, req.ClientIP)
+		if err != nil {
+			return err
+		}
+		return org.SyncTeamsTx(ctx, tx, p.GroupTeams.SyncRequest(p.OrgID, u.ID, tok.GetStrings(p.GroupsClaim)))
+	})
+	if err != nil {
+		return resp, err
+	}
+
+	// The provider checks the user's own factors, but a second factor that they set up with us still applies
+	enabled, err := isMFAEnabled(u.ID)
+	if err != nil {
+		return resp, err
+	}
+	if enabled {
+		return startMFAChallenge(ctx, u, req.ClientIP)
+	}
+	return completeLogin(ctx, u, req.ClientIP, req.UserAgent)
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* H E L P E R S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// findOrCreateOIDCUserTx returns the user that the subject of the ID token is linked to, as part of the transaction tx.
+// A subject that isn't linked yet is linked to the user of the state, if it's for linking, or else to a new user, who
+// is created and added to the organization.
+func findOrCreateOIDCUserTx(ctx context.Context, tx *orm.Tx, p OIDCProvider, s OIDCLoginState, tok oidc.IDToken, clientIP string) (user.User, error) {
+	var u user.User
+
+	var ident OIDCIdentity
+	linked, err := tx.FindOne(map[string]interface{}{"provider_id": p.ID, "subject": tok.Subject}, &ident)
+	if err != nil {
+		return u, err
+	}
+	details := fmt.Sprintf("oidc provider: %s; subject: %s", p.ID, tok.Subject)
+
+	switch {
+	case !s.LinkUserID.IsEmpty():
+		if linked && ident.UserID != s.LinkUserID {
+			return u, ErrOIDCIdentityLinked
+		}
+		if err := requireOrgMemberTx(ctx, tx, p.OrgID, s.LinkUserID); err != nil {
+			return u, err
+		}
+		if _, err := tx.FindByID(s.LinkUserID, &u); err != nil {
+			return u, err
+		}
+		if linked {
+			return u, nil
+		}
+		err = tx.InsertOne(&OIDCIdentity{ProviderID: p.ID, Subject: tok.Subject, UserID: u.ID})
+		if err != nil {
+			return u, err
+		}
+		return u, audit.Record(ctx, tx, audit.RecordRequest{
+			ActorUserID: u.ID,
+			Action:      AuditActionOIDCIdentityLinked,
+			EntityType:  auditEntityUser,
+			EntityID:    u.ID,
+			ClientIP:    clientIP,
+			Details:     details,
+		})
+
+	case linked:
+		found, err := tx.FindByID(ident.UserID, &u)
+		if err != nil {
+			return u, err
+		}
+		if !found {
+			return u, ErrNotOrgMember
+		}
+		return u, requireOrgMemberTx(ctx, tx, p.OrgID, u.ID)
+	}
+
+	email := strings.TrimSpace(tok.Email)
+	if email == "" || !tok.EmailVerified {
+		return u, ErrEmailNotVerified
+	}
+	u, created, err := findOrCreateExternalUserTx(ctx, tx, tok.Name, email, clientIP, details)
+	if err != nil {
+		return u, err
+	}
+	if !created {
+		return u, ErrOIDCIdentityNotLinked
+	}
+	err = tx.InsertOne(&OIDCIdentity{ProviderID: p.ID, Subject: tok.Subject, UserID: u.ID})
+	if err != nil {
+		return u, err
+	}
+	return u, org.EnsureMemberTx(ctx, tx, p.OrgID, u)
+}
+
+// requireOrgMemberTx returns ErrNotOrgMember if the user isn't a member of the organization, as part of the
+// transaction tx
+func requireOrgMemberTx(ctx context.Context, tx *orm.Tx, orgID, userID id.ID) error {
+	isMember, err := org.IsMemberTx(ctx, tx, orgID, userID)
+	if err != nil {
+		return err
+	}
+	if !isMember {
+		return ErrNotOrgMember
+	}
+	return nil
+}
+
+// loadOIDCRedirectURL returns our callback URL, from the configuration
+func loadOIDCRedirectURL() string {
+	if s, err := env.GetEnvVar(envOIDCRedirectURL); err == nil && strings.TrimSpace(s) != "" {
+		return strings.TrimSpace(s)
+	}
+	return gDefaultOIDCRedirectURL
+}
+
+// getOIDCProvider returns the provider, and its discovered OpenID provider, which is cached
+func getOIDCProvider(ctx context.Context, providerID id.ID) (OIDCProvider, *oidc.Provider, error) {
+	var p OIDCProvider
+	found, err := orm.FindByID(providerID, &p)
+	if err != nil {
+		return p, nil, err
+	}
+	if !found {
+		return p, nil, ErrOIDCProviderNotFound
+	}
+
+	gOIDCProvidersLock.Lock()
+	defer gOIDCProvidersLock.Unlock()
+	if op, ok := gOIDCProviders[p.ID]; ok {
+		return p, op, nil
+	}
+
+	var secret []byte
+	if len(p.EncryptedClientSecret) > 0 {
+		secret, err = totp.OpenKey(totp.SealedKey{EncryptedPrivateKey: p.EncryptedClientSecret, WrappedDataKey: p.WrappedDataKey, KeyID: p.KeyID})
+		if err != nil {
+			return p, nil, fmt.Errorf("opening the client secret of oidc provider %v: %v", p.ID, err)
+		}
+	}
+	op, err := oidc.NewProvider(ctx, oidcConfig(p, string(secret)))
+	if err != nil {
+		return p, nil, err
+	}
+	gOIDCProviders[p.ID] = op
+	return p, op, nil
+}
+
+// oidcConfig returns the configuration of the OpenID provider, with our callback URL
+func oidcConfig(p OIDCProvider, clientSecret string) oidc.Config {
+	return oidc.Config{
+		Issuer:       p.Issuer,
+		ClientID:     p.ClientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  gOIDCRedirectURL,
+		Scopes:       p.Scopes,
+	}
+}
+
+// requirePasswordLogin returns ErrPasswordLoginDisabled if an organization of the user only allows single sign-on. Only
+// the organizations that the user has accepted count, so that an invitation can't lock them out.
+func requirePasswordLogin(ctx context.Context, u user.User) error {
+	orgs, err := org.GetOrgsByUser(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+	for _, o := range orgs {
+		if o.PasswordLoginDisabled {
+			return ErrPasswordLoginDisabled
+		}
+	}
+	return nil
+}
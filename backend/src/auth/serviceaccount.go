@@ -0,0 +1,625 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/teejays/clog"
+
+	"github.com/teejays/n-factor-vault/backend/library/id"
+	"github.com/teejays/n-factor-vault/backend/library/orm"
+
+	"github.com/teejays/n-factor-vault/backend/src/audit"
+	"github.com/teejays/n-factor-vault/backend/src/org"
+	"github.com/teejays/n-factor-vault/backend/src/user"
+	"github.com/teejays/n-factor-vault/backend/src/vault"
+)
+
+/* Service Accounts
+
+Machines, e.g. CI pipelines and deploy scripts, act as service accounts. A service account is owned by a vault, and
+managed by the vault's owners, or by an organization, and managed by its admins. Each service account is a user too
+(with no email or password), so it can request the secrets of vaults like anyone else, and the members of the vault
+approve its requests. Service accounts never approve requests themselves.
+
+Service accounts authenticate with API keys, sent as bearer tokens in place of a JWT. Only a hash of the key is
+stored. A key is limited to some vaults (the owner vault, or vaults of the owner organization), and to some scopes: a
+key can only be used on the routes whose scope it has. Keys can expire, be revoked, and be rotated: rotating a key
+issues a new key with the same vaults and scopes, and keeps the old key working for a grace period, so the machines can
+be updated without downtime.
+
+*/
+
+// gAPIKeyPrefix starts every API key, so they can be told apart from JWTs (and spotted by secret scanners)
+const gAPIKeyPrefix = "nfv_"
+
+// gMaxRotationGracePeriod is the longest that the old key keeps working after a rotation
+const gMaxRotationGracePeriod = 7 * 24 * time.Hour
+
+// The scopes that API keys can have. Each is the scope of the routes that it allows.
+const (
+	// ScopeSecretRequest allows requesting the secrets of vaults, and checking the status of the requests
+	ScopeSecretRequest = "secret.request"
+	// ScopeSecretReveal allows revealing the secrets of approved requests
+	ScopeSecretReveal = "secret.reveal"
+	// ScopeTOTPCode allows getting (and streaming) the codes of TOTP accounts, with approved requests
+	ScopeTOTPCode = "totp.code"
+	// ScopeTOTPExport allows exporting the TOTP accounts of a vault, with an approved request
+	ScopeTOTPExport = "totp.export"
+)
+
+var gScopes = []string{ScopeSecretRequest, ScopeSecretReveal, ScopeTOTPCode, ScopeTOTPExport}
+
+const auditEntityServiceAccount = "service_account"
+
+const (
+	// AuditActionServiceAccountCreated is recorded against a service account when it is created
+	AuditActionServiceAccountCreated = "auth.service_account_created"
+	// AuditActionServiceAccountDisabled is recorded against a service account when it is disabled
+	AuditActionServiceAccountDisabled = "auth.service_account_disabled"
+	// AuditActionAPIKeyCreated is recorded against a service account when a key is created for it
+	AuditActionAPIKeyCreated = "auth.api_key_created"
+	// AuditActionAPIKeyRotated is recorded against a service account when one of its keys is rotated
+	AuditActionAPIKeyRotated = "auth.api_key_rotated"
+	// AuditActionAPIKeyRevoked is recorded against a service account when one of its keys is revoked
+	AuditActionAPIKeyRevoked = "auth.api_key_revoked"
+)
+
+// ErrServiceAccountNotFound is returned when a service account doesn't exist, or has been disabled
+var ErrServiceAccountNotFound = fmt.Errorf("service account not found")
+
+// ErrAPIKeyNotFound is returned when an API key doesn't exist, or belongs to another service account
+var ErrAPIKeyNotFound = fmt.Errorf("api key not found")
+
+// ErrInvalidAPIKey is returned when an API key is unknown, has expired or has been revoked
+var ErrInvalidAPIKey = fmt.Errorf("api key is invalid, expired or revoked")
+
+// ErrAPIKeyScope is returned when an API key is used for something that it is not scoped to
+var ErrAPIKeyScope = fmt.Errorf("api key is not scoped to this operation")
+
+// ErrAPIKeyVault is returned when an API key is used to access a vault that it is not scoped to
+var ErrAPIKeyVault = fmt.Errorf("api key is not scoped to this vault")
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* O R M   M O D E L S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// ServiceAccount is a principal for machines, owned by either a vault or an organization
+type ServiceAccount struct {
+	orm.BaseModel   `gorm:"embedded"`
+	UserID          id.ID      `gorm:"unique_index" json:"user_id"` // the user that the service account acts as
+	Name            string     `json:"name"`
+	Description     string     `json:"description"`
+	VaultID         *id.ID     `gorm:"index" json:"vault_id"` // set if the vault owns the service account
+	OrgID           *id.ID     `gorm:"index" json:"org_id"`   // set if the organization owns the service account
+	CreatedByUserID id.ID      `json:"created_by_user_id"`
+	DisabledAt      *time.Time `json:"disabled_at"`
+}
+
+// TableName overrides the SQL table name of ServiceAccount struct
+func (sa ServiceAccount) TableName() string {
+	return "auth_service_accounts"
+}
+
+// APIKey is a key that a service account authenticates with
+type APIKey struct {
+	orm.BaseModel    `gorm:"embedded"`
+	ServiceAccountID id.ID          `gorm:"index" json:"service_account_id"`
+	UserID           id.ID          `json:"-"` // the user of the service account
+	Name             string         `json:"name"`
+	Hint             string         `json:"hint"` // the start of the key, so users can tell their keys apart
+	KeyHash          string         `gorm:"unique_index" json:"-"`
+	VaultIDs         pq.StringArray `gorm:"type:text[]" json:"vault_ids"`
+	Scopes           pq.StringArray `gorm:"type:text[]" json:"scopes"`
+	ExpireAt         *time.Time     `json:"expire_at"` // nil if the key doesn't expire
+	RevokedAt        *time.Time     `json:"revoked_at"`
+	LastUsedAt       *time.Time     `json:"last_used_at"`
+	RotatedToKeyID   *id.ID         `json:"rotated_to_key_id"` // the key that replaced this one, if it was rotated
+}
+
+// TableName overrides the SQL table name of APIKey struct
+func (k APIKey) TableName() string {
+	return "auth_api_keys"
+}
+
+// IsActive returns true if the key can be used at time t
+func (k APIKey) IsActive(t time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpireAt == nil || t.Before(*k.ExpireAt))
+}
+
+// HasScope returns true if the key can be used for the scope
+func (k APIKey) HasScope(scope string) bool {
+	return scope != "" && containsString(k.Scopes, scope)
+}
+
+// HasVault returns true if the key can be used to access the vault
+func (k APIKey) HasVault(vaultID id.ID) bool {
+	return containsString(k.VaultIDs, string(vaultID))
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* M E T H O D S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// CreateServiceAccountRequest are the parameters to create a service account. Exactly one of the VaultID and the OrgID
+// should be set.
+type CreateServiceAccountRequest struct {
+	Name        string
+	Description string
+	VaultID     id.ID
+	OrgID       id.ID
+	ClientIP    string `json:"-"`
+}
+
+// GetServiceAccountsRequest are the parameters to list the service accounts of a vault, or of an organization
+type GetServiceAccountsRequest struct {
+	VaultID id.ID
+	OrgID   id.ID
+}
+
+// CreateAPIKeyRequest are the parameters to create an API key for a service account
+type CreateAPIKeyRequest struct {
+	ServiceAccountID id.ID `json:"-"`
+	Name             string
+	VaultIDs         []id.ID
+	Scopes           []string
+	ExpireAt         *time.Time
+	ClientIP         string `json:"-"`
+}
+
+// RotateAPIKeyRequest are the parameters to rotate an API key. The old key keeps working for the grace period.
+type RotateAPIKeyRequest struct {
+	ServiceAccountID   id.ID `json:"-"`
+	APIKeyID           id.ID `json:"-"`
+	GracePeriodMinutes int
+	ClientIP           string `json:"-"`
+}
+
+// APIKeyRequest identifies an API key of a service account
+type APIKeyRequest struct {
+	ServiceAccountID id.ID
+	APIKeyID         id.ID
+	ClientIP         string
+}
+
+// NewAPIKey is a newly created API key. The key itself is only ever returned here.
+type NewAPIKey struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+// CreateServiceAccount creates a service account, owned by a vault or an organization. The authenticated user should
+// own the vault, or be an admin of the organization.
+func CreateServiceAccount(ctx context.Context, req CreateServiceAccountRequest) (*ServiceAccount, error) {
+	u, err := GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return nil, fmt.Errorf("no name provided for the service account")
+	}
+	if req.VaultID.IsEmpty() == req.OrgID.IsEmpty() {
+		return nil, fmt.Errorf("a service account should be owned by either a vault or an organization")
+	}
+
+	var sa = ServiceAccount{Name: req.Name, Description: req.Description, CreatedByUserID: u.ID}
+	if !req.VaultID.IsEmpty() {
+		sa.VaultID = &req.VaultID
+	} else {
+		sa.OrgID = &req.OrgID
+	}
+
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		if err := requireServiceAccountManager(ctx, tx, sa, u.ID); err != nil {
+			return err
+		}
+		su, err := user.CreateServiceAccountUserTx(ctx, tx, sa.Name)
+		if err != nil {
+			return err
+		}
+		sa.UserID = su.ID
+		if err := tx.InsertOne(&sa); err != nil {
+			return err
+		}
+		return recordServiceAccountEvent(ctx, tx, u.ID, sa.ID, AuditActionServiceAccountCreated, req.ClientIP, sa.Name)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &sa, nil
+}
+
+// GetServiceAccounts returns the service accounts of a vault, or of an organization. The authenticated user should
+// own the vault, or be an admin of the organization.
+func GetServiceAccounts(ctx context.Context, req GetServiceAccountsRequest) ([]ServiceAccount, error) {
+	u, err := GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.VaultID.IsEmpty() == req.OrgID.IsEmpty() {
+		return nil, fmt.Errorf("either a vault or an organization should be provided")
+	}
+
+	var owner ServiceAccount
+	var conditions = map[string]interface{}{"vault_id": req.VaultID}
+	if req.VaultID.IsEmpty() {
+		owner.OrgID = &req.OrgID
+		conditions = map[string]interface{}{"org_id": req.OrgID}
+	} else {
+		owner.VaultID = &req.VaultID
+	}
+
+	var sas []ServiceAccount
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		if err := requireServiceAccountManager(ctx, tx, owner, u.ID); err != nil {
+			return err
+		}
+		_, err := tx.Find(conditions, &sas)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sas, nil
+}
+
+// DisableServiceAccount disables a service account, and revokes all its keys
+func DisableServiceAccount(ctx context.Context, serviceAccountID id.ID, clientIP string) error {
+	u, err := GetUserFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	return orm.WithTx(ctx, func(tx *orm.Tx) error {
+		sa, err := getServiceAccountAsManager(ctx, tx, serviceAccountID, u.ID)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		err = tx.UpdateColumnsByConditions(map[string]interface{}{"id": sa.ID}, map[string]interface{}{"disabled_at": now}, &ServiceAccount{})
+		if err != nil {
+			return err
+		}
+		var keys []APIKey
+		_, err = tx.FindWhere(&keys, "service_account_id = ? AND revoked_at IS NULL", sa.ID)
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			err = tx.UpdateColumnsByConditions(map[string]interface{}{"id": k.ID}, map[string]interface{}{"revoked_at": now}, &APIKey{})
+			if err != nil {
+				return err
+			}
+		}
+		return recordServiceAccountEvent(ctx, tx, u.ID, sa.ID, AuditActionServiceAccountDisabled, clientIP, sa.Name)
+	})
+}
+
+// CreateAPIKey creates an API key for the service account. The key is only returned this once.
+func CreateAPIKey(ctx context.Context, req CreateAPIKeyRequest) (*NewAPIKey, error) {
+	u, err := GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return nil, fmt.Errorf("no name provided for the api key")
+	}
+	scopes, err := cleanScopes(req.Scopes)
+	if err != nil {
+		return nil, err
+	}
+	if req.ExpireAt != nil && !req.ExpireAt.After(time.Now()) {
+		return nil, fmt.Errorf("api key should expire in the future")
+	}
+
+	var k *NewAPIKey
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		sa, err := getServiceAccountAsManager(ctx, tx, req.ServiceAccountID, u.ID)
+		if err != nil {
+			return err
+		}
+		vaultIDs, err := cleanKeyVaults(ctx, sa, req.VaultIDs)
+		if err != nil {
+			return err
+		}
+
+		k, err = insertAPIKey(tx, APIKey{ServiceAccountID: sa.ID, UserID: sa.UserID, Name: req.Name, VaultIDs: vaultIDs, Scopes: scopes, ExpireAt: req.ExpireAt})
+		if err != nil {
+			return err
+		}
+		return recordServiceAccountEvent(ctx, tx, u.ID, sa.ID, AuditActionAPIKeyCreated, req.ClientIP, k.describe())
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// GetAPIKeys returns the API keys of the service account, including the revoked and expired ones
+func GetAPIKeys(ctx context.Context, serviceAccountID id.ID) ([]APIKey, error) {
+	u, err := GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []APIKey
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		sa, err := getServiceAccountAsManager(ctx, tx, serviceAccountID, u.ID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Find(map[string]interface{}{"service_account_id": sa.ID}, &keys)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// RotateAPIKey replaces the API key with a new key, with the same vaults, scopes and expiry. The old key keeps working
+// for the grace period, if any.
+func RotateAPIKey(ctx context.Context, req RotateAPIKeyRequest) (*NewAPIKey, error) {
+	u, err := GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	grace := time.Duration(req.GracePeriodMinutes) * time.Minute
+	if grace < 0 || grace > gMaxRotationGracePeriod {
+		return nil, fmt.Errorf("grace period should be between 0 and %d minutes", int(gMaxRotationGracePeriod.Minutes()))
+	}
+
+	var k *NewAPIKey
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		sa, err := getServiceAccountAsManager(ctx, tx, req.ServiceAccountID, u.ID)
+		if err != nil {
+			return err
+		}
+		old, err := findAPIKey(tx, sa.ID, req.APIKeyID)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if !old.IsActive(now) {
+			return ErrInvalidAPIKey
+		}
+
+		k, err = insertAPIKey(tx, APIKey{ServiceAccountID: sa.ID, UserID: sa.UserID, Name: old.Name, VaultIDs: old.VaultIDs, Scopes: old.Scopes, ExpireAt: old.ExpireAt})
+		if err != nil {
+			return err
+		}
+
+		// The old key expires at the end of the grace period, unless it was going to expire before that anyway
+		cols := map[string]interface{}{"rotated_to_key_id": k.ID}
+		if grace == 0 {
+			cols["revoked_at"] = now
+		} else if end := now.Add(grace); old.ExpireAt == nil || end.Before(*old.ExpireAt) {
+			cols["expire_at"] = end
+		}
+		err = tx.UpdateColumnsByConditions(map[string]interface{}{"id": old.ID}, cols, &APIKey{})
+		if err != nil {
+			return err
+		}
+		return recordServiceAccountEvent(ctx, tx, u.ID, sa.ID, AuditActionAPIKeyRotated, req.ClientIP, fmt.Sprintf("%s, grace period of %v", k.describe(), grace))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// RevokeAPIKey revokes an API key of the service account, right away
+func RevokeAPIKey(ctx context.Context, req APIKeyRequest) error {
+	u, err := GetUserFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	return orm.WithTx(ctx, func(tx *orm.Tx) error {
+		sa, err := getServiceAccountAsManager(ctx, tx, req.ServiceAccountID, u.ID)
+		if err != nil {
+			return err
+		}
+		k, err := findAPIKey(tx, sa.ID, req.APIKeyID)
+		if err != nil {
+			return err
+		}
+		if k.RevokedAt != nil {
+			return nil
+		}
+		err = tx.UpdateColumnsByConditions(map[string]interface{}{"id": k.ID}, map[string]interface{}{"revoked_at": time.Now()}, &APIKey{})
+		if err != nil {
+			return err
+		}
+		return recordServiceAccountEvent(ctx, tx, u.ID, sa.ID, AuditActionAPIKeyRevoked, req.ClientIP, k.Name)
+	})
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* H E L P E R S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// isAPIKey returns true if the bearer token is an API key, rather than a JWT
+func isAPIKey(token string) bool {
+	return strings.HasPrefix(token, gAPIKeyPrefix)
+}
+
+// authenticateAPIKey returns the active API key, if it has the scope
+func authenticateAPIKey(token string, scope string) (APIKey, error) {
+	var k APIKey
+	found, err := orm.FindOne(map[string]interface{}{"key_hash": hashToken(token)}, &k)
+	if err != nil {
+		return k, err
+	}
+	now := time.Now()
+	if !found || !k.IsActive(now) {
+		return k, ErrInvalidAPIKey
+	}
+	if !k.HasScope(scope) {
+		return k, ErrAPIKeyScope
+	}
+
+	// It's only to show users which keys are still in use, so it doesn't need to hold up the request
+	err = orm.UpdateColumnsByConditions(map[string]interface{}{"id": k.ID}, map[string]interface{}{"last_used_at": now}, &APIKey{})
+	if err != nil {
+		clog.Errorf("auth: updating the last use of api key %v: %v", k.ID, err)
+	}
+	return k, nil
+}
+
+// getAPIKeyFromContext returns the API key that the context was authenticated with, if it was
+func getAPIKeyFromContext(ctx context.Context) (APIKey, bool) {
+	k, ok := ctx.Value(gCtxKeyAPIKey).(APIKey)
+	return k, ok
+}
+
+// requireAPIKeyVault is the access hook of the vaults. Requests authenticated with an API key can only access the
+// vaults that the key is scoped to.
+func requireAPIKeyVault(ctx context.Context, req vault.CheckAccessRequest) error {
+	k, ok := getAPIKeyFromContext(ctx)
+	if !ok {
+		return nil
+	}
+	if !k.HasVault(req.Vault.ID) {
+		return ErrAPIKeyVault
+	}
+	return nil
+}
+
+// requireServiceAccountManager returns an error unless the user can manage the service accounts of the owner of sa:
+// the owners of its vault, or the admins of its organization
+func requireServiceAccountManager(ctx context.Context, tx *orm.Tx, sa ServiceAccount, userID id.ID) error {
+	if sa.VaultID != nil {
+		return vault.RequireRoleTx(ctx, tx, *sa.VaultID, userID, vault.RoleOwner)
+	}
+	if sa.OrgID != nil {
+		return org.RequireRoleTx(ctx, tx, *sa.OrgID, userID, org.RoleAdmin)
+	}
+	return ErrServiceAccountNotFound
+}
+
+// getServiceAccountAsManager locks and returns the service account, if it hasn't been disabled and the user can manage
+// it
+func getServiceAccountAsManager(ctx context.Context, tx *orm.Tx, serviceAccountID, userID id.ID) (ServiceAccount, error) {
+	var sa ServiceAccount
+	found, err := tx.FindByID(serviceAccountID, &sa)
+	if err != nil {
+		return sa, err
+	}
+	if !found || sa.DisabledAt != nil {
+		return sa, ErrServiceAccountNotFound
+	}
+	return sa, requireServiceAccountManager(ctx, tx, sa, userID)
+}
+
+// findAPIKey returns the key, if it belongs to the service account
+func findAPIKey(tx *orm.Tx, serviceAccountID, keyID id.ID) (APIKey, error) {
+	var k APIKey
+	found, err := tx.FindByID(keyID, &k)
+	if err != nil {
+		return k, err
+	}
+	if !found || k.ServiceAccountID != serviceAccountID {
+		return k, ErrAPIKeyNotFound
+	}
+	return k, nil
+}
+
+// insertAPIKey generates a new key, and saves k with the hash of it
+func insertAPIKey(tx *orm.Tx, k APIKey) (*NewAPIKey, error) {
+	token, err := newRandomToken()
+	if err != nil {
+		return nil, err
+	}
+	token = gAPIKeyPrefix + token
+	k.KeyHash = hashToken(token)
+	k.Hint = token[:len(gAPIKeyPrefix)+4]
+	if err := tx.InsertOne(&k); err != nil {
+		return nil, err
+	}
+	return &NewAPIKey{APIKey: k, Key: token}, nil
+}
+
+// cleanScopes returns the scopes without duplicates, or an error if there are none or one is unknown
+func cleanScopes(scopes []string) (pq.StringArray, error) {
+	var cleaned = pq.StringArray{}
+	for _, s := range scopes {
+		s = strings.TrimSpace(s)
+		if !containsString(gScopes, s) {
+			return nil, fmt.Errorf("unknown scope %q, should be one of %s", s, strings.Join(gScopes, ", "))
+		}
+		if !containsString(cleaned, s) {
+			cleaned = append(cleaned, s)
+		}
+	}
+	if len(cleaned) == 0 {
+		return nil, fmt.Errorf("api key should have at least one scope")
+	}
+	return cleaned, nil
+}
+
+// cleanKeyVaults returns the vaults that a key of the service account can be scoped to. A key of a vault's service
+// account can only access that vault, and a key of an organization's service account can access the vaults of that
+// organization.
+func cleanKeyVaults(ctx context.Context, sa ServiceAccount, vaultIDs []id.ID) (pq.StringArray, error) {
+	if sa.VaultID != nil && len(vaultIDs) == 0 {
+		vaultIDs = []id.ID{*sa.VaultID}
+	}
+	if len(vaultIDs) == 0 {
+		return nil, fmt.Errorf("api key should be scoped to at least one vault")
+	}
+
+	var cleaned = pq.StringArray{}
+	for _, vaultID := range vaultIDs {
+		if containsString(cleaned, string(vaultID)) {
+			continue
+		}
+		if sa.VaultID != nil && vaultID != *sa.VaultID {
+			return nil, fmt.Errorf("api key of a vault's service account can only be scoped to that vault")
+		}
+		if sa.OrgID != nil {
+			v, err := vault.GetVault(ctx, vaultID)
+			if err != nil {
+				return nil, err
+			}
+			if v == nil || v.OrgID == nil || *v.OrgID != *sa.OrgID {
+				return nil, fmt.Errorf("api key of an organization's service account can only be scoped to the organization's vaults, but vault %v isn't one", vaultID)
+			}
+		}
+		cleaned = append(cleaned, string(vaultID))
+	}
+	return cleaned, nil
+}
+
+// describe returns the name, vaults and scopes of the key, for the audit events
+func (k APIKey) describe() string {
+	return fmt.Sprintf("%s: vaults %s, scopes %s", k.Name, strings.Join(k.VaultIDs, ","), strings.Join(k.Scopes, ","))
+}
+
+func recordServiceAccountEvent(ctx context.Context, tx *orm.Tx, actorUserID, serviceAccountID id.ID, action, clientIP, details string) error {
+	return audit.Record(ctx, tx, audit.RecordRequest{
+		ActorUserID: actorUserID,
+		Action:      action,
+		EntityType:  auditEntityServiceAccount,
+		EntityID:    serviceAccountID,
+		ClientIP:    clientIP,
+		Details:     details,
+	})
+}
+
+func containsString(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,491 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/teejays/clog"
+
+	"github.com/teejays/n-factor-vault/backend/library/id"
+	"github.com/teejays/n-factor-vault/backend/library/orm"
+
+	"github.com/teejays/n-factor-vault/backend/src/audit"
+	"github.com/teejays/n-factor-vault/backend/src/user"
+)
+
+/* Sessions
+
+Logging in starts a session, and returns a short-lived access token (the JWT) along with a refresh token. The access
+token carries the ID of its session (sid) and its own ID (jti). When it expires, the client exchanges the refresh token
+for a new pair. Refresh tokens are single use: each refresh rotates it, and only a hash of it is stored. If a refresh
+token is used a second time, someone has a copy of it, so the whole session is revoked.
+
+Logging out revokes the session, so its refresh token stops working, and the access token, which is added to the list
+of revoked tokens until it expires. The middleware rejects access tokens that are revoked, or whose session is.
+
+Sessions keep the IP, user agent and device that they were started from, and when they were last seen, i.e. when their
+last access token was used or refreshed. Users can list their active sessions and revoke any of them, e.g. a session on
+a device that they no longer have, and admins of the instance can do the same for any user during an incident.
+
+*/
+
+// refreshTokenLifespan is how long a session lasts after the login, however often it's refreshed
+const refreshTokenLifespan = 30 * 24 * time.Hour
+
+// sessionLastSeenInterval is how often the last seen time of a session is updated, so that every request doesn't
+// write to the session
+const sessionLastSeenInterval = time.Minute
+
+// gRandomTokenSize is the number of random bytes in a refresh token or an MFA challenge token
+const gRandomTokenSize = 32
+
+const (
+	// AuditActionLogout is recorded against a user when they log out
+	AuditActionLogout = "auth.logout"
+	// AuditActionLogoutEverywhere is recorded against a user when they log out of all their sessions
+	AuditActionLogoutEverywhere = "auth.logout_everywhere"
+	// AuditActionRefreshTokenReused is recorded against a user when a refresh token of theirs is used twice
+	AuditActionRefreshTokenReused = "auth.refresh_token_reused"
+	// AuditActionSessionRevoked is recorded against a user when they, or an admin, revoke a session of theirs
+	AuditActionSessionRevoked = "auth.session_revoked"
+)
+
+const auditEntityUser = "user"
+
+// ErrInvalidRefreshToken is returned when a refresh token doesn't exist, has expired, or its session was revoked
+var ErrInvalidRefreshToken = fmt.Errorf("refresh token is invalid or has expired")
+
+// ErrTokenRevoked is returned when an access token, or its session, has been revoked
+var ErrTokenRevoked = fmt.Errorf("token has been revoked")
+
+// ErrSessionNotFound is returned when a session doesn't exist, isn't active, or isn't of the user
+var ErrSessionNotFound = fmt.Errorf("session not found")
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* O R M   M O D E L S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// Session is started when a user logs in, and lasts until it expires or is revoked
+type Session struct {
+	orm.BaseModel `gorm:"embedded"`
+	UserID        id.ID      `gorm:"index" json:"user_id"`
+	ClientIP      string     `json:"client_ip"`
+	UserAgent     string     `json:"user_agent"`
+	Device        string     `json:"device"` // e.g. Firefox on Windows, from the user agent
+	LastSeenAt    time.Time  `json:"last_seen_at"`
+	ExpireAt      time.Time  `json:"expire_at"`
+	RevokedAt     *time.Time `json:"revoked_at"`       // nil while the session is active
+	Current       bool       `gorm:"-" json:"current"` // set when listed, for the session of the request
+}
+
+// TableName overrides the SQL table name of Session struct
+func (s Session) TableName() string {
+	return "auth_sessions"
+}
+
+// IsActive returns true if the session has neither expired nor been revoked
+func (s Session) IsActive() bool {
+	return s.RevokedAt == nil && time.Now().Before(s.ExpireAt)
+}
+
+// RefreshToken is the hash of a refresh token of a session
+type RefreshToken struct {
+	orm.BaseModel `gorm:"embedded"`
+	SessionID     id.ID      `gorm:"index"`
+	TokenHash     string     `gorm:"unique_index"`
+	UsedAt        *time.Time // set when the token is exchanged for a new one
+}
+
+// TableName overrides the SQL table name of RefreshToken struct
+func (t RefreshToken) TableName() string {
+	return "auth_refresh_tokens"
+}
+
+// RevokedToken is an access token that was revoked before it expired
+type RevokedToken struct {
+	orm.BaseModel `gorm:"embedded"`
+	TokenID       string `gorm:"unique_index"` // the jti of the token
+	ExpireAt      time.Time
+}
+
+// TableName overrides the SQL table name of RevokedToken struct
+func (t RevokedToken) TableName() string {
+	return "auth_revoked_tokens"
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* M E T H O D S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// RefreshRequest is the data required to refresh an access token
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+	ClientIP     string `json:"-"`
+}
+
+// Refresh exchanges a refresh token for a new access token and a new refresh token. The refresh token can only be used
+// once: using it again revokes its session.
+func Refresh(ctx context.Context, req RefreshRequest) (LoginResponse, error) {
+	var resp LoginResponse
+	if req.RefreshToken == "" {
+		return resp, fmt.Errorf("no refresh token provided")
+	}
+
+	var reused *Session
+	err := orm.WithTx(ctx, func(tx *orm.Tx) error {
+		var rt RefreshToken
+		found, err := tx.FindOne(map[string]interface{}{"token_hash": hashToken(req.RefreshToken)}, &rt)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return ErrInvalidRefreshToken
+		}
+
+		// Lock the session, so that the same token can't be exchanged twice concurrently
+		var s Session
+		found, err = tx.FindByIDForUpdate(rt.SessionID, &s)
+		if err != nil {
+			return err
+		}
+		if !found || !s.IsActive() {
+			return ErrInvalidRefreshToken
+		}
+		if rt.UsedAt != nil {
+			reused = &s
+			return revokeSessions(tx, []id.ID{s.ID})
+		}
+
+		now := time.Now()
+		err = tx.UpdateColumnsByConditions(map[string]interface{}{"id": rt.ID}, map[string]interface{}{"used_at": now}, &RefreshToken{})
+		if err != nil {
+			return err
+		}
+		err = tx.UpdateColumnsByConditions(map[string]interface{}{"id": s.ID}, map[string]interface{}{"last_seen_at": now}, &Session{})
+		if err != nil {
+			return err
+		}
+
+		resp, err = issueTokens(tx, s)
+		return err
+	})
+	if err != nil {
+		return LoginResponse{}, err
+	}
+
+	if reused != nil {
+		rerr := audit.RecordSecurityEvent(ctx, audit.RecordRequest{
+			ActorUserID: reused.UserID,
+			Action:      AuditActionRefreshTokenReused,
+			EntityType:  auditEntityUser,
+			EntityID:    reused.UserID,
+			ClientIP:    req.ClientIP,
+			Details:     fmt.Sprintf("session %v was revoked", reused.ID),
+		})
+		if rerr != nil {
+			clog.Errorf("auth: could not record security event: %v", rerr)
+		}
+		return LoginResponse{}, ErrInvalidRefreshToken
+	}
+
+	return resp, nil
+}
+
+// Logout revokes the session and the access token that the context was authenticated with
+func Logout(ctx context.Context, clientIP string) error {
+	claim, err := getClaimFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	return orm.WithTx(ctx, func(tx *orm.Tx) error {
+		err := revokeSessions(tx, []id.ID{claim.SessionID})
+		if err != nil {
+			return err
+		}
+		err = revokeToken(tx, claim)
+		if err != nil {
+			return err
+		}
+		return audit.Record(ctx, tx, audit.RecordRequest{
+			ActorUserID: claim.UserID,
+			Action:      AuditActionLogout,
+			EntityType:  auditEntityUser,
+			EntityID:    claim.UserID,
+			ClientIP:    clientIP,
+			Details:     fmt.Sprintf("session %v", claim.SessionID),
+		})
+	})
+}
+
+// LogoutEverywhere revokes all the active sessions of the user that the context was authenticated as, e.g. after a
+// device was lost. It returns the number of sessions revoked.
+func LogoutEverywhere(ctx context.Context, clientIP string) (int, error) {
+	claim, err := getClaimFromContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		var sessions []Session
+		_, err := tx.FindWhere(&sessions, "user_id = ? AND revoked_at IS NULL", claim.UserID)
+		if err != nil {
+			return err
+		}
+		var ids []id.ID
+		for _, s := range sessions {
+			ids = append(ids, s.ID)
+		}
+		n = len(ids)
+
+		err = revokeSessions(tx, ids)
+		if err != nil {
+			return err
+		}
+		err = revokeToken(tx, claim)
+		if err != nil {
+			return err
+		}
+		return audit.Record(ctx, tx, audit.RecordRequest{
+			ActorUserID: claim.UserID,
+			Action:      AuditActionLogoutEverywhere,
+			EntityType:  auditEntityUser,
+			EntityID:    claim.UserID,
+			ClientIP:    clientIP,
+			Details:     fmt.Sprintf("%d sessions", n),
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// GetSessions returns the active sessions of the authenticated user, the most recently seen first. The session of the
+// request is marked as current.
+func GetSessions(ctx context.Context) ([]Session, error) {
+	claim, err := getClaimFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := getActiveSessions(claim.UserID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == claim.SessionID
+	}
+	return sessions, nil
+}
+
+// RevokeSession revokes a session of the authenticated user, e.g. on a device that they no longer have
+func RevokeSession(ctx context.Context, sessionID id.ID, clientIP string) error {
+	claim, err := getClaimFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	return revokeUserSession(ctx, claim.UserID, claim.UserID, sessionID, clientIP)
+}
+
+// GetUserSessions returns the active sessions of the user, the most recently seen first. The authenticated user should
+// be an admin of the instance.
+func GetUserSessions(ctx context.Context, userID id.ID) ([]Session, error) {
+	_, err := requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return getActiveSessions(userID)
+}
+
+// RevokeUserSession revokes a session of the user, e.g. one that has been compromised. The authenticated user should
+// be an admin of the instance.
+func RevokeUserSession(ctx context.Context, userID, sessionID id.ID, clientIP string) error {
+	admin, err := requireAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	return revokeUserSession(ctx, admin.ID, userID, sessionID, clientIP)
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* H E L P E R S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// startSession starts a new session for the user, and returns its first tokens
+func startSession(ctx context.Context, u user.User, clientIP, userAgent string) (LoginResponse, error) {
+	var resp LoginResponse
+	err := orm.WithTx(ctx, func(tx *orm.Tx) error {
+		now := time.Now()
+		s := Session{
+			UserID:     u.ID,
+			ClientIP:   clientIP,
+			UserAgent:  userAgent,
+			Device:     describeDevice(userAgent),
+			LastSeenAt: now,
+			ExpireAt:   now.Add(refreshTokenLifespan),
+		}
+		err := tx.InsertOne(&s)
+		if err != nil {
+			return err
+		}
+		resp, err = issueTokens(tx, s)
+		return err
+	})
+	return resp, err
+}
+
+// issueTokens creates an access token and a new refresh token for the session
+func issueTokens(tx *orm.Tx, s Session) (LoginResponse, error) {
+	var resp LoginResponse
+
+	refreshToken, err := newRandomToken()
+	if err != nil {
+		return resp, err
+	}
+
+	err = tx.InsertOne(&RefreshToken{SessionID: s.ID, TokenHash: hashToken(refreshToken)})
+	if err != nil {
+		return resp, err
+	}
+
+	claim, token, err := generateToken(s)
+	if err != nil {
+		return resp, err
+	}
+
+	resp.JWT = token
+	resp.ExpireAt = time.Unix(claim.ExpireAt, 0)
+	resp.RefreshToken = refreshToken
+	return resp, nil
+}
+
+// revokeSessions revokes the sessions with the IDs, so their refresh and access tokens stop working
+func revokeSessions(tx *orm.Tx, ids []id.ID) error {
+	now := time.Now()
+	for _, sessionID := range ids {
+		err := tx.UpdateColumnsByConditions(map[string]interface{}{"id": sessionID}, map[string]interface{}{"revoked_at": now}, &Session{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revokeToken adds the access token of the claim to the revoked tokens
+func revokeToken(tx *orm.Tx, claim JWTClaim) error {
+	found, err := tx.FindOne(map[string]interface{}{"token_id": claim.UniqueID}, &RevokedToken{})
+	if err != nil {
+		return err
+	}
+	if found {
+		return nil
+	}
+	return tx.InsertOne(&RevokedToken{TokenID: claim.UniqueID, ExpireAt: time.Unix(claim.ExpireAt, 0)})
+}
+
+// checkRevoked returns ErrTokenRevoked if the access token, or its session, has been revoked. Otherwise, the session
+// is marked as seen.
+func checkRevoked(claim JWTClaim) error {
+	found, err := orm.FindOne(map[string]interface{}{"token_id": claim.UniqueID}, &RevokedToken{})
+	if err != nil {
+		return err
+	}
+	if found {
+		return ErrTokenRevoked
+	}
+
+	var s Session
+	found, err = orm.FindOne(map[string]interface{}{"id": claim.SessionID}, &s)
+	if err != nil {
+		return err
+	}
+	if !found || s.RevokedAt != nil {
+		return ErrTokenRevoked
+	}
+
+	// Not being able to mark the session as seen shouldn't fail the request
+	if time.Since(s.LastSeenAt) > sessionLastSeenInterval {
+		err = orm.UpdateColumnsByConditions(map[string]interface{}{"id": s.ID}, map[string]interface{}{"last_seen_at": time.Now()}, &Session{})
+		if err != nil {
+			clog.Errorf("auth: could not update the last seen time of session %v: %v", s.ID, err)
+		}
+	}
+	return nil
+}
+
+// getActiveSessions returns the sessions of the user that have neither expired nor been revoked, the most recently
+// seen first
+func getActiveSessions(userID id.ID) ([]Session, error) {
+	var sessions []Session
+	_, err := orm.FindWhere(&sessions, "user_id = ? AND revoked_at IS NULL AND expire_at > ?", userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+	})
+	return sessions, nil
+}
+
+// revokeUserSession revokes the active session of the user, and records it against the user, with the actor being
+// the user or an admin
+func revokeUserSession(ctx context.Context, actorUserID, userID, sessionID id.ID, clientIP string) error {
+	return orm.WithTx(ctx, func(tx *orm.Tx) error {
+		var s Session
+		found, err := tx.FindByID(sessionID, &s)
+		if err != nil {
+			return err
+		}
+		if !found || s.UserID != userID || !s.IsActive() {
+			return ErrSessionNotFound
+		}
+		err = revokeSessions(tx, []id.ID{s.ID})
+		if err != nil {
+			return err
+		}
+		return audit.Record(ctx, tx, audit.RecordRequest{
+			ActorUserID: actorUserID,
+			Action:      AuditActionSessionRevoked,
+			EntityType:  auditEntityUser,
+			EntityID:    userID,
+			ClientIP:    clientIP,
+			Details:     fmt.Sprintf("session %v; device: %s; ip: %s", s.ID, s.Device, s.ClientIP),
+		})
+	})
+}
+
+// describeDevice returns a short description of the device of the user agent, e.g. Firefox on Windows
+func describeDevice(userAgent string) string {
+	if userAgent == "" {
+		return "Unknown device"
+	}
+
+	// The order matters, since most browsers claim to be the ones before them too
+	var client string
+	for _, b := range []struct{ token, name string }{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"}, {"Chrome/", "Chrome"}, {"Safari/", "Safari"},
+		{"curl/", "curl"},
+	} {
+		if strings.Contains(userAgent, b.token) {
+			client = b.name
+			break
+		}
+	}
+	if client == "" {
+		client = strings.SplitN(userAgent, "/", 2)[0]
+	}
+
+	for _, o := range []struct{ token, name string }{
+		{"iPhone", "iPhone"}, {"iPad", "iPad"}, {"Android", "Android"}, {"Windows", "Windows"},
+		{"Mac OS X", "macOS"}, {"CrOS", "ChromeOS"}, {"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, o.token) {
+			return client + " on " + o.name
+		}
+	}
+	return client
+}
@@ -0,0 +1,642 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/teejays/clog"
+
+	"github.com/teejays/n-factor-vault/backend/library/env"
+	webauthn "github.com/teejays/n-factor-vault/backend/library/go-webauthn"
+	"github.com/teejays/n-factor-vault/backend/library/id"
+	"github.com/teejays/n-factor-vault/backend/library/orm"
+
+	"github.com/teejays/n-factor-vault/backend/src/audit"
+	"github.com/teejays/n-factor-vault/backend/src/secret"
+	"github.com/teejays/n-factor-vault/backend/src/user"
+)
+
+/* WebAuthn
+
+Users can register WebAuthn credentials (security keys, or passkeys on their phones and laptops), which are bound to
+our site and can't be phished. Each ceremony starts with a challenge (Begin...), which the browser passes to the
+authenticator, and finishes with the authenticator's response (Finish...). Challenges are stored until they're used
+once, or expire.
+
+A credential can be used to log in, instead of the password. Since authenticators verify the user themselves (with a
+PIN or a fingerprint), such a login doesn't need the TOTP code either.
+
+A credential is also the step-up proof for approving secret requests: once a user has a credential, approving a request
+needs a step-up token, which they get by signing a challenge for that request. The token can be used once. Deleting a
+credential needs a step-up token for that credential too, so a stolen session can't strip the user of their keys.
+
+Authenticators count their signatures. If a signature comes with a counter that isn't greater than the last one, the
+credential has likely been cloned, so the assertion is rejected and a security event is recorded.
+
+*/
+
+const (
+	// envRPID is the env variable with the relying party ID: the domain that credentials are bound to
+	envRPID = "WEBAUTHN_RP_ID"
+	// envOrigins is the env variable with the comma separated origins that the ceremonies can be done on
+	envOrigins = "WEBAUTHN_ORIGINS"
+)
+
+const gDefaultRPID = "localhost"
+const gDefaultOrigins = "http://localhost:8080"
+
+// webAuthnChallengeLifespan is how long the user has to respond to a challenge
+const webAuthnChallengeLifespan = 5 * time.Minute
+
+// stepUpLifespan is how long a step-up token can be used for, after the user signed its challenge
+const stepUpLifespan = 5 * time.Minute
+
+// The purposes of the challenges
+const (
+	purposeRegister = "register"
+	purposeLogin    = "login"
+	purposeStepUp   = "step_up"
+)
+
+const (
+	// AuditActionWebAuthnRegistered is recorded against a user when they register a credential
+	AuditActionWebAuthnRegistered = "auth.webauthn_registered"
+	// AuditActionWebAuthnDeleted is recorded against a user when they delete a credential
+	AuditActionWebAuthnDeleted = "auth.webauthn_deleted"
+	// AuditActionWebAuthnCloned is recorded against a user when the signature counter of their credential goes back
+	AuditActionWebAuthnCloned = "auth.webauthn_counter_mismatch"
+)
+
+// gRelyingParty is our site, as WebAuthn sees it. It is set up by Init.
+var gRelyingParty *webauthn.RelyingParty
+
+// ErrInvalidChallenge is returned when a challenge doesn't exist, has expired, or is for another ceremony
+var ErrInvalidChallenge = fmt.Errorf("webauthn challenge is invalid or has expired")
+
+// ErrCredentialNotFound is returned when a credential doesn't exist, or belongs to another user
+var ErrCredentialNotFound = fmt.Errorf("webauthn credential not found")
+
+// ErrNoCredentials is returned when a step-up is requested by a user who has no credentials
+var ErrNoCredentials = fmt.Errorf("no webauthn credentials registered")
+
+// ErrStepUpRequired is returned when a user with WebAuthn credentials approves a secret request, or deletes a
+// credential, without a valid step-up token for it
+var ErrStepUpRequired = fmt.Errorf("this needs a step-up token from a webauthn credential")
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* O R M   M O D E L S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// WebAuthnCredential is a credential that a user has registered
+type WebAuthnCredential struct {
+	orm.BaseModel `gorm:"embedded"`
+	UserID        id.ID      `gorm:"index" json:"user_id"`
+	Name          string     `json:"name"`                              // chosen by the user, e.g. "YubiKey"
+	CredentialID  string     `gorm:"unique_index" json:"credential_id"` // base64url encoded
+	PublicKey     []byte     `json:"-"`                                 // COSE encoded
+	SignCount     int64      `json:"-"`                                 // the last signature counter
+	LastUsedAt    *time.Time `json:"last_used_at"`
+}
+
+// TableName overrides the SQL table name of WebAuthnCredential struct
+func (c WebAuthnCredential) TableName() string {
+	return "auth_webauthn_credentials"
+}
+
+// WebAuthnChallenge is a challenge that is waiting for the authenticator's response
+type WebAuthnChallenge struct {
+	orm.BaseModel      `gorm:"embedded"`
+	UserID             id.ID // empty for a login with a passkey, where we don't know the user yet
+	Purpose            string
+	SecretRequestID    id.ID // for step-ups to approve a secret request
+	DeleteCredentialID id.ID // for step-ups to delete a credential
+	Challenge          []byte
+	ExpireAt           time.Time
+}
+
+// TableName overrides the SQL table name of WebAuthnChallenge struct
+func (c WebAuthnChallenge) TableName() string {
+	return "auth_webauthn_challenges"
+}
+
+// StepUp is a step-up token, which lets a user approve a secret request, or delete a credential, once
+type StepUp struct {
+	orm.BaseModel      `gorm:"embedded"`
+	UserID             id.ID `gorm:"index"`
+	SecretRequestID    id.ID
+	DeleteCredentialID id.ID
+	TokenHash          string `gorm:"unique_index"`
+	ExpireAt           time.Time
+}
+
+// TableName overrides the SQL table name of StepUp struct
+func (s StepUp) TableName() string {
+	return "auth_step_ups"
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* M E T H O D S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// CreationChallenge is the challenge to register a credential, as the options of navigator.credentials.create()
+type CreationChallenge struct {
+	ChallengeID id.ID                    `json:"challenge_id"`
+	Options     webauthn.CreationOptions `json:"options"`
+}
+
+// RequestChallenge is the challenge to sign with a credential, as the options of navigator.credentials.get()
+type RequestChallenge struct {
+	ChallengeID id.ID                   `json:"challenge_id"`
+	Options     webauthn.RequestOptions `json:"options"`
+}
+
+// CredentialResponse is the PublicKeyCredential that the browser returns, with the binary fields base64url encoded.
+// Registrations have the attestation object, and assertions have the authenticator data and the signature.
+type CredentialResponse struct {
+	ID       string
+	Response struct {
+		ClientDataJSON    string
+		AttestationObject string
+		AuthenticatorData string
+		Signature         string
+	}
+}
+
+// FinishRegistrationRequest is the data required to register a credential
+type FinishRegistrationRequest struct {
+	ChallengeID id.ID
+	Name        string
+	Credential  CredentialResponse
+	ClientIP    string `json:"-"`
+}
+
+// FinishAssertionRequest is the data required to finish a login or a step-up with a credential
+type FinishAssertionRequest struct {
+	ChallengeID id.ID
+	Credential  CredentialResponse
+	ClientIP    string `json:"-"`
+	UserAgent   string `json:"-"`
+}
+
+// BeginWebAuthnLoginRequest is the data to start a login with a credential. The email is optional: without it, the
+// user picks one of their passkeys for our site.
+type BeginWebAuthnLoginRequest struct {
+	Email string
+}
+
+// BeginStepUpRequest is the data to start a step-up, for either approving a secret request or deleting a credential
+type BeginStepUpRequest struct {
+	SecretRequestID    id.ID
+	DeleteCredentialID id.ID
+}
+
+// DeleteWebAuthnCredentialRequest is the data required to delete a credential
+type DeleteWebAuthnCredentialRequest struct {
+	CredentialID id.ID `json:"-"`
+	StepUpToken  string
+	ClientIP     string `json:"-"`
+}
+
+// StepUpResponse has the step-up token, which can be used once for what it was requested for
+type StepUpResponse struct {
+	StepUpToken string    `json:"step_up_token"`
+	ExpireAt    time.Time `json:"expire_at"`
+}
+
+// BeginWebAuthnRegistration starts the registration of a new credential for the authenticated user
+func BeginWebAuthnRegistration(ctx context.Context) (CreationChallenge, error) {
+	var c CreationChallenge
+
+	u, err := GetUserFromContext(ctx)
+	if err != nil {
+		return c, err
+	}
+	existing, err := getCredentialIDs(u.ID)
+	if err != nil {
+		return c, err
+	}
+
+	ch, err := newWebAuthnChallenge(ctx, WebAuthnChallenge{UserID: u.ID, Purpose: purposeRegister})
+	if err != nil {
+		return c, err
+	}
+
+	wu := webauthn.User{ID: []byte(u.ID), Name: u.Email, DisplayName: u.Name}
+	c.ChallengeID = ch.ID
+	c.Options = gRelyingParty.NewCreationOptions(ch.Challenge, wu, existing, webauthn.UserVerificationPreferred)
+	return c, nil
+}
+
+// FinishWebAuthnRegistration verifies the authenticator's response to the registration challenge, and stores the new
+// credential
+func FinishWebAuthnRegistration(ctx context.Context, req FinishRegistrationRequest) (WebAuthnCredential, error) {
+	var c WebAuthnCredential
+
+	u, err := GetUserFromContext(ctx)
+	if err != nil {
+		return c, err
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		return c, fmt.Errorf("no name provided for the credential")
+	}
+	bs, err := decodeBase64s(req.Credential.Response.ClientDataJSON, req.Credential.Response.AttestationObject)
+	if err != nil {
+		return c, err
+	}
+
+	ch, err := useWebAuthnChallenge(ctx, req.ChallengeID, purposeRegister)
+	if err != nil {
+		return c, err
+	}
+	if ch.UserID != u.ID {
+		return c, ErrInvalidChallenge
+	}
+
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		cred, err := gRelyingParty.VerifyRegistration(ch.Challenge, webauthn.AttestationResponse{ClientDataJSON: bs[0], AttestationObject: bs[1]}, webauthn.UserVerificationPreferred)
+		if err != nil {
+			return err
+		}
+
+		c = WebAuthnCredential{
+			UserID:       u.ID,
+			Name:         strings.TrimSpace(req.Name),
+			CredentialID: base64.RawURLEncoding.EncodeToString(cred.ID),
+			PublicKey:    cred.PublicKey,
+			SignCount:    int64(cred.SignCount),
+		}
+		found, err := tx.FindOne(map[string]interface{}{"credential_id": c.CredentialID}, &WebAuthnCredential{})
+		if err != nil {
+			return err
+		}
+		if found {
+			return fmt.Errorf("webauthn credential is already registered")
+		}
+		if err := tx.InsertOne(&c); err != nil {
+			return err
+		}
+
+		return audit.Record(ctx, tx, audit.RecordRequest{
+			ActorUserID: u.ID,
+			Action:      AuditActionWebAuthnRegistered,
+			EntityType:  auditEntityUser,
+			EntityID:    u.ID,
+			ClientIP:    req.ClientIP,
+			Details:     c.Name,
+		})
+	})
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+
+	return c, nil
+}
+
+// GetWebAuthnCredentials returns the credentials of the authenticated user
+func GetWebAuthnCredentials(ctx context.Context) ([]WebAuthnCredential, error) {
+	u, err := GetUserFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var creds []WebAuthnCredential
+	_, err = orm.Find(map[string]interface{}{"user_id": u.ID}, &creds)
+	if err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// DeleteWebAuthnCredential deletes a credential of the authenticated user, with a step-up token for deleting it
+func DeleteWebAuthnCredential(ctx context.Context, req DeleteWebAuthnCredentialRequest) error {
+	u, err := GetUserFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	return orm.WithTx(ctx, func(tx *orm.Tx) error {
+		var c WebAuthnCredential
+		found, err := tx.FindByID(req.CredentialID, &c)
+		if err != nil {
+			return err
+		}
+		if !found || c.UserID != u.ID {
+			return ErrCredentialNotFound
+		}
+		if err := useStepUp(tx, StepUp{UserID: u.ID, DeleteCredentialID: c.ID}, req.StepUpToken); err != nil {
+			return err
+		}
+		if _, err := tx.HardDeleteByConditions(map[string]interface{}{"id": c.ID}, &WebAuthnCredential{}); err != nil {
+			return err
+		}
+		return audit.Record(ctx, tx, audit.RecordRequest{
+			ActorUserID: u.ID,
+			Action:      AuditActionWebAuthnDeleted,
+			EntityType:  auditEntityUser,
+			EntityID:    u.ID,
+			ClientIP:    req.ClientIP,
+			Details:     c.Name,
+		})
+	})
+}
+
+// BeginWebAuthnLogin starts a login with a credential
+func BeginWebAuthnLogin(ctx context.Context, req BeginWebAuthnLoginRequest) (RequestChallenge, error) {
+	var c RequestChallenge
+
+	// If the email is given, the user can only pick from their credentials. To not give away which emails have an
+	// account, an unknown email gets a challenge without any credentials, which can't be completed.
+	var allow [][]byte
+	var userID id.ID
+	if strings.TrimSpace(req.Email) != "" {
+		u, err := user.GetUserByEmail(req.Email)
+		if err != nil {
+			return c, err
+		}
+		userID = u.ID
+		if !u.ID.IsEmpty() {
+			if allow, err = getCredentialIDs(u.ID); err != nil {
+				return c, err
+			}
+		}
+	}
+
+	ch, err := newWebAuthnChallenge(ctx, WebAuthnChallenge{UserID: userID, Purpose: purposeLogin})
+	if err != nil {
+		return c, err
+	}
+
+	c.ChallengeID = ch.ID
+	c.Options = gRelyingParty.NewRequestOptions(ch.Challenge, allow, webauthn.UserVerificationRequired)
+	return c, nil
+}
+
+// FinishWebAuthnLogin verifies the authenticator's response to the login challenge, and starts a session for the
+// owner of the credential
+func FinishWebAuthnLogin(ctx context.Context, req FinishAssertionRequest) (LoginResponse, error) {
+	var resp LoginResponse
+
+	ch, err := useWebAuthnChallenge(ctx, req.ChallengeID, purposeLogin)
+	if err != nil {
+		return resp, err
+	}
+
+	var userID id.ID
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		c, err := verifyAssertion(ctx, tx, ch, req, webauthn.UserVerificationRequired)
+		if err != nil {
+			return err
+		}
+		userID = c.UserID
+		return nil
+	})
+	if err != nil {
+		return resp, err
+	}
+
+	u, err := user.GetUser(userID)
+	if err != nil {
+		return resp, err
+	}
+	return completeLogin(ctx, u, req.ClientIP, req.UserAgent)
+}
+
+// BeginStepUp starts a step-up of the authenticated user, for approving the secret request or deleting the credential
+func BeginStepUp(ctx context.Context, req BeginStepUpRequest) (RequestChallenge, error) {
+	var c RequestChallenge
+
+	u, err := GetUserFromContext(ctx)
+	if err != nil {
+		return c, err
+	}
+	if req.SecretRequestID.IsEmpty() == req.DeleteCredentialID.IsEmpty() {
+		return c, fmt.Errorf("either a secret request or a credential to delete should be provided")
+	}
+	allow, err := getCredentialIDs(u.ID)
+	if err != nil {
+		return c, err
+	}
+	if len(allow) == 0 {
+		return c, ErrNoCredentials
+	}
+
+	ch, err := newWebAuthnChallenge(ctx, WebAuthnChallenge{UserID: u.ID, Purpose: purposeStepUp, SecretRequestID: req.SecretRequestID, DeleteCredentialID: req.DeleteCredentialID})
+	if err != nil {
+		return c, err
+	}
+
+	c.ChallengeID = ch.ID
+	c.Options = gRelyingParty.NewRequestOptions(ch.Challenge, allow, webauthn.UserVerificationPreferred)
+	return c, nil
+}
+
+// FinishStepUp verifies the authenticator's response to the step-up challenge, and returns a step-up token for
+// what the challenge was for
+func FinishStepUp(ctx context.Context, req FinishAssertionRequest) (StepUpResponse, error) {
+	var resp StepUpResponse
+
+	u, err := GetUserFromContext(ctx)
+	if err != nil {
+		return resp, err
+	}
+	token, err := newRandomToken()
+	if err != nil {
+		return resp, err
+	}
+	ch, err := useWebAuthnChallenge(ctx, req.ChallengeID, purposeStepUp)
+	if err != nil {
+		return resp, err
+	}
+	if ch.UserID != u.ID {
+		return resp, ErrInvalidChallenge
+	}
+
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		if _, err := verifyAssertion(ctx, tx, ch, req, webauthn.UserVerificationPreferred); err != nil {
+			return err
+		}
+
+		s := StepUp{UserID: u.ID, SecretRequestID: ch.SecretRequestID, DeleteCredentialID: ch.DeleteCredentialID, TokenHash: hashToken(token), ExpireAt: time.Now().Add(stepUpLifespan)}
+		resp.StepUpToken, resp.ExpireAt = token, s.ExpireAt
+		return tx.InsertOne(&s)
+	})
+	if err != nil {
+		return StepUpResponse{}, err
+	}
+
+	return resp, nil
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* H E L P E R S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// loadRelyingParty loads the relying party ID and origins from the configuration
+func loadRelyingParty() *webauthn.RelyingParty {
+	rp := webauthn.RelyingParty{ID: gDefaultRPID, Name: gMFAIssuer, Origins: strings.Split(gDefaultOrigins, ",")}
+	if s, err := env.GetEnvVar(envRPID); err == nil {
+		rp.ID = strings.TrimSpace(s)
+	}
+	if s, err := env.GetEnvVar(envOrigins); err == nil {
+		rp.Origins = nil
+		for _, o := range strings.Split(s, ",") {
+			rp.Origins = append(rp.Origins, strings.TrimSpace(o))
+		}
+	}
+	clog.Infof("auth: webauthn relying party %s, on origins %v", rp.ID, rp.Origins)
+	return &rp
+}
+
+// requireApprovalStepUp is the approval hook of the secret requests. Users with a credential should approve with a
+// step-up token for the request, which is used up.
+func requireApprovalStepUp(ctx context.Context, tx *orm.Tx, req secret.UpdateParams) error {
+	var creds []WebAuthnCredential
+	found, err := tx.Find(map[string]interface{}{"user_id": req.UserID}, &creds)
+	if err != nil {
+		return err
+	}
+	if !found || len(creds) == 0 {
+		return nil
+	}
+	return useStepUp(tx, StepUp{UserID: req.UserID, SecretRequestID: req.SecretRequestID}, req.StepUpToken)
+}
+
+// useStepUp deletes the step-up of the token, so it can only be used once, if it is for the same user, secret request
+// and credential as want, and hasn't expired
+func useStepUp(tx *orm.Tx, want StepUp, token string) error {
+	if token == "" {
+		return ErrStepUpRequired
+	}
+	var s StepUp
+	found, err := tx.FindOne(map[string]interface{}{"token_hash": hashToken(token)}, &s)
+	if err != nil {
+		return err
+	}
+	if !found || s.UserID != want.UserID || s.SecretRequestID != want.SecretRequestID || s.DeleteCredentialID != want.DeleteCredentialID || !time.Now().Before(s.ExpireAt) {
+		return ErrStepUpRequired
+	}
+	_, err = tx.HardDeleteByConditions(map[string]interface{}{"id": s.ID}, &StepUp{})
+	return err
+}
+
+// newWebAuthnChallenge stores a new random challenge
+func newWebAuthnChallenge(ctx context.Context, ch WebAuthnChallenge) (WebAuthnChallenge, error) {
+	var err error
+	ch.Challenge, err = webauthn.NewChallenge()
+	if err != nil {
+		return ch, err
+	}
+	ch.ExpireAt = time.Now().Add(webAuthnChallengeLifespan)
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		return tx.InsertOne(&ch)
+	})
+	return ch, err
+}
+
+// useWebAuthnChallenge deletes the challenge, so it can only be responded to once, and returns it if it's for the
+// purpose and hasn't expired. The challenge is used up in its own transaction, so a response that fails verification
+// can't be retried with it.
+func useWebAuthnChallenge(ctx context.Context, challengeID id.ID, purpose string) (WebAuthnChallenge, error) {
+	var ch WebAuthnChallenge
+	err := orm.WithTx(ctx, func(tx *orm.Tx) error {
+		found, err := tx.FindByIDForUpdate(challengeID, &ch)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return ErrInvalidChallenge
+		}
+		_, err = tx.HardDeleteByConditions(map[string]interface{}{"id": ch.ID}, &WebAuthnChallenge{})
+		return err
+	})
+	if err != nil {
+		return ch, err
+	}
+	if ch.Purpose != purpose || !time.Now().Before(ch.ExpireAt) {
+		return ch, ErrInvalidChallenge
+	}
+	return ch, nil
+}
+
+// verifyAssertion verifies the authenticator's response to the challenge, and updates the signature counter of the
+// credential that signed it. The credential should belong to the user of the challenge, if there is one.
+func verifyAssertion(ctx context.Context, tx *orm.Tx, ch WebAuthnChallenge, req FinishAssertionRequest, uv webauthn.UserVerification) (WebAuthnCredential, error) {
+	var c WebAuthnCredential
+
+	bs, err := decodeBase64s(req.Credential.Response.ClientDataJSON, req.Credential.Response.AuthenticatorData, req.Credential.Response.Signature)
+	if err != nil {
+		return c, err
+	}
+
+	found, err := tx.FindOne(map[string]interface{}{"credential_id": strings.TrimRight(req.Credential.ID, "=")}, &c)
+	if err != nil {
+		return c, err
+	}
+	if !found || (!ch.UserID.IsEmpty() && c.UserID != ch.UserID) {
+		return c, ErrCredentialNotFound
+	}
+	// Lock the credential, so its counter is checked against the latest value
+	if _, err := tx.FindByIDForUpdate(c.ID, &c); err != nil {
+		return c, err
+	}
+
+	stored := webauthn.Credential{PublicKey: c.PublicKey, SignCount: uint32(c.SignCount)}
+	count, err := gRelyingParty.VerifyAssertion(ch.Challenge, stored, webauthn.AssertionResponse{ClientDataJSON: bs[0], AuthenticatorData: bs[1], Signature: bs[2]}, uv)
+	if err == webauthn.ErrSignCountNotIncreased {
+		rerr := audit.RecordSecurityEvent(ctx, audit.RecordRequest{
+			ActorUserID: c.UserID,
+			Action:      AuditActionWebAuthnCloned,
+			EntityType:  auditEntityUser,
+			EntityID:    c.UserID,
+			ClientIP:    req.ClientIP,
+			Details:     fmt.Sprintf("credential %q reported counter %d after %d", c.Name, count, c.SignCount),
+		})
+		if rerr != nil {
+			clog.Errorf("auth: could not record security event: %v", rerr)
+		}
+		return c, err
+	}
+	if err != nil {
+		return c, err
+	}
+
+	now := time.Now()
+	err = tx.UpdateColumnsByConditions(map[string]interface{}{"id": c.ID}, map[string]interface{}{"sign_count": int64(count), "last_used_at": now}, &WebAuthnCredential{})
+	if err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// getCredentialIDs returns the IDs of the credentials of the user
+func getCredentialIDs(userID id.ID) ([][]byte, error) {
+	var creds []WebAuthnCredential
+	_, err := orm.Find(map[string]interface{}{"user_id": userID}, &creds)
+	if err != nil {
+		return nil, err
+	}
+	var ids [][]byte
+	for _, c := range creds {
+		b, err := base64.RawURLEncoding.DecodeString(c.CredentialID)
+		if err != nil {
+			return nil, fmt.Errorf("decoding webauthn credential ID %v: %v", c.ID, err)
+		}
+		ids = append(ids, b)
+	}
+	return ids, nil
+}
+
+// decodeBase64s decodes base64url encoded fields of the browser's response, with or without padding
+func decodeBase64s(fields ...string) ([][]byte, error) {
+	var bs [][]byte
+	for _, f := range fields {
+		b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(f, "="))
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("webauthn response should have base64url encoded fields")
+		}
+		bs = append(bs, b)
+	}
+	return bs, nil
+}
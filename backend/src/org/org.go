@@ -0,0 +1,665 @@
+// Package org implements organizations, which own users and vaults, and teams, which are groups of users of an
+// organization that can be added to a vault as a unit.
+//
+// An org admin adds a user to the organization by inviting them, and the user is only a member once they accept. Until
+// then the organization has no say over them: its settings (e.g. disabling password login) don't apply to them, and
+// they can't be added to its teams or vaults.
+package org
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/teejays/clog"
+
+	"github.com/teejays/n-factor-vault/backend/library/id"
+	"github.com/teejays/n-factor-vault/backend/library/orm"
+
+	"github.com/teejays/n-factor-vault/backend/src/audit"
+	"github.com/teejays/n-factor-vault/backend/src/user"
+)
+
+var gServiceName = "Org Service"
+
+// ErrOrgNotFound is returned when the organization being acted upon does not exist
+var ErrOrgNotFound = fmt.Errorf("organization not found")
+
+// ErrTeamNotFound is returned when the team being acted upon does not exist in the organization
+var ErrTeamNotFound = fmt.Errorf("team not found")
+
+// ErrForbidden is returned when the user does not have the role required for the action on the organization
+var ErrForbidden = fmt.Errorf("user does not have the required role on the organization")
+
+// ErrInvitationNotFound is returned when a user accepts an invitation to an organization that they don't have
+var ErrInvitationNotFound = fmt.Errorf("no pending invitation to the organization")
+
+// Audit actions for organizations
+const (
+	auditEntityType           = "org"
+	AuditActionSettingsUpdate = "org.settings_updated"
+	AuditActionMemberInvited  = "org.member_invited"
+	AuditActionInviteAccepted = "org.invitation_accepted"
+)
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* O R M   M O D E L S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// Organization owns a set of users and vaults, and holds the settings that apply to all of them
+type Organization struct {
+	orm.BaseModel `gorm:"embedded"`
+	Name          string `gorm:"unique_index:idx_org_name" json:"name"`
+	Settings      `gorm:"embedded"`
+}
+
+// Settings are the org-wide settings that apply to all the vaults and members of an organization
+type Settings struct {
+	MinK                int            `json:"minK"`                                   // minimum number of approvals any vault in the org can be set up with
+	AllowedEmailDomains pq.StringArray `gorm:"type:text[]" json:"allowedEmailDomains"` // if not empty, only users with these email domains can join
+	// if set, the members can only log in through single sign-on, and not with a password
+	PasswordLoginDisabled bool `gorm:"NOT NULL;default:false" json:"passwordLoginDisabled"`
+}
+
+// OrgUser represents the mapping between an organization and its users. It is an invitation until the user accepts it.
+type OrgUser struct {
+	orm.BaseModel `gorm:"embedded"`
+	OrgID         id.ID `gorm:"unique_index:idx_org_user" json:"org_id"`
+	UserID        id.ID `gorm:"unique_index:idx_org_user" json:"user_id"`
+	Role          Role  `gorm:"NOT NULL;default:'MEMBER'" json:"role"`
+	Accepted      bool  `gorm:"NOT NULL;default:false" json:"accepted"`
+}
+
+// Team is a group of users within an organization
+type Team struct {
+	orm.BaseModel `gorm:"embedded"`
+	OrgID         id.ID        `gorm:"unique_index:idx_org_team" json:"org_id"`
+	Name          string       `gorm:"unique_index:idx_org_team" json:"name"`
+	TeamMembers   []TeamMember `json:"team_members"`
+}
+
+// TeamMember represents the mapping between a team and its users
+type TeamMember struct {
+	orm.BaseModel `gorm:"embedded"`
+	TeamID        id.ID `gorm:"unique_index:idx_team_user" json:"team_id"`
+	UserID        id.ID `gorm:"unique_index:idx_team_user" json:"user_id"`
+}
+
+// Role represents the access level that a user has on an organization
+type Role string
+
+const (
+	// RoleAdmin can manage the organization's settings, members and teams
+	RoleAdmin Role = "ADMIN"
+	// RoleMember can create and be a part of the organization's vaults
+	RoleMember Role = "MEMBER"
+)
+
+// Init initializes the service so it can connect with the ORM
+func Init() error {
+	// Members who were added before invitations had to be accepted keep their membership
+	backfill := orm.HasColumn(&OrgUser{}, "id") && !orm.HasColumn(&OrgUser{}, "accepted")
+
+	err := orm.RegisterModels(&Organization{}, &OrgUser{}, &Team{}, &TeamMember{})
+	if err != nil {
+		return err
+	}
+
+	if backfill {
+		return orm.Exec(`UPDATE org_users SET accepted = true`)
+	}
+	return nil
+}
+
+// TeamMembershipHookFunc is called, as part of the same transaction, whenever the members of a team change. It allows
+// other services (e.g. vaults that the team is a part of) to keep their own membership in sync.
+type TeamMembershipHookFunc func(ctx context.Context, tx *orm.Tx, teamID id.ID) error
+
+var gTeamMembershipHooks []TeamMembershipHookFunc
+
+// RegisterTeamMembershipHook registers f to be called whenever the members of a team change
+func RegisterTeamMembershipHook(f TeamMembershipHookFunc) {
+	gTeamMembershipHooks = append(gTeamMembershipHooks, f)
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* M E T H O D S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// CreateOrgRequest are the parameters that are passed when creating an organization
+type CreateOrgRequest struct {
+	AdminUserID id.ID    `json:"-"`
+	Name        string   `json:"name"`
+	Settings    Settings `json:"settings"`
+}
+
+// UpdateSettingsRequest are the parameters that are passed when updating the settings of an organization
+type UpdateSettingsRequest struct {
+	OrgID    id.ID    `json:"-"`
+	UserID   id.ID    `json:"-"`
+	Settings Settings `json:"settings"`
+}
+
+// AddMemberRequest are the parameters for adding a user to an organization
+type AddMemberRequest struct {
+	OrgID  id.ID  `json:"-"`
+	UserID id.ID  `json:"-"` // the user making the request
+	Email  string `json:"email"`
+	Role   Role   `json:"role"`
+}
+
+// AcceptInvitationRequest are the parameters for a user accepting their invitation to an organization
+type AcceptInvitationRequest struct {
+	OrgID  id.ID `json:"-"`
+	UserID id.ID `json:"-"` // the invited user
+}
+
+// CreateTeamRequest are the parameters for creating a team in an organization
+type CreateTeamRequest struct {
+	OrgID  id.ID  `json:"-"`
+	UserID id.ID  `json:"-"`
+	Name   string `json:"name"`
+}
+
+// TeamMemberRequest are the parameters for adding or removing a member of a team
+type TeamMemberRequest struct {
+	OrgID        id.ID `json:"-"`
+	TeamID       id.ID `json:"-"`
+	UserID       id.ID `json:"-"` // the user making the request
+	MemberUserID id.ID `json:"userId"`
+}
+
+// CreateOrg creates a new organization, with the user creating it as its admin
+func CreateOrg(ctx context.Context, req CreateOrgRequest) (*Organization, error) {
+	clog.Debugf("%s: creating organization %s", gServiceName, req.Name)
+
+	if strings.TrimSpace(req.Name) == "" {
+		return nil, fmt.Errorf("name is empty")
+	}
+	if req.AdminUserID.IsEmpty() {
+		return nil, fmt.Errorf("admin userID is empty")
+	}
+	settings, err := cleanSettings(req.Settings)
+	if err != nil {
+		return nil, err
+	}
+
+	// The admin should be allowed to be a member of the org they're creating
+	u, err := user.GetUser(req.AdminUserID)
+	if err != nil {
+		return nil, err
+	}
+	if !IsEmailDomainAllowed(settings, u.Email) {
+		return nil, fmt.Errorf("email domain of the admin is not in the allowed email domains")
+	}
+
+	o := Organization{
+		Name:     strings.TrimSpace(req.Name),
+		Settings: settings,
+	}
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		err := tx.InsertOne(&o)
+		if err != nil {
+			return err
+		}
+		ou := OrgUser{OrgID: o.ID, UserID: req.AdminUserID, Role: RoleAdmin, Accepted: true}
+		return tx.InsertOne(&ou)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &o, nil
+}
+
+// GetOrg returns the organization with the given id, or nil if it does not exist
+func GetOrg(ctx context.Context, orgID id.ID) (*Organization, error) {
+	var o Organization
+	exists, err := orm.FindByID(orgID, &o)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, nil
+	}
+	return &o, nil
+}
+
+// GetOrgsByUser returns all the organizations that the user is a member of
+func GetOrgsByUser(ctx context.Context, userID id.ID) ([]*Organization, error) {
+	return getOrgsByUser(ctx, userID, true)
+}
+
+// GetInvitationsByUser returns all the organizations that the user has been invited to, but hasn't accepted yet
+func GetInvitationsByUser(ctx context.Context, userID id.ID) ([]*Organization, error) {
+	return getOrgsByUser(ctx, userID, false)
+}
+
+// getOrgsByUser returns the organizations that the user is a member of, or has a pending invitation to
+func getOrgsByUser(ctx context.Context, userID id.ID, accepted bool) ([]*Organization, error) {
+	var ous []OrgUser
+	_, err := orm.Find(map[string]interface{}{"user_id": userID, "accepted": accepted}, &ous)
+	if err != nil {
+		return nil, err
+	}
+
+	var orgs = []*Organization{}
+	for _, ou := range ous {
+		o, err := GetOrg(ctx, ou.OrgID)
+		if err != nil {
+			return nil, err
+		}
+		if o == nil {
+			continue
+		}
+		orgs = append(orgs, o)
+	}
+	return orgs, nil
+}
+
+// UpdateSettings replaces the settings of the organization. Only org admins can do this.
+func UpdateSettings(ctx context.Context, req UpdateSettingsRequest) (*Organization, error) {
+	settings, err := cleanSettings(req.Settings)
+	if err != nil {
+		return nil, err
+	}
+
+	var o Organization
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		exists, err := tx.FindByIDForUpdate(req.OrgID, &o)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrOrgNotFound
+		}
+		err = RequireRoleTx(ctx, tx, req.OrgID, req.UserID, RoleAdmin)
+		if err != nil {
+			return err
+		}
+
+		details := fmt.Sprintf("min_k: %d -> %d; allowed_email_domains: %v -> %v; password_login_disabled: %t -> %t",
+			o.MinK, settings.MinK, o.AllowedEmailDomains, settings.AllowedEmailDomains, o.PasswordLoginDisabled, settings.PasswordLoginDisabled)
+		o.Settings = settings
+		err = tx.UpdateColumnsByConditions(map[string]interface{}{"id": o.ID}, map[string]interface{}{
+			"min_k":                   settings.MinK,
+			"allowed_email_domains":   settings.AllowedEmailDomains,
+			"password_login_disabled": settings.PasswordLoginDisabled,
+		}, &Organization{})
+		if err != nil {
+			return err
+		}
+
+		return audit.Record(ctx, tx, audit.RecordRequest{
+			ActorUserID: req.UserID,
+			Action:      AuditActionSettingsUpdate,
+			EntityType:  auditEntityType,
+			EntityID:    o.ID,
+			Details:     details,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// AddMember invites the user with the given email to the organization. They are a member once they accept it. Only org
+// admins can do this, and the user's email domain should be allowed by the org settings.
+func AddMember(ctx context.Context, req AddMemberRequest) (*OrgUser, error) {
+	if req.Role == "" {
+		req.Role = RoleMember
+	}
+	if req.Role != RoleAdmin && req.Role != RoleMember {
+		return nil, fmt.Errorf("invalid role '%s'", req.Role)
+	}
+
+	u, err := user.GetUserByEmail(req.Email)
+	if err != nil {
+		return nil, err
+	}
+	if u.ID.IsEmpty() {
+		return nil, fmt.Errorf("no user with email %s found", req.Email)
+	}
+
+	var ou OrgUser
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		var o Organization
+		exists, err := tx.FindByID(req.OrgID, &o)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrOrgNotFound
+		}
+		err = RequireRoleTx(ctx, tx, req.OrgID, req.UserID, RoleAdmin)
+		if err != nil {
+			return err
+		}
+		if !IsEmailDomainAllowed(o.Settings, u.Email) {
+			return fmt.Errorf("email domain of %s is not allowed in the organization", u.Email)
+		}
+
+		ou = OrgUser{OrgID: o.ID, UserID: u.ID, Role: req.Role}
+		err = tx.InsertOne(&ou)
+		if err != nil {
+			return err
+		}
+
+		return audit.Record(ctx, tx, audit.RecordRequest{
+			ActorUserID: req.UserID,
+			Action:      AuditActionMemberInvited,
+			EntityType:  auditEntityType,
+			EntityID:    o.ID,
+			Details:     fmt.Sprintf("user: %s; role: %s", u.ID, req.Role),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ou, nil
+}
+
+// AcceptInvitation makes the user a member of the organization that they have been invited to
+func AcceptInvitation(ctx context.Context, req AcceptInvitationRequest) (*OrgUser, error) {
+	var ou OrgUser
+	err := orm.WithTx(ctx, func(tx *orm.Tx) error {
+		exists, err := tx.FindOne(map[string]interface{}{"org_id": req.OrgID, "user_id": req.UserID, "accepted": false}, &ou)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrInvitationNotFound
+		}
+
+		ou.Accepted = true
+		err = tx.UpdateColumnsByConditions(map[string]interface{}{"id": ou.ID}, map[string]interface{}{"accepted": true}, &OrgUser{})
+		if err != nil {
+			return err
+		}
+
+		return audit.Record(ctx, tx, audit.RecordRequest{
+			ActorUserID: req.UserID,
+			Action:      AuditActionInviteAccepted,
+			EntityType:  auditEntityType,
+			EntityID:    req.OrgID,
+			Details:     fmt.Sprintf("role: %s", ou.Role),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ou, nil
+}
+
+// CreateTeam creates a new team in the organization. Only org admins can do this.
+func CreateTeam(ctx context.Context, req CreateTeamRequest) (*Team, error) {
+	if strings.TrimSpace(req.Name) == "" {
+		return nil, fmt.Errorf("name is empty")
+	}
+
+	var t Team
+	err := orm.WithTx(ctx, func(tx *orm.Tx) error {
+		err := RequireRoleTx(ctx, tx, req.OrgID, req.UserID, RoleAdmin)
+		if err != nil {
+			return err
+		}
+		t = Team{OrgID: req.OrgID, Name: strings.TrimSpace(req.Name)}
+		return tx.InsertOne(&t)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// GetTeam returns the team with the given id, or nil if it does not exist
+func GetTeam(ctx context.Context, teamID id.ID) (*Team, error) {
+	var t Team
+	exists, err := orm.FindByID(teamID, &t)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, nil
+	}
+	return &t, nil
+}
+
+// AddTeamMember adds a member of the organization to the team. Only org admins can do this. The change flows through
+// to all the vaults that the team is a part of.
+func AddTeamMember(ctx context.Context, req TeamMemberRequest) (*TeamMember, error) {
+	var tm TeamMember
+	err := orm.WithTx(ctx, func(tx *orm.Tx) error {
+		err := lockTeamAsAdmin(ctx, tx, req)
+		if err != nil {
+			return err
+		}
+
+		// Only members of the org can be a part of its teams
+		exists, err := IsMemberTx(ctx, tx, req.OrgID, req.MemberUserID)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("user %v is not a member of the organization", req.MemberUserID)
+		}
+
+		tm = TeamMember{TeamID: req.TeamID, UserID: req.MemberUserID}
+		err = tx.InsertOne(&tm)
+		if err != nil {
+			return err
+		}
+
+		return runTeamMembershipHooks(ctx, tx, req.TeamID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &tm, nil
+}
+
+// RemoveTeamMember removes the user from the team. Only org admins can do this. The change flows through to all the
+// vaults that the team is a part of.
+func RemoveTeamMember(ctx context.Context, req TeamMemberRequest) error {
+	return orm.WithTx(ctx, func(tx *orm.Tx) error {
+		err := lockTeamAsAdmin(ctx, tx, req)
+		if err != nil {
+			return err
+		}
+
+		n, err := tx.HardDeleteByConditions(map[string]interface{}{"team_id": req.TeamID, "user_id": req.MemberUserID}, &TeamMember{})
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("user %v is not a member of the team", req.MemberUserID)
+		}
+
+		return runTeamMembershipHooks(ctx, tx, req.TeamID)
+	})
+}
+
+// EnsureMemberTx adds the user to the organization as a member, if they aren't one already, as part of the transaction
+// tx. It is for users who have logged in through a sign-on of the organization, so it doesn't need an admin, and the
+// login stands in for the user accepting. A pending invitation is accepted. The user's email domain should still be
+// allowed by the org settings.
+func EnsureMemberTx(ctx context.Context, tx *orm.Tx, orgID id.ID, u user.User) error {
+	var o Organization
+	exists, err := tx.FindByID(orgID, &o)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrOrgNotFound
+	}
+
+	var ou OrgUser
+	exists, err = tx.FindOne(map[string]interface{}{"org_id": orgID, "user_id": u.ID}, &ou)
+	if err != nil {
+		return err
+	}
+	if exists && ou.Accepted {
+		return nil
+	}
+	if !IsEmailDomainAllowed(o.Settings, u.Email) {
+		return fmt.Errorf("email domain of %s is not allowed in the organization", u.Email)
+	}
+	if exists {
+		return tx.UpdateColumnsByConditions(map[string]interface{}{"id": ou.ID}, map[string]interface{}{"accepted": true}, &OrgUser{})
+	}
+	return tx.InsertOne(&OrgUser{OrgID: orgID, UserID: u.ID, Role: RoleMember, Accepted: true})
+}
+
+// SyncTeamsRequest are the parameters for syncing the teams of a user with an external directory, e.g. the groups of
+// an identity provider
+type SyncTeamsRequest struct {
+	OrgID  id.ID
+	UserID id.ID
+	// ManagedTeamIDs are the teams whose membership comes from the directory
+	ManagedTeamIDs []id.ID
+	// TeamIDs are the managed teams that the user should be a member of
+	TeamIDs []id.ID
+}
+
+// SyncTeamsTx adds the user to the managed teams that they should be a member of, and removes them from the other
+// managed teams, as part of the transaction tx. The teams that aren't managed are left as they are. The user should be
+// a member of the organization. The changes flow through to the vaults that the teams are a part of.
+func SyncTeamsTx(ctx context.Context, tx *orm.Tx, req SyncTeamsRequest) error {
+	var want = make(map[id.ID]bool)
+	for _, teamID := range req.TeamIDs {
+		want[teamID] = true
+	}
+
+	for _, teamID := range req.ManagedTeamIDs {
+		var t Team
+		exists, err := tx.FindByID(teamID, &t)
+		if err != nil {
+			return err
+		}
+		if !exists || t.OrgID != req.OrgID {
+			clog.Warnf("%s: skipping sync of team %v, which is not a team of org %v", gServiceName, teamID, req.OrgID)
+			continue
+		}
+
+		var tm TeamMember
+		isMember, err := tx.FindOne(map[string]interface{}{"team_id": teamID, "user_id": req.UserID}, &tm)
+		if err != nil {
+			return err
+		}
+		switch {
+		case want[teamID] && !isMember:
+			err = tx.InsertOne(&TeamMember{TeamID: teamID, UserID: req.UserID})
+		case !want[teamID] && isMember:
+			_, err = tx.HardDeleteByConditions(map[string]interface{}{"team_id": teamID, "user_id": req.UserID}, &TeamMember{})
+		default:
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		err = runTeamMembershipHooks(ctx, tx, teamID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetTeamMemberIDsTx returns the userIDs of all the members of the team, as part of the transaction tx
+func GetTeamMemberIDsTx(ctx context.Context, tx *orm.Tx, teamID id.ID) ([]id.ID, error) {
+	var tms []TeamMember
+	_, err := tx.FindByColumn("team_id", teamID, &tms)
+	if err != nil {
+		return nil, err
+	}
+	var ids []id.ID
+	for _, tm := range tms {
+		ids = append(ids, tm.UserID)
+	}
+	return ids, nil
+}
+
+// IsMemberTx returns true if the user is a member of the organization, as part of the transaction tx. Users who
+// haven't accepted their invitation aren't members yet.
+func IsMemberTx(ctx context.Context, tx *orm.Tx, orgID, userID id.ID) (bool, error) {
+	var ou OrgUser
+	return tx.FindOne(map[string]interface{}{"org_id": orgID, "user_id": userID, "accepted": true}, &ou)
+}
+
+// RequireRoleTx returns ErrForbidden if the user does not have the role in the organization
+func RequireRoleTx(ctx context.Context, tx *orm.Tx, orgID, userID id.ID, role Role) error {
+	var ou OrgUser
+	exists, err := tx.FindOne(map[string]interface{}{"org_id": orgID, "user_id": userID, "accepted": true}, &ou)
+	if err != nil {
+		return err
+	}
+	if !exists || ou.Role != role {
+		return ErrForbidden
+	}
+	return nil
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* H E L P E R S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// IsEmailDomainAllowed returns true if the email's domain is allowed by the settings. If the settings do not restrict
+// the email domains, all emails are allowed.
+func IsEmailDomainAllowed(s Settings, email string) bool {
+	if len(s.AllowedEmailDomains) == 0 {
+		return true
+	}
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[at+1:])
+	for _, d := range s.AllowedEmailDomains {
+		if domain == d {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanSettings validates the settings and normalizes the email domains
+func cleanSettings(s Settings) (Settings, error) {
+	if s.MinK < 0 {
+		return s, fmt.Errorf("min_k cannot be negative")
+	}
+	var domains = pq.StringArray{}
+	for _, d := range s.AllowedEmailDomains {
+		d = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(d), "@"))
+		if d == "" {
+			return s, fmt.Errorf("allowed email domains cannot be empty")
+		}
+		domains = append(domains, d)
+	}
+	s.AllowedEmailDomains = domains
+	return s, nil
+}
+
+// lockTeamAsAdmin locks the team row, and makes sure that it belongs to the org and that the user is an admin of the org
+func lockTeamAsAdmin(ctx context.Context, tx *orm.Tx, req TeamMemberRequest) error {
+	var t Team
+	exists, err := tx.FindByIDForUpdate(req.TeamID, &t)
+	if err != nil {
+		return err
+	}
+	if !exists || t.OrgID != req.OrgID {
+		return ErrTeamNotFound
+	}
+	return RequireRoleTx(ctx, tx, req.OrgID, req.UserID, RoleAdmin)
+}
+
+func runTeamMembershipHooks(ctx context.Context, tx *orm.Tx, teamID id.ID) error {
+	for _, hook := range gTeamMembershipHooks {
+		if err := hook(ctx, tx, teamID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
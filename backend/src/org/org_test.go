@@ -0,0 +1,72 @@
+package org
+
+import (
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsEmailDomainAllowed(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings Settings
+		email    string
+		want     bool
+	}{
+		{
+			name:     "any email allowed if no domains are set",
+			settings: Settings{},
+			email:    "jon.doe@email.com",
+			want:     true,
+		},
+		{
+			name:     "allowed if domain is in the list",
+			settings: Settings{AllowedEmailDomains: pq.StringArray{"acme.com", "email.com"}},
+			email:    "jon.doe@email.com",
+			want:     true,
+		},
+		{
+			name:     "allowed if domain is in the list but in a different case",
+			settings: Settings{AllowedEmailDomains: pq.StringArray{"email.com"}},
+			email:    "jon.doe@EMAIL.com",
+			want:     true,
+		},
+		{
+			name:     "not allowed if domain is not in the list",
+			settings: Settings{AllowedEmailDomains: pq.StringArray{"acme.com"}},
+			email:    "jon.doe@email.com",
+			want:     false,
+		},
+		{
+			name:     "not allowed if a sub-domain of an allowed domain",
+			settings: Settings{AllowedEmailDomains: pq.StringArray{"email.com"}},
+			email:    "jon.doe@evil.email.com",
+			want:     false,
+		},
+		{
+			name:     "not allowed if email has no domain",
+			settings: Settings{AllowedEmailDomains: pq.StringArray{"email.com"}},
+			email:    "jon.doe",
+			want:     false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, IsEmailDomainAllowed(tt.settings, tt.email))
+		})
+	}
+}
+
+func TestCleanSettings(t *testing.T) {
+	got, err := cleanSettings(Settings{MinK: 2, AllowedEmailDomains: pq.StringArray{" @Acme.com ", "email.com"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, got.MinK)
+	assert.Equal(t, pq.StringArray{"acme.com", "email.com"}, got.AllowedEmailDomains)
+
+	_, err = cleanSettings(Settings{MinK: -1})
+	assert.Error(t, err)
+
+	_, err = cleanSettings(Settings{AllowedEmailDomains: pq.StringArray{" "}})
+	assert.Error(t, err)
+}
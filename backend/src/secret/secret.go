@@ -3,6 +3,7 @@ package secret
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/teejays/clog"
 
@@ -14,6 +15,18 @@ import (
 
 var gServiceName = "Secret Service" //LOL
 
+// ErrRequestNotFound is returned when a secret request does not exist
+var ErrRequestNotFound = fmt.Errorf("secret request not found")
+
+// ErrNotRequester is returned when a user tries to use a secret request that someone else made
+var ErrNotRequester = fmt.Errorf("secret request was made by another user")
+
+// ErrNotApproved is returned when a secret request has not been approved yet
+var ErrNotApproved = fmt.Errorf("secret request has not been approved")
+
+// ErrApprovalExpired is returned when the approval of a secret request is older than the vault's approval policy allows
+var ErrApprovalExpired = fmt.Errorf("approval of secret request has expired")
+
 /* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
 * O R M   M O D E L S
 * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
@@ -31,6 +44,8 @@ type SecretRequest struct {
 	UserID        id.ID `xorm:"notnull" json:"user_id"`
 	VaultID       id.ID `xorm:"notnull" json:"vault_id"`
 	Approved      bool  `xorm:"notnull default false" json:"approved"`
+	// ApprovedAt is when the last approval needed came in, and the approval policy's window opened
+	ApprovedAt *time.Time `json:"approved_at"`
 }
 
 // SecretApproval stores the approvals for reveal requests
@@ -48,6 +63,9 @@ func Init() error {
 		return err
 	}
 
+	// When a vault is purged, its secrets and their requests should go with it
+	vault.RegisterPurgeHook(purgeVaultSecrets)
+
 	return nil
 }
 
@@ -57,8 +75,9 @@ func Init() error {
 
 // RequestParams are the parameters for a request to reveal a vault's secret
 type RequestParams struct {
-	VaultID id.ID
-	UserID  id.ID
+	VaultID  id.ID
+	UserID   id.ID
+	ClientIP string
 }
 
 // UpdateParams are the parameters to update the reveal secret status (approve/reject)
@@ -66,12 +85,27 @@ type UpdateParams struct {
 	SecretRequestID id.ID
 	UserID          id.ID
 	Approval        bool
+	ClientIP        string
+	// StepUpToken is the proof, e.g. of a security key, that the approval hooks may ask for
+	StepUpToken string
+}
+
+// ApprovalHookFunc is called, as part of the same transaction, before a user approves a secret request. It allows
+// other services to ask for more proof that it's really the user, e.g. a security key.
+type ApprovalHookFunc func(ctx context.Context, tx *orm.Tx, req UpdateParams) error
+
+var gApprovalHooks []ApprovalHookFunc
+
+// RegisterApprovalHook registers f to be called whenever a user approves a secret request
+func RegisterApprovalHook(f ApprovalHookFunc) {
+	gApprovalHooks = append(gApprovalHooks, f)
 }
 
 // GetParams are the parameters to get the secret/secret status
 type GetParams struct {
 	SecretRequestID id.ID
 	UserID          id.ID
+	ClientIP        string
 }
 
 // Status stores the information of the current approval status for the reveal secret request
@@ -84,89 +118,169 @@ type Status struct {
 // Request creates a request to reveal a vault's secret for the current authenticated user
 func Request(ctx context.Context, req RequestParams) (*Status, error) {
 	clog.Debugf("%s: creating a request to reveal secret of vault %s", gServiceName, req.VaultID)
-	//Find all other users of the vault
-	users, err := vault.GetVaultUsersByVaultID(ctx, req.VaultID)
+
+	// Archived vaults are read-only, so no new requests can be made for them
+	v, err := vault.GetVault(ctx, req.VaultID)
 	if err != nil {
 		return nil, err
 	}
-
-	// Create a new request
-	rr := SecretRequest{
-		UserID:   req.UserID,
-		VaultID:  req.VaultID,
-		Approved: false,
+	if v == nil {
+		return nil, vault.ErrVaultNotFound
+	}
+	if v.IsArchived() {
+		return nil, vault.ErrVaultArchived
 	}
-	rr.ID = id.GetNewID()
-	err = orm.InsertOne(&rr)
+	err = vault.CheckAccess(ctx, vault.CheckAccessRequest{Vault: v, UserID: req.UserID, ClientIP: req.ClientIP, Action: "secret.request"})
 	if err != nil {
 		return nil, err
 	}
 
-	var ras []SecretApproval
+	//Find all other users of the vault
+	users, err := vault.GetVaultUsersByVaultID(ctx, req.VaultID)
+	if err != nil {
+		return nil, err
+	}
 
-	// Create new approvals
-	for _, user := range users {
-		if user == nil {
-			continue
-		}
-		ra := SecretApproval{
-			SecretRequestID: rr.ID,
-			UserID:          user.UserID,
-			Approved:        false,
+	var s *Status
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		// Create a new request
+		rr := SecretRequest{
+			UserID:   req.UserID,
+			VaultID:  req.VaultID,
+			Approved: false,
 		}
-		if user.UserID == req.UserID {
-			ra.Approved = true
+		rr.ID = id.GetNewID()
+		err := tx.InsertOne(&rr)
+		if err != nil {
+			return err
 		}
-		ras = append(ras, ra)
-	}
 
-	for _, v := range ras {
-		err := orm.InsertOne(&v)
-		if err != nil {
-			return nil, err
+		// Create new approvals
+		for _, user := range users {
+			if user == nil {
+				continue
+			}
+			ra := SecretApproval{
+				SecretRequestID: rr.ID,
+				UserID:          user.UserID,
+				Approved:        false,
+			}
+			if user.UserID == req.UserID {
+				ra.Approved = true
+			}
+			err := tx.InsertOne(&ra)
+			if err != nil {
+				return err
+			}
 		}
+
+		s, err = getStatus(ctx, tx, GetParams{SecretRequestID: rr.ID, UserID: req.UserID})
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return GetStatus(ctx, GetParams{rr.ID, req.UserID})
+	return s, nil
 }
 
 // UpdateStatus updates the approval status of the specified request for the current authenticated user
 func UpdateStatus(ctx context.Context, req UpdateParams) (*Status, error) {
 	clog.Debugf("%s: updating the approval of secret of request %s", gServiceName, req.SecretRequestID)
-	//Update the approval of the secret status of this user
-	saConditions := map[string]interface{}{
-		"user_id":           req.UserID,
-		"secret_request_id": req.SecretRequestID,
-	}
 
-	err := orm.UpdateByColumn(saConditions, &SecretApproval{Approved: true})
-	if err != nil {
-		return nil, err
-	}
-	//Check if the overall request has been approved with this approval
-	if req.Approval {
-		s, err := GetStatus(ctx, GetParams{req.SecretRequestID, req.UserID})
+	var s *Status
+	err := orm.WithTx(ctx, func(tx *orm.Tx) error {
+		// Lock the request, so concurrent approvals are applied one after the other
+		var sr SecretRequest
+		exists, err := tx.FindByIDForUpdate(req.SecretRequestID, &sr)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("%s: no secret request found with id %s", gServiceName, req.SecretRequestID)
+		}
+
+		// Approvals are subject to the access restrictions of the vault too
+		v, err := vault.GetVault(ctx, sr.VaultID)
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			return vault.ErrVaultNotFound
+		}
+		err = vault.CheckAccess(ctx, vault.CheckAccessRequest{Vault: v, UserID: req.UserID, ClientIP: req.ClientIP, Action: "secret.approve"})
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if req.Approval {
+			for _, hook := range gApprovalHooks {
+				if err := hook(ctx, tx, req); err != nil {
+					return err
+				}
+			}
 		}
 
-		for _, approvals := range s.Approvals {
-			if !approvals {
-				return GetStatus(ctx, GetParams{req.SecretRequestID, req.UserID})
+		//Update the approval of the secret status of this user
+		saConditions := map[string]interface{}{
+			"user_id":           req.UserID,
+			"secret_request_id": req.SecretRequestID,
+		}
+		err = tx.UpdateColumnsByConditions(saConditions, map[string]interface{}{"approved": req.Approval}, &SecretApproval{})
+		if err != nil {
+			return err
+		}
+
+		//Check if the overall request has been approved with this approval
+		s, err = getStatus(ctx, tx, GetParams{SecretRequestID: req.SecretRequestID, UserID: req.UserID})
+		if err != nil {
+			return err
+		}
+		approved := true
+		for _, approval := range s.Approvals {
+			if !approval {
+				approved = false
+				break
 			}
 		}
-		err = orm.UpdateByColumn(map[string]interface{}{"id": req.SecretRequestID}, &SecretRequest{Approved: true})
+		if approved == s.Approved {
+			return nil
+		}
+
+		var approvedAt *time.Time
+		if approved {
+			now := time.Now()
+			approvedAt = &now
+		}
+		err = tx.UpdateColumnsByConditions(map[string]interface{}{"id": req.SecretRequestID}, map[string]interface{}{"approved": approved, "approved_at": approvedAt}, &SecretRequest{})
 		if err != nil {
-			return nil, err
+			return err
 		}
+		s.Approved = approved
 
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return GetStatus(ctx, GetParams{req.SecretRequestID, req.UserID})
+	return s, nil
 }
 
 // GetStatus gets the current status of the given SecretRequest id
 func GetStatus(ctx context.Context, req GetParams) (*Status, error) {
+	var s *Status
+	err := orm.WithTx(ctx, func(tx *orm.Tx) error {
+		var err error
+		s, err = getStatus(ctx, tx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func getStatus(ctx context.Context, tx *orm.Tx, req GetParams) (*Status, error) {
 	clog.Debugf("%s: getting secret status of request %s", gServiceName, req.SecretRequestID)
 	//TODO: confirm user has access to the request to retrieve status
 
@@ -174,7 +288,7 @@ func GetStatus(ctx context.Context, req GetParams) (*Status, error) {
 	var srs []SecretRequest
 	var sas []SecretApproval
 	//Get the secret request
-	_, err := orm.FindByColumn("id", req.SecretRequestID, &srs)
+	_, err := tx.FindByColumn("id", req.SecretRequestID, &srs)
 	if err != nil {
 		return nil, err
 	}
@@ -185,7 +299,7 @@ func GetStatus(ctx context.Context, req GetParams) (*Status, error) {
 	s.Approved = srs[0].Approved
 
 	//Get the secret approvals
-	_, err = orm.FindByColumn("secret_request_id", req.SecretRequestID, &sas)
+	_, err = tx.FindByColumn("secret_request_id", req.SecretRequestID, &sas)
 	if err != nil {
 		return nil, err
 	}
@@ -202,28 +316,13 @@ func GetStatus(ctx context.Context, req GetParams) (*Status, error) {
 func Get(ctx context.Context, req GetParams) (*Secret, error) {
 	clog.Debugf("%s: revealing secret of vault %s", gServiceName, req.SecretRequestID)
 
-	//Check the approval status
-	status, err := GetStatus(ctx, GetParams{req.SecretRequestID, req.UserID})
-	if err != nil {
-		return nil, err
-	}
-	if !status.Approved {
-		return nil, fmt.Errorf("%s: secret %s not approved", gServiceName, req.SecretRequestID)
-	}
-
-	//Get the secret
-	var srs []SecretRequest
-	//Get the secret request
-	_, err = orm.FindByColumn("id", req.SecretRequestID, &srs)
+	sr, err := requireApproval(ctx, req, "secret.reveal")
 	if err != nil {
 		return nil, err
 	}
-	if len(srs) != 1 {
-		return nil, fmt.Errorf("%s: expected %d secret request but got %d", gServiceName, 1, len(srs))
-	}
 
 	var ss []Secret
-	_, err = orm.FindByColumn("vault_id", srs[0].VaultID, &ss)
+	_, err = orm.FindByColumn("vault_id", sr.VaultID, &ss)
 	if err != nil {
 		return nil, err
 	}
@@ -234,3 +333,72 @@ func Get(ctx context.Context, req GetParams) (*Secret, error) {
 	}
 	return &ss[0], err
 }
+
+// RequireApproval returns the secret request if it was made by the user, has been approved, the approval has not
+// expired, and the vault can be accessed from the client IP right now. Other services use it to gate access to what they
+// store for a vault e.g. the TOTP service before generating a code. action describes the access, for security events.
+func RequireApproval(ctx context.Context, req GetParams, action string) (*SecretRequest, error) {
+	return requireApproval(ctx, req, action)
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* H E L P E R S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+func requireApproval(ctx context.Context, req GetParams, action string) (*SecretRequest, error) {
+	var sr SecretRequest
+	exists, err := orm.FindByID(req.SecretRequestID, &sr)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrRequestNotFound
+	}
+	if sr.UserID != req.UserID {
+		return nil, ErrNotRequester
+	}
+	if !sr.Approved {
+		return nil, ErrNotApproved
+	}
+
+	// The approval can only be used for as long as the vault's approval policy allows. Requests approved before we
+	// recorded when have no window to go by, so they are expired.
+	v, err := vault.GetVault(ctx, sr.VaultID)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, vault.ErrVaultNotFound
+	}
+	if sr.ApprovedAt == nil || v.ApprovalPolicy.IsExpired(*sr.ApprovedAt) {
+		return nil, ErrApprovalExpired
+	}
+	err = vault.CheckAccess(ctx, vault.CheckAccessRequest{Vault: v, UserID: req.UserID, ClientIP: req.ClientIP, Action: action})
+	if err != nil {
+		return nil, err
+	}
+
+	return &sr, nil
+}
+
+// purgeVaultSecrets permanently deletes the secrets, secret requests and approvals of the vault. It is registered as
+// a vault purge hook.
+func purgeVaultSecrets(ctx context.Context, tx *orm.Tx, vaultID id.ID) error {
+	var srs []SecretRequest
+	_, err := tx.FindByColumn("vault_id", vaultID, &srs)
+	if err != nil {
+		return err
+	}
+	for _, sr := range srs {
+		_, err := tx.HardDeleteByConditions(map[string]interface{}{"secret_request_id": sr.ID}, &SecretApproval{})
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.HardDeleteByConditions(map[string]interface{}{"vault_id": vaultID}, &SecretRequest{})
+	if err != nil {
+		return err
+	}
+	_, err = tx.HardDeleteByConditions(map[string]interface{}{"vault_id": vaultID}, &Secret{})
+	return err
+}
@@ -0,0 +1,308 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/teejays/n-factor-vault/backend/library/go-api"
+
+	"github.com/teejays/n-factor-vault/backend/src/auth"
+	"github.com/teejays/n-factor-vault/backend/src/vault"
+)
+
+// HandleCreateFolder (POST) creates a new folder
+func HandleCreateFolder(w http.ResponseWriter, r *http.Request) {
+
+	var req vault.CreateFolderRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	// Populate the UserID field of req using the authenticated userID
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+	req.UserID = u.ID
+
+	f, err := vault.CreateFolder(r.Context(), req)
+	if err != nil {
+		writeVaultError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusCreated, f)
+}
+
+// HandleGetFolder (GET) returns a folder, with its effective members and approval policy
+func HandleGetFolder(w http.ResponseWriter, r *http.Request) {
+
+	folderID, err := getIDFromRequest(r, "folder_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+
+	f, err := vault.GetFolder(r.Context(), folderID, u.ID)
+	if err != nil {
+		writeVaultError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, f)
+}
+
+// HandleDeleteFolder (DELETE) deletes an empty folder
+func HandleDeleteFolder(w http.ResponseWriter, r *http.Request) {
+
+	folderID, err := getIDFromRequest(r, "folder_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+
+	err = vault.DeleteFolder(r.Context(), folderID, u.ID)
+	if err != nil {
+		writeVaultError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, nil)
+}
+
+// HandleSetFolderMember (PUT) sets the role of a user on a folder
+func HandleSetFolderMember(w http.ResponseWriter, r *http.Request) {
+
+	var req vault.FolderMemberRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	req.FolderID, err = getIDFromRequest(r, "folder_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	req.MemberUserID, err = getIDFromRequest(r, "user_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+	req.UserID = u.ID
+
+	f, err := vault.SetFolderMember(r.Context(), req)
+	if err != nil {
+		writeVaultError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, f)
+}
+
+// HandleRemoveFolderMember (DELETE) removes the role set for a user on a folder, so they inherit it from above
+func HandleRemoveFolderMember(w http.ResponseWriter, r *http.Request) {
+
+	var req vault.FolderMemberRequest
+	var err error
+
+	req.FolderID, err = getIDFromRequest(r, "folder_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	req.MemberUserID, err = getIDFromRequest(r, "user_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+	req.UserID = u.ID
+
+	f, err := vault.RemoveFolderMember(r.Context(), req)
+	if err != nil {
+		writeVaultError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, f)
+}
+
+// HandleSetFolderPolicy (PUT) sets the approval policy of a folder
+func HandleSetFolderPolicy(w http.ResponseWriter, r *http.Request) {
+
+	var req vault.SetFolderPolicyRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	req.FolderID, err = getIDFromRequest(r, "folder_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+	req.UserID = u.ID
+
+	f, err := vault.SetFolderPolicy(r.Context(), req)
+	if err != nil {
+		writeVaultError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, f)
+}
+
+// HandleMoveVault (PUT) moves a vault owned by the authenticated user into another folder
+func HandleMoveVault(w http.ResponseWriter, r *http.Request) {
+
+	var req vault.MoveVaultRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	req.VaultID, err = getVaultIDFromRequest(r)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+	req.UserID = u.ID
+
+	v, err := vault.MoveVault(r.Context(), req)
+	if err != nil {
+		writeVaultError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, v)
+}
+
+// HandleSetVaultApprovalPolicy (PUT) overrides the approval policy that a vault inherits from its folders
+func HandleSetVaultApprovalPolicy(w http.ResponseWriter, r *http.Request) {
+
+	var req vault.SetApprovalPolicyRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	req.VaultID, err = getVaultIDFromRequest(r)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+	req.UserID = u.ID
+
+	v, err := vault.SetApprovalPolicy(r.Context(), req)
+	if err != nil {
+		writeVaultError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, v)
+}
+
+// HandleSetVaultAccessRestrictions (PUT) replaces the IP allowlist and time windows that the secrets of a vault can be
+// accessed in
+func HandleSetVaultAccessRestrictions(w http.ResponseWriter, r *http.Request) {
+
+	var req vault.SetAccessRestrictionsRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	req.VaultID, err = getVaultIDFromRequest(r)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+	req.UserID = u.ID
+
+	v, err := vault.SetAccessRestrictions(r.Context(), req)
+	if err != nil {
+		writeVaultError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, v)
+}
+
+// HandleGetVaultPermissions (GET) returns the effective members, roles and approval policy of a vault
+func HandleGetVaultPermissions(w http.ResponseWriter, r *http.Request) {
+
+	vaultID, err := getVaultIDFromRequest(r)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+
+	ep, err := vault.GetEffectivePermissions(r.Context(), vaultID, u.ID)
+	if err != nil {
+		writeVaultError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, ep)
+}
@@ -0,0 +1,76 @@
+package handler_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/teejays/n-factor-vault/backend/library/go-api/apitest"
+	"github.com/teejays/n-factor-vault/backend/library/id"
+	"github.com/teejays/n-factor-vault/backend/library/orm"
+
+	"github.com/teejays/n-factor-vault/backend/src/auth"
+	"github.com/teejays/n-factor-vault/backend/src/server/handler"
+	"github.com/teejays/n-factor-vault/backend/src/user"
+	"github.com/teejays/n-factor-vault/backend/src/vault"
+)
+
+func TestHandleCreateFolder(t *testing.T) {
+
+	// Make sure that we empty any table that these tests might populate once the test is over
+	var relevantOrmTables = []orm.Entity{&user.User{}, &user.Password{}, &vault.Folder{}, &vault.FolderMember{}}
+	orm.EmptyTestTables(t, relevantOrmTables...)
+	defer orm.EmptyTestTables(t, relevantOrmTables...)
+
+	// Setup Test
+	helperCreateTestUsersT(t)
+	token, _ := helperLoginTestUsersT(t)
+	var getAuthTokenFunc = func(t *testing.T) string { return token }
+
+	// Define the Test Suite
+	ts := apitest.TestSuite{
+		Route:                 "/v1/folder",
+		Method:                http.MethodPost,
+		HandlerFunc:           handler.HandleCreateFolder,
+		AuthBearerTokenFunc:   getAuthTokenFunc,
+		AuthMiddlewareHandler: auth.AuthenticateRequestMiddleware,
+		AfterTestFunc:         func(t *testing.T) { orm.EmptyTestTables(t, &vault.Folder{}, &vault.FolderMember{}) },
+	}
+
+	tests := []apitest.HandlerTest{
+		{
+			Name:           "status OK if request has valid content",
+			Content:        `{"name":"Payments", "approval_policy":{"ttl_minutes":30}}`,
+			WantStatusCode: http.StatusCreated,
+			AssertContentFields: map[string]apitest.AssertFunc{
+				"id":   apitest.AssertNotEmptyFunc,
+				"name": apitest.AssertIsEqual("Payments"),
+			},
+		},
+		{
+			Name:           "status Unauthorized if request has no auth token",
+			Content:        `{"name":"Payments"}`,
+			SkipAuthToken:  true,
+			WantStatusCode: http.StatusUnauthorized,
+		},
+		{
+			Name:           "status BadRequest if name is empty",
+			Content:        `{"name":""}`,
+			WantStatusCode: http.StatusBadRequest,
+			WantErrMessage: "name is empty",
+		},
+		{
+			Name:           "status BadRequest if the approval TTL is negative",
+			Content:        `{"name":"Payments", "approval_policy":{"ttl_minutes":-1}}`,
+			WantStatusCode: http.StatusBadRequest,
+			WantErrMessage: "approval TTL cannot be negative",
+		},
+		{
+			Name:           "status NotFound if the parent folder does not exist",
+			Content:        `{"name":"Prod", "parent_id":"` + string(id.GetNewID()) + `"}`,
+			WantStatusCode: http.StatusNotFound,
+			WantErrMessage: vault.ErrFolderNotFound.Error(),
+		},
+	}
+
+	ts.RunHandlerTests(t, tests)
+}
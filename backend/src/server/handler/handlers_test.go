@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"testing"
 
+	"github.com/gorilla/mux"
 	"github.com/teejays/clog"
 
 	"github.com/teejays/n-factor-vault/backend/library/env"
@@ -13,8 +14,12 @@ import (
 	"github.com/teejays/n-factor-vault/backend/library/go-api/apitest"
 	"github.com/teejays/n-factor-vault/backend/library/orm"
 
+	"github.com/teejays/n-factor-vault/backend/src/audit"
 	"github.com/teejays/n-factor-vault/backend/src/auth"
+	"github.com/teejays/n-factor-vault/backend/src/org"
+	"github.com/teejays/n-factor-vault/backend/src/secret"
 	"github.com/teejays/n-factor-vault/backend/src/server/handler"
+	"github.com/teejays/n-factor-vault/backend/src/totp"
 	"github.com/teejays/n-factor-vault/backend/src/user"
 	"github.com/teejays/n-factor-vault/backend/src/vault"
 )
@@ -40,22 +45,41 @@ func initError() error {
 	}
 
 	// Initialize the services: the order should be important ideally, so dependent services are initialized later
+	err = audit.Init()
+	if err != nil {
+		return err
+	}
+
+	err = auth.Init()
+	if err != nil {
+		return err
+	}
+
 	err = user.Init()
 	if err != nil {
 		return err
 	}
 
+	err = org.Init()
+	if err != nil {
+		return err
+	}
+
 	err = vault.Init()
 	if err != nil {
 		return err
 	}
 
-	/* Uncomment when we tests for secrets service
 	err = secret.Init()
 	if err != nil {
 		return err
 	}
-	*/
+
+	// The second factor of logins is encrypted with the master key of the TOTP service
+	err = totp.Init()
+	if err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -89,6 +113,8 @@ func helperCreateTestVaultsT(t *testing.T, token string) {
 var mockUsers = map[string]string{
 	"Jon":  `{"name":"Jon Doe", "email":"jon.doe@email.com","password":"jons_secret"}`,
 	"Jane": `{"name":"Jane Does", "email":"jane.does@email.com","password":"janes_secret"}`,
+	// Sansa has the email of an entry of the test directory, with a password of our own
+	"Sansa": `{"name":"Sansa Stark", "email":"sansa.stark@example.org","password":"sansas_own_secret"}`,
 }
 
 var mockVaults = map[string]string{
@@ -172,3 +198,36 @@ func helperCreateVaults(token string, vaults ...string) error {
 
 	return nil
 }
+
+func helperCreateVaultGetID(token string, vault string) (string, error) {
+	p := apitest.HandlerReqParams{
+		Route:           "/v1/vault",
+		Method:          http.MethodPost,
+		HandlerFunc:     handler.HandleCreateVault,
+		AuthBearerToken: token,
+		Middlewares:     []api.MiddlewareFunc{auth.AuthenticateRequestMiddleware},
+	}
+
+	_, body, err := p.MakeHandlerRequest(mockVaults[vault], []int{http.StatusCreated})
+	if err != nil {
+		return "", err
+	}
+
+	var m = make(map[string]interface{})
+	if err := json.Unmarshal(body, &m); err != nil {
+		return "", err
+	}
+	vaultID, ok := m["id"].(string)
+	if !ok || vaultID == "" {
+		return "", fmt.Errorf("couldn't get vault id in response")
+	}
+
+	return vaultID, nil
+}
+
+// helperMuxHandler wraps the handler h in a router, so that it receives the URL params of the route pattern
+func helperMuxHandler(pattern string, method string, h http.HandlerFunc) http.Handler {
+	m := mux.NewRouter()
+	m.HandleFunc(pattern, h).Methods(method)
+	return m
+}
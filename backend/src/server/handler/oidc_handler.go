@@ -0,0 +1,149 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/teejays/n-factor-vault/backend/library/go-api"
+	oidc "github.com/teejays/n-factor-vault/backend/library/go-oidc"
+
+	"github.com/teejays/n-factor-vault/backend/src/auth"
+	"github.com/teejays/n-factor-vault/backend/src/org"
+)
+
+// HandleCreateOIDCProvider (POST) registers an OpenID provider that the members of an organization can log in with
+func HandleCreateOIDCProvider(w http.ResponseWriter, r *http.Request) {
+
+	var req auth.CreateOIDCProviderRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	req.OrgID, err = getIDFromRequest(r, "org_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	req.ClientIP = api.GetClientIP(r)
+
+	p, err := auth.CreateOIDCProvider(r.Context(), req)
+	if err != nil {
+		writeOIDCError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusCreated, p)
+
+}
+
+// HandleGetOIDCProviders (GET) returns the OpenID providers of an organization
+func HandleGetOIDCProviders(w http.ResponseWriter, r *http.Request) {
+
+	orgID, err := getIDFromRequest(r, "org_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	ps, err := auth.GetOIDCProviders(r.Context(), orgID)
+	if err != nil {
+		writeOIDCError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, ps)
+
+}
+
+// HandleBeginOIDCLogin (POST) starts a login with an OpenID provider, and returns the URL that the user should be sent
+// to
+func HandleBeginOIDCLogin(w http.ResponseWriter, r *http.Request) {
+
+	providerID, err := getIDFromRequest(r, "provider_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	start, err := auth.BeginOIDCLogin(r.Context(), providerID)
+	if err != nil {
+		writeOIDCError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, start)
+
+}
+
+// HandleBeginOIDCLink (POST) starts a login with an OpenID provider that links the account of the authenticated user to
+// it, and returns the URL that the user should be sent to
+func HandleBeginOIDCLink(w http.ResponseWriter, r *http.Request) {
+
+	providerID, err := getIDFromRequest(r, "provider_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	start, err := auth.BeginOIDCLink(r.Context(), providerID)
+	if err != nil {
+		writeOIDCError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, start)
+
+}
+
+// HandleFinishOIDCLogin (GET) is where the OpenID provider sends the user back to, with the state and the code in the
+// query params. It logs the user in.
+func HandleFinishOIDCLogin(w http.ResponseWriter, r *http.Request) {
+
+	// The provider sends an error instead of a code if the user didn't log in, or didn't consent
+	if e, _ := api.GetQueryParamStr(r, "error", ""); e != "" {
+		desc, _ := api.GetQueryParamStr(r, "error_description", "")
+		api.WriteError(w, http.StatusUnauthorized, fmt.Errorf("login at the identity provider failed: %s %s", e, desc), false, nil)
+		return
+	}
+
+	var req auth.FinishOIDCLoginRequest
+	var err error
+	req.State, err = api.GetQueryParamStr(r, "state", "")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	req.Code, err = api.GetQueryParamStr(r, "code", "")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	req.ClientIP = api.GetClientIP(r)
+	req.UserAgent = r.UserAgent()
+
+	resp, err := auth.FinishOIDCLogin(r.Context(), req)
+	if err != nil {
+		writeOIDCError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, resp)
+
+}
+
+// writeOIDCError writes the error returned by single sign-on with the appropriate HTTP status code
+func writeOIDCError(w http.ResponseWriter, err error) {
+	switch err {
+	case org.ErrForbidden, auth.ErrNotOrgMember, auth.ErrOIDCIdentityNotLinked:
+		api.WriteError(w, http.StatusForbidden, err, false, nil)
+	case auth.ErrOIDCIdentityLinked:
+		api.WriteError(w, http.StatusConflict, err, false, nil)
+	case auth.ErrOIDCProviderNotFound, org.ErrOrgNotFound, org.ErrTeamNotFound:
+		api.WriteError(w, http.StatusNotFound, err, false, nil)
+	case auth.ErrInvalidOIDCState, auth.ErrEmailNotVerified, oidc.ErrInvalidIDToken:
+		api.WriteError(w, http.StatusUnauthorized, err, false, nil)
+	default:
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+	}
+}
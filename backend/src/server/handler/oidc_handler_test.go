@@ -0,0 +1,307 @@
+package handler_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/teejays/n-factor-vault/backend/library/go-api"
+	"github.com/teejays/n-factor-vault/backend/library/go-api/apitest"
+	jwt "github.com/teejays/n-factor-vault/backend/library/go-jwt"
+	"github.com/teejays/n-factor-vault/backend/library/orm"
+
+	"github.com/teejays/n-factor-vault/backend/src/audit"
+	"github.com/teejays/n-factor-vault/backend/src/auth"
+	"github.com/teejays/n-factor-vault/backend/src/org"
+	"github.com/teejays/n-factor-vault/backend/src/server/handler"
+	"github.com/teejays/n-factor-vault/backend/src/user"
+)
+
+var oidcOrmTables = []orm.Entity{&user.User{}, &user.Password{}, &org.Organization{}, &org.OrgUser{}, &org.Team{}, &org.TeamMember{},
+	&auth.OIDCProvider{}, &auth.OIDCLoginState{}, &auth.OIDCIdentity{}, &audit.Event{}}
+
+type mockIDTokenClaim struct {
+	jwt.BaseClaim
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Groups        []string `json:"groups"`
+}
+
+// mockIdP is an OpenID provider, which gives out the code "the-code" for the claim
+type mockIdP struct {
+	*httptest.Server
+	client    *jwt.Client
+	claim     mockIDTokenClaim
+	challenge string
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := jwt.NewKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mockIdP{}
+	m.client, err = jwt.NewClient(k, nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(m.client.JWKS())
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if r.PostFormValue("code") != "the-code" || base64.RawURLEncoding.EncodeToString(sum[:]) != m.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		claim := m.claim
+		token, err := m.client.CreateToken(&claim)
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": token})
+	})
+	m.Server = httptest.NewServer(mux)
+	m.claim = mockIDTokenClaim{
+		BaseClaim:     jwt.BaseClaim{Issuer: m.URL, Subject: "arya", Audience: "n-factor-vault"},
+		Email:         "arya.stark@email.com",
+		EmailVerified: true,
+		Groups:        []string{"engineering"},
+	}
+	return &m
+}
+
+func TestHandleOIDCLogin(t *testing.T) {
+
+	orm.EmptyTestTables(t, oidcOrmTables...)
+	defer orm.EmptyTestTables(t, oidcOrmTables...)
+
+	idp := newMockIdP(t)
+	defer idp.Close()
+
+	// Setup Test: Jon is the admin of the org, which has a team for the engineering group
+	helperCreateTestUsersT(t)
+	token, token2 := helperLoginTestUsersT(t)
+	orgID := helperCreateGetID(t, "/v1/org", "/v1/org", http.MethodPost, handler.HandleCreateOrg, token, `{"name":"Acme"}`)
+	teamID := helperCreateGetID(t, "/v1/org/"+orgID+"/team", "/v1/org/{org_id}/team", http.MethodPost, handler.HandleCreateTeam, token, `{"name":"Engineering"}`)
+
+	ts := apitest.TestSuite{
+		Route:                 "/v1/org/" + orgID + "/oidc_provider",
+		Method:                http.MethodPost,
+		Handler:               helperMuxHandler("/v1/org/{org_id}/oidc_provider", http.MethodPost, handler.HandleCreateOIDCProvider),
+		AuthBearerTokenFunc:   func(t *testing.T) string { return token },
+		AuthMiddlewareHandler: auth.AuthenticateRequestMiddleware,
+	}
+	provider := fmt.Sprintf(`{"name":"Acme SSO", "issuer":"%s", "client_id":"n-factor-vault", "group_teams":[{"group":"engineering", "team_id":"%s"}]}`, idp.URL, teamID)
+	tests := []apitest.HandlerTest{
+		{
+			Name:                "status Forbidden if the user isn't an admin of the org",
+			Content:             provider,
+			AuthBearerTokenFunc: func(t *testing.T) string { return token2 },
+			WantStatusCode:      http.StatusForbidden,
+			WantErrMessage:      org.ErrForbidden.Error(),
+		},
+		{
+			Name:           "status BadRequest if the issuer can't be discovered",
+			Content:        `{"name":"Acme SSO", "issuer":"` + idp.URL + `/unknown", "client_id":"n-factor-vault"}`,
+			WantStatusCode: http.StatusBadRequest,
+		},
+	}
+	ts.RunHandlerTests(t, tests)
+
+	providerID := helperCreateGetID(t, ts.Route, "/v1/org/{org_id}/oidc_provider", http.MethodPost, handler.HandleCreateOIDCProvider, token, provider)
+
+	// The login starts with the URL of the provider, with a PKCE challenge
+	p := apitest.HandlerReqParams{
+		Route:   "/v1/login/oidc/" + providerID,
+		Method:  http.MethodPost,
+		Handler: helperMuxHandler("/v1/login/oidc/{provider_id}", http.MethodPost, handler.HandleBeginOIDCLogin),
+	}
+	_, body, err := p.MakeHandlerRequest("", []int{http.StatusOK})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var start auth.OIDCLoginStart
+	if err := json.Unmarshal(body, &start); err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(start.AuthorizationURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "S256", u.Query().Get("code_challenge_method"))
+
+	// The user logs in at the provider, and comes back with the code
+	idp.challenge = u.Query().Get("code_challenge")
+	idp.claim.Nonce = u.Query().Get("nonce")
+	p = apitest.HandlerReqParams{
+		Route:       "/v1/login/oidc/callback?code=the-code&state=" + url.QueryEscape(u.Query().Get("state")),
+		Method:      http.MethodGet,
+		HandlerFunc: handler.HandleFinishOIDCLogin,
+	}
+	_, body, err = p.MakeHandlerRequest("", []int{http.StatusOK})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp auth.LoginResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEmpty(t, resp.JWT)
+
+	// Arya was created, added to the org, and to the team of her group
+	arya, err := user.GetUserByEmail("arya.stark@email.com")
+	if !assert.NoError(t, err) || !assert.False(t, arya.ID.IsEmpty()) {
+		return
+	}
+	var tm org.TeamMember
+	found, err := orm.FindOne(map[string]interface{}{"team_id": teamID, "user_id": arya.ID}, &tm)
+	assert.NoError(t, err)
+	assert.True(t, found)
+
+	// The state can't be used again
+	_, _, err = p.MakeHandlerRequest("", []int{http.StatusUnauthorized})
+	assert.NoError(t, err)
+
+	// The provider can't log in as Jane, who already has an account, by her email. Not even once she's a member.
+	idp.claim.Subject, idp.claim.Email = "jane", "jane.does@email.com"
+	body = helperOIDCLogin(t, idp, providerID, "", http.StatusForbidden)
+	assert.Contains(t, string(body), auth.ErrOIDCIdentityNotLinked.Error())
+	helperCreateGetID(t, "/v1/org/"+orgID+"/user", "/v1/org/{org_id}/user", http.MethodPost, handler.HandleAddOrgMember, token, `{"email":"jane.does@email.com"}`)
+	body = helperOIDCLogin(t, idp, providerID, token2, http.StatusForbidden)
+	assert.Contains(t, string(body), auth.ErrNotOrgMember.Error())
+	p = apitest.HandlerReqParams{
+		Route:           "/v1/org/" + orgID + "/accept",
+		Method:          http.MethodPost,
+		Handler:         helperMuxHandler("/v1/org/{org_id}/accept", http.MethodPost, handler.HandleAcceptOrgInvitation),
+		AuthBearerToken: token2,
+		Middlewares:     []api.MiddlewareFunc{auth.AuthenticateRequestMiddleware},
+	}
+	_, _, err = p.MakeHandlerRequest("", []int{http.StatusOK})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body = helperOIDCLogin(t, idp, providerID, "", http.StatusForbidden)
+	assert.Contains(t, string(body), auth.ErrOIDCIdentityNotLinked.Error())
+
+	// Jane links her account herself, and can then log in with the provider
+	helperOIDCLogin(t, idp, providerID, token2, http.StatusOK)
+	idp.claim.Email = "someone.else@email.com"
+	helperOIDCLogin(t, idp, providerID, "", http.StatusOK)
+
+	// Arya's identity can't be linked to Jane's account
+	idp.claim.Subject = "arya"
+	body = helperOIDCLogin(t, idp, providerID, token2, http.StatusConflict)
+	assert.Contains(t, string(body), auth.ErrOIDCIdentityLinked.Error())
+
+	// Once the org disables password login, Jon can't log in with his password
+	p = apitest.HandlerReqParams{
+		Route:           "/v1/org/" + orgID + "/settings",
+		Method:          http.MethodPatch,
+		Handler:         helperMuxHandler("/v1/org/{org_id}/settings", http.MethodPatch, handler.HandleUpdateOrgSettings),
+		AuthBearerToken: token,
+		Middlewares:     []api.MiddlewareFunc{auth.AuthenticateRequestMiddleware},
+	}
+	_, _, err = p.MakeHandlerRequest(`{"settings":{"password_login_disabled":true}}`, []int{http.StatusOK})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p = apitest.HandlerReqParams{
+		Route:       "/v1/login",
+		Method:      http.MethodPost,
+		HandlerFunc: handler.HandleLogin,
+	}
+	_, _, err = p.MakeHandlerRequest(mockUsers["Jon"], []int{http.StatusForbidden})
+	assert.NoError(t, err)
+}
+
+// helperOIDCLogin logs in with the provider, expecting the status code from the callback, and returns its body. If the
+// token is set, the login links the provider to the account of the token.
+func helperOIDCLogin(t *testing.T, idp *mockIdP, providerID, token string, code int) []byte {
+	p := apitest.HandlerReqParams{
+		Route:   "/v1/login/oidc/" + providerID,
+		Method:  http.MethodPost,
+		Handler: helperMuxHandler("/v1/login/oidc/{provider_id}", http.MethodPost, handler.HandleBeginOIDCLogin),
+	}
+	if token != "" {
+		p.Route, p.Handler = "/v1/oidc/"+providerID+"/link", helperMuxHandler("/v1/oidc/{provider_id}/link", http.MethodPost, handler.HandleBeginOIDCLink)
+		p.AuthBearerToken, p.Middlewares = token, []api.MiddlewareFunc{auth.AuthenticateRequestMiddleware}
+	}
+	_, body, err := p.MakeHandlerRequest("", []int{http.StatusOK, code})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var start auth.OIDCLoginStart
+	if err := json.Unmarshal(body, &start); err != nil || start.AuthorizationURL == "" {
+		// The link was refused before the user was sent to the provider
+		return body
+	}
+	u, err := url.Parse(start.AuthorizationURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp.challenge = u.Query().Get("code_challenge")
+	idp.claim.Nonce = u.Query().Get("nonce")
+	p = apitest.HandlerReqParams{
+		Route:       "/v1/login/oidc/callback?code=the-code&state=" + url.QueryEscape(u.Query().Get("state")),
+		Method:      http.MethodGet,
+		HandlerFunc: handler.HandleFinishOIDCLogin,
+	}
+	_, body, err = p.MakeHandlerRequest("", []int{code})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// helperCreateGetID makes an authenticated create request, and returns the id of what was created
+func helperCreateGetID(t *testing.T, route, pattern, method string, h http.HandlerFunc, token, content string) string {
+	p := apitest.HandlerReqParams{
+		Route:           route,
+		Method:          method,
+		Handler:         helperMuxHandler(pattern, method, h),
+		AuthBearerToken: token,
+		Middlewares:     []api.MiddlewareFunc{auth.AuthenticateRequestMiddleware},
+	}
+	_, body, err := p.MakeHandlerRequest(content, []int{http.StatusCreated})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m = make(map[string]interface{})
+	if err := json.Unmarshal(body, &m); err != nil {
+		t.Fatal(err)
+	}
+	id, ok := m["id"].(string)
+	if !ok || id == "" {
+		t.Fatalf("couldn't get id in response of %s", route)
+	}
+	return id
+}
@@ -0,0 +1,413 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/teejays/n-factor-vault/backend/library/go-api"
+	"github.com/teejays/n-factor-vault/backend/library/id"
+
+	"github.com/teejays/n-factor-vault/backend/src/auth"
+	"github.com/teejays/n-factor-vault/backend/src/org"
+	"github.com/teejays/n-factor-vault/backend/src/vault"
+)
+
+// HandleCreateOrg creates a new organization with the authenticated user as its admin
+func HandleCreateOrg(w http.ResponseWriter, r *http.Request) {
+
+	var req org.CreateOrgRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	// Populate the UserID field of req using the authenticated userID
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+	req.AdminUserID = u.ID
+
+	o, err := org.CreateOrg(r.Context(), req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusCreated, o)
+}
+
+// HandleGetOrgs (GET) returns the organizations that the authenticated user is a member of
+func HandleGetOrgs(w http.ResponseWriter, r *http.Request) {
+
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+
+	orgs, err := org.GetOrgsByUser(r.Context(), u.ID)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, orgs)
+}
+
+// HandleGetOrgInvitations (GET) returns the organizations that the authenticated user has been invited to, and hasn't
+// accepted yet
+func HandleGetOrgInvitations(w http.ResponseWriter, r *http.Request) {
+
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+
+	orgs, err := org.GetInvitationsByUser(r.Context(), u.ID)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, orgs)
+}
+
+// HandleAcceptOrgInvitation (POST) makes the authenticated user a member of the organization that they have been
+// invited to
+func HandleAcceptOrgInvitation(w http.ResponseWriter, r *http.Request) {
+
+	var req org.AcceptInvitationRequest
+	var err error
+	req.OrgID, err = getIDFromRequest(r, "org_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+	req.UserID = u.ID
+
+	ou, err := org.AcceptInvitation(r.Context(), req)
+	if err != nil {
+		writeOrgError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, ou)
+}
+
+// HandleUpdateOrgSettings (PATCH) updates the org-wide settings of an organization
+func HandleUpdateOrgSettings(w http.ResponseWriter, r *http.Request) {
+
+	var req org.UpdateSettingsRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	req.OrgID, err = getIDFromRequest(r, "org_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+	req.UserID = u.ID
+
+	o, err := org.UpdateSettings(r.Context(), req)
+	if err != nil {
+		writeOrgError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, o)
+}
+
+// HandleAddOrgMember (POST) invites a user, by email, to an organization
+func HandleAddOrgMember(w http.ResponseWriter, r *http.Request) {
+
+	var req org.AddMemberRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	req.OrgID, err = getIDFromRequest(r, "org_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+	req.UserID = u.ID
+
+	ou, err := org.AddMember(r.Context(), req)
+	if err != nil {
+		writeOrgError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusCreated, ou)
+}
+
+// HandleCreateTeam (POST) creates a new team in an organization
+func HandleCreateTeam(w http.ResponseWriter, r *http.Request) {
+
+	var req org.CreateTeamRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	req.OrgID, err = getIDFromRequest(r, "org_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+	req.UserID = u.ID
+
+	t, err := org.CreateTeam(r.Context(), req)
+	if err != nil {
+		writeOrgError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusCreated, t)
+}
+
+// HandleAddTeamMember (POST) adds a member of the organization to a team
+func HandleAddTeamMember(w http.ResponseWriter, r *http.Request) {
+
+	var req org.TeamMemberRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	req.OrgID, err = getIDFromRequest(r, "org_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	req.TeamID, err = getIDFromRequest(r, "team_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+	req.UserID = u.ID
+
+	tm, err := org.AddTeamMember(r.Context(), req)
+	if err != nil {
+		writeOrgError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusCreated, tm)
+}
+
+// HandleRemoveTeamMember (DELETE) removes a user from a team
+func HandleRemoveTeamMember(w http.ResponseWriter, r *http.Request) {
+
+	var req org.TeamMemberRequest
+	var err error
+
+	req.OrgID, err = getIDFromRequest(r, "org_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	req.TeamID, err = getIDFromRequest(r, "team_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	req.MemberUserID, err = getIDFromRequest(r, "user_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+	req.UserID = u.ID
+
+	err = org.RemoveTeamMember(r.Context(), req)
+	if err != nil {
+		writeOrgError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, nil)
+}
+
+// HandleAddVaultTeam (POST) adds an org team to a vault, making all of its members members of the vault
+func HandleAddVaultTeam(w http.ResponseWriter, r *http.Request) {
+
+	var req vault.AddTeamToVaultRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	req.VaultID, err = getVaultIDFromRequest(r)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+	req.UserID = u.ID
+
+	v, err := vault.AddTeamToVault(r.Context(), req)
+	if err != nil {
+		if err == org.ErrTeamNotFound {
+			api.WriteError(w, http.StatusNotFound, err, false, nil)
+			return
+		}
+		writeVaultError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, v)
+}
+
+// HandleRemoveVaultTeam (DELETE) removes an org team from a vault, along with the members who were only members of
+// the vault through it
+func HandleRemoveVaultTeam(w http.ResponseWriter, r *http.Request) {
+
+	var req vault.RemoveTeamFromVaultRequest
+	var err error
+
+	req.VaultID, err = getVaultIDFromRequest(r)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	req.TeamID, err = getIDFromRequest(r, "team_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+	req.UserID = u.ID
+
+	v, err := vault.RemoveTeamFromVault(r.Context(), req)
+	if err != nil {
+		writeVaultError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, v)
+}
+
+// HandleGetOrgVaultHealth (GET) returns the health reports of the vaults of an org, so its admins can review the
+// unhealthy ones in one place. Pass unhealthy=true to leave out the healthy vaults.
+func HandleGetOrgVaultHealth(w http.ResponseWriter, r *http.Request) {
+
+	var req vault.OrgHealthRequest
+	var err error
+
+	req.OrgID, err = getIDFromRequest(r, "org_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	if req.InactiveDays, err = api.GetQueryParamInt(r, "inactive_days", 0); err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	unhealthy, err := api.GetQueryParamStr(r, "unhealthy", "")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	if unhealthy != "" {
+		if req.UnhealthyOnly, err = strconv.ParseBool(unhealthy); err != nil {
+			api.WriteError(w, http.StatusBadRequest, fmt.Errorf("error parsing unhealthy value to a bool: %v", err), false, nil)
+			return
+		}
+	}
+
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+	req.UserID = u.ID
+
+	oh, err := vault.GetOrgHealth(r.Context(), req)
+	if err != nil {
+		writeOrgError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, oh)
+}
+
+// getIDFromRequest gets the id with the given name from the URL params
+func getIDFromRequest(r *http.Request, name string) (id.ID, error) {
+	idStr, err := api.GetMuxParamStr(r, name)
+	if err != nil {
+		return "", err
+	}
+	return id.StrToID(idStr)
+}
+
+// writeOrgError writes the error returned by the org service with the appropriate HTTP status code
+func writeOrgError(w http.ResponseWriter, err error) {
+	switch err {
+	case org.ErrForbidden:
+		api.WriteError(w, http.StatusForbidden, err, false, nil)
+	case org.ErrOrgNotFound, org.ErrTeamNotFound, org.ErrInvitationNotFound:
+		api.WriteError(w, http.StatusNotFound, err, false, nil)
+	default:
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+	}
+}
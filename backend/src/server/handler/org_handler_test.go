@@ -0,0 +1,266 @@
+package handler_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/teejays/n-factor-vault/backend/library/go-api/apitest"
+	"github.com/teejays/n-factor-vault/backend/library/id"
+	"github.com/teejays/n-factor-vault/backend/library/orm"
+
+	"github.com/teejays/n-factor-vault/backend/src/audit"
+	"github.com/teejays/n-factor-vault/backend/src/auth"
+	"github.com/teejays/n-factor-vault/backend/src/org"
+	"github.com/teejays/n-factor-vault/backend/src/server/handler"
+	"github.com/teejays/n-factor-vault/backend/src/user"
+	"github.com/teejays/n-factor-vault/backend/src/vault"
+)
+
+func TestHandleCreateOrg(t *testing.T) {
+
+	// Make sure that we empty any table that these tests might populate once the test is over
+	var relevantOrmTables = []orm.Entity{&user.User{}, &user.Password{}, &org.Organization{}, &org.OrgUser{}}
+	orm.EmptyTestTables(t, relevantOrmTables...)
+	defer orm.EmptyTestTables(t, relevantOrmTables...)
+
+	// Setup Test
+	helperCreateTestUsersT(t)
+	token, _ := helperLoginTestUsersT(t)
+	var getAuthTokenFunc = func(t *testing.T) string { return token }
+
+	// Define the Test Suite
+	ts := apitest.TestSuite{
+		Route:                 "/v1/org",
+		Method:                http.MethodPost,
+		HandlerFunc:           handler.HandleCreateOrg,
+		AuthBearerTokenFunc:   getAuthTokenFunc,
+		AuthMiddlewareHandler: auth.AuthenticateRequestMiddleware,
+		AfterTestFunc:         func(t *testing.T) { orm.EmptyTestTables(t, &org.Organization{}, &org.OrgUser{}) },
+	}
+
+	tests := []apitest.HandlerTest{
+		{
+			Name:           "status OK if request has valid content",
+			Content:        `{"name":"Acme", "settings":{"min_k":2, "allowed_email_domains":["email.com"]}}`,
+			WantStatusCode: http.StatusCreated,
+			AssertContentFields: map[string]apitest.AssertFunc{
+				"id":    apitest.AssertNotEmptyFunc,
+				"name":  apitest.AssertIsEqual("Acme"),
+				"min_k": apitest.AssertIsEqual(float64(2)),
+			},
+		},
+		{
+			Name:           "status Unauthorized if request has no auth token",
+			Content:        `{"name":"Acme"}`,
+			SkipAuthToken:  true,
+			WantStatusCode: http.StatusUnauthorized,
+		},
+		{
+			Name:           "status BadRequest if name is empty",
+			Content:        `{"name":""}`,
+			WantStatusCode: http.StatusBadRequest,
+			WantErrMessage: "name is empty",
+		},
+		{
+			Name:           "status BadRequest if the admin's email domain is not allowed",
+			Content:        `{"name":"Acme", "settings":{"allowed_email_domains":["acme.com"]}}`,
+			WantStatusCode: http.StatusBadRequest,
+			WantErrMessage: "email domain of the admin is not in the allowed email domains",
+		},
+	}
+
+	ts.RunHandlerTests(t, tests)
+}
+
+func TestHandleRemoveVaultTeam(t *testing.T) {
+
+	var relevantOrmTables = []orm.Entity{&user.User{}, &user.Password{}, &org.Organization{}, &org.OrgUser{}, &org.Team{}, &org.TeamMember{},
+		&vault.Vault{}, &vault.VaultUser{}, &vault.ShamirsVault{}, &vault.VaultTeam{}, &audit.Event{}}
+	orm.EmptyTestTables(t, relevantOrmTables...)
+	defer orm.EmptyTestTables(t, relevantOrmTables...)
+
+	// Setup Test: Jon's org has Jane, Arya and Bran as members, and a team with Bran in it. Jon's vault of the org
+	// requires 2 approvals, and has Jane and Arya as direct members, and Bran through the team.
+	helperCreateTestUsersT(t)
+	token, janeToken := helperLoginTestUsersT(t)
+	jon, err := user.GetUserByEmail("jon.doe@email.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	o, err := org.CreateOrg(ctx, org.CreateOrgRequest{AdminUserID: jon.ID, Name: "Winterfell"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var users = make(map[string]*user.User)
+	for _, name := range []string{"arya", "bran"} {
+		users[name], err = user.CreateUser(user.CreateUserRequest{Name: name, Email: name + ".stark@email.com", Password: name + "s_secret"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, email := range []string{"jane.does@email.com", "arya.stark@email.com", "bran.stark@email.com"} {
+		ou, err := org.AddMember(ctx, org.AddMemberRequest{OrgID: o.ID, UserID: jon.ID, Email: email})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := org.AcceptInvitation(ctx, org.AcceptInvitationRequest{OrgID: o.ID, UserID: ou.UserID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	team, err := org.CreateTeam(ctx, org.CreateTeamRequest{OrgID: o.ID, UserID: jon.ID, Name: "Wolves"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = org.AddTeamMember(ctx, org.TeamMemberRequest{OrgID: o.ID, TeamID: team.ID, UserID: jon.ID, MemberUserID: users["bran"].ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := vault.CreateAndInitializeVault(ctx, vault.CreateAndInitializeVaultRequest{
+		CreateVaultRequest:              vault.CreateVaultRequest{AdminUserID: jon.ID, OrgID: &o.ID, Name: "Facebook", Description: "Shared account"},
+		CreateShamirVaultRequest:        vault.CreateShamirVaultRequest{K: 2},
+		AddMemberByEmailsToVaultRequest: vault.AddMemberByEmailsToVaultRequest{MemberEmails: []string{"jane.does@email.com", "arya.stark@email.com"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTeam := func(t *testing.T) {
+		_, err := vault.AddTeamToVault(ctx, vault.AddTeamToVaultRequest{VaultID: v.ID, UserID: jon.ID, TeamID: team.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	addTeam(t)
+
+	ts := apitest.TestSuite{
+		Route:                 "/v1/vault/" + string(v.ID) + "/team/" + string(team.ID),
+		Method:                http.MethodDelete,
+		Handler:               helperMuxHandler("/v1/vault/{vault_id}/team/{team_id}", http.MethodDelete, handler.HandleRemoveVaultTeam),
+		AuthBearerTokenFunc:   func(t *testing.T) string { return token },
+		AuthMiddlewareHandler: auth.AuthenticateRequestMiddleware,
+	}
+	tests := []apitest.HandlerTest{
+		{
+			Name:                "status Forbidden if the user is not an owner of the vault",
+			AuthBearerTokenFunc: func(t *testing.T) string { return janeToken },
+			WantStatusCode:      http.StatusForbidden,
+			WantErrMessage:      vault.ErrForbidden.Error(),
+		},
+		{
+			Name:           "status OK if the team is a part of the vault, and the members of the team are removed",
+			WantStatusCode: http.StatusOK,
+			AssertContentFields: map[string]apitest.AssertFunc{
+				"vault_users": func(t *testing.T, v interface{}) { assert.Len(t, v, 3) },
+			},
+		},
+		{
+			Name:           "status NotFound if the team is not a part of the vault",
+			WantStatusCode: http.StatusNotFound,
+			WantErrMessage: vault.ErrTeamNotInVault.Error(),
+		},
+		{
+			// With K raised to 4, the vault can't do without the member of the team
+			Name: "status Conflict if the vault would have fewer members than K",
+			BeforeRunFunc: func(t *testing.T) {
+				addTeam(t)
+				err := orm.UpdateColumnsByConditions(map[string]interface{}{"vault_id": v.ID}, map[string]interface{}{"k": 4}, &vault.ShamirsVault{})
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			WantStatusCode: http.StatusConflict,
+			WantErrMessage: vault.ErrTooFewMembers.Error(),
+		},
+	}
+	ts.RunHandlerTests(t, tests)
+
+	// The team that couldn't be removed is still a part of the vault
+	var vts []vault.VaultTeam
+	_, err = orm.FindByColumn("vault_id", v.ID, &vts)
+	if assert.NoError(t, err) {
+		assert.Len(t, vts, 1)
+	}
+}
+
+func TestHandleAcceptOrgInvitation(t *testing.T) {
+
+	var relevantOrmTables = []orm.Entity{&user.User{}, &user.Password{}, &auth.Session{}, &auth.RefreshToken{}, &org.Organization{}, &org.OrgUser{},
+		&org.Team{}, &org.TeamMember{}, &audit.Event{}}
+	orm.EmptyTestTables(t, relevantOrmTables...)
+	defer orm.EmptyTestTables(t, relevantOrmTables...)
+
+	// Setup Test: Jon's org only allows single sign-on, and he invites Jane to it
+	helperCreateTestUsersT(t)
+	token, janeToken := helperLoginTestUsersT(t)
+	orgID := helperCreateGetID(t, "/v1/org", "/v1/org", http.MethodPost, handler.HandleCreateOrg, token, `{"name":"Acme", "settings":{"password_login_disabled":true}}`)
+	teamID := helperCreateGetID(t, "/v1/org/"+orgID+"/team", "/v1/org/{org_id}/team", http.MethodPost, handler.HandleCreateTeam, token, `{"name":"Engineering"}`)
+	helperCreateGetID(t, "/v1/org/"+orgID+"/user", "/v1/org/{org_id}/user", http.MethodPost, handler.HandleAddOrgMember, token, `{"email":"jane.does@email.com"}`)
+	jane, err := user.GetUserByEmail("jane.does@email.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Until Jane accepts, the org has no say over her: she can still log in with her password, and isn't a member of it
+	_, err = helperLoginUser("Jane")
+	assert.NoError(t, err)
+	ctx := context.Background()
+	orgs, err := org.GetOrgsByUser(ctx, jane.ID)
+	if assert.NoError(t, err) {
+		assert.Empty(t, orgs)
+	}
+	invitations, err := org.GetInvitationsByUser(ctx, jane.ID)
+	if assert.NoError(t, err) && assert.Len(t, invitations, 1) {
+		assert.Equal(t, orgID, string(invitations[0].ID))
+	}
+	jon, err := user.GetUserByEmail("jon.doe@email.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = org.AddTeamMember(ctx, org.TeamMemberRequest{OrgID: id.ID(orgID), TeamID: id.ID(teamID), UserID: jon.ID, MemberUserID: jane.ID})
+	assert.Error(t, err)
+
+	ts := apitest.TestSuite{
+		Route:                 "/v1/org/" + orgID + "/accept",
+		Method:                http.MethodPost,
+		Handler:               helperMuxHandler("/v1/org/{org_id}/accept", http.MethodPost, handler.HandleAcceptOrgInvitation),
+		AuthBearerTokenFunc:   func(t *testing.T) string { return janeToken },
+		AuthMiddlewareHandler: auth.AuthenticateRequestMiddleware,
+	}
+	tests := []apitest.HandlerTest{
+		{
+			Name:                "status NotFound if the user hasn't been invited",
+			AuthBearerTokenFunc: func(t *testing.T) string { return token },
+			WantStatusCode:      http.StatusNotFound,
+			WantErrMessage:      org.ErrInvitationNotFound.Error(),
+		},
+		{
+			Name:           "status OK if the user has been invited",
+			WantStatusCode: http.StatusOK,
+			AssertContentFields: map[string]apitest.AssertFunc{
+				"accepted": apitest.AssertIsEqual(true),
+			},
+		},
+		{
+			Name:           "status NotFound if the invitation has been accepted already",
+			WantStatusCode: http.StatusNotFound,
+			WantErrMessage: org.ErrInvitationNotFound.Error(),
+		},
+	}
+	ts.RunHandlerTests(t, tests)
+
+	// Now that Jane is a member, the org's settings apply to her
+	orgs, err = org.GetOrgsByUser(ctx, jane.ID)
+	if assert.NoError(t, err) {
+		assert.Len(t, orgs, 1)
+	}
+	p := apitest.HandlerReqParams{
+		Route:       "/v1/login",
+		Method:      http.MethodPost,
+		HandlerFunc: handler.HandleLogin,
+	}
+	_, _, err = p.MakeHandlerRequest(mockUsers["Jane"], []int{http.StatusForbidden})
+	assert.NoError(t, err)
+}
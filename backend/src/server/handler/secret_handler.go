@@ -8,6 +8,7 @@ import (
 
 	"github.com/teejays/n-factor-vault/backend/src/auth"
 	"github.com/teejays/n-factor-vault/backend/src/secret"
+	"github.com/teejays/n-factor-vault/backend/src/vault"
 )
 
 // HandleRequestSecret handles request to reveal a secret
@@ -33,11 +34,12 @@ func HandleRequestSecret(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	req.UserID = u.ID
+	req.ClientIP = api.GetClientIP(r)
 
 	// Send the secret request and get the status
 	s, err := secret.Request(r.Context(), req)
 	if err != nil {
-		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		writeSecretError(w, http.StatusBadRequest, err, false)
 		return
 	}
 
@@ -72,11 +74,12 @@ func HandleUpdateSecretStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	req.UserID = u.ID
+	req.ClientIP = api.GetClientIP(r)
 
 	// Update the secret status
 	s, err := secret.UpdateStatus(r.Context(), req)
 	if err != nil {
-		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		writeSecretError(w, http.StatusBadRequest, err, false)
 		return
 	}
 
@@ -105,7 +108,7 @@ func HandleGetSecretStatus(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get status
-	vaults, err := secret.GetStatus(r.Context(), secret.GetParams{secretRequestID, u.ID})
+	vaults, err := secret.GetStatus(r.Context(), secret.GetParams{SecretRequestID: secretRequestID, UserID: u.ID})
 	if err != nil {
 		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
 		return
@@ -135,10 +138,22 @@ func HandleGetSecret(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get status
-	vaults, err := secret.Get(r.Context(), secret.GetParams{secretRequestID, u.ID})
+	vaults, err := secret.Get(r.Context(), secret.GetParams{SecretRequestID: secretRequestID, UserID: u.ID, ClientIP: api.GetClientIP(r)})
 	if err != nil {
-		api.WriteError(w, http.StatusInternalServerError, err, false, nil)
+		writeSecretError(w, http.StatusInternalServerError, err, false)
 		return
 	}
 	api.WriteResponse(w, http.StatusOK, vaults)
 }
+
+// writeSecretError writes err with the given status code, unless it's a known error about access to the secret
+func writeSecretError(w http.ResponseWriter, code int, err error, hide bool) {
+	switch err {
+	case vault.ErrIPNotAllowed, vault.ErrOutsideTimeWindow, secret.ErrNotRequester, secret.ErrNotApproved, secret.ErrApprovalExpired, auth.ErrStepUpRequired, auth.ErrAPIKeyVault:
+		api.WriteError(w, http.StatusForbidden, err, false, nil)
+	case secret.ErrRequestNotFound, vault.ErrVaultNotFound:
+		api.WriteError(w, http.StatusNotFound, err, false, nil)
+	default:
+		api.WriteError(w, code, err, hide, nil)
+	}
+}
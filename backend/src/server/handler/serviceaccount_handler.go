@@ -0,0 +1,199 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/teejays/n-factor-vault/backend/library/go-api"
+	"github.com/teejays/n-factor-vault/backend/library/id"
+
+	"github.com/teejays/n-factor-vault/backend/src/auth"
+	"github.com/teejays/n-factor-vault/backend/src/org"
+	"github.com/teejays/n-factor-vault/backend/src/vault"
+)
+
+// HandleCreateServiceAccount (POST) creates a service account, owned by a vault or an organization
+func HandleCreateServiceAccount(w http.ResponseWriter, r *http.Request) {
+
+	var req auth.CreateServiceAccountRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	req.ClientIP = api.GetClientIP(r)
+
+	sa, err := auth.CreateServiceAccount(r.Context(), req)
+	if err != nil {
+		writeServiceAccountError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusCreated, sa)
+
+}
+
+// HandleGetServiceAccounts (GET) returns the service accounts of the vault_id, or of the org_id, in the query params
+func HandleGetServiceAccounts(w http.ResponseWriter, r *http.Request) {
+
+	var req auth.GetServiceAccountsRequest
+	for name, v := range map[string]*id.ID{"vault_id": &req.VaultID, "org_id": &req.OrgID} {
+		s, err := api.GetQueryParamStr(r, name, "")
+		if err != nil {
+			api.WriteError(w, http.StatusBadRequest, err, false, nil)
+			return
+		}
+		if s == "" {
+			continue
+		}
+		*v, err = id.StrToID(s)
+		if err != nil {
+			api.WriteError(w, http.StatusBadRequest, err, false, nil)
+			return
+		}
+	}
+
+	sas, err := auth.GetServiceAccounts(r.Context(), req)
+	if err != nil {
+		writeServiceAccountError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, sas)
+
+}
+
+// HandleDisableServiceAccount (DELETE) disables a service account, and revokes all its API keys
+func HandleDisableServiceAccount(w http.ResponseWriter, r *http.Request) {
+
+	serviceAccountID, err := getIDFromRequest(r, "service_account_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	err = auth.DisableServiceAccount(r.Context(), serviceAccountID, api.GetClientIP(r))
+	if err != nil {
+		writeServiceAccountError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, nil)
+
+}
+
+// HandleCreateAPIKey (POST) creates an API key for a service account. The key is only returned in this response.
+func HandleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+
+	var req auth.CreateAPIKeyRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	req.ServiceAccountID, err = getIDFromRequest(r, "service_account_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	req.ClientIP = api.GetClientIP(r)
+
+	k, err := auth.CreateAPIKey(r.Context(), req)
+	if err != nil {
+		writeServiceAccountError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusCreated, k)
+
+}
+
+// HandleGetAPIKeys (GET) returns the API keys of a service account
+func HandleGetAPIKeys(w http.ResponseWriter, r *http.Request) {
+
+	serviceAccountID, err := getIDFromRequest(r, "service_account_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	keys, err := auth.GetAPIKeys(r.Context(), serviceAccountID)
+	if err != nil {
+		writeServiceAccountError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, keys)
+
+}
+
+// HandleRotateAPIKey (POST) replaces an API key with a new one. The old key keeps working for the grace period.
+func HandleRotateAPIKey(w http.ResponseWriter, r *http.Request) {
+
+	var req auth.RotateAPIKeyRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	req.ServiceAccountID, err = getIDFromRequest(r, "service_account_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	req.APIKeyID, err = getIDFromRequest(r, "api_key_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	req.ClientIP = api.GetClientIP(r)
+
+	k, err := auth.RotateAPIKey(r.Context(), req)
+	if err != nil {
+		writeServiceAccountError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusCreated, k)
+
+}
+
+// HandleRevokeAPIKey (DELETE) revokes an API key of a service account
+func HandleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+
+	var req auth.APIKeyRequest
+	var err error
+	req.ServiceAccountID, err = getIDFromRequest(r, "service_account_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	req.APIKeyID, err = getIDFromRequest(r, "api_key_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	req.ClientIP = api.GetClientIP(r)
+
+	err = auth.RevokeAPIKey(r.Context(), req)
+	if err != nil {
+		writeServiceAccountError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, nil)
+
+}
+
+// writeServiceAccountError writes the error returned by the service accounts with the appropriate HTTP status code
+func writeServiceAccountError(w http.ResponseWriter, err error) {
+	switch err {
+	case vault.ErrForbidden, org.ErrForbidden:
+		api.WriteError(w, http.StatusForbidden, err, false, nil)
+	case auth.ErrServiceAccountNotFound, auth.ErrAPIKeyNotFound:
+		api.WriteError(w, http.StatusNotFound, err, false, nil)
+	case auth.ErrInvalidAPIKey:
+		api.WriteError(w, http.StatusConflict, err, false, nil)
+	default:
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+	}
+}
@@ -0,0 +1,175 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/teejays/n-factor-vault/backend/library/go-api"
+	"github.com/teejays/n-factor-vault/backend/library/go-api/apitest"
+	"github.com/teejays/n-factor-vault/backend/library/orm"
+
+	"github.com/teejays/n-factor-vault/backend/src/audit"
+	"github.com/teejays/n-factor-vault/backend/src/auth"
+	"github.com/teejays/n-factor-vault/backend/src/server/handler"
+	"github.com/teejays/n-factor-vault/backend/src/user"
+	"github.com/teejays/n-factor-vault/backend/src/vault"
+)
+
+var serviceAccountOrmTables = []orm.Entity{&user.User{}, &user.Password{}, &vault.Vault{}, &vault.VaultUser{}, &vault.ShamirsVault{},
+	&auth.ServiceAccount{}, &auth.APIKey{}, &audit.Event{}}
+
+func TestHandleCreateServiceAccount(t *testing.T) {
+
+	orm.EmptyTestTables(t, serviceAccountOrmTables...)
+	defer orm.EmptyTestTables(t, serviceAccountOrmTables...)
+
+	// Setup Test: Jon owns the vault
+	helperCreateTestUsersT(t)
+	token, token2 := helperLoginTestUsersT(t)
+	vaultID, err := helperCreateVaultGetID(token, "Facebook")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := apitest.TestSuite{
+		Route:                 "/v1/service_account",
+		Method:                http.MethodPost,
+		HandlerFunc:           handler.HandleCreateServiceAccount,
+		AuthBearerTokenFunc:   func(t *testing.T) string { return token },
+		AuthMiddlewareHandler: auth.AuthenticateRequestMiddleware,
+	}
+
+	tests := []apitest.HandlerTest{
+		{
+			Name:           "status Created if the vault's owner creates it",
+			Content:        `{"name":"CI", "vault_id":"` + vaultID + `"}`,
+			WantStatusCode: http.StatusCreated,
+			AssertContentFields: map[string]apitest.AssertFunc{
+				"id":       apitest.AssertNotEmptyFunc,
+				"user_id":  apitest.AssertNotEmptyFunc,
+				"name":     apitest.AssertIsEqual("CI"),
+				"vault_id": apitest.AssertIsEqual(vaultID),
+			},
+		},
+		{
+			Name:                "status Forbidden if the user doesn't own the vault",
+			Content:             `{"name":"CI", "vault_id":"` + vaultID + `"}`,
+			AuthBearerTokenFunc: func(t *testing.T) string { return token2 },
+			WantStatusCode:      http.StatusForbidden,
+			WantErrMessage:      vault.ErrForbidden.Error(),
+		},
+		{
+			Name:           "status BadRequest if there is no owner",
+			Content:        `{"name":"CI"}`,
+			WantStatusCode: http.StatusBadRequest,
+			WantErrMessage: "a service account should be owned by either a vault or an organization",
+		},
+	}
+
+	ts.RunHandlerTests(t, tests)
+}
+
+func TestHandleCreateAPIKey(t *testing.T) {
+
+	orm.EmptyTestTables(t, serviceAccountOrmTables...)
+	defer orm.EmptyTestTables(t, serviceAccountOrmTables...)
+
+	// Setup Test: a service account of Jon's vault
+	helperCreateTestUsersT(t)
+	token, _ := helperLoginTestUsersT(t)
+	vaultID, err := helperCreateVaultGetID(token, "Facebook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherVaultID, err := helperCreateVaultGetID(token, "Twitter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := apitest.HandlerReqParams{
+		Route:           "/v1/service_account",
+		Method:          http.MethodPost,
+		HandlerFunc:     handler.HandleCreateServiceAccount,
+		AuthBearerToken: token,
+		Middlewares:     []api.MiddlewareFunc{auth.AuthenticateRequestMiddleware},
+	}
+	_, body, err := p.MakeHandlerRequest(`{"name":"CI", "vault_id":"`+vaultID+`"}`, []int{http.StatusCreated})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sa auth.ServiceAccount
+	if err := json.Unmarshal(body, &sa); err != nil {
+		t.Fatal(err)
+	}
+
+	route := "/v1/service_account/" + string(sa.ID) + "/key"
+	ts := apitest.TestSuite{
+		Route:                 route,
+		Method:                http.MethodPost,
+		Handler:               helperMuxHandler("/v1/service_account/{service_account_id}/key", http.MethodPost, handler.HandleCreateAPIKey),
+		AuthBearerTokenFunc:   func(t *testing.T) string { return token },
+		AuthMiddlewareHandler: auth.AuthenticateRequestMiddleware,
+	}
+
+	tests := []apitest.HandlerTest{
+		{
+			Name:           "status Created with the key, scoped to the vault by default",
+			Content:        `{"name":"deploy", "scopes":["secret.request", "secret.reveal"]}`,
+			WantStatusCode: http.StatusCreated,
+			AssertContentFields: map[string]apitest.AssertFunc{
+				"key":       apitest.AssertNotEmptyFunc,
+				"hint":      apitest.AssertNotEmptyFunc,
+				"vault_ids": apitest.AssertIsEqual([]interface{}{vaultID}),
+				"scopes":    apitest.AssertIsEqual([]interface{}{"secret.request", "secret.reveal"}),
+			},
+		},
+		{
+			Name:           "status BadRequest if a scope is unknown",
+			Content:        `{"name":"deploy", "scopes":["vault.delete"]}`,
+			WantStatusCode: http.StatusBadRequest,
+		},
+		{
+			Name:           "status BadRequest if the key is scoped to another vault",
+			Content:        `{"name":"deploy", "scopes":["secret.request"], "vault_ids":["` + otherVaultID + `"]}`,
+			WantStatusCode: http.StatusBadRequest,
+			WantErrMessage: "api key of a vault's service account can only be scoped to that vault",
+		},
+	}
+
+	ts.RunHandlerTests(t, tests)
+
+	// The key authenticates the service account, but only on the routes of its scopes
+	p = apitest.HandlerReqParams{
+		Route:           route,
+		Method:          http.MethodPost,
+		Handler:         helperMuxHandler("/v1/service_account/{service_account_id}/key", http.MethodPost, handler.HandleCreateAPIKey),
+		AuthBearerToken: token,
+		Middlewares:     []api.MiddlewareFunc{auth.AuthenticateRequestMiddleware},
+	}
+	_, body, err = p.MakeHandlerRequest(`{"name":"ci", "scopes":["secret.request"]}`, []int{http.StatusCreated})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var k auth.NewAPIKey
+	if err := json.Unmarshal(body, &k); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, strings.HasPrefix(k.Key, "nfv_"))
+
+	p = apitest.HandlerReqParams{
+		Route:           "/v1/vault",
+		Method:          http.MethodPost,
+		HandlerFunc:     handler.HandleCreateVault,
+		AuthBearerToken: k.Key,
+		Middlewares:     []api.MiddlewareFunc{auth.AuthenticateRequestMiddleware},
+	}
+	_, _, err = p.MakeHandlerRequest(mockVaults["Facebook"], []int{http.StatusForbidden})
+	assert.NoError(t, err)
+
+	p.AuthBearerToken = "nfv_unknown"
+	_, _, err = p.MakeHandlerRequest(mockVaults["Facebook"], []int{http.StatusUnauthorized})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/teejays/n-factor-vault/backend/library/go-api"
+	"github.com/teejays/n-factor-vault/backend/library/id"
+
+	"github.com/teejays/n-factor-vault/backend/src/auth"
+)
+
+// HandleGetSessions (GET) returns the active sessions of the authenticated user
+func HandleGetSessions(w http.ResponseWriter, r *http.Request) {
+
+	sessions, err := auth.GetSessions(r.Context())
+	if err != nil {
+		writeSessionError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, sessions)
+
+}
+
+// HandleRevokeSession (DELETE) revokes a session of the authenticated user
+func HandleRevokeSession(w http.ResponseWriter, r *http.Request) {
+
+	sessionIDStr, err := api.GetMuxParamStr(r, "session_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	sessionID, err := id.StrToID(sessionIDStr)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	err = auth.RevokeSession(r.Context(), sessionID, api.GetClientIP(r))
+	if err != nil {
+		writeSessionError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, nil)
+
+}
+
+// HandleGetUserSessions (GET) returns the active sessions of any user. The authenticated user should be an admin.
+func HandleGetUserSessions(w http.ResponseWriter, r *http.Request) {
+
+	userIDStr, err := api.GetMuxParamStr(r, "user_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	userID, err := id.StrToID(userIDStr)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	sessions, err := auth.GetUserSessions(r.Context(), userID)
+	if err != nil {
+		writeSessionError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, sessions)
+
+}
+
+// HandleRevokeUserSession (DELETE) revokes a session of any user, e.g. one that has been compromised. The
+// authenticated user should be an admin.
+func HandleRevokeUserSession(w http.ResponseWriter, r *http.Request) {
+
+	userIDStr, err := api.GetMuxParamStr(r, "user_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	userID, err := id.StrToID(userIDStr)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	sessionIDStr, err := api.GetMuxParamStr(r, "session_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	sessionID, err := id.StrToID(sessionIDStr)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	err = auth.RevokeUserSession(r.Context(), userID, sessionID, api.GetClientIP(r))
+	if err != nil {
+		writeSessionError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, nil)
+
+}
+
+// writeSessionError writes the error returned by the sessions with the appropriate HTTP status code
+func writeSessionError(w http.ResponseWriter, err error) {
+	switch err {
+	case auth.ErrNotAdmin:
+		api.WriteError(w, http.StatusForbidden, err, false, nil)
+	case auth.ErrSessionNotFound:
+		api.WriteError(w, http.StatusNotFound, err, false, nil)
+	default:
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+	}
+}
@@ -0,0 +1,151 @@
+package handler_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/teejays/n-factor-vault/backend/library/go-api"
+	"github.com/teejays/n-factor-vault/backend/library/go-api/apitest"
+	"github.com/teejays/n-factor-vault/backend/library/orm"
+
+	"github.com/teejays/n-factor-vault/backend/src/audit"
+	"github.com/teejays/n-factor-vault/backend/src/auth"
+	"github.com/teejays/n-factor-vault/backend/src/server/handler"
+	"github.com/teejays/n-factor-vault/backend/src/user"
+)
+
+func TestHandleSessions(t *testing.T) {
+
+	var relevantModels = []orm.Entity{&user.User{}, &user.Password{}, &auth.Session{}, &auth.RefreshToken{}, &auth.RevokedToken{}, &audit.Event{}}
+	orm.EmptyTestTables(t, relevantModels...)
+	defer orm.EmptyTestTables(t, relevantModels...)
+
+	// Setup Test: Jon logs in on two devices, and Jane on one
+	helperCreateTestUsersT(t)
+	token, janeToken := helperLoginTestUsersT(t)
+	otherToken, err := helperLoginUser("Jon")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Jon sees both his sessions, and which one is the current one
+	sessions := helperGetSessions(t, token)
+	if !assert.Len(t, sessions, 2) {
+		return
+	}
+	var current, other auth.Session
+	for _, s := range sessions {
+		assert.False(t, s.LastSeenAt.IsZero())
+		assert.NotEmpty(t, s.Device)
+		if s.Current {
+			current = s
+		} else {
+			other = s
+		}
+	}
+	if !assert.False(t, current.ID.IsEmpty()) || !assert.False(t, other.ID.IsEmpty()) {
+		return
+	}
+
+	ts := apitest.TestSuite{
+		Route:                 "/v1/sessions/" + string(other.ID),
+		Method:                http.MethodDelete,
+		Handler:               helperMuxHandler("/v1/sessions/{session_id}", http.MethodDelete, handler.HandleRevokeSession),
+		AuthBearerTokenFunc:   func(t *testing.T) string { return token },
+		AuthMiddlewareHandler: auth.AuthenticateRequestMiddleware,
+	}
+	tests := []apitest.HandlerTest{
+		{
+			Name:                "status NotFound if the session is of another user",
+			AuthBearerTokenFunc: func(t *testing.T) string { return janeToken },
+			WantStatusCode:      http.StatusNotFound,
+			WantErrMessage:      auth.ErrSessionNotFound.Error(),
+		},
+		{
+			Name:           "status OK if the session is of the user",
+			WantStatusCode: http.StatusOK,
+		},
+		{
+			Name:           "status NotFound if the session has been revoked already",
+			WantStatusCode: http.StatusNotFound,
+			WantErrMessage: auth.ErrSessionNotFound.Error(),
+		},
+	}
+	ts.RunHandlerTests(t, tests)
+
+	// The token of the revoked session stops working, and the session isn't listed anymore
+	p := apitest.HandlerReqParams{
+		Route:           "/v1/sessions",
+		Method:          http.MethodGet,
+		HandlerFunc:     handler.HandleGetSessions,
+		AuthBearerToken: otherToken,
+		Middlewares:     []api.MiddlewareFunc{auth.AuthenticateRequestMiddleware},
+	}
+	_, _, err = p.MakeHandlerRequest("", []int{http.StatusUnauthorized})
+	assert.NoError(t, err)
+	sessions = helperGetSessions(t, token)
+	if assert.Len(t, sessions, 1) {
+		assert.Equal(t, current.ID, sessions[0].ID)
+	}
+
+	// Users who aren't admins of the instance can't see, or revoke, the sessions of others
+	jon, err := user.GetUserByEmail("jon.doe@email.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts = apitest.TestSuite{
+		Route:                 "/v1/admin/users/" + string(jon.ID) + "/sessions",
+		Method:                http.MethodGet,
+		Handler:               helperMuxHandler("/v1/admin/users/{user_id}/sessions", http.MethodGet, handler.HandleGetUserSessions),
+		AuthBearerTokenFunc:   func(t *testing.T) string { return janeToken },
+		AuthMiddlewareHandler: auth.AuthenticateRequestMiddleware,
+	}
+	tests = []apitest.HandlerTest{
+		{
+			Name:           "status Forbidden if the user isn't an admin",
+			WantStatusCode: http.StatusForbidden,
+			WantErrMessage: auth.ErrNotAdmin.Error(),
+		},
+	}
+	ts.RunHandlerTests(t, tests)
+
+	ts.Route, ts.Method = "/v1/admin/users/"+string(jon.ID)+"/sessions/"+string(current.ID), http.MethodDelete
+	ts.Handler = helperMuxHandler("/v1/admin/users/{user_id}/sessions/{session_id}", http.MethodDelete, handler.HandleRevokeUserSession)
+	ts.RunHandlerTests(t, tests)
+
+	// The revocation was recorded against Jon
+	events, err := audit.GetEventsByEntity(context.Background(), "user", jon.ID)
+	if assert.NoError(t, err) {
+		var revoked int
+		for _, e := range events {
+			if e.Action == auth.AuditActionSessionRevoked {
+				revoked++
+			}
+		}
+		assert.Equal(t, 1, revoked)
+	}
+}
+
+// helperGetSessions returns the sessions of the user of the token
+func helperGetSessions(t *testing.T, token string) []auth.Session {
+	p := apitest.HandlerReqParams{
+		Route:           "/v1/sessions",
+		Method:          http.MethodGet,
+		HandlerFunc:     handler.HandleGetSessions,
+		AuthBearerToken: token,
+		Middlewares:     []api.MiddlewareFunc{auth.AuthenticateRequestMiddleware},
+	}
+	_, body, err := p.MakeHandlerRequest("", []int{http.StatusOK})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sessions []auth.Session
+	if err := json.Unmarshal(body, &sessions); err != nil {
+		t.Fatal(err)
+	}
+	return sessions
+}
@@ -1,22 +1,40 @@
 package handler
 
 import (
+	"fmt"
+	"io"
 	"net/http"
 
 	"github.com/teejays/clog"
 
 	"github.com/teejays/n-factor-vault/backend/library/go-api"
 	"github.com/teejays/n-factor-vault/backend/library/id"
+	"github.com/teejays/n-factor-vault/backend/library/json"
 
+	"github.com/teejays/n-factor-vault/backend/src/auth"
 	"github.com/teejays/n-factor-vault/backend/src/totp"
+	"github.com/teejays/n-factor-vault/backend/src/vault"
 )
 
 type CreateAccountRequest struct {
-	Name       string
-	PrivateKey string
+	VaultID         id.ID
+	Name            string
+	PrivateKey      string
+	URI             string
+	Type            totp.AccountType
+	Counter         int64
+	Algorithm       totp.Algorithm
+	Digits          int
+	IntervalSeconds int64
+	StartUnixTime   int64
+	Protection      totp.Protection
 }
 
-// HandleCreateTOTPAccount creates a new vault for the authenticated user
+// HeaderPassphrase is the header in which the authenticated user sends their passphrase, which is needed to get the
+// codes of accounts that are protected by threshold combinations. A header keeps the passphrase out of the URL.
+const HeaderPassphrase = "X-Passphrase"
+
+// HandleCreateTOTPAccount creates a new TOTP account in a vault owned by the authenticated user
 func HandleCreateTOTPAccount(w http.ResponseWriter, r *http.Request) {
 
 	var body CreateAccountRequest
@@ -26,49 +44,457 @@ func HandleCreateTOTPAccount(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+
 	var req = totp.CreateAccountRequest{
-		Name:       body.Name,
-		PrivateKey: []byte(body.PrivateKey),
+		VaultID:         body.VaultID,
+		UserID:          u.ID,
+		Name:            body.Name,
+		PrivateKey:      []byte(body.PrivateKey),
+		URI:             body.URI,
+		Type:            body.Type,
+		Counter:         body.Counter,
+		Algorithm:       body.Algorithm,
+		Digits:          body.Digits,
+		IntervalSeconds: body.IntervalSeconds,
+		StartUnixTime:   body.StartUnixTime,
+		Protection:      body.Protection,
+	}
+
+	a, err := totp.CreateAccount(r.Context(), req)
+	if err != nil {
+		writeVaultError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusCreated, a.ID)
+
+}
+
+// gMaxQRCodeUploadBytes is the largest request that HandleCreateTOTPAccountFromQRCode accepts
+var gMaxQRCodeUploadBytes int64 = 6 << 20
+
+// HandleCreateTOTPAccountFromQRCode creates a new TOTP account from the QR code that a website shows when setting up
+// 2FA. It expects a multipart form with the vault_id, an optional name, and the PNG or JPEG image of the QR code.
+func HandleCreateTOTPAccountFromQRCode(w http.ResponseWriter, r *http.Request) {
+
+	r.Body = http.MaxBytesReader(w, r.Body, gMaxQRCodeUploadBytes)
+	err := r.ParseMultipartForm(gMaxQRCodeUploadBytes)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	vaultID, err := id.StrToID(r.FormValue("vault_id"))
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid vault_id: %v", err), false, nil)
+		return
+	}
+
+	f, _, err := r.FormFile("image")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, fmt.Errorf("image of the QR code is required: %v", err), false, nil)
+		return
 	}
+	defer f.Close()
 
-	// Attempt login and get the token
-	a, err := totp.CreateAccount(req)
+	uri, err := totp.DecodeQRCode(f)
 	if err != nil {
 		api.WriteError(w, http.StatusBadRequest, err, false, nil)
 		return
 	}
 
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+
+	var req = totp.CreateAccountRequest{
+		VaultID: vaultID,
+		UserID:  u.ID,
+		Name:    r.FormValue("name"),
+		URI:     uri,
+	}
+
+	a, err := totp.CreateAccount(r.Context(), req)
+	if err != nil {
+		writeVaultError(w, err)
+		return
+	}
+
 	api.WriteResponse(w, http.StatusCreated, a.ID)
 
 }
 
-// HandleTOTPGetCode (GET) returns the vaults that the authenticated user is a part of
+// HandleTOTPGetCode (GET) returns the current code of a TOTP account. The secret_request_id query param should be a
+// request to access the account's vault, made by the authenticated user and approved by their peers. For accounts that
+// are protected by threshold combinations, the user's passphrase should be sent in the X-Passphrase header.
 func HandleTOTPGetCode(w http.ResponseWriter, r *http.Request) {
 
-	var req totp.GetCodeRequest
+	req, err := getCodeRequestFromRequest(r)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
 
-	// TODO: Verify that the requesting user has access to this TOTP account
-	// AND the user has been approved by peers to access the code
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+	req.UserID = u.ID
 
-	// Get the ID of the TOTP account for which we need the code
-	accountID, err := api.GetMuxParamStr(r, "totp_account_id")
+	code, err := totp.GetCode(r.Context(), req)
+	if err != nil {
+		writeTOTPError(w, err)
+		return
+	}
+	clog.Debugf("%s: HandleGetCode(): returning code valid until %v", "HandleTOTPGetCode", code.ExpireAt)
+	api.WriteResponse(w, http.StatusOK, code)
+
+}
+
+// HandleStreamTOTPCodes (GET) streams the codes of a TOTP account as Server-Sent Events. At the start of every period
+// it pushes a "code" event with the current and the next code, until the reveal window of the approval closes, at
+// which point it pushes an "end" event. Like HandleTOTPGetCode, it needs the secret_request_id query param.
+func HandleStreamTOTPCodes(w http.ResponseWriter, r *http.Request) {
+
+	req, err := getCodeRequestFromRequest(r)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+	req.UserID = u.ID
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		api.WriteError(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported by the response writer"), true, nil)
+		return
+	}
+
+	// The headers are only written with the first update, so that errors before it, e.g. an unapproved request, are
+	// returned as usual
+	var started bool
+	send := func(c totp.CodeUpdate) error {
+		if !started {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("Connection", "keep-alive")
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+		err := writeEvent(w, "code", c)
+		if err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	err = totp.StreamCodes(r.Context(), req, send)
+	if !started {
+		if err != nil {
+			writeTOTPError(w, err)
+		}
+		return
+	}
+	if r.Context().Err() != nil {
+		// The client has gone away
+		return
+	}
+	if err != nil {
+		clog.Warnf("%s: streaming codes of totp account %v: %v", "HandleStreamTOTPCodes", req.AccountID, err)
+		msg := api.ErrMessageClean
+		switch err {
+		case vault.ErrForbidden, vault.ErrIPNotAllowed, vault.ErrOutsideTimeWindow, vault.ErrVaultNotFound, auth.ErrAPIKeyVault:
+			msg = err.Error()
+		}
+		writeEvent(w, "error", api.Error{Message: msg})
+	} else {
+		writeEvent(w, "end", nil)
+	}
+	flusher.Flush()
+
+}
+
+// HandleResyncTOTPAccount (POST) moves the counter of an HOTP account forward, to right after the consecutive codes in
+// the body. It requires the owner role on the account's vault.
+func HandleResyncTOTPAccount(w http.ResponseWriter, r *http.Request) {
+
+	var req totp.ResyncRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	req.AccountID, err = getIDFromRequest(r, "totp_account_id")
 	if err != nil {
 		api.WriteError(w, http.StatusBadRequest, err, false, nil)
 		return
 	}
-	req.AccountID, err = id.StrToID(accountID)
+
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+	req.UserID = u.ID
+
+	a, err := totp.ResyncAccount(r.Context(), req)
+	if err != nil {
+		writeTOTPError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, a.Counter)
+
+}
+
+// HandleGetTOTPAccountHistory (GET) returns who generated the codes of a TOTP account, when, and from where, along with
+// the alerts of the account e.g. attempts to get a code without an approval. Any member of the vault can see it.
+func HandleGetTOTPAccountHistory(w http.ResponseWriter, r *http.Request) {
+
+	var req totp.GetHistoryRequest
+	var err error
+
+	req.AccountID, err = getIDFromRequest(r, "totp_account_id")
 	if err != nil {
 		api.WriteError(w, http.StatusBadRequest, err, false, nil)
 		return
 	}
 
-	// Attempt login and get the token
-	code, err := totp.GetCode(req)
+	u, err := auth.GetUserFromContext(r.Context())
 	if err != nil {
 		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
 		return
 	}
-	clog.Debugf("%s: HandleGetCode(): returning:\n%+v", "HandleTOTPGetCode", code)
-	api.WriteResponse(w, http.StatusOK, code)
+	req.UserID = u.ID
+
+	h, err := totp.GetHistory(r.Context(), req)
+	if err != nil {
+		writeTOTPError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, h)
+
+}
+
+// HandleImportTOTPAccounts (POST) imports the accounts exported from Google Authenticator, as otpauth-migration URIs,
+// into a vault owned by the authenticated user. It returns the IDs of the new accounts.
+func HandleImportTOTPAccounts(w http.ResponseWriter, r *http.Request) {
 
+	var req totp.ImportMigrationRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	req.VaultID, err = getVaultIDFromRequest(r)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+	req.UserID = u.ID
+
+	accounts, err := totp.ImportMigration(r.Context(), req)
+	if err != nil {
+		writeVaultError(w, err)
+		return
+	}
+
+	var ids = make([]id.ID, len(accounts))
+	for i, a := range accounts {
+		ids[i] = a.ID
+	}
+	api.WriteResponse(w, http.StatusCreated, ids)
+
+}
+
+// HandleExportTOTPAccounts (GET) returns all the TOTP accounts of a vault, with their private keys, as
+// otpauth-migration URIs and as otpauth URIs. The secret_request_id query param should be a request to access the
+// vault, made by the authenticated user and approved by their peers. Accounts protected by threshold combinations are
+// only exported if the X-Passphrase header is set and enough shares have been contributed.
+func HandleExportTOTPAccounts(w http.ResponseWriter, r *http.Request) {
+
+	var req totp.ExportRequest
+	var err error
+
+	req.VaultID, err = getVaultIDFromRequest(r)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	secretRequestID, err := api.GetQueryParamStr(r, "secret_request_id", "")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	if secretRequestID == "" {
+		api.WriteError(w, http.StatusBadRequest, fmt.Errorf("secret_request_id is required"), false, nil)
+		return
+	}
+	req.SecretRequestID, err = id.StrToID(secretRequestID)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+	req.UserID = u.ID
+	req.ClientIP = api.GetClientIP(r)
+	req.Passphrase = r.Header.Get(HeaderPassphrase)
+
+	e, err := totp.ExportAccounts(r.Context(), req)
+	if err != nil {
+		writeTOTPError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, e)
+
+}
+
+// HandleSetTOTPMemberKey (POST) sets the passphrase from which the authenticated user's member key is derived. The
+// member key is needed to take part in the threshold combinations of TOTP accounts, and can only be set once.
+func HandleSetTOTPMemberKey(w http.ResponseWriter, r *http.Request) {
+
+	var req totp.SetMemberKeyRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+	req.UserID = u.ID
+
+	_, err = totp.SetMemberKey(r.Context(), req)
+	if err != nil {
+		writeTOTPError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusCreated, nil)
+
+}
+
+// HandleContributeTOTPShares (POST) lets the authenticated user, who has approved the secret request, unlock their shares
+// of the threshold combinations with their passphrase and pass them on to the requester. It returns the number of
+// shares contributed.
+func HandleContributeTOTPShares(w http.ResponseWriter, r *http.Request) {
+
+	var req totp.ContributeSharesRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	req.SecretRequestID, err = getIDFromRequest(r, "secret_request_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+	req.UserID = u.ID
+	req.ClientIP = api.GetClientIP(r)
+
+	n, err := totp.ContributeShares(r.Context(), req)
+	if err != nil {
+		writeTOTPError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, n)
+
+}
+
+// getCodeRequestFromRequest reads the TOTP account ID from the route, the secret_request_id from the query params and the
+// passphrase from the X-Passphrase header
+func getCodeRequestFromRequest(r *http.Request) (totp.GetCodeRequest, error) {
+	var req totp.GetCodeRequest
+	var err error
+
+	// Get the ID of the TOTP account for which we need the code
+	req.AccountID, err = getIDFromRequest(r, "totp_account_id")
+	if err != nil {
+		return req, err
+	}
+	secretRequestID, err := api.GetQueryParamStr(r, "secret_request_id", "")
+	if err != nil {
+		return req, err
+	}
+	if secretRequestID == "" {
+		return req, fmt.Errorf("secret_request_id is required")
+	}
+	req.SecretRequestID, err = id.StrToID(secretRequestID)
+	if err != nil {
+		return req, err
+	}
+	req.ClientIP = api.GetClientIP(r)
+	req.Passphrase = r.Header.Get(HeaderPassphrase)
+
+	return req, nil
+}
+
+// writeEvent writes a Server-Sent Event with the JSON encoded data
+func writeEvent(w io.Writer, event string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
+
+// writeTOTPError writes err with the status code that matches it
+func writeTOTPError(w http.ResponseWriter, err error) {
+	switch err {
+	case totp.ErrAccountNotFound:
+		api.WriteError(w, http.StatusNotFound, err, false, nil)
+	case totp.ErrWrongVault, vault.ErrForbidden:
+		api.WriteError(w, http.StatusForbidden, err, false, nil)
+	case totp.ErrWrongPassphrase, totp.ErrNotApprover, totp.ErrNotEnoughShares:
+		api.WriteError(w, http.StatusForbidden, err, false, nil)
+	case totp.ErrNotHOTP, totp.ErrResyncFailed, totp.ErrStreamNotSupported, totp.ErrMemberKeyNotFound, totp.ErrPassphraseRequired,
+		totp.ErrCombinationsNotSupported, totp.ErrTooManyCombinations:
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+	case totp.ErrMemberKeyExists:
+		api.WriteError(w, http.StatusConflict, err, false, nil)
+	default:
+		writeSecretError(w, http.StatusInternalServerError, err, true)
+	}
 }
@@ -8,6 +8,7 @@ import (
 	"github.com/teejays/n-factor-vault/backend/library/go-api"
 
 	"github.com/teejays/n-factor-vault/backend/src/auth"
+	"github.com/teejays/n-factor-vault/backend/src/totp"
 	"github.com/teejays/n-factor-vault/backend/src/user"
 )
 
@@ -32,6 +33,17 @@ func HandleSignup(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// HandleGetJWKS (GET) returns the public keys that our tokens can be verified with, as a JSON Web Key Set. It doesn't
+// need authentication, so other services can fetch it.
+func HandleGetJWKS(w http.ResponseWriter, r *http.Request) {
+	jwks, err := auth.GetJWKS()
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+	api.WriteResponse(w, http.StatusOK, jwks)
+}
+
 // HandleLogin handles the login API requests
 func HandleLogin(w http.ResponseWriter, r *http.Request) {
 
@@ -56,13 +68,182 @@ func HandleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	creds.ClientIP = api.GetClientIP(r)
+	creds.UserAgent = r.UserAgent()
+
 	// Attempt login and get the token
-	resp, err := auth.Login(creds)
+	resp, err := auth.Login(r.Context(), creds)
+	if err == auth.ErrPasswordLoginDisabled || err == auth.ErrLDAPIdentityNotLinked {
+		api.WriteError(w, http.StatusForbidden, err, false, nil)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, resp)
+
+}
+
+// HandleLinkLDAPIdentity (POST) links the entry of a directory login to the authenticated user, who proves that it is
+// theirs with its password
+func HandleLinkLDAPIdentity(w http.ResponseWriter, r *http.Request) {
+
+	var req auth.LinkLDAPIdentityRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+	req.UserID = u.ID
+	req.ClientIP = api.GetClientIP(r)
+
+	err = auth.LinkLDAPIdentity(r.Context(), req)
+	if err == auth.ErrLDAPNotConfigured {
+		api.WriteError(w, http.StatusNotFound, err, false, nil)
+		return
+	}
+	if err == auth.ErrLDAPIdentityLinked {
+		api.WriteError(w, http.StatusConflict, err, false, nil)
+		return
+	}
 	if err != nil {
 		api.WriteError(w, http.StatusBadRequest, err, false, nil)
 		return
 	}
 
+	api.WriteResponse(w, http.StatusOK, nil)
+
+}
+
+// HandleVerifyMFA (POST) completes a login of a user with a second factor, with the MFA token that the login returned
+// and a code from their authenticator app, or a recovery code
+func HandleVerifyMFA(w http.ResponseWriter, r *http.Request) {
+
+	var req auth.VerifyMFARequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	req.ClientIP = api.GetClientIP(r)
+	req.UserAgent = r.UserAgent()
+
+	resp, err := auth.VerifyMFA(r.Context(), req)
+	if err != nil {
+		writeMFAError(w, err)
+		return
+	}
+
 	api.WriteResponse(w, http.StatusOK, resp)
 
 }
+
+// HandleEnrollTOTP (POST) generates a TOTP key for the second factor of the authenticated user. It returns the key as
+// an otpauth URI and a QR code, for the authenticator app.
+func HandleEnrollTOTP(w http.ResponseWriter, r *http.Request) {
+
+	e, err := auth.EnrollTOTP(r.Context())
+	if err != nil {
+		writeMFAError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusCreated, e)
+
+}
+
+// HandleConfirmTOTP (POST) enables the second factor of the authenticated user, with a code from their authenticator
+// app. It returns the recovery codes.
+func HandleConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+
+	var req auth.ConfirmTOTPRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	req.ClientIP = api.GetClientIP(r)
+
+	codes, err := auth.ConfirmTOTP(r.Context(), req)
+	if err != nil {
+		writeMFAError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, map[string][]string{"recovery_codes": codes})
+
+}
+
+// HandleRefreshToken (POST) exchanges a refresh token for a new access token and refresh token. It doesn't need
+// authentication, since the access token has usually expired by then.
+func HandleRefreshToken(w http.ResponseWriter, r *http.Request) {
+
+	var req auth.RefreshRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	req.ClientIP = api.GetClientIP(r)
+
+	resp, err := auth.Refresh(r.Context(), req)
+	if err == auth.ErrInvalidRefreshToken {
+		api.WriteError(w, http.StatusUnauthorized, err, false, nil)
+		return
+	}
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, resp)
+
+}
+
+// HandleLogout (POST) revokes the session of the authenticated request, along with its access token
+func HandleLogout(w http.ResponseWriter, r *http.Request) {
+
+	err := auth.Logout(r.Context(), api.GetClientIP(r))
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, nil)
+
+}
+
+// HandleLogoutEverywhere (POST) revokes all the sessions of the authenticated user, and returns how many were revoked
+func HandleLogoutEverywhere(w http.ResponseWriter, r *http.Request) {
+
+	n, err := auth.LogoutEverywhere(r.Context(), api.GetClientIP(r))
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, map[string]int{"revoked_sessions": n})
+
+}
+
+// writeMFAError writes the HTTP error response for an error of the second factor
+func writeMFAError(w http.ResponseWriter, err error) {
+	switch err {
+	case auth.ErrInvalidMFAToken, auth.ErrInvalidMFACode, totp.ErrCodeReused:
+		api.WriteError(w, http.StatusUnauthorized, err, false, nil)
+	case auth.ErrMFANotEnrolled:
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+	case auth.ErrMFAAlreadyEnabled:
+		api.WriteError(w, http.StatusConflict, err, false, nil)
+	default:
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+	}
+}
@@ -1,12 +1,28 @@
 package handler_test
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
+
+	"github.com/teejays/n-factor-vault/backend/library/env"
+	"github.com/teejays/n-factor-vault/backend/library/go-api"
 	"github.com/teejays/n-factor-vault/backend/library/go-api/apitest"
 	"github.com/teejays/n-factor-vault/backend/library/orm"
 
+	"github.com/teejays/n-factor-vault/backend/src/audit"
+	"github.com/teejays/n-factor-vault/backend/src/auth"
 	"github.com/teejays/n-factor-vault/backend/src/server/handler"
 	"github.com/teejays/n-factor-vault/backend/src/user"
 )
@@ -148,7 +164,9 @@ func TestHandleLogin(t *testing.T) {
 			WantContent:    "",
 			WantErrMessage: "",
 			AssertContentFields: map[string]apitest.AssertFunc{
-				"jwt": apitest.AssertNotEmptyFunc,
+				"jwt":           apitest.AssertNotEmptyFunc,
+				"refresh_token": apitest.AssertNotEmptyFunc,
+				"expire_at":     apitest.AssertNotEmptyFunc,
 			},
 		},
 		{
@@ -158,7 +176,9 @@ func TestHandleLogin(t *testing.T) {
 			WantContent:    "",
 			WantErrMessage: "",
 			AssertContentFields: map[string]apitest.AssertFunc{
-				"jwt": apitest.AssertNotEmptyFunc,
+				"jwt":           apitest.AssertNotEmptyFunc,
+				"refresh_token": apitest.AssertNotEmptyFunc,
+				"expire_at":     apitest.AssertNotEmptyFunc,
 			},
 		},
 		{
@@ -223,3 +243,408 @@ func TestHandleLogin(t *testing.T) {
 	ts.RunHandlerTests(t, tests)
 
 }
+
+func TestHandleRefreshToken(t *testing.T) {
+
+	var relevantModels = []orm.Entity{&user.User{}, &user.Password{}, &auth.Session{}, &auth.RefreshToken{}}
+	defer orm.EmptyTestTables(t, relevantModels...)
+
+	helperCreateTestUsersT(t)
+	resp, err := auth.Login(context.Background(), auth.LoginCredentials{Email: "jon.doe@email.com", Password: "jons_secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := apitest.TestSuite{
+		Route:       "/v1/token/refresh",
+		Method:      http.MethodPost,
+		HandlerFunc: handler.HandleRefreshToken,
+	}
+
+	tests := []apitest.HandlerTest{
+		{
+			Name:           "status Unauthorized if the refresh token doesn't exist",
+			Content:        `{"refresh_token":"not a refresh token"}`,
+			WantStatusCode: http.StatusUnauthorized,
+			WantErrMessage: "refresh token is invalid or has expired",
+		},
+		{
+			Name:           "status OK if the refresh token is valid",
+			Content:        `{"refresh_token":"` + resp.RefreshToken + `"}`,
+			WantStatusCode: http.StatusOK,
+			AssertContentFields: map[string]apitest.AssertFunc{
+				"jwt":           apitest.AssertNotEmptyFunc,
+				"refresh_token": apitest.AssertNotEmptyFunc,
+			},
+		},
+		{
+			Name:           "status Unauthorized if the refresh token was already used",
+			Content:        `{"refresh_token":"` + resp.RefreshToken + `"}`,
+			WantStatusCode: http.StatusUnauthorized,
+			WantErrMessage: "refresh token is invalid or has expired",
+		},
+	}
+
+	ts.RunHandlerTests(t, tests)
+
+}
+
+func TestHandleLogout(t *testing.T) {
+
+	var relevantModels = []orm.Entity{&user.User{}, &user.Password{}, &auth.Session{}, &auth.RefreshToken{}, &auth.RevokedToken{}}
+	defer orm.EmptyTestTables(t, relevantModels...)
+
+	helperCreateTestUsersT(t)
+	token, _ := helperLoginTestUsersT(t)
+
+	ts := apitest.TestSuite{
+		Route:                 "/v1/logout",
+		Method:                http.MethodPost,
+		HandlerFunc:           handler.HandleLogout,
+		AuthBearerTokenFunc:   func(t *testing.T) string { return token },
+		AuthMiddlewareHandler: auth.AuthenticateRequestMiddleware,
+	}
+
+	tests := []apitest.HandlerTest{
+		{
+			Name:           "status OK if the request is authenticated",
+			WantStatusCode: http.StatusOK,
+		},
+		{
+			Name:           "status Unauthorized if the token was logged out",
+			WantStatusCode: http.StatusUnauthorized,
+			WantErrMessage: "token has been revoked",
+		},
+	}
+
+	ts.RunHandlerTests(t, tests)
+
+}
+
+// TestHandleLoginLDAP runs when a directory is configured, e.g. the OpenLDAP server of docker-compose, seeded with
+// ldap/seed.ldif
+func TestHandleLoginLDAP(t *testing.T) {
+	if _, err := env.GetEnvVar("LDAP_URL"); err != nil {
+		t.Skip("LDAP_URL is not set")
+	}
+
+	var relevantModels = []orm.Entity{&user.User{}, &user.Password{}, &auth.LDAPIdentity{}, &audit.Event{}}
+	defer orm.EmptyTestTables(t, relevantModels...)
+
+	ts := apitest.TestSuite{
+		Route:          "/v1/login",
+		Method:         http.MethodPost,
+		HandlerFunc:    handler.HandleLogin,
+		BeforeTestFunc: helperCreateTestUsersT,
+		AfterTestFunc:  func(t *testing.T) { orm.EmptyTestTables(t, relevantModels...) },
+	}
+
+	tests := []apitest.HandlerTest{
+		{
+			Name:           "status OK if the credentials are of a directory user",
+			Content:        `{"email":"arya.stark@example.org", "password":"aryas_secret"}`,
+			WantStatusCode: http.StatusOK,
+			AssertContentFields: map[string]apitest.AssertFunc{
+				"jwt": apitest.AssertNotEmptyFunc,
+			},
+		},
+		{
+			Name:           "status OK if the credentials are of a password user",
+			Content:        `{"email":"jon.doe@email.com", "password":"jons_secret"}`,
+			WantStatusCode: http.StatusOK,
+			AssertContentFields: map[string]apitest.AssertFunc{
+				"jwt": apitest.AssertNotEmptyFunc,
+			},
+		},
+		{
+			Name:           "status BadRequest if the password is wrong for a directory user",
+			Content:        `{"email":"arya.stark@example.org", "password":"wrong password"}`,
+			WantStatusCode: http.StatusBadRequest,
+			WantErrMessage: "login credentials are invalid",
+		},
+		{
+			Name:           "status BadRequest if the filter characters of the login are escaped",
+			Content:        `{"email":"*", "password":"aryas_secret"}`,
+			WantStatusCode: http.StatusBadRequest,
+			WantErrMessage: "login credentials are invalid",
+		},
+	}
+	ts.RunHandlerTests(t, tests)
+
+	// The directory user was created on their first login, without a password
+	u, err := user.GetUserByEmail("arya.stark@example.org")
+	if assert.NoError(t, err) {
+		assert.False(t, u.ID.IsEmpty())
+		assert.Equal(t, "Arya Stark", u.Name)
+	}
+}
+
+// TestHandleLinkLDAPIdentity runs when a directory is configured, like TestHandleLoginLDAP
+func TestHandleLinkLDAPIdentity(t *testing.T) {
+	if _, err := env.GetEnvVar("LDAP_URL"); err != nil {
+		t.Skip("LDAP_URL is not set")
+	}
+
+	var relevantModels = []orm.Entity{&user.User{}, &user.Password{}, &auth.Session{}, &auth.RefreshToken{}, &auth.LDAPIdentity{}, &audit.Event{}}
+	orm.EmptyTestTables(t, relevantModels...)
+	defer orm.EmptyTestTables(t, relevantModels...)
+
+	// Setup Test: Sansa has an account of her own, with the email of her directory entry
+	helperCreateTestUsersT(t)
+	if err := helperCreateUsers("Sansa"); err != nil {
+		t.Fatal(err)
+	}
+	jonToken, _ := helperLoginTestUsersT(t)
+	sansaToken, err := helperLoginUser("Sansa")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	login := apitest.TestSuite{
+		Route:       "/v1/login",
+		Method:      http.MethodPost,
+		HandlerFunc: handler.HandleLogin,
+	}
+	directoryLogin := `{"email":"sansa.stark@example.org", "password":"sansas_secret"}`
+
+	// The directory can't log in as Sansa by her email, since anyone who can edit an entry's mail could
+	login.RunHandlerTests(t, []apitest.HandlerTest{
+		{
+			Name:           "status Forbidden if the directory entry has the email of an unlinked account",
+			Content:        directoryLogin,
+			WantStatusCode: http.StatusForbidden,
+			WantErrMessage: auth.ErrLDAPIdentityNotLinked.Error(),
+		},
+	})
+
+	link := func(token string) apitest.TestSuite {
+		return apitest.TestSuite{
+			Route:                 "/v1/ldap/link",
+			Method:                http.MethodPost,
+			HandlerFunc:           handler.HandleLinkLDAPIdentity,
+			AuthBearerTokenFunc:   func(t *testing.T) string { return token },
+			AuthMiddlewareHandler: auth.AuthenticateRequestMiddleware,
+		}
+	}
+	ts := link(sansaToken)
+	ts.RunHandlerTests(t, []apitest.HandlerTest{
+		{
+			Name:           "status BadRequest if the directory password is wrong",
+			Content:        `{"email":"sansa.stark@example.org", "password":"wrong password"}`,
+			WantStatusCode: http.StatusBadRequest,
+			WantErrMessage: "login credentials are invalid",
+		},
+		{
+			Name:           "status OK if the user logs in to the directory",
+			Content:        directoryLogin,
+			WantStatusCode: http.StatusOK,
+		},
+	})
+	ts = link(jonToken)
+	ts.RunHandlerTests(t, []apitest.HandlerTest{
+		{
+			Name:           "status Conflict if the entry is linked to another user",
+			Content:        directoryLogin,
+			WantStatusCode: http.StatusConflict,
+			WantErrMessage: auth.ErrLDAPIdentityLinked.Error(),
+		},
+	})
+
+	// Once linked, the directory logs in as Sansa
+	login.RunHandlerTests(t, []apitest.HandlerTest{
+		{
+			Name:           "status OK if the directory entry is linked to the account",
+			Content:        directoryLogin,
+			WantStatusCode: http.StatusOK,
+			AssertContentFields: map[string]apitest.AssertFunc{
+				"jwt": apitest.AssertNotEmptyFunc,
+			},
+		},
+	})
+}
+
+func TestHandleVerifyMFA(t *testing.T) {
+
+	var relevantModels = []orm.Entity{&user.User{}, &user.Password{}, &auth.Session{}, &auth.RefreshToken{},
+		&auth.TOTPFactor{}, &auth.RecoveryCode{}, &auth.MFAChallenge{}, &audit.Event{}}
+	orm.EmptyTestTables(t, relevantModels...)
+	defer orm.EmptyTestTables(t, relevantModels...)
+
+	// Setup Test: Jon enables a second factor, confirming it with the code of the previous period
+	helperCreateTestUsersT(t)
+	token, _ := helperLoginTestUsersT(t)
+	secret, recoveryCodes := helperEnableMFA(t, token)
+
+	// Logging in with the password asks for a code, rather than starting a session
+	ts := apitest.TestSuite{
+		Route:       "/v1/login",
+		Method:      http.MethodPost,
+		HandlerFunc: handler.HandleLogin,
+	}
+	ts.RunHandlerTests(t, []apitest.HandlerTest{
+		{
+			Name:           "status OK with mfa_required if the user has a second factor",
+			Content:        mockUsers["Jon"],
+			WantStatusCode: http.StatusOK,
+			AssertContentFields: map[string]apitest.AssertFunc{
+				"mfa_required": apitest.AssertIsEqual(true),
+				"mfa_token":    apitest.AssertNotEmptyFunc,
+			},
+			AssertContentFuncs: []apitest.AssertFunc{
+				func(t *testing.T, v interface{}) { assert.NotContains(t, v, "jwt") },
+			},
+		},
+	})
+
+	ts = apitest.TestSuite{
+		Route:       "/v1/login/mfa",
+		Method:      http.MethodPost,
+		HandlerFunc: handler.HandleVerifyMFA,
+	}
+
+	// Every wrong code counts, and the challenge can't be used once they run out, not even with the right code
+	mfaToken := helperStartMFALogin(t)
+	var tests []apitest.HandlerTest
+	for i := 0; i < 5; i++ {
+		tests = append(tests, apitest.HandlerTest{
+			Name:           fmt.Sprintf("status Unauthorized if the code is wrong (attempt %d)", i+1),
+			Content:        fmt.Sprintf(`{"mfa_token":%q, "code":"abcdef"}`, mfaToken),
+			WantStatusCode: http.StatusUnauthorized,
+			WantErrMessage: auth.ErrInvalidMFACode.Error(),
+		})
+	}
+	tests = append(tests, apitest.HandlerTest{
+		Name:           "status Unauthorized if the challenge has run out of attempts",
+		Content:        fmt.Sprintf(`{"mfa_token":%q, "code":%q}`, mfaToken, helperTOTPCode(t, secret, time.Now())),
+		WantStatusCode: http.StatusUnauthorized,
+		WantErrMessage: auth.ErrInvalidMFAToken.Error(),
+	})
+	ts.RunHandlerTests(t, tests)
+
+	// A code logs in once, and can't be replayed for the same period, even with a new challenge
+	code := helperTOTPCode(t, secret, time.Now())
+	ts.RunHandlerTests(t, []apitest.HandlerTest{
+		{
+			Name:           "status OK if the code is right",
+			Content:        fmt.Sprintf(`{"mfa_token":%q, "code":%q}`, helperStartMFALogin(t), code),
+			WantStatusCode: http.StatusOK,
+			AssertContentFields: map[string]apitest.AssertFunc{
+				"jwt":           apitest.AssertNotEmptyFunc,
+				"refresh_token": apitest.AssertNotEmptyFunc,
+			},
+		},
+		{
+			Name:           "status Unauthorized if the code has already been used",
+			Content:        fmt.Sprintf(`{"mfa_token":%q, "code":%q}`, helperStartMFALogin(t), code),
+			WantStatusCode: http.StatusUnauthorized,
+			WantErrMessage: "code has already been used",
+		},
+	})
+
+	// A recovery code works exactly once, without regard to its case and dashes
+	recoveryCode := strings.ToUpper(strings.Replace(recoveryCodes[0], "-", "", -1))
+	ts.RunHandlerTests(t, []apitest.HandlerTest{
+		{
+			Name:           "status OK if the recovery code is unused",
+			Content:        fmt.Sprintf(`{"mfa_token":%q, "recovery_code":%q}`, helperStartMFALogin(t), recoveryCode),
+			WantStatusCode: http.StatusOK,
+			AssertContentFields: map[string]apitest.AssertFunc{
+				"jwt": apitest.AssertNotEmptyFunc,
+			},
+		},
+		{
+			Name:           "status Unauthorized if the recovery code has been used",
+			Content:        fmt.Sprintf(`{"mfa_token":%q, "recovery_code":%q}`, helperStartMFALogin(t), recoveryCodes[0]),
+			WantStatusCode: http.StatusUnauthorized,
+			WantErrMessage: auth.ErrInvalidMFACode.Error(),
+		},
+	})
+
+	// Two logins at once can't both use the same recovery code, even though they have a challenge each
+	mfaTokens := []string{helperStartMFALogin(t), helperStartMFALogin(t)}
+	errs := make([]error, len(mfaTokens))
+	var wg sync.WaitGroup
+	for i, mfaToken := range mfaTokens {
+		wg.Add(1)
+		go func(i int, mfaToken string) {
+			defer wg.Done()
+			_, errs[i] = auth.VerifyMFA(context.Background(), auth.VerifyMFARequest{MFAToken: mfaToken, RecoveryCode: recoveryCodes[1]})
+		}(i, mfaToken)
+	}
+	wg.Wait()
+	var succeeded int
+	for _, err := range errs {
+		if err == nil {
+			succeeded++
+		} else {
+			assert.Equal(t, auth.ErrInvalidMFACode, err)
+		}
+	}
+	assert.Equal(t, 1, succeeded)
+}
+
+// helperEnableMFA enrolls and confirms a TOTP second factor for the user of the token, and returns its secret and the
+// recovery codes. It is confirmed with the code of the previous period, so the current one can still be used.
+func helperEnableMFA(t *testing.T, token string) (string, []string) {
+	p := apitest.HandlerReqParams{
+		Route:           "/v1/mfa/totp",
+		Method:          http.MethodPost,
+		HandlerFunc:     handler.HandleEnrollTOTP,
+		AuthBearerToken: token,
+		Middlewares:     []api.MiddlewareFunc{auth.AuthenticateRequestMiddleware},
+	}
+	_, body, err := p.MakeHandlerRequest("", []int{http.StatusCreated})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e auth.TOTPEnrollment
+	if err := json.Unmarshal(body, &e); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Route, p.HandlerFunc = "/v1/mfa/totp/confirm", handler.HandleConfirmTOTP
+	code := helperTOTPCode(t, e.Secret, time.Now().Add(-30*time.Second))
+	_, body, err = p.MakeHandlerRequest(fmt.Sprintf(`{"code":%q}`, code), []int{http.StatusOK})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.RecoveryCodes) == 0 {
+		t.Fatal("no recovery codes were returned")
+	}
+	return e.Secret, resp.RecoveryCodes
+}
+
+// helperStartMFALogin logs Jon in with his password, and returns the token of the MFA challenge
+func helperStartMFALogin(t *testing.T) string {
+	resp, err := auth.Login(context.Background(), auth.LoginCredentials{Email: "jon.doe@email.com", Password: "jons_secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.MFARequired || resp.MFAToken == "" {
+		t.Fatal("login did not ask for a second factor")
+	}
+	return resp.MFAToken
+}
+
+// helperTOTPCode returns the code that an authenticator app shows at time now for the base32 secret (RFC 6238, with
+// SHA1, 6 digits and a 30 second period)
+func helperTOTPCode(t *testing.T, secret string, now time.Time) string {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(strings.ToUpper(secret), "="))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(now.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
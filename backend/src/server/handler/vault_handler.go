@@ -1,8 +1,11 @@
 package handler
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/teejays/clog"
 
@@ -46,25 +49,124 @@ func HandleCreateVault(w http.ResponseWriter, r *http.Request) {
 
 }
 
-// HandleGetVaults (GET) returns the vaults that the authenticated user is a part of
+// HandleGetVaults (GET) returns the vaults that the authenticated user is a part of. The vaults can be searched and
+// filtered using the URL query params: q (full-text search), tag (can be repeated), role, folder, pending (true/false),
+// sort, cursor and limit. If there are more vaults, the cursor for the next page is set in the X-Next-Cursor header.
 func HandleGetVaults(w http.ResponseWriter, r *http.Request) {
 
+	req, err := getListVaultsRequest(r)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
 	// Populate the UserID field of req using the authenticated userID
 	u, err := auth.GetUserFromContext(r.Context())
 	if err != nil {
 		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
 		return
 	}
+	req.UserID = u.ID
 
-	// Attempt login and get the token
-	vaults, err := vault.GetVaultsByUser(r.Context(), u.ID)
+	page, err := vault.ListVaults(r.Context(), req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	clog.Debugf("%s: HandleGetVaults(): returning:\n%+v", "Vault Handler", page)
+
+	if page.NextCursor != "" {
+		w.Header().Set(HeaderNextCursor, page.NextCursor)
+	}
+	api.WriteResponse(w, http.StatusOK, page.Vaults)
+
+}
+
+// HeaderNextCursor is the HTTP response header that holds the cursor for the next page of a paginated response
+const HeaderNextCursor = "X-Next-Cursor"
+
+// getListVaultsRequest populates the search params for listing vaults from the URL query
+func getListVaultsRequest(r *http.Request) (vault.ListVaultsRequest, error) {
+	var req vault.ListVaultsRequest
+	var err error
+
+	if req.Query, err = api.GetQueryParamStr(r, "q", ""); err != nil {
+		return req, err
+	}
+	if req.Tags, err = api.GetQueryParamStrs(r, "tag"); err != nil {
+		return req, err
+	}
+	role, err := api.GetQueryParamStr(r, "role", "")
+	if err != nil {
+		return req, err
+	}
+	req.Role = vault.Role(strings.ToUpper(role))
+	pending, err := api.GetQueryParamStr(r, "pending", "")
+	if err != nil {
+		return req, err
+	}
+	if pending != "" {
+		hasPending, err := strconv.ParseBool(pending)
+		if err != nil {
+			return req, fmt.Errorf("error parsing pending value to a bool: %v", err)
+		}
+		req.HasPendingRequests = &hasPending
+	}
+	folder, err := api.GetQueryParamStr(r, "folder", "")
+	if err != nil {
+		return req, err
+	}
+	if folder != "" {
+		folderID, err := id.StrToID(folder)
+		if err != nil {
+			return req, err
+		}
+		req.FolderID = &folderID
+	}
+	if req.Sort, err = api.GetQueryParamStr(r, "sort", ""); err != nil {
+		return req, err
+	}
+	if req.Cursor, err = api.GetQueryParamStr(r, "cursor", ""); err != nil {
+		return req, err
+	}
+	if req.Limit, err = api.GetQueryParamInt(r, "limit", 0); err != nil {
+		return req, err
+	}
+
+	return req, nil
+}
+
+// HandleSetVaultTags (PUT) replaces the tags of a vault owned by the authenticated user
+func HandleSetVaultTags(w http.ResponseWriter, r *http.Request) {
+
+	var req vault.SetTagsRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	req.VaultID, err = getVaultIDFromRequest(r)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	// Populate the UserID field of req using the authenticated userID
+	u, err := auth.GetUserFromContext(r.Context())
 	if err != nil {
 		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
 		return
 	}
-	clog.Debugf("%s: HandleGetVaults(): returning:\n%+v", "Vault Handler", vaults)
-	api.WriteResponse(w, http.StatusOK, vaults)
+	req.UserID = u.ID
+
+	v, err := vault.SetTags(r.Context(), req)
+	if err != nil {
+		writeVaultError(w, err)
+		return
+	}
 
+	api.WriteResponse(w, http.StatusOK, v)
 }
 
 // HandleAddVaultUser is the HTTP handler for adding a new user to a vault
@@ -98,13 +200,265 @@ func HandleAddVaultUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Populate the ActorUserID field of req using the authenticated userID
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+	req.ActorUserID = u.ID
+
 	// Call the vault package function to add user to the vault
 	v, err := vault.AddUserToVault(r.Context(), req)
+	if err != nil {
+		writeVaultError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, v)
+
+}
+
+// HandleUpdateVault (PATCH) updates the name and/or description of a vault owned by the authenticated user
+func HandleUpdateVault(w http.ResponseWriter, r *http.Request) {
+
+	var req vault.UpdateVaultRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	req.VaultID, err = getVaultIDFromRequest(r)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	// Populate the UserID field of req using the authenticated userID
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+	req.UserID = u.ID
+
+	v, err := vault.UpdateVault(r.Context(), req)
+	if err != nil {
+		writeVaultError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, v)
+}
+
+// HandleArchiveVault (POST) archives a vault owned by the authenticated user, making it read-only
+func HandleArchiveVault(w http.ResponseWriter, r *http.Request) {
+	handleVaultAction(w, r, vault.ArchiveVault)
+}
+
+// HandleRestoreVault (POST) restores an archived vault owned by the authenticated user
+func HandleRestoreVault(w http.ResponseWriter, r *http.Request) {
+	handleVaultAction(w, r, vault.RestoreVault)
+}
+
+// HandleDeleteVault (DELETE) schedules an archived vault owned by the authenticated user to be permanently purged
+func HandleDeleteVault(w http.ResponseWriter, r *http.Request) {
+	handleVaultAction(w, r, vault.DeleteVault)
+}
+
+// handleVaultAction handles the requests for vault actions that only need the vaultID (from the URL) and the
+// authenticated user
+func handleVaultAction(w http.ResponseWriter, r *http.Request, action func(context.Context, vault.VaultActionRequest) (*vault.Vault, error)) {
+
+	var req vault.VaultActionRequest
+	var err error
+
+	req.VaultID, err = getVaultIDFromRequest(r)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	// Populate the UserID field of req using the authenticated userID
+	u, err := auth.GetUserFromContext(r.Context())
 	if err != nil {
 		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
 		return
 	}
+	req.UserID = u.ID
+
+	v, err := action(r.Context(), req)
+	if err != nil {
+		writeVaultError(w, err)
+		return
+	}
 
 	api.WriteResponse(w, http.StatusOK, v)
+}
+
+// HandleCreateVaultTemplate (POST) creates a new vault template for the authenticated user
+func HandleCreateVaultTemplate(w http.ResponseWriter, r *http.Request) {
 
+	var req vault.CreateTemplateRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	// Populate the UserID field of req using the authenticated userID
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+	req.UserID = u.ID
+
+	t, err := vault.CreateTemplate(r.Context(), req)
+	if err != nil {
+		writeVaultError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusCreated, t)
+}
+
+// HandleGetVaultTemplates (GET) returns the vault templates that the authenticated user can use
+func HandleGetVaultTemplates(w http.ResponseWriter, r *http.Request) {
+
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+
+	ts, err := vault.GetTemplatesByUser(r.Context(), u.ID)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, ts)
+}
+
+// HandleCreateVaultFromTemplate (POST) creates and initializes a new vault, owned by the authenticated user, using
+// the template in the URL
+func HandleCreateVaultFromTemplate(w http.ResponseWriter, r *http.Request) {
+
+	var req vault.CreateAndInitializeVaultRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	templateID, err := getIDFromRequest(r, "template_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	req.TemplateID = &templateID
+
+	// Populate the UserID field of req using the authenticated userID
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+	req.AdminUserID = u.ID
+
+	v, err := vault.CreateAndInitializeVault(r.Context(), req)
+	if err != nil {
+		writeVaultError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusCreated, v)
+}
+
+// HandleCloneVault (POST) creates a new vault with the structure, but not the secrets, of a vault owned by the
+// authenticated user
+func HandleCloneVault(w http.ResponseWriter, r *http.Request) {
+
+	var req vault.CloneVaultRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	req.VaultID, err = getVaultIDFromRequest(r)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	// Populate the UserID field of req using the authenticated userID
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+	req.UserID = u.ID
+
+	v, err := vault.CloneVault(r.Context(), req)
+	if err != nil {
+		writeVaultError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusCreated, v)
+}
+
+// getVaultIDFromRequest gets the vaultID from the URL params
+func getVaultIDFromRequest(r *http.Request) (id.ID, error) {
+	return getIDFromRequest(r, "vault_id")
+}
+
+// HandleGetVaultHealth (GET) returns the health report of a vault. The inactive_days query param sets the number of
+// days after which a member who hasn't logged in is considered inactive.
+func HandleGetVaultHealth(w http.ResponseWriter, r *http.Request) {
+
+	var req vault.HealthRequest
+	var err error
+
+	req.VaultID, err = getVaultIDFromRequest(r)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	if req.InactiveDays, err = api.GetQueryParamInt(r, "inactive_days", 0); err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	u, err := auth.GetUserFromContext(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+	req.UserID = u.ID
+
+	h, err := vault.GetHealth(r.Context(), req)
+	if err != nil {
+		writeVaultError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, h)
+}
+
+// writeVaultError writes the error returned by the vault service with the appropriate HTTP status code
+func writeVaultError(w http.ResponseWriter, err error) {
+	switch err {
+	case vault.ErrForbidden, vault.ErrIPNotAllowed, vault.ErrOutsideTimeWindow:
+		api.WriteError(w, http.StatusForbidden, err, false, nil)
+	case vault.ErrVaultNotFound, vault.ErrTemplateNotFound, vault.ErrFolderNotFound, vault.ErrTeamNotInVault:
+		api.WriteError(w, http.StatusNotFound, err, false, nil)
+	case vault.ErrVaultArchived, vault.ErrTooFewMembers:
+		api.WriteError(w, http.StatusConflict, err, false, nil)
+	default:
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+	}
 }
@@ -1,15 +1,22 @@
 package handler_test
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/teejays/clog"
 
 	"github.com/teejays/n-factor-vault/backend/library/go-api/apitest"
+	"github.com/teejays/n-factor-vault/backend/library/id"
 	"github.com/teejays/n-factor-vault/backend/library/orm"
 
+	"github.com/teejays/n-factor-vault/backend/src/audit"
 	"github.com/teejays/n-factor-vault/backend/src/auth"
+	"github.com/teejays/n-factor-vault/backend/src/org"
+	"github.com/teejays/n-factor-vault/backend/src/secret"
 	"github.com/teejays/n-factor-vault/backend/src/server/handler"
 	"github.com/teejays/n-factor-vault/backend/src/user"
 	"github.com/teejays/n-factor-vault/backend/src/vault"
@@ -185,3 +192,375 @@ func TestHandleGetVaults(t *testing.T) {
 	ts.RunHandlerTests(t, tests)
 
 }
+
+func TestHandleArchiveVault(t *testing.T) {
+
+	// Make sure that we empty any table that these tests might populate once the test is over
+	var relevantOrmTables = []orm.Entity{&user.User{}, &user.Password{}, &vault.Vault{}, &vault.VaultUser{}, &audit.Event{}}
+	orm.EmptyTestTables(t, relevantOrmTables...)
+	defer orm.EmptyTestTables(t, relevantOrmTables...)
+
+	// Setup Test
+	// 1. Create some users
+	helperCreateTestUsersT(t)
+	// 2. Login the test users and get the JWT tokens
+	token1, token2 := helperLoginTestUsersT(t)
+	// 3. Create a test vault owned by the first user
+	vaultID, err := helperCreateVaultGetID(token1, "Facebook")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var getAuthTokenFunc = func(t *testing.T) string { return token1 }
+
+	// Define the Test Suite
+	ts := apitest.TestSuite{
+		Route:                 "/v1/vault/" + vaultID + "/archive",
+		Method:                http.MethodPost,
+		Handler:               helperMuxHandler("/v1/vault/{vault_id}/archive", http.MethodPost, handler.HandleArchiveVault),
+		AuthBearerTokenFunc:   getAuthTokenFunc,
+		AuthMiddlewareHandler: auth.AuthenticateRequestMiddleware,
+	}
+
+	tests := []apitest.HandlerTest{
+		{
+			Name:           "status Unauthorized if request has no auth token",
+			SkipAuthToken:  true,
+			WantStatusCode: http.StatusUnauthorized,
+		},
+		{
+			Name:                "status Forbidden if the user does not own the vault",
+			AuthBearerTokenFunc: func(t *testing.T) string { return token2 },
+			WantStatusCode:      http.StatusForbidden,
+			WantErrMessage:      vault.ErrForbidden.Error(),
+		},
+		{
+			Name:           "status OK if the owner archives the vault",
+			WantStatusCode: http.StatusOK,
+			AssertContentFields: map[string]apitest.AssertFunc{
+				"id":          apitest.AssertIsEqual(vaultID),
+				"archived_at": apitest.AssertNotEmptyFunc,
+			},
+		},
+		{
+			Name:           "status Conflict if the vault is already archived",
+			WantStatusCode: http.StatusConflict,
+			WantErrMessage: vault.ErrVaultArchived.Error(),
+		},
+	}
+
+	ts.RunHandlerTests(t, tests)
+
+}
+
+func TestHandleAddVaultUser(t *testing.T) {
+
+	// Make sure that we empty any table that these tests might populate once the test is over
+	var relevantOrmTables = []orm.Entity{&user.User{}, &user.Password{}, &vault.Vault{}, &vault.VaultUser{}, &vault.ShamirsVault{}, &audit.Event{}}
+	orm.EmptyTestTables(t, relevantOrmTables...)
+	defer orm.EmptyTestTables(t, relevantOrmTables...)
+
+	// Setup Test
+	// 1. Create some users, and the user of a service account
+	helperCreateTestUsersT(t)
+	jane, err := user.GetUserByEmail("jane.does@email.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var machine *user.User
+	err = orm.WithTx(context.Background(), func(tx *orm.Tx) error {
+		machine, err = user.CreateServiceAccountUserTx(context.Background(), tx, "CI")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2. Login the test users and get the JWT tokens
+	token1, token2 := helperLoginTestUsersT(t)
+	// 3. Create a test vault owned by the first user
+	vaultID, err := helperCreateVaultGetID(token1, "Facebook")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Define the Test Suite
+	ts := apitest.TestSuite{
+		Route:                 "/v1/vault/" + vaultID + "/user",
+		Method:                http.MethodPost,
+		Handler:               helperMuxHandler("/v1/vault/{vault_id}/user", http.MethodPost, handler.HandleAddVaultUser),
+		AuthBearerTokenFunc:   func(t *testing.T) string { return token1 },
+		AuthMiddlewareHandler: auth.AuthenticateRequestMiddleware,
+	}
+
+	tests := []apitest.HandlerTest{
+		{
+			Name:           "status Unauthorized if request has no auth token",
+			Content:        fmt.Sprintf(`{"user_id":"%s"}`, jane.ID),
+			SkipAuthToken:  true,
+			WantStatusCode: http.StatusUnauthorized,
+		},
+		{
+			Name:                "status Forbidden if the user does not own the vault",
+			Content:             fmt.Sprintf(`{"user_id":"%s"}`, jane.ID),
+			AuthBearerTokenFunc: func(t *testing.T) string { return token2 },
+			WantStatusCode:      http.StatusForbidden,
+			WantErrMessage:      vault.ErrForbidden.Error(),
+		},
+		{
+			Name:           "status BadRequest if the user is a service account",
+			Content:        fmt.Sprintf(`{"user_id":"%s"}`, machine.ID),
+			WantStatusCode: http.StatusBadRequest,
+			WantErrMessage: vault.ErrServiceAccountMember.Error(),
+		},
+		{
+			Name:           "status OK if the owner adds the user",
+			Content:        fmt.Sprintf(`{"user_id":"%s"}`, jane.ID),
+			WantStatusCode: http.StatusOK,
+			AssertContentFields: map[string]apitest.AssertFunc{
+				"id": apitest.AssertIsEqual(vaultID),
+			},
+		},
+	}
+
+	ts.RunHandlerTests(t, tests)
+
+}
+
+func TestHandleGetVaultsSearch(t *testing.T) {
+
+	// Make sure that we empty any table that these tests might populate once the test is over
+	var relevantOrmTables = []orm.Entity{&user.User{}, &user.Password{}, &vault.Vault{}, &vault.VaultUser{}, &vault.VaultTag{}}
+	orm.EmptyTestTables(t, relevantOrmTables...)
+	defer orm.EmptyTestTables(t, relevantOrmTables...)
+
+	// Setup Test
+	helperCreateTestUsersT(t)
+	token, _ := helperLoginTestUsersT(t)
+	helperCreateTestVaultsT(t, token)
+
+	var getAuthTokenFunc = func(t *testing.T) string { return token }
+
+	tests := []struct {
+		route string
+		test  apitest.HandlerTest
+	}{
+		{
+			route: "/v1/vaults?q=facebook",
+			test: apitest.HandlerTest{
+				Name:               "full-text search matches the vault name",
+				WantStatusCode:     http.StatusOK,
+				AssertContentFuncs: []apitest.AssertFunc{apitest.AssertSliceOfLen(1)},
+			},
+		},
+		{
+			route: "/v1/vaults?q=friends",
+			test: apitest.HandlerTest{
+				Name:               "full-text search matches the vault description",
+				WantStatusCode:     http.StatusOK,
+				AssertContentFuncs: []apitest.AssertFunc{apitest.AssertSliceOfLen(1)},
+			},
+		},
+		{
+			route: "/v1/vaults?role=owner&pending=false&sort=-created_at",
+			test: apitest.HandlerTest{
+				Name:               "filter by role and pending requests",
+				WantStatusCode:     http.StatusOK,
+				AssertContentFuncs: []apitest.AssertFunc{apitest.AssertSliceOfLen(2)},
+			},
+		},
+		{
+			route: "/v1/vaults?limit=1",
+			test: apitest.HandlerTest{
+				Name:               "limit the number of vaults",
+				WantStatusCode:     http.StatusOK,
+				AssertContentFuncs: []apitest.AssertFunc{apitest.AssertSliceOfLen(1)},
+			},
+		},
+		{
+			route: "/v1/vaults?tag=prod",
+			test: apitest.HandlerTest{
+				Name:               "no vaults if none have the tag",
+				WantStatusCode:     http.StatusOK,
+				AssertContentFuncs: []apitest.AssertFunc{apitest.AssertSliceOfLen(0)},
+			},
+		},
+		{
+			route: "/v1/vaults?sort=description",
+			test: apitest.HandlerTest{
+				Name:           "status BadRequest if sort field is not allowed",
+				WantStatusCode: http.StatusBadRequest,
+				WantErrMessage: "cannot sort by 'description'",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		ts := apitest.TestSuite{
+			Route:                 tt.route,
+			Method:                http.MethodGet,
+			HandlerFunc:           handler.HandleGetVaults,
+			AuthBearerTokenFunc:   getAuthTokenFunc,
+			AuthMiddlewareHandler: auth.AuthenticateRequestMiddleware,
+		}
+		ts.RunHandlerTests(t, []apitest.HandlerTest{tt.test})
+	}
+
+}
+
+func TestHandleCloneVault(t *testing.T) {
+
+	// Make sure that we empty any table that these tests might populate once the test is over
+	var relevantOrmTables = []orm.Entity{&user.User{}, &user.Password{}, &vault.Vault{}, &vault.VaultUser{}, &vault.VaultTag{}, &vault.VaultTeam{}, &vault.ShamirsVault{}, &audit.Event{}}
+	orm.EmptyTestTables(t, relevantOrmTables...)
+	defer orm.EmptyTestTables(t, relevantOrmTables...)
+
+	// Setup Test
+	helperCreateTestUsersT(t)
+	token1, token2 := helperLoginTestUsersT(t)
+	vaultID, err := helperCreateVaultGetID(token1, "Facebook")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var getAuthTokenFunc = func(t *testing.T) string { return token1 }
+
+	ts := apitest.TestSuite{
+		Route:                 "/v1/vault/" + vaultID + "/clone",
+		Method:                http.MethodPost,
+		Handler:               helperMuxHandler("/v1/vault/{vault_id}/clone", http.MethodPost, handler.HandleCloneVault),
+		AuthBearerTokenFunc:   getAuthTokenFunc,
+		AuthMiddlewareHandler: auth.AuthenticateRequestMiddleware,
+	}
+
+	tests := []apitest.HandlerTest{
+		{
+			Name:           "status Unauthorized if request has no auth token",
+			Content:        `{"name":"Facebook Staging"}`,
+			SkipAuthToken:  true,
+			WantStatusCode: http.StatusUnauthorized,
+		},
+		{
+			Name:                "status Forbidden if the user does not own the vault",
+			Content:             `{"name":"Facebook Staging"}`,
+			AuthBearerTokenFunc: func(t *testing.T) string { return token2 },
+			WantStatusCode:      http.StatusForbidden,
+			WantErrMessage:      vault.ErrForbidden.Error(),
+		},
+		{
+			Name:           "status BadRequest if the clone has no name",
+			Content:        `{}`,
+			WantStatusCode: http.StatusBadRequest,
+			WantErrMessage: "creating vault: name is empty",
+		},
+		{
+			Name:           "status Created if the owner clones the vault",
+			Content:        `{"name":"Facebook Staging"}`,
+			WantStatusCode: http.StatusCreated,
+			AssertContentFields: map[string]apitest.AssertFunc{
+				"id":          apitest.AssertNotEmptyFunc,
+				"name":        apitest.AssertIsEqual("Facebook Staging"),
+				"description": apitest.AssertIsEqual("Shared account for our org"),
+			},
+		},
+	}
+
+	ts.RunHandlerTests(t, tests)
+
+}
+
+func TestCreateAndInitializeVaultRollback(t *testing.T) {
+
+	var relevantOrmTables = []orm.Entity{&user.User{}, &user.Password{}, &org.Organization{}, &org.OrgUser{}, &vault.Vault{}, &vault.VaultUser{}, &vault.ShamirsVault{}, &secret.SecretRequest{}, &secret.SecretApproval{}}
+	orm.EmptyTestTables(t, relevantOrmTables...)
+	defer orm.EmptyTestTables(t, relevantOrmTables...)
+
+	// Setup Test: Jon creates an organization that requires at least 3 approvals, and one that doesn't. Neither Jane
+	// nor Arya are members of them.
+	helperCreateTestUsersT(t)
+	jon, err := user.GetUserByEmail("jon.doe@email.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = user.CreateUser(user.CreateUserRequest{Name: "Arya Stark", Email: "arya.stark@email.com", Password: "aryas_secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	strict, err := org.CreateOrg(ctx, org.CreateOrgRequest{AdminUserID: jon.ID, Name: "Winterfell", Settings: org.Settings{MinK: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lenient, err := org.CreateOrg(ctx, org.CreateOrgRequest{AdminUserID: jon.ID, Name: "Dragonstone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var members = vault.AddMemberByEmailsToVaultRequest{MemberEmails: []string{"jane.does@email.com", "arya.stark@email.com"}}
+
+	tests := []struct {
+		name string
+		req  vault.CreateAndInitializeVaultRequest
+	}{
+		{
+			name: "K is invalid",
+			req: vault.CreateAndInitializeVaultRequest{
+				CreateVaultRequest:              vault.CreateVaultRequest{AdminUserID: jon.ID, Name: "Facebook", Description: "Shared account"},
+				CreateShamirVaultRequest:        vault.CreateShamirVaultRequest{K: 1},
+				AddMemberByEmailsToVaultRequest: members,
+			},
+		},
+		{
+			// The vault and its owner are written before the settings of the org are checked
+			name: "K is below the min K of the org",
+			req: vault.CreateAndInitializeVaultRequest{
+				CreateVaultRequest:              vault.CreateVaultRequest{AdminUserID: jon.ID, OrgID: &strict.ID, Name: "Facebook", Description: "Shared account"},
+				CreateShamirVaultRequest:        vault.CreateShamirVaultRequest{K: 2},
+				AddMemberByEmailsToVaultRequest: members,
+			},
+		},
+		{
+			name: "a member is not a member of the org",
+			req: vault.CreateAndInitializeVaultRequest{
+				CreateVaultRequest:              vault.CreateVaultRequest{AdminUserID: jon.ID, OrgID: &lenient.ID, Name: "Facebook", Description: "Shared account"},
+				CreateShamirVaultRequest:        vault.CreateShamirVaultRequest{K: 2},
+				AddMemberByEmailsToVaultRequest: members,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := vault.CreateAndInitializeVault(ctx, tt.req)
+			assert.Error(t, err)
+
+			// Nothing of the vault is left behind
+			var vs []vault.Vault
+			var vus []vault.VaultUser
+			var svs []vault.ShamirsVault
+			for _, v := range []interface{}{&vs, &vus, &svs} {
+				_, err = orm.Find(map[string]interface{}{}, v)
+				assert.NoError(t, err)
+			}
+			assert.Empty(t, vs)
+			assert.Empty(t, vus)
+			assert.Empty(t, svs)
+		})
+	}
+
+	// A secret request isn't left behind without its approvals either, if recording them fails
+	v, err := vault.CreateVault(ctx, vault.CreateVaultRequest{AdminUserID: jon.ID, Name: "Facebook", Description: "Shared account"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		sr := secret.SecretRequest{UserID: jon.ID, VaultID: v.ID}
+		sr.ID = id.GetNewID()
+		if err := tx.InsertOne(&sr); err != nil {
+			return err
+		}
+		return fmt.Errorf("recording the approvals failed")
+	})
+	assert.Error(t, err)
+	var srs []secret.SecretRequest
+	_, err = orm.Find(map[string]interface{}{}, &srs)
+	assert.NoError(t, err)
+	assert.Empty(t, srs)
+}
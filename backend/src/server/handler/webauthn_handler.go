@@ -0,0 +1,197 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/teejays/n-factor-vault/backend/library/go-api"
+	webauthn "github.com/teejays/n-factor-vault/backend/library/go-webauthn"
+	"github.com/teejays/n-factor-vault/backend/library/id"
+
+	"github.com/teejays/n-factor-vault/backend/src/auth"
+)
+
+// HandleBeginWebAuthnRegistration (POST) returns the challenge to register a new WebAuthn credential, for the
+// authenticated user
+func HandleBeginWebAuthnRegistration(w http.ResponseWriter, r *http.Request) {
+
+	c, err := auth.BeginWebAuthnRegistration(r.Context())
+	if err != nil {
+		writeWebAuthnError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, c)
+
+}
+
+// HandleFinishWebAuthnRegistration (POST) registers the WebAuthn credential, created by the authenticator in response
+// to the challenge
+func HandleFinishWebAuthnRegistration(w http.ResponseWriter, r *http.Request) {
+
+	var req auth.FinishRegistrationRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	req.ClientIP = api.GetClientIP(r)
+
+	c, err := auth.FinishWebAuthnRegistration(r.Context(), req)
+	if err != nil {
+		writeWebAuthnError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusCreated, c)
+
+}
+
+// HandleGetWebAuthnCredentials (GET) returns the WebAuthn credentials of the authenticated user
+func HandleGetWebAuthnCredentials(w http.ResponseWriter, r *http.Request) {
+
+	creds, err := auth.GetWebAuthnCredentials(r.Context())
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, err, true, nil)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, creds)
+
+}
+
+// HandleDeleteWebAuthnCredential (DELETE) deletes a WebAuthn credential of the authenticated user, with a step-up
+// token for deleting it
+func HandleDeleteWebAuthnCredential(w http.ResponseWriter, r *http.Request) {
+
+	credentialID, err := api.GetMuxParamStr(r, "credential_id")
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	cid, err := id.StrToID(credentialID)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	var req auth.DeleteWebAuthnCredentialRequest
+	err = api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	req.CredentialID = cid
+	req.ClientIP = api.GetClientIP(r)
+
+	err = auth.DeleteWebAuthnCredential(r.Context(), req)
+	if err != nil {
+		writeWebAuthnError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, nil)
+
+}
+
+// HandleBeginWebAuthnLogin (POST) returns the challenge to log in with a WebAuthn credential. It doesn't need
+// authentication.
+func HandleBeginWebAuthnLogin(w http.ResponseWriter, r *http.Request) {
+
+	var req auth.BeginWebAuthnLoginRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	c, err := auth.BeginWebAuthnLogin(r.Context(), req)
+	if err != nil {
+		writeWebAuthnError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, c)
+
+}
+
+// HandleFinishWebAuthnLogin (POST) logs the user in with the authenticator's response to the challenge. It returns the
+// same tokens as a login with the password.
+func HandleFinishWebAuthnLogin(w http.ResponseWriter, r *http.Request) {
+
+	var req auth.FinishAssertionRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	req.ClientIP = api.GetClientIP(r)
+	req.UserAgent = r.UserAgent()
+
+	resp, err := auth.FinishWebAuthnLogin(r.Context(), req)
+	if err != nil {
+		writeWebAuthnError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, resp)
+
+}
+
+// HandleBeginStepUp (POST) returns the challenge to sign with a WebAuthn credential, before approving a secret request
+// or deleting a credential
+func HandleBeginStepUp(w http.ResponseWriter, r *http.Request) {
+
+	var req auth.BeginStepUpRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+
+	c, err := auth.BeginStepUp(r.Context(), req)
+	if err != nil {
+		writeWebAuthnError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, c)
+
+}
+
+// HandleFinishStepUp (POST) verifies the authenticator's response to the step-up challenge, and returns the step-up
+// token to approve the secret request, or delete the credential, with
+func HandleFinishStepUp(w http.ResponseWriter, r *http.Request) {
+
+	var req auth.FinishAssertionRequest
+	err := api.UnmarshalJSONFromRequest(r, &req)
+	if err != nil {
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+		return
+	}
+	req.ClientIP = api.GetClientIP(r)
+
+	resp, err := auth.FinishStepUp(r.Context(), req)
+	if err != nil {
+		writeWebAuthnError(w, err)
+		return
+	}
+
+	api.WriteResponse(w, http.StatusOK, resp)
+
+}
+
+// writeWebAuthnError writes err with the status code for it. Failed ceremonies are unauthorized, and a credential whose
+// counter went back, or a missing step-up, is forbidden.
+func writeWebAuthnError(w http.ResponseWriter, err error) {
+	switch err {
+	case auth.ErrInvalidChallenge, webauthn.ErrChallengeMismatch, webauthn.ErrOriginNotAllowed, webauthn.ErrUserNotPresent,
+		webauthn.ErrUserNotVerified, webauthn.ErrInvalidSignature:
+		api.WriteError(w, http.StatusUnauthorized, err, false, nil)
+	case webauthn.ErrSignCountNotIncreased, auth.ErrStepUpRequired:
+		api.WriteError(w, http.StatusForbidden, err, false, nil)
+	case auth.ErrCredentialNotFound:
+		api.WriteError(w, http.StatusNotFound, err, false, nil)
+	default:
+		api.WriteError(w, http.StatusBadRequest, err, false, nil)
+	}
+}
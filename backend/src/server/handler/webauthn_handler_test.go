@@ -0,0 +1,282 @@
+package handler_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/teejays/n-factor-vault/backend/library/go-api"
+	"github.com/teejays/n-factor-vault/backend/library/go-api/apitest"
+	"github.com/teejays/n-factor-vault/backend/library/json"
+	"github.com/teejays/n-factor-vault/backend/library/orm"
+
+	"github.com/teejays/n-factor-vault/backend/src/audit"
+	"github.com/teejays/n-factor-vault/backend/src/auth"
+	"github.com/teejays/n-factor-vault/backend/src/secret"
+	"github.com/teejays/n-factor-vault/backend/src/server/handler"
+	"github.com/teejays/n-factor-vault/backend/src/user"
+	"github.com/teejays/n-factor-vault/backend/src/vault"
+)
+
+func TestHandleStepUp(t *testing.T) {
+
+	var relevantModels = []orm.Entity{&user.User{}, &user.Password{}, &auth.Session{}, &auth.RefreshToken{}, &vault.Vault{}, &vault.VaultUser{},
+		&secret.SecretRequest{}, &secret.SecretApproval{}, &auth.WebAuthnCredential{}, &auth.WebAuthnChallenge{}, &auth.StepUp{}, &audit.Event{}}
+	orm.EmptyTestTables(t, relevantModels...)
+	defer orm.EmptyTestTables(t, relevantModels...)
+
+	// Setup Test: Jon has a vault, with two requests to reveal its secret
+	helperCreateTestUsersT(t)
+	token, _ := helperLoginTestUsersT(t)
+	vaultID, err := helperCreateVaultGetID(token, "Facebook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	requestID := helperRequestSecret(t, token, vaultID)
+	otherRequestID := helperRequestSecret(t, token, vaultID)
+
+	ts := apitest.TestSuite{
+		Route:                 "/v1/vault/secret/" + requestID,
+		Method:                http.MethodPatch,
+		Handler:               helperMuxHandler("/v1/vault/secret/{secret_request_id}", http.MethodPatch, handler.HandleUpdateSecretStatus),
+		AuthBearerTokenFunc:   func(t *testing.T) string { return token },
+		AuthMiddlewareHandler: auth.AuthenticateRequestMiddleware,
+	}
+	tests := []apitest.HandlerTest{
+		{
+			Name:           "status Created without a step-up token if the user has no credentials",
+			Content:        `{"approval":true}`,
+			WantStatusCode: http.StatusCreated,
+		},
+	}
+	ts.RunHandlerTests(t, tests)
+
+	// Jon registers a security key, and gets a step-up token for the other request
+	key := helperRegisterSoftKey(t, "jon.doe@email.com")
+	stepUpToken := helperStepUp(t, token, key, fmt.Sprintf(`{"secret_request_id":"%s"}`, otherRequestID))
+
+	tests = []apitest.HandlerTest{
+		{
+			Name:           "status Forbidden without a step-up token once the user has a credential",
+			Content:        `{"approval":true}`,
+			WantStatusCode: http.StatusForbidden,
+			WantErrMessage: auth.ErrStepUpRequired.Error(),
+		},
+		{
+			Name:           "status Forbidden with a step-up token for another request",
+			Content:        `{"approval":true, "step_up_token":"` + stepUpToken + `"}`,
+			WantStatusCode: http.StatusForbidden,
+			WantErrMessage: auth.ErrStepUpRequired.Error(),
+		},
+	}
+	ts.RunHandlerTests(t, tests)
+
+	ts.Route = "/v1/vault/secret/" + otherRequestID
+	tests = []apitest.HandlerTest{
+		{
+			Name:           "status Created with the step-up token for the request",
+			Content:        `{"approval":true, "step_up_token":"` + stepUpToken + `"}`,
+			WantStatusCode: http.StatusCreated,
+		},
+		{
+			Name:           "status Forbidden if the step-up token has been used already",
+			Content:        `{"approval":true, "step_up_token":"` + stepUpToken + `"}`,
+			WantStatusCode: http.StatusForbidden,
+			WantErrMessage: auth.ErrStepUpRequired.Error(),
+		},
+	}
+	ts.RunHandlerTests(t, tests)
+
+	// A challenge can't be retried after a response to it fails verification
+	c := helperBeginStepUp(t, token, fmt.Sprintf(`{"secret_request_id":"%s"}`, requestID))
+	bad := key.sign(t, c.Options.Challenge)
+	bad.Response.Signature = key.sign(t, "c29tZXRoaW5nIGVsc2U").Response.Signature
+	_, _, err = helperFinishStepUp(token, string(c.ChallengeID), bad, http.StatusUnauthorized)
+	assert.NoError(t, err)
+	_, body, err := helperFinishStepUp(token, string(c.ChallengeID), key.sign(t, c.Options.Challenge), http.StatusUnauthorized)
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(body), auth.ErrInvalidChallenge.Error())
+	}
+
+	// Deleting the security key needs a step-up token for deleting it
+	ts = apitest.TestSuite{
+		Route:                 "/v1/webauthn/credentials/" + string(key.cred.ID),
+		Method:                http.MethodDelete,
+		Handler:               helperMuxHandler("/v1/webauthn/credentials/{credential_id}", http.MethodDelete, handler.HandleDeleteWebAuthnCredential),
+		AuthBearerTokenFunc:   func(t *testing.T) string { return token },
+		AuthMiddlewareHandler: auth.AuthenticateRequestMiddleware,
+	}
+	approvalToken := helperStepUp(t, token, key, fmt.Sprintf(`{"secret_request_id":"%s"}`, requestID))
+	deleteToken := helperStepUp(t, token, key, fmt.Sprintf(`{"delete_credential_id":"%s"}`, key.cred.ID))
+	tests = []apitest.HandlerTest{
+		{
+			Name:           "status Forbidden without a step-up token",
+			Content:        `{}`,
+			WantStatusCode: http.StatusForbidden,
+			WantErrMessage: auth.ErrStepUpRequired.Error(),
+		},
+		{
+			Name:           "status Forbidden with a step-up token for approving a request",
+			Content:        `{"step_up_token":"` + approvalToken + `"}`,
+			WantStatusCode: http.StatusForbidden,
+			WantErrMessage: auth.ErrStepUpRequired.Error(),
+		},
+		{
+			Name:           "status OK with the step-up token for deleting the credential",
+			Content:        `{"step_up_token":"` + deleteToken + `"}`,
+			WantStatusCode: http.StatusOK,
+		},
+	}
+	ts.RunHandlerTests(t, tests)
+
+	var creds []auth.WebAuthnCredential
+	_, err = orm.Find(map[string]interface{}{"id": key.cred.ID}, &creds)
+	if assert.NoError(t, err) {
+		assert.Len(t, creds, 0)
+	}
+}
+
+// softKey is a security key in software, with an ES256 key, for the relying party of the tests (localhost)
+type softKey struct {
+	cred  auth.WebAuthnCredential
+	ec    *ecdsa.PrivateKey
+	count uint32
+}
+
+// helperRegisterSoftKey stores a new software security key as a credential of the user with the email
+func helperRegisterSoftKey(t *testing.T, email string) *softKey {
+	u, err := user.GetUserByEmail(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := softKey{}
+	k.ec, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialID := make([]byte, 16)
+	rand.Read(credentialID)
+
+	// The public key is a COSE key: kty EC2, alg ES256, crv P-256, and its coordinates
+	pad := func(b []byte) []byte { return append(make([]byte, 32-len(b)), b...) }
+	cose := []byte{0xa5, 0x01, 0x02, 0x03, 0x26, 0x20, 0x01, 0x21, 0x58, 0x20}
+	cose = append(cose, pad(k.ec.X.Bytes())...)
+	cose = append(cose, 0x22, 0x58, 0x20)
+	cose = append(cose, pad(k.ec.Y.Bytes())...)
+
+	k.cred = auth.WebAuthnCredential{UserID: u.ID, Name: "YubiKey", CredentialID: base64.RawURLEncoding.EncodeToString(credentialID), PublicKey: cose}
+	if err := orm.InsertOne(&k.cred); err != nil {
+		t.Fatal(err)
+	}
+	return &k
+}
+
+// sign returns the key's response to the base64url encoded challenge, made on the origin of the tests
+func (k *softKey) sign(t *testing.T, challenge string) auth.CredentialResponse {
+	k.count++
+	clientData, err := json.Marshal(map[string]string{"type": "webauthn.get", "challenge": challenge, "origin": "http://localhost:8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpIDHash := sha256.Sum256([]byte("localhost"))
+	authData := append(rpIDHash[:], 0x05) // user present and verified
+	count := make([]byte, 4)
+	binary.BigEndian.PutUint32(count, k.count)
+	authData = append(authData, count...)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	r, s, err := ecdsa.Sign(rand.Reader, k.ec, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resp auth.CredentialResponse
+	resp.ID = k.cred.CredentialID
+	resp.Response.ClientDataJSON = base64.RawURLEncoding.EncodeToString(clientData)
+	resp.Response.AuthenticatorData = base64.RawURLEncoding.EncodeToString(authData)
+	resp.Response.Signature = base64.RawURLEncoding.EncodeToString(sig)
+	return resp
+}
+
+// helperRequestSecret requests the secret of the vault, and returns the ID of the request
+func helperRequestSecret(t *testing.T, token, vaultID string) string {
+	p := apitest.HandlerReqParams{
+		Route:           "/v1/vault/" + vaultID + "/secret",
+		Method:          http.MethodPost,
+		HandlerFunc:     helperMuxHandler("/v1/vault/{vault_id}/secret", http.MethodPost, handler.HandleRequestSecret).ServeHTTP,
+		AuthBearerToken: token,
+		Middlewares:     []api.MiddlewareFunc{auth.AuthenticateRequestMiddleware},
+	}
+	_, body, err := p.MakeHandlerRequest("", []int{http.StatusCreated})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s secret.Status
+	if err := json.Unmarshal(body, &s); err != nil {
+		t.Fatal(err)
+	}
+	return string(s.SecretRequestID)
+}
+
+// helperBeginStepUp starts a step-up with the content, and returns its challenge
+func helperBeginStepUp(t *testing.T, token, content string) auth.RequestChallenge {
+	p := apitest.HandlerReqParams{
+		Route:           "/v1/webauthn/step_up/begin",
+		Method:          http.MethodPost,
+		HandlerFunc:     handler.HandleBeginStepUp,
+		AuthBearerToken: token,
+		Middlewares:     []api.MiddlewareFunc{auth.AuthenticateRequestMiddleware},
+	}
+	_, body, err := p.MakeHandlerRequest(content, []int{http.StatusOK})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c auth.RequestChallenge
+	if err := json.Unmarshal(body, &c); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// helperFinishStepUp finishes the step-up of the challenge with the response, expecting the status code
+func helperFinishStepUp(token, challengeID string, resp auth.CredentialResponse, code int) (*http.Response, []byte, error) {
+	p := apitest.HandlerReqParams{
+		Route:           "/v1/webauthn/step_up/finish",
+		Method:          http.MethodPost,
+		HandlerFunc:     handler.HandleFinishStepUp,
+		AuthBearerToken: token,
+		Middlewares:     []api.MiddlewareFunc{auth.AuthenticateRequestMiddleware},
+	}
+	content := fmt.Sprintf(`{"challenge_id":"%s", "credential":{"id":"%s", "response":{"client_data_json":"%s", "authenticator_data":"%s", "signature":"%s"}}}`,
+		challengeID, resp.ID, resp.Response.ClientDataJSON, resp.Response.AuthenticatorData, resp.Response.Signature)
+	return p.MakeHandlerRequest(content, []int{code})
+}
+
+// helperStepUp does a step-up with the key, and returns the step-up token
+func helperStepUp(t *testing.T, token string, k *softKey, content string) string {
+	c := helperBeginStepUp(t, token, content)
+	_, body, err := helperFinishStepUp(token, string(c.ChallengeID), k.sign(t, c.Options.Challenge), http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp auth.StepUpResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StepUpToken
+}
@@ -5,6 +5,7 @@ import (
 
 	api "github.com/teejays/n-factor-vault/backend/library/go-api"
 
+	"github.com/teejays/n-factor-vault/backend/src/auth"
 	"github.com/teejays/n-factor-vault/backend/src/server/handler"
 )
 
@@ -46,6 +47,175 @@ func GetRoutes() []api.Route {
 			Path:        "login",
 			HandlerFunc: handler.HandleLogin,
 		},
+		// MFA Login Handler: completes the login of a user with a second factor
+		{
+			Method:      http.MethodPost,
+			Version:     ver1,
+			Path:        "login/mfa",
+			HandlerFunc: handler.HandleVerifyMFA,
+		},
+		// TOTP Factor Enroll Handler
+		{
+			Method:       http.MethodPost,
+			Version:      ver1,
+			Path:         "mfa/totp",
+			HandlerFunc:  handler.HandleEnrollTOTP,
+			Authenticate: true,
+		},
+		// TOTP Factor Confirm Handler: enables the second factor, and returns the recovery codes
+		{
+			Method:       http.MethodPost,
+			Version:      ver1,
+			Path:         "mfa/totp/confirm",
+			HandlerFunc:  handler.HandleConfirmTOTP,
+			Authenticate: true,
+		},
+		// WebAuthn Login Handlers: log in with a security key or passkey, instead of the password
+		{
+			Method:      http.MethodPost,
+			Version:     ver1,
+			Path:        "login/webauthn/begin",
+			HandlerFunc: handler.HandleBeginWebAuthnLogin,
+		},
+		{
+			Method:      http.MethodPost,
+			Version:     ver1,
+			Path:        "login/webauthn/finish",
+			HandlerFunc: handler.HandleFinishWebAuthnLogin,
+		},
+		// OIDC Login Handlers: log in through the identity provider of an organization (single sign-on)
+		{
+			Method:      http.MethodPost,
+			Version:     ver1,
+			Path:        "login/oidc/{provider_id}",
+			HandlerFunc: handler.HandleBeginOIDCLogin,
+		},
+		{
+			Method:      http.MethodGet,
+			Version:     ver1,
+			Path:        "login/oidc/callback",
+			HandlerFunc: handler.HandleFinishOIDCLogin,
+		},
+		{
+			Method:       http.MethodPost,
+			Version:      ver1,
+			Path:         "oidc/{provider_id}/link",
+			HandlerFunc:  handler.HandleBeginOIDCLink,
+			Authenticate: true,
+		},
+		// LDAP Handlers: link an account to the directory, which logs in like a password
+		{
+			Method:       http.MethodPost,
+			Version:      ver1,
+			Path:         "ldap/link",
+			HandlerFunc:  handler.HandleLinkLDAPIdentity,
+			Authenticate: true,
+		},
+		// WebAuthn Registration Handlers
+		{
+			Method:       http.MethodPost,
+			Version:      ver1,
+			Path:         "webauthn/register/begin",
+			HandlerFunc:  handler.HandleBeginWebAuthnRegistration,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodPost,
+			Version:      ver1,
+			Path:         "webauthn/register/finish",
+			HandlerFunc:  handler.HandleFinishWebAuthnRegistration,
+			Authenticate: true,
+		},
+		// WebAuthn Credentials Handlers
+		{
+			Method:       http.MethodGet,
+			Version:      ver1,
+			Path:         "webauthn/credentials",
+			HandlerFunc:  handler.HandleGetWebAuthnCredentials,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodDelete,
+			Version:      ver1,
+			Path:         "webauthn/credentials/{credential_id}",
+			HandlerFunc:  handler.HandleDeleteWebAuthnCredential,
+			Authenticate: true,
+		},
+		// WebAuthn Step-Up Handlers: get a step-up token, to approve a secret request with
+		{
+			Method:       http.MethodPost,
+			Version:      ver1,
+			Path:         "webauthn/step_up/begin",
+			HandlerFunc:  handler.HandleBeginStepUp,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodPost,
+			Version:      ver1,
+			Path:         "webauthn/step_up/finish",
+			HandlerFunc:  handler.HandleFinishStepUp,
+			Authenticate: true,
+		},
+		// Refresh Token Handler: exchanges a refresh token for new tokens
+		{
+			Method:      http.MethodPost,
+			Version:     ver1,
+			Path:        "token/refresh",
+			HandlerFunc: handler.HandleRefreshToken,
+		},
+		// Logout Handler
+		{
+			Method:       http.MethodPost,
+			Version:      ver1,
+			Path:         "logout",
+			HandlerFunc:  handler.HandleLogout,
+			Authenticate: true,
+		},
+		// Logout Everywhere Handler: revokes all the sessions of the user
+		{
+			Method:       http.MethodPost,
+			Version:      ver1,
+			Path:         "logout/all",
+			HandlerFunc:  handler.HandleLogoutEverywhere,
+			Authenticate: true,
+		},
+		// Sessions Handlers: the active sessions of the user, any of which they can revoke
+		{
+			Method:       http.MethodGet,
+			Version:      ver1,
+			Path:         "sessions",
+			HandlerFunc:  handler.HandleGetSessions,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodDelete,
+			Version:      ver1,
+			Path:         "sessions/{session_id}",
+			HandlerFunc:  handler.HandleRevokeSession,
+			Authenticate: true,
+		},
+		// Admin Sessions Handlers: the sessions of any user, for admins of the instance
+		{
+			Method:       http.MethodGet,
+			Version:      ver1,
+			Path:         "admin/users/{user_id}/sessions",
+			HandlerFunc:  handler.HandleGetUserSessions,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodDelete,
+			Version:      ver1,
+			Path:         "admin/users/{user_id}/sessions/{session_id}",
+			HandlerFunc:  handler.HandleRevokeUserSession,
+			Authenticate: true,
+		},
+		// JWKS Handler: the public keys that tokens are verified with
+		{
+			Method:      http.MethodGet,
+			Version:     ver1,
+			Path:        ".well-known/jwks.json",
+			HandlerFunc: handler.HandleGetJWKS,
+		},
 		// Vault Create Handler
 		{
 			Method:       http.MethodPost,
@@ -69,12 +239,170 @@ func GetRoutes() []api.Route {
 			HandlerFunc:  handler.HandleAddVaultUser,
 			Authenticate: true,
 		},
+		// Vault Lifecycle
+		{
+			Method:       http.MethodPatch,
+			Version:      ver1,
+			Path:         "vault/{vault_id}",
+			HandlerFunc:  handler.HandleUpdateVault,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodPost,
+			Version:      ver1,
+			Path:         "vault/{vault_id}/archive",
+			HandlerFunc:  handler.HandleArchiveVault,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodPost,
+			Version:      ver1,
+			Path:         "vault/{vault_id}/restore",
+			HandlerFunc:  handler.HandleRestoreVault,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodDelete,
+			Version:      ver1,
+			Path:         "vault/{vault_id}",
+			HandlerFunc:  handler.HandleDeleteVault,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodPut,
+			Version:      ver1,
+			Path:         "vault/{vault_id}/tags",
+			HandlerFunc:  handler.HandleSetVaultTags,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodPost,
+			Version:      ver1,
+			Path:         "vault/{vault_id}/team",
+			HandlerFunc:  handler.HandleAddVaultTeam,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodDelete,
+			Version:      ver1,
+			Path:         "vault/{vault_id}/team/{team_id}",
+			HandlerFunc:  handler.HandleRemoveVaultTeam,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodPost,
+			Version:      ver1,
+			Path:         "vault/{vault_id}/clone",
+			HandlerFunc:  handler.HandleCloneVault,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodPut,
+			Version:      ver1,
+			Path:         "vault/{vault_id}/folder",
+			HandlerFunc:  handler.HandleMoveVault,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodPut,
+			Version:      ver1,
+			Path:         "vault/{vault_id}/approval_policy",
+			HandlerFunc:  handler.HandleSetVaultApprovalPolicy,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodGet,
+			Version:      ver1,
+			Path:         "vault/{vault_id}/permissions",
+			HandlerFunc:  handler.HandleGetVaultPermissions,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodPut,
+			Version:      ver1,
+			Path:         "vault/{vault_id}/access_restrictions",
+			HandlerFunc:  handler.HandleSetVaultAccessRestrictions,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodGet,
+			Version:      ver1,
+			Path:         "vault/{vault_id}/health",
+			HandlerFunc:  handler.HandleGetVaultHealth,
+			Authenticate: true,
+		},
+		// Folders
+		{
+			Method:       http.MethodPost,
+			Version:      ver1,
+			Path:         "folder",
+			HandlerFunc:  handler.HandleCreateFolder,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodGet,
+			Version:      ver1,
+			Path:         "folder/{folder_id}",
+			HandlerFunc:  handler.HandleGetFolder,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodDelete,
+			Version:      ver1,
+			Path:         "folder/{folder_id}",
+			HandlerFunc:  handler.HandleDeleteFolder,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodPut,
+			Version:      ver1,
+			Path:         "folder/{folder_id}/approval_policy",
+			HandlerFunc:  handler.HandleSetFolderPolicy,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodPut,
+			Version:      ver1,
+			Path:         "folder/{folder_id}/user/{user_id}",
+			HandlerFunc:  handler.HandleSetFolderMember,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodDelete,
+			Version:      ver1,
+			Path:         "folder/{folder_id}/user/{user_id}",
+			HandlerFunc:  handler.HandleRemoveFolderMember,
+			Authenticate: true,
+		},
+		// Vault Templates
+		{
+			Method:       http.MethodPost,
+			Version:      ver1,
+			Path:         "vault/template",
+			HandlerFunc:  handler.HandleCreateVaultTemplate,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodGet,
+			Version:      ver1,
+			Path:         "vault/templates",
+			HandlerFunc:  handler.HandleGetVaultTemplates,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodPost,
+			Version:      ver1,
+			Path:         "vault/template/{template_id}/vault",
+			HandlerFunc:  handler.HandleCreateVaultFromTemplate,
+			Authenticate: true,
+		},
 		{
 			Method:       http.MethodPost,
 			Version:      ver1,
 			Path:         "vault/{vault_id}/secret",
 			HandlerFunc:  handler.HandleRequestSecret,
 			Authenticate: true,
+			Scope:        auth.ScopeSecretRequest,
 		},
 		{
 			Method:       http.MethodPatch,
@@ -89,6 +417,7 @@ func GetRoutes() []api.Route {
 			Path:         "vault/secret/{secret_request_id}/status",
 			HandlerFunc:  handler.HandleGetSecretStatus,
 			Authenticate: true,
+			Scope:        auth.ScopeSecretRequest,
 		},
 		{
 			Method:       http.MethodGet,
@@ -96,21 +425,216 @@ func GetRoutes() []api.Route {
 			Path:         "vault/secret/{secret_request_id}",
 			HandlerFunc:  handler.HandleGetSecret,
 			Authenticate: true,
+			Scope:        auth.ScopeSecretReveal,
+		},
+		// Service Accounts & API Keys
+		{
+			Method:       http.MethodPost,
+			Version:      ver1,
+			Path:         "service_account",
+			HandlerFunc:  handler.HandleCreateServiceAccount,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodGet,
+			Version:      ver1,
+			Path:         "service_account",
+			HandlerFunc:  handler.HandleGetServiceAccounts,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodDelete,
+			Version:      ver1,
+			Path:         "service_account/{service_account_id}",
+			HandlerFunc:  handler.HandleDisableServiceAccount,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodPost,
+			Version:      ver1,
+			Path:         "service_account/{service_account_id}/key",
+			HandlerFunc:  handler.HandleCreateAPIKey,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodGet,
+			Version:      ver1,
+			Path:         "service_account/{service_account_id}/key",
+			HandlerFunc:  handler.HandleGetAPIKeys,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodPost,
+			Version:      ver1,
+			Path:         "service_account/{service_account_id}/key/{api_key_id}/rotate",
+			HandlerFunc:  handler.HandleRotateAPIKey,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodDelete,
+			Version:      ver1,
+			Path:         "service_account/{service_account_id}/key/{api_key_id}",
+			HandlerFunc:  handler.HandleRevokeAPIKey,
+			Authenticate: true,
+		},
+		// Organizations & Teams
+		{
+			Method:       http.MethodPost,
+			Version:      ver1,
+			Path:         "org",
+			HandlerFunc:  handler.HandleCreateOrg,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodGet,
+			Version:      ver1,
+			Path:         "orgs",
+			HandlerFunc:  handler.HandleGetOrgs,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodGet,
+			Version:      ver1,
+			Path:         "orgs/invitations",
+			HandlerFunc:  handler.HandleGetOrgInvitations,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodPost,
+			Version:      ver1,
+			Path:         "org/{org_id}/accept",
+			HandlerFunc:  handler.HandleAcceptOrgInvitation,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodPatch,
+			Version:      ver1,
+			Path:         "org/{org_id}/settings",
+			HandlerFunc:  handler.HandleUpdateOrgSettings,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodPost,
+			Version:      ver1,
+			Path:         "org/{org_id}/user",
+			HandlerFunc:  handler.HandleAddOrgMember,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodPost,
+			Version:      ver1,
+			Path:         "org/{org_id}/team",
+			HandlerFunc:  handler.HandleCreateTeam,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodPost,
+			Version:      ver1,
+			Path:         "org/{org_id}/team/{team_id}/user",
+			HandlerFunc:  handler.HandleAddTeamMember,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodDelete,
+			Version:      ver1,
+			Path:         "org/{org_id}/team/{team_id}/user/{user_id}",
+			HandlerFunc:  handler.HandleRemoveTeamMember,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodPost,
+			Version:      ver1,
+			Path:         "org/{org_id}/oidc_provider",
+			HandlerFunc:  handler.HandleCreateOIDCProvider,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodGet,
+			Version:      ver1,
+			Path:         "org/{org_id}/oidc_provider",
+			HandlerFunc:  handler.HandleGetOIDCProviders,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodGet,
+			Version:      ver1,
+			Path:         "org/{org_id}/vault_health",
+			HandlerFunc:  handler.HandleGetOrgVaultHealth,
+			Authenticate: true,
 		},
 		// TOTP
 		{
-			Method:      http.MethodPost,
-			Version:     ver1,
-			Path:        "totp/account",
-			HandlerFunc: handler.HandleCreateTOTPAccount,
-			// Authenticate: true,
+			Method:       http.MethodPost,
+			Version:      ver1,
+			Path:         "totp/account",
+			HandlerFunc:  handler.HandleCreateTOTPAccount,
+			Authenticate: true,
 		},
 		{
-			Method:      http.MethodGet,
-			Version:     ver1,
-			Path:        "totp/account/{totp_account_id}",
-			HandlerFunc: handler.HandleTOTPGetCode,
-			// Authenticate: true,
+			Method:       http.MethodPost,
+			Version:      ver1,
+			Path:         "totp/account/qr",
+			HandlerFunc:  handler.HandleCreateTOTPAccountFromQRCode,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodGet,
+			Version:      ver1,
+			Path:         "totp/account/{totp_account_id}",
+			HandlerFunc:  handler.HandleTOTPGetCode,
+			Authenticate: true,
+			Scope:        auth.ScopeTOTPCode,
+		},
+		{
+			Method:       http.MethodGet,
+			Version:      ver1,
+			Path:         "totp/account/{totp_account_id}/stream",
+			HandlerFunc:  handler.HandleStreamTOTPCodes,
+			Authenticate: true,
+			Scope:        auth.ScopeTOTPCode,
+		},
+		{
+			Method:       http.MethodGet,
+			Version:      ver1,
+			Path:         "totp/account/{totp_account_id}/history",
+			HandlerFunc:  handler.HandleGetTOTPAccountHistory,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodPost,
+			Version:      ver1,
+			Path:         "totp/account/{totp_account_id}/resync",
+			HandlerFunc:  handler.HandleResyncTOTPAccount,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodPost,
+			Version:      ver1,
+			Path:         "vault/{vault_id}/totp/import",
+			HandlerFunc:  handler.HandleImportTOTPAccounts,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodGet,
+			Version:      ver1,
+			Path:         "vault/{vault_id}/totp/export",
+			HandlerFunc:  handler.HandleExportTOTPAccounts,
+			Authenticate: true,
+			Scope:        auth.ScopeTOTPExport,
+		},
+		{
+			Method:       http.MethodPost,
+			Version:      ver1,
+			Path:         "totp/member_key",
+			HandlerFunc:  handler.HandleSetTOTPMemberKey,
+			Authenticate: true,
+		},
+		{
+			Method:       http.MethodPost,
+			Version:      ver1,
+			Path:         "vault/secret/{secret_request_id}/totp_shares",
+			HandlerFunc:  handler.HandleContributeTOTPShares,
+			Authenticate: true,
 		},
 	}
 
@@ -1,6 +1,9 @@
 package server
 
 import (
+	"strings"
+
+	"github.com/teejays/n-factor-vault/backend/library/env"
 	api "github.com/teejays/n-factor-vault/backend/library/go-api"
 
 	"github.com/teejays/n-factor-vault/backend/src/auth"
@@ -9,6 +12,13 @@ import (
 // StartServer initializes and startes the HTTP server
 func StartServer(addr string, port int) error {
 
+	// Requests from these proxies are trusted to tell us the IP of the client e.g. TRUSTED_PROXIES=10.0.0.0/8,172.16.0.1
+	if proxies, err := env.GetEnvVar("TRUSTED_PROXIES"); err == nil {
+		if err := api.SetTrustedProxies(strings.Split(proxies, ",")); err != nil {
+			return err
+		}
+	}
+
 	// Get the Routes
 	routes := GetRoutes()
 
@@ -0,0 +1,732 @@
+package totp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/lib/pq"
+	"github.com/teejays/clog"
+	"golang.org/x/crypto/curve25519"
+
+	"github.com/teejays/n-factor-vault/backend/library/env"
+	pwd "github.com/teejays/n-factor-vault/backend/library/go-pwd"
+	"github.com/teejays/n-factor-vault/backend/library/id"
+	"github.com/teejays/n-factor-vault/backend/library/orm"
+
+	"github.com/teejays/n-factor-vault/backend/src/secret"
+	"github.com/teejays/n-factor-vault/backend/src/vault"
+)
+
+/* Threshold Combinations
+
+This implements the approach described in the notes of totp.go, as an alternative to protecting the private key of an
+account with the master key. If a vault has m members and needs k of them to access a secret, the private key is
+encrypted once for every combination of k members (m choose k ciphertexts), so any k members together can decrypt it,
+and fewer than k members cannot, even with the master key and the database.
+
+Every member sets up a passphrase, from which we derive their X25519 key pair using PBKDF2. Only the public key is
+stored. For each combination, we generate a random combination key, encrypt the private key of the account with it,
+and split it into k shares that XOR back into the key. Each share is encrypted (wrapped) with the public key of one
+member of the combination, so we only need the public keys to encrypt, and never store anything that a single member
+could decrypt the private key with.
+
+	PrivateKey + CombinationKey --> EncryptedPrivateKey of the combination (DB)
+	CombinationKey = Share(A) ^ Share(B) ^ Share(C)
+	Share(X) + PublicKey(X) --> WrappedShare of X (DB)
+
+To get a code, the requester makes a secret request as usual. Each approver then unwraps their shares with their
+passphrase, and wraps them again with the public key of the requester, for the combinations that include both of them.
+Once the approvers of a combination have contributed their shares, the requester can unwrap all of the shares with
+their own passphrase, and decrypt the private key.
+
+When a member leaves, we delete the combinations that include them: the combinations of the remaining members are
+already there. If the number of approvals goes up, we delete the combinations that are too small. When a member joins, or the number of approvals changes, new combinations are needed, but we can't
+decrypt the private key to encrypt it for them. The account is marked for re-encryption instead, which happens the
+next time that a code is generated for it.
+
+The number of combinations grows quickly with the members (e.g. 20 choose 10 is 184756), so it is capped by
+TOTP_MAX_COMBINATIONS.
+
+*/
+
+// envMaxCombinations is the env variable with the maximum number of combinations that an account can be encrypted for
+const envMaxCombinations = "TOTP_MAX_COMBINATIONS"
+
+var gDefaultMaxCombinations = 1000
+
+// gMemberKeyIterations is the number of PBKDF2 iterations used to derive the keys of the members from their passphrases
+var gMemberKeyIterations = 100000
+
+var gMemberKeySaltSize = 16
+
+// Protection is how the private key of an account is protected
+type Protection string
+
+// The supported protections
+const (
+	// ProtectionMasterKey accounts are encrypted with a data key, wrapped by the master key
+	ProtectionMasterKey Protection = "MASTER_KEY"
+	// ProtectionCombinations accounts are encrypted for every combination of k members of the vault
+	ProtectionCombinations Protection = "COMBINATIONS"
+)
+
+// ErrMemberKeyNotFound is returned when a member of the vault has not set up their passphrase
+var ErrMemberKeyNotFound = fmt.Errorf("every member of the vault should set up a passphrase for threshold combinations")
+
+// ErrMemberKeyExists is returned when a user tries to set up a passphrase for a second time
+var ErrMemberKeyExists = fmt.Errorf("passphrase for threshold combinations has already been set up")
+
+// ErrWrongPassphrase is returned when the passphrase does not match the key of the member
+var ErrWrongPassphrase = fmt.Errorf("passphrase is not correct")
+
+// ErrTooManyCombinations is returned when encrypting an account would need more combinations than allowed
+var ErrTooManyCombinations = fmt.Errorf("the vault has too many members for threshold combinations: the number of combinations is over %s", envMaxCombinations)
+
+// ErrNotEnoughShares is returned when not enough approvers have contributed their shares to decrypt an account
+var ErrNotEnoughShares = fmt.Errorf("not enough approvers of the secret request have contributed their shares")
+
+// ErrNotApprover is returned when a user who hasn't approved a secret request tries to contribute shares for it
+var ErrNotApprover = fmt.Errorf("user has not approved the secret request")
+
+// ErrCombinationsNotSupported is returned for operations that need the private key of an account without an approved
+// secret request, which accounts protected by threshold combinations can't support
+var ErrCombinationsNotSupported = fmt.Errorf("operation is not supported for accounts protected by threshold combinations")
+
+// ErrPassphraseRequired is returned when a passphrase is needed to decrypt an account, but none was given
+var ErrPassphraseRequired = fmt.Errorf("passphrase is required for accounts protected by threshold combinations")
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* O R M   M O D E L S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// MemberKey is the public key of a user, derived from their passphrase
+type MemberKey struct {
+	orm.BaseModel `gorm:"EMBEDDED"`
+	UserID        id.ID  `gorm:"UNIQUE_INDEX;NOT NULL"`
+	Salt          []byte `gorm:"NOT NULL"`
+	Iterations    int    `gorm:"NOT NULL"`
+	PublicKey     []byte `gorm:"NOT NULL"`
+}
+
+// TableName overrides the SQL table name of MemberKey struct
+func (k MemberKey) TableName() string {
+	return "totp_member_keys"
+}
+
+// Combination is the private key of an account, encrypted for a combination of members
+type Combination struct {
+	orm.BaseModel       `gorm:"EMBEDDED"`
+	AccountID           id.ID          `gorm:"INDEX;NOT NULL"`
+	MemberIDs           pq.StringArray `gorm:"type:text[]"` // sorted
+	EncryptedPrivateKey []byte         `gorm:"NOT NULL"`
+}
+
+// TableName overrides the SQL table name of Combination struct
+func (c Combination) TableName() string {
+	return "totp_combinations"
+}
+
+// Share is one member's share of the key of a combination, wrapped with the public key of UserID. The original shares
+// are wrapped for the members themselves. Approvers contribute their shares for a secret request by wrapping them again
+// for the requester.
+type Share struct {
+	orm.BaseModel      `gorm:"EMBEDDED"`
+	CombinationID      id.ID  `gorm:"INDEX;NOT NULL"`
+	UserID             id.ID  `gorm:"NOT NULL"` // the user who can unwrap the share
+	FromUserID         id.ID  `gorm:"NOT NULL"` // the member whose share it is
+	SecretRequestID    *id.ID `gorm:"INDEX"`    // set for shares contributed to a secret request
+	EphemeralPublicKey []byte `gorm:"NOT NULL"`
+	WrappedShare       []byte `gorm:"NOT NULL"`
+}
+
+// TableName overrides the SQL table name of Share struct
+func (s Share) TableName() string {
+	return "totp_combination_shares"
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* M E T H O D S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// SetMemberKeyRequest is the data required to set up the passphrase of a user
+type SetMemberKeyRequest struct {
+	UserID     id.ID  `validate:"required"`
+	Passphrase string `validate:"required,min=12"`
+}
+
+// SetMemberKey derives the key of the user from their passphrase, and stores its public part. The passphrase can't be
+// changed once set, since the accounts encrypted for the user would need to be re-encrypted.
+func SetMemberKey(ctx context.Context, req SetMemberKeyRequest) (MemberKey, error) {
+	var k MemberKey
+
+	err := validate.Struct(req)
+	if err != nil {
+		return k, err
+	}
+
+	k.UserID = req.UserID
+	k.Iterations = gMemberKeyIterations
+	k.Salt, err = pwd.GetSalt(gMemberKeySaltSize)
+	if err != nil {
+		return k, err
+	}
+	_, k.PublicKey = deriveMemberKeyPair(req.Passphrase, k.Salt, k.Iterations)
+
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		var existing MemberKey
+		exists, err := tx.FindOne(map[string]interface{}{"user_id": req.UserID}, &existing)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return ErrMemberKeyExists
+		}
+		return tx.InsertOne(&k)
+	})
+	if err != nil {
+		return k, err
+	}
+
+	return k, nil
+}
+
+// ContributeSharesRequest is the data required for an approver to contribute their shares to a secret request
+type ContributeSharesRequest struct {
+	SecretRequestID id.ID  `validate:"required"`
+	UserID          id.ID  `validate:"required"` // the approver
+	Passphrase      string `validate:"required"`
+	ClientIP        string
+}
+
+// ContributeShares unwraps the shares of the approver, for the combinations of the vault's accounts that also include
+// the requester, and wraps them for the requester. The approver should have approved the secret request. It returns
+// the number of shares contributed.
+func ContributeShares(ctx context.Context, req ContributeSharesRequest) (int, error) {
+
+	err := validate.Struct(req)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		var sr secret.SecretRequest
+		exists, err := tx.FindByIDForUpdate(req.SecretRequestID, &sr)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return secret.ErrRequestNotFound
+		}
+		var sa secret.SecretApproval
+		exists, err = tx.FindOne(map[string]interface{}{"secret_request_id": sr.ID, "user_id": req.UserID, "approved": true}, &sa)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrNotApprover
+		}
+
+		// Contributing shares is subject to the access restrictions of the vault, like approving
+		v, err := vault.GetVault(ctx, sr.VaultID)
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			return vault.ErrVaultNotFound
+		}
+		err = vault.CheckAccess(ctx, vault.CheckAccessRequest{Vault: v, UserID: req.UserID, ClientIP: req.ClientIP, Action: "totp.contribute_shares"})
+		if err != nil {
+			return err
+		}
+
+		privateKey, err := unlockMemberKey(tx, req.UserID, req.Passphrase)
+		if err != nil {
+			return err
+		}
+		var requesterKey MemberKey
+		exists, err = tx.FindOne(map[string]interface{}{"user_id": sr.UserID}, &requesterKey)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrMemberKeyNotFound
+		}
+
+		// The approver's own shares, for the combinations that include the requester
+		var shares []Share
+		err = tx.ScanRaw(&shares, `SELECT totp_combination_shares.* FROM totp_combination_shares
+INNER JOIN totp_combinations ON totp_combinations.id = totp_combination_shares.combination_id AND totp_combinations.deleted_at IS NULL
+INNER JOIN totp_accounts ON totp_accounts.id = totp_combinations.account_id AND totp_accounts.deleted_at IS NULL
+WHERE totp_accounts.vault_id = ? AND ? = ANY(totp_combinations.member_ids)
+AND totp_combination_shares.user_id = ? AND totp_combination_shares.from_user_id = ? AND totp_combination_shares.secret_request_id IS NULL
+AND totp_combination_shares.deleted_at IS NULL`, sr.VaultID, string(sr.UserID), req.UserID, req.UserID)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range shares {
+			var existing Share
+			exists, err := tx.FindOne(map[string]interface{}{"combination_id": s.CombinationID, "from_user_id": req.UserID, "secret_request_id": sr.ID}, &existing)
+			if err != nil {
+				return err
+			}
+			if exists {
+				continue
+			}
+			plain, err := unwrapShare(privateKey, s)
+			if err != nil {
+				return fmt.Errorf("unwrapping share of combination %v: %v", s.CombinationID, err)
+			}
+			contributed, err := wrapShare(requesterKey.PublicKey, plain)
+			if err != nil {
+				return err
+			}
+			srID := sr.ID
+			contributed.CombinationID, contributed.UserID, contributed.FromUserID, contributed.SecretRequestID = s.CombinationID, sr.UserID, req.UserID, &srID
+			if err = tx.InsertOne(&contributed); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* H E L P E R S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// openAccount decrypts the private key of the account, for the user of an approved secret request
+func openAccount(ctx context.Context, a Account, secretRequestID, userID id.ID, passphrase string) ([]byte, error) {
+	if a.Protection == ProtectionCombinations {
+		return openCombinations(ctx, a, secretRequestID, userID, passphrase)
+	}
+	return gMasterKey.open(a)
+}
+
+// encryptCombinations encrypts the private key of the account for every combination of k members of its vault, and
+// replaces any combinations that the account had. The account should already be saved.
+func encryptCombinations(ctx context.Context, tx *orm.Tx, a *Account, privateKey []byte) error {
+	memberIDs, k, err := getVaultThreshold(tx, a.VaultID)
+	if err != nil {
+		return err
+	}
+	if k < 1 || k > len(memberIDs) {
+		return fmt.Errorf("vault needs %d approvals, but has %d members", k, len(memberIDs))
+	}
+	if countCombinations(len(memberIDs), k, getMaxCombinations()) > getMaxCombinations() {
+		return ErrTooManyCombinations
+	}
+
+	var keys []MemberKey
+	_, err = tx.FindWhere(&keys, "user_id IN (?)", memberIDs)
+	if err != nil {
+		return err
+	}
+	var publicKeys = make(map[string][]byte)
+	for _, mk := range keys {
+		publicKeys[string(mk.UserID)] = mk.PublicKey
+	}
+	for _, m := range memberIDs {
+		if publicKeys[m] == nil {
+			return ErrMemberKeyNotFound
+		}
+	}
+
+	var old []Combination
+	_, err = tx.Find(map[string]interface{}{"account_id": a.ID}, &old)
+	if err != nil {
+		return err
+	}
+	err = deleteCombinations(tx, old)
+	if err != nil {
+		return err
+	}
+
+	for _, members := range getCombinations(memberIDs, k) {
+		c, shares, err := sealCombination(privateKey, members, publicKeys)
+		if err != nil {
+			return err
+		}
+		c.AccountID = a.ID
+		if err = tx.InsertOne(&c); err != nil {
+			return err
+		}
+		for i := range shares {
+			shares[i].CombinationID = c.ID
+			if err = tx.InsertOne(&shares[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	a.PendingReencryption = false
+	return tx.UpdateColumnsByConditions(map[string]interface{}{"id": a.ID}, map[string]interface{}{"pending_reencryption": false}, &Account{})
+}
+
+// openCombinations decrypts the private key of the account for the user of the secret request, using their passphrase
+// and the shares that the approvers have contributed. If the account is pending re-encryption, it is re-encrypted for
+// the current members of the vault.
+func openCombinations(ctx context.Context, a Account, secretRequestID, userID id.ID, passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, ErrPassphraseRequired
+	}
+
+	var privateKey []byte
+	err := orm.WithTx(ctx, func(tx *orm.Tx) error {
+		memberKey, err := unlockMemberKey(tx, userID, passphrase)
+		if err != nil {
+			return err
+		}
+
+		var combinations []Combination
+		_, err = tx.FindWhere(&combinations, "account_id = ? AND ? = ANY(member_ids)", a.ID, string(userID))
+		if err != nil {
+			return err
+		}
+		for _, c := range combinations {
+			var shares []Share
+			_, err := tx.FindWhere(&shares, "combination_id = ? AND user_id = ? AND ((secret_request_id IS NULL AND from_user_id = ?) OR secret_request_id = ?)", c.ID, userID, userID, secretRequestID)
+			if err != nil {
+				return err
+			}
+			if len(shares) < len(c.MemberIDs) {
+				continue
+			}
+			privateKey, err = openCombination(c, shares, memberKey)
+			if err != nil {
+				return err
+			}
+			break
+		}
+		if privateKey == nil {
+			return ErrNotEnoughShares
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if a.PendingReencryption {
+		// The re-encryption has its own transaction, so that if it fails half way, the old combinations are kept
+		err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+			// Lock the account, and make sure that no one has re-encrypted it in the meantime
+			var locked Account
+			if _, err := tx.FindByIDForUpdate(a.ID, &locked); err != nil {
+				return err
+			}
+			if !locked.PendingReencryption {
+				return nil
+			}
+			return encryptCombinations(ctx, tx, &locked, privateKey)
+		})
+		if err != nil {
+			// We still have the private key, so the code can be generated. We'll try again next time.
+			clog.Warnf("%s: could not re-encrypt account %v for the members of vault %v: %v", gServiceName, a.ID, a.VaultID, err)
+		}
+	}
+	return privateKey, nil
+}
+
+// syncCombinations is called whenever the members of a vault change. It deletes the combinations of the vault's
+// accounts that include members who left, or that have fewer members than the vault now needs, so that fewer than k
+// members can never decrypt an account. It marks the accounts that need new combinations for re-encryption.
+func syncCombinations(ctx context.Context, tx *orm.Tx, vaultID id.ID) error {
+	var accounts []Account
+	_, err := tx.Find(map[string]interface{}{"vault_id": vaultID, "protection": ProtectionCombinations}, &accounts)
+	if err != nil {
+		return err
+	}
+	if len(accounts) == 0 {
+		return nil
+	}
+
+	memberIDs, k, err := getVaultThreshold(tx, vaultID)
+	if err != nil {
+		return err
+	}
+	isMember := make(map[string]bool)
+	for _, m := range memberIDs {
+		isMember[m] = true
+	}
+	want := countCombinations(len(memberIDs), k, getMaxCombinations())
+
+	for _, a := range accounts {
+		var combinations []Combination
+		_, err := tx.Find(map[string]interface{}{"account_id": a.ID}, &combinations)
+		if err != nil {
+			return err
+		}
+
+		var stale []Combination
+		var current int
+		for _, c := range combinations {
+			ok := len(c.MemberIDs) >= k
+			for _, m := range c.MemberIDs {
+				ok = ok && isMember[m]
+			}
+			if !ok {
+				stale = append(stale, c)
+				continue
+			}
+			if len(c.MemberIDs) == k {
+				current++
+			}
+		}
+		if len(stale) > 0 {
+			clog.Debugf("%s: deleting %d stale combinations of account %v of vault %v", gServiceName, len(stale), a.ID, vaultID)
+			if err := deleteCombinations(tx, stale); err != nil {
+				return err
+			}
+		}
+		if len(stale) == len(combinations) {
+			clog.Warnf("%s: account %v has no combinations left, so its private key can't be decrypted anymore", gServiceName, a.ID)
+		}
+
+		pending := current != want || current != len(combinations)-len(stale)
+		if pending != a.PendingReencryption {
+			err := tx.UpdateColumnsByConditions(map[string]interface{}{"id": a.ID}, map[string]interface{}{"pending_reencryption": pending}, &Account{})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteCombinations deletes the combinations, with their shares
+func deleteCombinations(tx *orm.Tx, combinations []Combination) error {
+	for _, c := range combinations {
+		if _, err := tx.HardDeleteByConditions(map[string]interface{}{"combination_id": c.ID}, &Share{}); err != nil {
+			return err
+		}
+		if _, err := tx.HardDeleteByConditions(map[string]interface{}{"id": c.ID}, &Combination{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getVaultThreshold returns the IDs of the members of the vault, sorted, and the number of members needed to access it
+func getVaultThreshold(tx *orm.Tx, vaultID id.ID) ([]string, int, error) {
+	var sv vault.ShamirsVault
+	_, err := tx.FindOne(map[string]interface{}{"vault_id": vaultID}, &sv)
+	if err != nil {
+		return nil, 0, err
+	}
+	var vus []vault.VaultUser
+	_, err = tx.FindByColumn("vault_id", vaultID, &vus)
+	if err != nil {
+		return nil, 0, err
+	}
+	var memberIDs = make([]string, len(vus))
+	for i, vu := range vus {
+		memberIDs[i] = string(vu.UserID)
+	}
+	sort.Strings(memberIDs)
+
+	// Vaults that haven't been initialized can be opened by any one member
+	k := sv.K
+	if k < 1 {
+		k = 1
+	}
+	return memberIDs, k, nil
+}
+
+// unlockMemberKey derives the private key of the user from their passphrase, and makes sure that it matches their
+// public key
+func unlockMemberKey(tx *orm.Tx, userID id.ID, passphrase string) ([]byte, error) {
+	var mk MemberKey
+	exists, err := tx.FindOne(map[string]interface{}{"user_id": userID}, &mk)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrMemberKeyNotFound
+	}
+	privateKey, publicKey := deriveMemberKeyPair(passphrase, mk.Salt, mk.Iterations)
+	if !hmac.Equal(publicKey, mk.PublicKey) {
+		return nil, ErrWrongPassphrase
+	}
+	return privateKey, nil
+}
+
+// deriveMemberKeyPair derives the X25519 key pair of a member from their passphrase using PBKDF2
+func deriveMemberKeyPair(passphrase string, salt []byte, iterations int) (privateKey, publicKey []byte) {
+	var priv, pub [32]byte
+	copy(priv[:], pwd.GetHash(passphrase, salt, iterations, 32))
+	curve25519.ScalarBaseMult(&pub, &priv)
+	return priv[:], pub[:]
+}
+
+// sealCombination encrypts the private key with a new combination key, and wraps a share of the combination key for
+// each of the members
+func sealCombination(privateKey []byte, members []string, publicKeys map[string][]byte) (Combination, []Share, error) {
+	var c = Combination{MemberIDs: pq.StringArray(members)}
+
+	key := make([]byte, gKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return c, nil, err
+	}
+	var err error
+	c.EncryptedPrivateKey, err = encryptWithKey(key, privateKey)
+	if err != nil {
+		return c, nil, err
+	}
+
+	// All the shares but the last one are random, and the last one makes them XOR into the key
+	var shares []Share
+	last := append([]byte(nil), key...)
+	for i, m := range members {
+		share := last
+		if i < len(members)-1 {
+			share = make([]byte, gKeySize)
+			if _, err := io.ReadFull(rand.Reader, share); err != nil {
+				return c, nil, err
+			}
+			xorInto(last, share)
+		}
+		s, err := wrapShare(publicKeys[m], share)
+		if err != nil {
+			return c, nil, err
+		}
+		s.UserID, s.FromUserID = id.ID(m), id.ID(m)
+		shares = append(shares, s)
+	}
+	return c, shares, nil
+}
+
+// openCombination unwraps the shares of the combination, which should all be wrapped for the user with memberKey, and
+// decrypts the private key
+func openCombination(c Combination, shares []Share, memberKey []byte) ([]byte, error) {
+	var byMember = make(map[id.ID]Share)
+	for _, s := range shares {
+		byMember[s.FromUserID] = s
+	}
+	key := make([]byte, gKeySize)
+	for _, m := range c.MemberIDs {
+		s, ok := byMember[id.ID(m)]
+		if !ok {
+			return nil, ErrNotEnoughShares
+		}
+		share, err := unwrapShare(memberKey, s)
+		if err != nil {
+			return nil, fmt.Errorf("unwrapping share of member %s: %v", m, err)
+		}
+		xorInto(key, share)
+	}
+	return decryptWithKey(key, c.EncryptedPrivateKey)
+}
+
+// wrapShare encrypts the share for the holder of the public key, using an ephemeral X25519 key pair
+func wrapShare(publicKey []byte, share []byte) (Share, error) {
+	var s Share
+	var ephPriv, ephPub, pub, shared [32]byte
+	if _, err := io.ReadFull(rand.Reader, ephPriv[:]); err != nil {
+		return s, err
+	}
+	curve25519.ScalarBaseMult(&ephPub, &ephPriv)
+	copy(pub[:], publicKey)
+	curve25519.ScalarMult(&shared, &ephPriv, &pub)
+
+	var err error
+	s.EphemeralPublicKey = ephPub[:]
+	s.WrappedShare, err = encryptWithKey(getWrappingKey(shared[:], ephPub[:], pub[:]), share)
+	if err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// unwrapShare decrypts a share wrapped for the holder of the private key
+func unwrapShare(privateKey []byte, s Share) ([]byte, error) {
+	var priv, pub, ephPub, shared [32]byte
+	copy(priv[:], privateKey)
+	copy(ephPub[:], s.EphemeralPublicKey)
+	curve25519.ScalarBaseMult(&pub, &priv)
+	curve25519.ScalarMult(&shared, &priv, &ephPub)
+	return decryptWithKey(getWrappingKey(shared[:], ephPub[:], pub[:]), s.WrappedShare)
+}
+
+// getWrappingKey derives the key that wraps a share from the X25519 shared secret and both the public keys
+func getWrappingKey(shared, ephemeralPublicKey, publicKey []byte) []byte {
+	h := sha256.New()
+	h.Write(shared)
+	h.Write(ephemeralPublicKey)
+	h.Write(publicKey)
+	return h.Sum(nil)
+}
+
+// getCombinations returns all the combinations of k of the members, in lexicographic order
+func getCombinations(members []string, k int) [][]string {
+	var result [][]string
+	var indices = make([]int, k)
+	for i := range indices {
+		indices[i] = i
+	}
+	for k <= len(members) {
+		var c = make([]string, k)
+		for i, j := range indices {
+			c[i] = members[j]
+		}
+		result = append(result, c)
+
+		// Move to the next combination: increment the rightmost index that can be incremented, and reset the ones after it
+		i := k - 1
+		for i >= 0 && indices[i] == len(members)-k+i {
+			i--
+		}
+		if i < 0 {
+			break
+		}
+		indices[i]++
+		for j := i + 1; j < k; j++ {
+			indices[j] = indices[j-1] + 1
+		}
+	}
+	return result
+}
+
+// countCombinations returns n choose k, or limit+1 if it's more than limit
+func countCombinations(n, k, limit int) int {
+	if k < 0 || k > n {
+		return 0
+	}
+	if k > n-k {
+		k = n - k
+	}
+	c := 1
+	for i := 0; i < k; i++ {
+		// c * (n-i) is divisible by i+1, since c * (n-i) / (i+1) is (n choose i+1)
+		c = c * (n - i) / (i + 1)
+		if c > limit {
+			return limit + 1
+		}
+	}
+	return c
+}
+
+func getMaxCombinations() int {
+	if n, err := env.GetEnvVarInt(envMaxCombinations); err == nil && n > 0 {
+		return n
+	}
+	return gDefaultMaxCombinations
+}
+
+func xorInto(dst, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
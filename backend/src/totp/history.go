@@ -0,0 +1,167 @@
+package totp
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/teejays/clog"
+
+	"github.com/teejays/n-factor-vault/backend/library/id"
+	"github.com/teejays/n-factor-vault/backend/library/orm"
+
+	"github.com/teejays/n-factor-vault/backend/src/audit"
+	"github.com/teejays/n-factor-vault/backend/src/secret"
+	"github.com/teejays/n-factor-vault/backend/src/vault"
+)
+
+/*
+	Code History
+
+	Every code that we generate is recorded as a CodeEvent: who generated it, for which time step (or HOTP counter),
+	from which IP, and under which approved secret request. If a team shares an account and the website reports a
+	suspicious login, the history tells us which teammate had a code at that time.
+
+	Codes are only ever generated under an approval: every way of getting a code checks the secret request first, and
+	records the code under it. Attempts to get a code without an approval are denied, and recorded as security events
+	(totp.code_denied) against the account. These are the alerts of the account's history.
+*/
+
+// AuditActionCodeDenied is recorded against an account when a user tries to get its code without an approval
+const AuditActionCodeDenied = "totp.code_denied"
+
+// auditEntityAccount is the entity type of the audit events recorded against a TOTP account
+const auditEntityAccount = "totp_account"
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* O R M   M O D E L S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// CodeEvent records the generation of a code
+type CodeEvent struct {
+	orm.BaseModel `gorm:"embedded"`
+	AccountID     id.ID `gorm:"index" json:"account_id"`
+	VaultID       id.ID `json:"vault_id"`
+	UserID        id.ID `gorm:"index" json:"user_id"`
+	// TimeStep is the period that a TOTP code was generated for, counted from T0, or the counter of an HOTP code
+	TimeStep        int64  `json:"time_step"`
+	ClientIP        string `json:"client_ip"`
+	SecretRequestID id.ID  `json:"secret_request_id"`
+}
+
+// TableName overrides the SQL table name of CodeEvent struct
+func (e CodeEvent) TableName() string {
+	return "totp_code_events"
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* M E T H O D S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// GetHistoryRequest is the data required to get the history of an account
+type GetHistoryRequest struct {
+	AccountID id.ID `validate:"required"`
+	UserID    id.ID `validate:"required"` // the user asking for the history, who should be a member of the vault
+}
+
+// History is the record of the codes generated for an account
+type History struct {
+	Events []CodeEvent `json:"events"` // newest first
+	// Alerts are the security events of the account e.g. attempts to get a code without an approval, newest first
+	Alerts []audit.Event `json:"alerts"`
+}
+
+// GetHistory returns the codes generated for an account, and its alerts. Any member of the account's vault can see it.
+func GetHistory(ctx context.Context, req GetHistoryRequest) (History, error) {
+	var h History
+
+	err := validate.Struct(req)
+	if err != nil {
+		return h, err
+	}
+
+	var a Account
+	found, err := orm.FindByID(req.AccountID, &a)
+	if err != nil {
+		return h, err
+	}
+	if !found {
+		return h, ErrAccountNotFound
+	}
+
+	var vu vault.VaultUser
+	found, err = orm.FindOne(map[string]interface{}{"vault_id": a.VaultID, "user_id": req.UserID}, &vu)
+	if err != nil {
+		return h, err
+	}
+	if !found {
+		return h, vault.ErrForbidden
+	}
+
+	_, err = orm.FindByColumn("account_id", a.ID, &h.Events)
+	if err != nil {
+		return h, err
+	}
+	sort.Slice(h.Events, func(i, j int) bool { return h.Events[i].CreatedAt.After(h.Events[j].CreatedAt) })
+
+	events, err := audit.GetEventsByEntity(ctx, auditEntityAccount, a.ID)
+	if err != nil {
+		return h, err
+	}
+	for _, e := range events {
+		if e.Security {
+			h.Alerts = append(h.Alerts, e)
+		}
+	}
+	sort.Slice(h.Alerts, func(i, j int) bool { return h.Alerts[i].CreatedAt.After(h.Alerts[j].CreatedAt) })
+
+	return h, nil
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* H E L P E R S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// recordCodeEvent saves the generation of the code for the time step as part of tx. sr is the approved secret request
+// that the code was generated under, as returned by requireCodeApproval.
+func recordCodeEvent(ctx context.Context, tx *orm.Tx, a Account, req GetCodeRequest, sr *secret.SecretRequest, timeStep int64) error {
+	e := CodeEvent{
+		AccountID:       a.ID,
+		VaultID:         a.VaultID,
+		UserID:          req.UserID,
+		TimeStep:        timeStep,
+		ClientIP:        req.ClientIP,
+		SecretRequestID: sr.ID,
+	}
+	return tx.InsertOne(&e)
+}
+
+// recordCodeDenied raises a security event for a user who tried to get a code of the account without an approval
+func recordCodeDenied(ctx context.Context, a Account, req GetCodeRequest, reason error) {
+	err := audit.RecordSecurityEvent(ctx, audit.RecordRequest{
+		ActorUserID: req.UserID,
+		Action:      AuditActionCodeDenied,
+		EntityType:  auditEntityAccount,
+		EntityID:    a.ID,
+		ClientIP:    req.ClientIP,
+		Details:     fmt.Sprintf("secret request %q: %v", req.SecretRequestID, reason),
+	})
+	if err != nil {
+		clog.Errorf("%s: could not record security event: %v", gServiceName, err)
+	}
+}
+
+// isDeniedApproval returns true if err means that the secret request doesn't approve the access
+func isDeniedApproval(err error) bool {
+	switch err {
+	case secret.ErrRequestNotFound, secret.ErrNotRequester, secret.ErrNotApproved, secret.ErrApprovalExpired, ErrWrongVault:
+		return true
+	}
+	return false
+}
+
+// getTimeStep returns the period, counted from T0, that the unix time t falls in
+func getTimeStep(a Account, t time.Time) int64 {
+	return (t.Unix() - a.StartUnixTime) / a.IntervalSeconds
+}
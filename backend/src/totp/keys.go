@@ -0,0 +1,185 @@
+package totp
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/teejays/clog"
+
+	"github.com/teejays/n-factor-vault/backend/library/env"
+	"github.com/teejays/n-factor-vault/backend/library/orm"
+)
+
+/* Key Management
+
+The private keys of the accounts are protected using envelope encryption. Each account has its own random data key,
+which encrypts the private key. The data key is itself encrypted (wrapped) with the master key-encryption key, and
+stored next to the account as WrappedDataKey.
+
+	PrivateKey + DataKey --> EncryptedPrivateKey (DB)
+	DataKey + MasterKey --> WrappedDataKey (DB)
+
+The master key is loaded from the configuration (TOTP_MASTER_KEY) or a keyfile (TOTP_MASTER_KEY_FILE), and is never
+stored in the database, so someone who can only read the database cannot decrypt the private keys. Accounts store
+the ID of the master key that wrapped their data key, so a wrong master key is caught before decrypting anything.
+
+*/
+
+const (
+	// envMasterKey is the env variable with the base64 encoded master key
+	envMasterKey = "TOTP_MASTER_KEY"
+	// envMasterKeyFile is the env variable with the path to a file that has the base64 encoded master key
+	envMasterKeyFile = "TOTP_MASTER_KEY_FILE"
+)
+
+// gKeySize is the size of the master and the data keys, for AES-256
+const gKeySize = 32
+
+// ErrMasterKeyNotConfigured is returned when neither the master key nor a keyfile has been configured
+var ErrMasterKeyNotConfigured = fmt.Errorf("totp master key is not configured: set %s or %s", envMasterKey, envMasterKeyFile)
+
+// ErrWrongMasterKey is returned when the data key of an account was wrapped with a different master key than the one
+// that is configured
+var ErrWrongMasterKey = fmt.Errorf("totp account was encrypted with a different master key")
+
+// gMasterKey is the master key loaded when the service is initialized
+var gMasterKey *masterKey
+
+// masterKey is the key-encryption key used to wrap the data keys of the accounts
+type masterKey struct {
+	// ID is a fingerprint of the key, so we know which master key wrapped a data key
+	ID  string
+	Key []byte
+}
+
+// loadMasterKey loads the master key from the env variable, or from the keyfile if the variable isn't set
+func loadMasterKey() (*masterKey, error) {
+	if s, err := env.GetEnvVar(envMasterKey); err == nil {
+		return parseMasterKey(s)
+	}
+	if path, err := env.GetEnvVar(envMasterKeyFile); err == nil {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading totp master keyfile: %v", err)
+		}
+		return parseMasterKey(string(b))
+	}
+	return nil, ErrMasterKeyNotConfigured
+}
+
+// parseMasterKey parses a base64 encoded master key
+func parseMasterKey(s string) (*masterKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("totp master key should be base64 encoded: %v", err)
+	}
+	if len(key) != gKeySize {
+		return nil, fmt.Errorf("totp master key should be %d bytes, but it is %d bytes", gKeySize, len(key))
+	}
+	sum := sha256.Sum256(key)
+	return &masterKey{ID: hex.EncodeToString(sum[:8]), Key: key}, nil
+}
+
+// seal encrypts the private key with a new random data key, and wraps the data key with the master key
+func (mk *masterKey) seal(privateKey []byte) (encryptedPrivateKey []byte, wrappedDataKey []byte, err error) {
+	dataKey := make([]byte, gKeySize)
+	if _, err = io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, nil, fmt.Errorf("generating data key: %v", err)
+	}
+	encryptedPrivateKey, err = encryptWithKey(dataKey, privateKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("encrypting private key: %v", err)
+	}
+	wrappedDataKey, err = encryptWithKey(mk.Key, dataKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("wrapping data key: %v", err)
+	}
+	return encryptedPrivateKey, wrappedDataKey, nil
+}
+
+// open unwraps the data key of the account with the master key, and decrypts the private key with it
+func (mk *masterKey) open(a Account) ([]byte, error) {
+	if a.KeyID != mk.ID {
+		return nil, ErrWrongMasterKey
+	}
+	dataKey, err := decryptWithKey(mk.Key, a.WrappedDataKey)
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping data key: %v", err)
+	}
+	privateKey, err := decryptWithKey(dataKey, a.EncryptedPrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting private key: %v", err)
+	}
+	return privateKey, nil
+}
+
+// migrateLegacyAccounts re-encrypts the accounts whose private keys are still encrypted with a key derived from their
+// name, so they use envelope encryption. It is safe to run more than once.
+func migrateLegacyAccounts(ctx context.Context, mk *masterKey) error {
+	var legacy []Account
+	_, err := orm.FindWhere(&legacy, "(wrapped_data_key IS NULL OR length(wrapped_data_key) = 0) AND protection = ?", ProtectionMasterKey)
+	if err != nil {
+		return err
+	}
+	if len(legacy) == 0 {
+		return nil
+	}
+	clog.Warnf("%s: re-encrypting %d accounts that use the legacy encryption key", gServiceName, len(legacy))
+
+	for _, l := range legacy {
+		err := orm.WithTx(ctx, func(tx *orm.Tx) error {
+			// Lock the account, and make sure that it hasn't been migrated by another instance in the meantime
+			var a Account
+			exists, err := tx.FindByIDForUpdate(l.ID, &a)
+			if err != nil {
+				return err
+			}
+			if !exists || len(a.WrappedDataKey) > 0 {
+				return nil
+			}
+			if err = reencryptLegacyAccount(&a, mk); err != nil {
+				return err
+			}
+			cols := map[string]interface{}{
+				"encrypted_private_key": a.EncryptedPrivateKey,
+				"wrapped_data_key":      a.WrappedDataKey,
+				"key_id":                a.KeyID,
+			}
+			return tx.UpdateColumnsByConditions(map[string]interface{}{"id": a.ID}, cols, &Account{})
+		})
+		if err != nil {
+			return fmt.Errorf("re-encrypting totp account %v: %v", l.ID, err)
+		}
+	}
+	return nil
+}
+
+// reencryptLegacyAccount decrypts the private key of the account with the legacy key, and encrypts it again using
+// envelope encryption with the master key
+func reencryptLegacyAccount(a *Account, mk *masterKey) error {
+	privateKey, err := decryptWithKey(getLegacyEncryptionKey(a.Name), a.EncryptedPrivateKey)
+	if err != nil {
+		return fmt.Errorf("decrypting with legacy key: %v", err)
+	}
+	a.EncryptedPrivateKey, a.WrappedDataKey, err = mk.seal(privateKey)
+	if err != nil {
+		return err
+	}
+	a.KeyID = mk.ID
+	return nil
+}
+
+// getLegacyEncryptionKey returns the key that the private keys of accounts used to be encrypted with, before
+// envelope encryption. It is only needed to migrate those accounts.
+func getLegacyEncryptionKey(accountName string) []byte {
+	h := sha256.New()
+	h.Write([]byte(accountName))
+	return h.Sum(nil)
+}
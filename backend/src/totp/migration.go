@@ -0,0 +1,534 @@
+package totp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/teejays/n-factor-vault/backend/library/id"
+	"github.com/teejays/n-factor-vault/backend/library/orm"
+
+	"github.com/teejays/n-factor-vault/backend/src/audit"
+	"github.com/teejays/n-factor-vault/backend/src/secret"
+)
+
+/* Migration Format
+
+Google Authenticator exports its accounts as otpauth-migration://offline?data=... URIs, where data is a base64 encoded
+protobuf message. Large exports are split into batches, one URI (and QR code) per batch. The message is:
+
+	message MigrationPayload {
+		enum Algorithm { ALGORITHM_UNSPECIFIED = 0; SHA1 = 1; SHA256 = 2; SHA512 = 3; MD5 = 4; }
+		enum DigitCount { DIGIT_COUNT_UNSPECIFIED = 0; SIX = 1; EIGHT = 2; }
+		enum OtpType { OTP_TYPE_UNSPECIFIED = 0; HOTP = 1; TOTP = 2; }
+		message OtpParameters {
+			bytes secret = 1;
+			string name = 2;
+			string issuer = 3;
+			Algorithm algorithm = 4;
+			DigitCount digits = 5;
+			OtpType type = 6;
+			int64 counter = 7;
+		}
+		repeated OtpParameters otp_parameters = 1;
+		int32 version = 2;
+		int32 batch_size = 3;
+		int32 batch_index = 4;
+		int32 batch_id = 5;
+	}
+
+The format has no period or T0, so TOTP accounts are always 30 second codes from the Unix epoch. We read and write the
+few fields we need by hand, rather than generating code for it.
+
+*/
+
+// AuditActionExported is recorded against a vault when its TOTP accounts are exported
+const AuditActionExported = "totp.exported"
+
+// gMigrationBatchSize is the number of accounts in each otpauth-migration URI that we export, so the QR codes don't get
+// too dense to scan
+var gMigrationBatchSize = 10
+
+// The field numbers and enum values of the migration payload
+const (
+	migrationFieldOtpParameters = 1
+	migrationFieldVersion       = 2
+	migrationFieldBatchSize     = 3
+	migrationFieldBatchIndex    = 4
+	migrationFieldBatchID       = 5
+
+	migrationParamSecret    = 1
+	migrationParamName      = 2
+	migrationParamIssuer    = 3
+	migrationParamAlgorithm = 4
+	migrationParamDigits    = 5
+	migrationParamType      = 6
+	migrationParamCounter   = 7
+
+	migrationDigitsSix   = 1
+	migrationDigitsEight = 2
+
+	migrationTypeHOTP = 1
+	migrationTypeTOTP = 2
+)
+
+var gMigrationAlgorithms = map[uint64]Algorithm{
+	0: AlgorithmSHA1, // unspecified
+	1: AlgorithmSHA1,
+	2: AlgorithmSHA256,
+	3: AlgorithmSHA512,
+}
+
+// The protobuf wire types that we read
+const (
+	wireVarint          = 0
+	wireFixed64         = 1
+	wireLengthDelimited = 2
+	wireFixed32         = 5
+)
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* M E T H O D S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// ImportMigrationRequest is the data required to import the accounts exported by Google Authenticator
+type ImportMigrationRequest struct {
+	VaultID id.ID `validate:"required"`
+	UserID  id.ID `validate:"required"` // the user importing the accounts, who should own the vault
+	// URIs are the otpauth-migration:// URIs of all the batches of the export
+	URIs []string `validate:"min=1,dive,required"`
+}
+
+// ImportMigration creates the accounts in the otpauth-migration:// URIs in the vault. Either all the accounts are
+// imported, or none of them are. Only the owners of the vault can do this.
+func ImportMigration(ctx context.Context, req ImportMigrationRequest) ([]Account, error) {
+
+	err := validate.Struct(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var accounts []*Account
+	for i, uri := range req.URIs {
+		keys, err := ParseMigrationURI(uri)
+		if err != nil {
+			return nil, fmt.Errorf("URI %d: %v", i+1, err)
+		}
+		for _, k := range keys {
+			a, err := newAccount(CreateAccountRequest{VaultID: req.VaultID, UserID: req.UserID, URI: k.String()})
+			if err != nil {
+				return nil, fmt.Errorf("URI %d: account '%s': %v", i+1, k.Name(), err)
+			}
+			accounts = append(accounts, &a)
+		}
+	}
+
+	err = insertAccounts(ctx, req.VaultID, req.UserID, accounts)
+	if err != nil {
+		return nil, err
+	}
+
+	var imported = make([]Account, len(accounts))
+	for i, a := range accounts {
+		imported[i] = *a
+	}
+	return imported, nil
+}
+
+// ExportRequest is the data required to export the accounts of a vault
+type ExportRequest struct {
+	VaultID id.ID `validate:"required"`
+	// UserID is the user exporting the accounts, who should have made the secret request
+	UserID id.ID `validate:"required"`
+	// SecretRequestID is an approved request to access the secrets of the vault
+	SecretRequestID id.ID `validate:"required"`
+	ClientIP        string
+	// Passphrase is the user's passphrase, needed for accounts protected by threshold combinations
+	Passphrase string
+}
+
+// Export has the accounts of a vault, with their private keys, in the formats that authenticator apps can import
+type Export struct {
+	// MigrationURIs are otpauth-migration:// URIs that Google Authenticator can import, in batches
+	MigrationURIs []string
+	// URIs are the otpauth:// URIs of the accounts, one per account
+	URIs []string
+	// Skipped are the accounts that could not be exported in one or both of the formats
+	Skipped []SkippedAccount
+}
+
+// SkippedAccount is an account that could not be exported in a format
+type SkippedAccount struct {
+	AccountID id.ID
+	Name      string
+	Format    string // "migration" or "uri"
+	Reason    string
+}
+
+// ExportAccounts returns all the TOTP accounts of the vault, with their private keys, e.g. for disaster recovery. The
+// user should hold an approved, unexpired secret request for the vault. Every export is audited.
+func ExportAccounts(ctx context.Context, req ExportRequest) (Export, error) {
+	var e Export
+
+	err := validate.Struct(req)
+	if err != nil {
+		return e, err
+	}
+
+	// Make sure that the peers of the user have approved them to access the vault
+	sr, err := secret.RequireApproval(ctx, secret.GetParams{SecretRequestID: req.SecretRequestID, UserID: req.UserID, ClientIP: req.ClientIP}, "totp.export")
+	if err != nil {
+		return e, err
+	}
+	if sr.VaultID != req.VaultID {
+		return e, ErrWrongVault
+	}
+
+	var accounts []Account
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		_, err := tx.Find(map[string]interface{}{"vault_id": req.VaultID}, &accounts)
+		if err != nil {
+			return err
+		}
+		return audit.Record(ctx, tx, audit.RecordRequest{
+			ActorUserID: req.UserID,
+			Action:      AuditActionExported,
+			EntityType:  "vault",
+			EntityID:    req.VaultID,
+			Details:     fmt.Sprintf("%d accounts, secret request %v", len(accounts), req.SecretRequestID),
+			ClientIP:    req.ClientIP,
+		})
+	})
+	if err != nil {
+		return e, err
+	}
+
+	var keys []KeyURI
+	for _, a := range accounts {
+		// The URIs can't hold T0, so we'd rather not export codes that would be wrong
+		if a.StartUnixTime != 0 {
+			e.Skipped = append(e.Skipped, getSkippedAccounts(a, "start unix time (T0) is not zero")...)
+			continue
+		}
+
+		privateKey, err := openAccount(ctx, a, req.SecretRequestID, req.UserID, req.Passphrase)
+		if err == ErrNotEnoughShares || err == ErrPassphraseRequired {
+			e.Skipped = append(e.Skipped, getSkippedAccounts(a, err.Error())...)
+			continue
+		}
+		if err != nil {
+			return e, fmt.Errorf("decrypting totp account %v: %v", a.ID, err)
+		}
+		k := getAccountKeyURI(a, privateKey)
+		e.URIs = append(e.URIs, k.String())
+
+		if reason := getMigrationUnsupportedReason(a); reason != "" {
+			e.Skipped = append(e.Skipped, SkippedAccount{AccountID: a.ID, Name: a.Name, Format: "migration", Reason: reason})
+			continue
+		}
+		keys = append(keys, k)
+	}
+
+	e.MigrationURIs, err = getMigrationURIs(keys)
+	if err != nil {
+		return e, err
+	}
+
+	return e, nil
+}
+
+// ParseMigrationURI returns the accounts in an otpauth-migration://offline?data=... URI
+func ParseMigrationURI(s string) ([]KeyURI, error) {
+	u, err := url.Parse(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid otpauth-migration URI: %v", err)
+	}
+	if u.Scheme != "otpauth-migration" || u.Host != "offline" {
+		return nil, fmt.Errorf("invalid otpauth-migration URI: should start with otpauth-migration://offline")
+	}
+
+	// The data is standard base64, and its '+' is not always escaped in the URI
+	data := strings.Replace(u.Query().Get("data"), " ", "+", -1)
+	if data == "" {
+		return nil, fmt.Errorf("invalid otpauth-migration URI: data is empty")
+	}
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		if b, err = base64.RawStdEncoding.DecodeString(data); err != nil {
+			return nil, fmt.Errorf("invalid otpauth-migration URI: data should be base64 encoded: %v", err)
+		}
+	}
+
+	keys, err := decodeMigrationPayload(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid otpauth-migration URI: %v", err)
+	}
+	return keys, nil
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* H E L P E R S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// getAccountKeyURI returns the otpauth URI of the account
+func getAccountKeyURI(a Account, privateKey []byte) KeyURI {
+	k := KeyURI{
+		Type:            a.Type,
+		Issuer:          a.Issuer,
+		Label:           a.Label,
+		Secret:          privateKey,
+		Algorithm:       a.Algorithm,
+		Digits:          a.Digits,
+		IntervalSeconds: a.IntervalSeconds,
+		Counter:         a.Counter,
+	}
+	if k.Issuer == "" && k.Label == "" {
+		k.Label = a.Name
+	}
+	return k
+}
+
+// getSkippedAccounts returns the account as skipped in both the formats
+func getSkippedAccounts(a Account, reason string) []SkippedAccount {
+	return []SkippedAccount{
+		{AccountID: a.ID, Name: a.Name, Format: "uri", Reason: reason},
+		{AccountID: a.ID, Name: a.Name, Format: "migration", Reason: reason},
+	}
+}
+
+// getMigrationUnsupportedReason returns why the account can't be exported in the migration format, if it can't
+func getMigrationUnsupportedReason(a Account) string {
+	if a.Digits != 6 && a.Digits != 8 {
+		return fmt.Sprintf("%d digit codes are not supported", a.Digits)
+	}
+	if a.Type == AccountTypeTOTP && a.IntervalSeconds != gDefaultIntervalInSeconds {
+		return fmt.Sprintf("a period of %d seconds is not supported", a.IntervalSeconds)
+	}
+	return ""
+}
+
+// getMigrationURIs encodes the keys into otpauth-migration URIs, gMigrationBatchSize keys per URI
+func getMigrationURIs(keys []KeyURI) ([]string, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	// The batches of an export share a random ID
+	var idBytes [4]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, err
+	}
+	batchID := uint64(binary.BigEndian.Uint32(idBytes[:]) & 0x7fffffff)
+
+	batchSize := (len(keys) + gMigrationBatchSize - 1) / gMigrationBatchSize
+	var uris []string
+	for i := 0; i < batchSize; i++ {
+		end := (i + 1) * gMigrationBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		b, err := encodeMigrationPayload(keys[i*gMigrationBatchSize:end], batchSize, i, batchID)
+		if err != nil {
+			return nil, err
+		}
+		q := url.Values{}
+		q.Set("data", base64.StdEncoding.EncodeToString(b))
+		u := url.URL{Scheme: "otpauth-migration", Host: "offline", RawQuery: q.Encode()}
+		uris = append(uris, u.String())
+	}
+	return uris, nil
+}
+
+// encodeMigrationPayload encodes the keys as one batch of a MigrationPayload
+func encodeMigrationPayload(keys []KeyURI, batchSize, batchIndex int, batchID uint64) ([]byte, error) {
+	var b []byte
+	for _, k := range keys {
+		secret, err := decodeSecret(k.Secret)
+		if err != nil {
+			return nil, err
+		}
+		name := k.Label
+		if k.Issuer != "" {
+			name = k.Issuer + ":" + k.Label
+		}
+
+		var p []byte
+		p = appendProtoBytes(p, migrationParamSecret, secret)
+		p = appendProtoBytes(p, migrationParamName, []byte(name))
+		if k.Issuer != "" {
+			p = appendProtoBytes(p, migrationParamIssuer, []byte(k.Issuer))
+		}
+		switch k.Algorithm {
+		case AlgorithmSHA256:
+			p = appendProtoVarint(p, migrationParamAlgorithm, 2)
+		case AlgorithmSHA512:
+			p = appendProtoVarint(p, migrationParamAlgorithm, 3)
+		default:
+			p = appendProtoVarint(p, migrationParamAlgorithm, 1)
+		}
+		digits := uint64(migrationDigitsSix)
+		if k.Digits == 8 {
+			digits = migrationDigitsEight
+		}
+		p = appendProtoVarint(p, migrationParamDigits, digits)
+		if k.Type == AccountTypeHOTP {
+			p = appendProtoVarint(p, migrationParamType, migrationTypeHOTP)
+			p = appendProtoVarint(p, migrationParamCounter, uint64(k.Counter))
+		} else {
+			p = appendProtoVarint(p, migrationParamType, migrationTypeTOTP)
+		}
+
+		b = appendProtoBytes(b, migrationFieldOtpParameters, p)
+	}
+	b = appendProtoVarint(b, migrationFieldVersion, 1)
+	b = appendProtoVarint(b, migrationFieldBatchSize, uint64(batchSize))
+	b = appendProtoVarint(b, migrationFieldBatchIndex, uint64(batchIndex))
+	b = appendProtoVarint(b, migrationFieldBatchID, batchID)
+	return b, nil
+}
+
+// decodeMigrationPayload decodes the accounts in a MigrationPayload. Fields that we don't know are ignored.
+func decodeMigrationPayload(b []byte) ([]KeyURI, error) {
+	var keys []KeyURI
+	err := readProtoFields(b, func(num int, v uint64, data []byte) error {
+		if num != migrationFieldOtpParameters || data == nil {
+			return nil
+		}
+		k, err := decodeMigrationOtpParameters(data)
+		if err != nil {
+			return fmt.Errorf("account %d: %v", len(keys)+1, err)
+		}
+		keys = append(keys, k)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no accounts found")
+	}
+	return keys, nil
+}
+
+// decodeMigrationOtpParameters decodes one account of a MigrationPayload
+func decodeMigrationOtpParameters(b []byte) (KeyURI, error) {
+	var k = KeyURI{Type: AccountTypeTOTP, Algorithm: AlgorithmSHA1, Digits: 6}
+	var secret []byte
+	var name string
+	err := readProtoFields(b, func(num int, v uint64, data []byte) error {
+		switch num {
+		case migrationParamSecret:
+			secret = data
+		case migrationParamName:
+			name = string(data)
+		case migrationParamIssuer:
+			k.Issuer = string(data)
+		case migrationParamAlgorithm:
+			a, ok := gMigrationAlgorithms[v]
+			if !ok {
+				return fmt.Errorf("unsupported algorithm %d", v)
+			}
+			k.Algorithm = a
+		case migrationParamDigits:
+			if v == migrationDigitsEight {
+				k.Digits = 8
+			}
+		case migrationParamType:
+			if v == migrationTypeHOTP {
+				k.Type = AccountTypeHOTP
+			}
+		case migrationParamCounter:
+			k.Counter = int64(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return k, err
+	}
+	if len(secret) == 0 {
+		return k, fmt.Errorf("secret is empty")
+	}
+	k.Secret = []byte(base32.StdEncoding.EncodeToString(secret))
+
+	// The name is "Issuer:account" or "account", like the label of an otpauth URI
+	if i := strings.Index(name, ":"); i >= 0 {
+		if k.Issuer == "" {
+			k.Issuer = strings.TrimSpace(name[:i])
+		}
+		name = name[i+1:]
+	}
+	k.Label = strings.TrimSpace(name)
+	return k, nil
+}
+
+// readProtoFields calls fn with each field of the protobuf message b, with either the value of a varint field or the
+// data of a length-delimited field. Fixed size fields are skipped.
+func readProtoFields(b []byte, fn func(num int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return fmt.Errorf("malformed protobuf tag")
+		}
+		b = b[n:]
+		num, wireType := int(tag>>3), int(tag&0x7)
+
+		var v uint64
+		var data []byte
+		switch wireType {
+		case wireVarint:
+			v, n = binary.Uvarint(b)
+			if n <= 0 {
+				return fmt.Errorf("malformed protobuf varint of field %d", num)
+			}
+			b = b[n:]
+		case wireLengthDelimited:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return fmt.Errorf("malformed protobuf length of field %d", num)
+			}
+			data = b[n : n+int(l)]
+			b = b[n+int(l):]
+		case wireFixed64, wireFixed32:
+			size := 8
+			if wireType == wireFixed32 {
+				size = 4
+			}
+			if len(b) < size {
+				return fmt.Errorf("malformed protobuf field %d", num)
+			}
+			b = b[size:]
+			continue
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d of field %d", wireType, num)
+		}
+
+		if err := fn(num, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendProtoVarint appends a varint field to the protobuf message b
+func appendProtoVarint(b []byte, num int, v uint64) []byte {
+	b = appendUvarint(b, uint64(num)<<3|wireVarint)
+	return appendUvarint(b, v)
+}
+
+// appendProtoBytes appends a length-delimited field to the protobuf message b
+func appendProtoBytes(b []byte, num int, data []byte) []byte {
+	b = appendUvarint(b, uint64(num)<<3|wireLengthDelimited)
+	b = appendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
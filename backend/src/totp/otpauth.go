@@ -0,0 +1,229 @@
+package totp
+
+import (
+	"bytes"
+	"encoding/base32"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+
+	// Register the image formats that the QR codes can be uploaded in
+	_ "image/jpeg"
+	_ "image/png"
+
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/qrcode"
+)
+
+// gMaxQRCodeBytes is the largest QR code image that we'll decode
+var gMaxQRCodeBytes int64 = 5 << 20
+
+// gBase32 decodes the secrets of the URIs, which usually leave out the padding
+var gBase32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// KeyURI is an otpauth:// URI, which websites use to share the private key and the parameters of an account. Its
+// format is described at https://github.com/google/google-authenticator/wiki/Key-Uri-Format
+type KeyURI struct {
+	Type   AccountType
+	Issuer string
+	// Label is the name of the user's account on the website, e.g. their email
+	Label     string
+	Secret    []byte // base32 encoded
+	Algorithm Algorithm
+	Digits    int
+	// IntervalSeconds is the period of the codes, for TOTP
+	IntervalSeconds int64
+	// Counter is the initial counter, for HOTP
+	Counter int64
+}
+
+// ParseKeyURI parses an otpauth://totp/... or otpauth://hotp/... URI
+func ParseKeyURI(s string) (*KeyURI, error) {
+	u, err := url.Parse(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid otpauth URI: %v", err)
+	}
+	if u.Scheme != "otpauth" {
+		return nil, fmt.Errorf("invalid otpauth URI: scheme should be otpauth, but it is '%s'", u.Scheme)
+	}
+
+	var k KeyURI
+
+	switch strings.ToLower(u.Host) {
+	case "totp":
+		k.Type = AccountTypeTOTP
+	case "hotp":
+		k.Type = AccountTypeHOTP
+	default:
+		return nil, fmt.Errorf("invalid otpauth URI: type should be totp or hotp, but it is '%s'", u.Host)
+	}
+
+	// The label is either "Issuer:account" or "account"
+	label := strings.TrimPrefix(u.Path, "/")
+	if i := strings.Index(label, ":"); i >= 0 {
+		k.Issuer, label = strings.TrimSpace(label[:i]), label[i+1:]
+	}
+	k.Label = strings.TrimSpace(label)
+
+	q := u.Query()
+	if issuer := q.Get("issuer"); issuer != "" {
+		k.Issuer = issuer
+	}
+
+	secret, err := normalizeSecret([]byte(q.Get("secret")))
+	if err != nil {
+		return nil, fmt.Errorf("invalid otpauth URI: %v", err)
+	}
+	k.Secret = secret
+
+	if a := q.Get("algorithm"); a != "" {
+		k.Algorithm = Algorithm(strings.ToUpper(a))
+		if _, ok := gAlgorithms[k.Algorithm]; !ok {
+			return nil, fmt.Errorf("invalid otpauth URI: unsupported algorithm '%s'", a)
+		}
+	}
+	if d := q.Get("digits"); d != "" {
+		if k.Digits, err = strconv.Atoi(d); err != nil {
+			return nil, fmt.Errorf("invalid otpauth URI: digits should be a number, but it is '%s'", d)
+		}
+	}
+	if p := q.Get("period"); p != "" {
+		if k.IntervalSeconds, err = strconv.ParseInt(p, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid otpauth URI: period should be a number, but it is '%s'", p)
+		}
+	}
+	if k.Type == AccountTypeHOTP {
+		c := q.Get("counter")
+		if c == "" {
+			return nil, fmt.Errorf("invalid otpauth URI: counter is required for hotp")
+		}
+		if k.Counter, err = strconv.ParseInt(c, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid otpauth URI: counter should be a number, but it is '%s'", c)
+		}
+	}
+
+	return &k, nil
+}
+
+// Name returns a name for the account: the issuer, or the label if there's no issuer
+func (k KeyURI) Name() string {
+	if k.Issuer != "" {
+		return k.Issuer
+	}
+	return k.Label
+}
+
+// String returns the otpauth:// URI
+func (k KeyURI) String() string {
+	label := k.Label
+	if k.Issuer != "" {
+		label = k.Issuer + ":" + k.Label
+	}
+
+	q := url.Values{}
+	q.Set("secret", strings.TrimRight(string(k.Secret), "="))
+	if k.Issuer != "" {
+		q.Set("issuer", k.Issuer)
+	}
+	if k.Algorithm != "" {
+		q.Set("algorithm", string(k.Algorithm))
+	}
+	if k.Digits != 0 {
+		q.Set("digits", strconv.Itoa(k.Digits))
+	}
+	if k.Type == AccountTypeHOTP {
+		q.Set("counter", strconv.FormatInt(k.Counter, 10))
+	} else if k.IntervalSeconds != 0 {
+		q.Set("period", strconv.FormatInt(k.IntervalSeconds, 10))
+	}
+
+	u := url.URL{Scheme: "otpauth", Host: strings.ToLower(string(k.Type)), Path: "/" + label, RawQuery: q.Encode()}
+	return u.String()
+}
+
+// DecodeQRCode decodes a PNG or JPEG image of a QR code into the text that it holds, e.g. an otpauth:// URI. The image
+// is decoded locally, so the secrets in it are not shared with anyone.
+func DecodeQRCode(r io.Reader) (string, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, gMaxQRCodeBytes+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(b)) > gMaxQRCodeBytes {
+		return "", fmt.Errorf("QR code image should not be larger than %d bytes", gMaxQRCodeBytes)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return "", fmt.Errorf("QR code should be a PNG or JPEG image: %v", err)
+	}
+	bmp, err := gozxing.NewBinaryBitmapFromImage(img)
+	if err != nil {
+		return "", fmt.Errorf("reading QR code image: %v", err)
+	}
+	result, err := qrcode.NewQRCodeReader().Decode(bmp, nil)
+	if err != nil {
+		return "", fmt.Errorf("no QR code found in the image: %v", err)
+	}
+	return result.GetText(), nil
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* H E L P E R S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// applyKeyURI fills the private key and the parameters of the request from the URI. Fields that are set in the
+// request, e.g. a name chosen by the user, are kept.
+func applyKeyURI(req CreateAccountRequest, k *KeyURI) CreateAccountRequest {
+	req.PrivateKey = k.Secret
+	if req.Type == "" {
+		req.Type = k.Type
+		req.Counter = k.Counter
+	}
+	if req.Name == "" {
+		req.Name = k.Name()
+	}
+	if req.Algorithm == "" {
+		req.Algorithm = k.Algorithm
+	}
+	if req.Digits == 0 {
+		req.Digits = k.Digits
+	}
+	if req.IntervalSeconds == 0 {
+		req.IntervalSeconds = k.IntervalSeconds
+	}
+	return req
+}
+
+// normalizeSecret makes sure that the base32 encoded secret can be decoded, and returns it in the canonical form:
+// upper case, without spaces, with padding. Websites often show the secret in lower case, in groups of four letters
+// and without the padding.
+func normalizeSecret(secret []byte) ([]byte, error) {
+	b, err := decodeSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(base32.StdEncoding.EncodeToString(b)), nil
+}
+
+// decodeSecret decodes a base32 encoded secret, ignoring case, spaces and padding
+func decodeSecret(secret []byte) ([]byte, error) {
+	s := strings.ToUpper(string(secret))
+	s = strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' || r == '=' {
+			return -1
+		}
+		return r
+	}, s)
+	if s == "" {
+		return nil, fmt.Errorf("secret is empty")
+	}
+	b, err := gBase32.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("secret should be base32 encoded: %v", err)
+	}
+	return b, nil
+}
@@ -0,0 +1,162 @@
+package totp
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/teejays/n-factor-vault/backend/library/orm"
+
+	"github.com/teejays/n-factor-vault/backend/src/secret"
+	"github.com/teejays/n-factor-vault/backend/src/vault"
+)
+
+// ErrStreamNotSupported is returned when streaming the codes of an HOTP account, which are only issued one at a time
+var ErrStreamNotSupported = fmt.Errorf("codes can only be streamed for TOTP accounts")
+
+// ErrNoRevealWindow is returned when the reveal window of an approval doesn't close, so a stream would never end
+var ErrNoRevealWindow = fmt.Errorf("the approval has no reveal window")
+
+// CodeUpdate is pushed by a code stream at the start of every period. It has the current code, and the next one, so a
+// client can switch to the next code right at the boundary without waiting on the network.
+type CodeUpdate struct {
+	Current Code
+	Next    Code
+}
+
+// StreamCodes sends the codes of a TOTP account at the start of every period, for as long as the approval of the
+// secret request can be used. The first update is sent right away. The approval is checked again at every period, so
+// the stream stops as soon as the vault can no longer be accessed e.g. from the client's IP. It blocks until the
+// approval's reveal window closes, in which case it returns nil, or until ctx is done, send fails, or the approval
+// can't be used anymore, in which case it returns the error.
+func StreamCodes(ctx context.Context, req GetCodeRequest, send func(CodeUpdate) error) error {
+	err := validate.Struct(req)
+	if err != nil {
+		return err
+	}
+
+	var a Account
+	found, err := orm.FindByID(req.AccountID, &a)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrAccountNotFound
+	}
+	if a.Type == AccountTypeHOTP {
+		return ErrStreamNotSupported
+	}
+
+	sr, closeAt, err := requireStreamApproval(ctx, req, a)
+	if err != nil {
+		return err
+	}
+
+	// The private key is only decrypted once, and stays in memory for as long as the stream is open
+	privateKey, err := openAccount(ctx, a, req.SecretRequestID, req.UserID, req.Passphrase)
+	if err != nil {
+		return err
+	}
+
+	// The next code of an update is the current code of the one after it, so we only record the steps that are new
+	var lastStep int64 = -1
+	for {
+		// Codes are only pushed while the window is open
+		if !time.Now().Before(closeAt) {
+			return nil
+		}
+
+		u, err := getCodeUpdate(a, privateKey, time.Now().Unix())
+		if err != nil {
+			return err
+		}
+		err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+			for _, c := range []Code{u.Current, u.Next} {
+				step := getTimeStep(a, c.ValidAt)
+				if step <= lastStep {
+					continue
+				}
+				if err := recordCodeEvent(ctx, tx, a, req, sr, step); err != nil {
+					return err
+				}
+				lastStep = step
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := send(u); err != nil {
+			return err
+		}
+
+		// Wait for the next period, or for the reveal window to close if that's sooner
+		wakeAt, closing := u.Current.ExpireAt, false
+		if !closeAt.After(wakeAt) {
+			wakeAt, closing = closeAt, true
+		}
+		t := time.NewTimer(time.Until(wakeAt))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+		if closing {
+			return nil
+		}
+
+		sr, closeAt, err = requireStreamApproval(ctx, req, a)
+		if err == secret.ErrApprovalExpired {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* H E L P E R S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// requireStreamApproval makes sure that the user can access the account's vault with the secret request, and returns
+// the request along with when its reveal window closes. Every approval's window closes at some point, so a stream
+// never outlives it.
+func requireStreamApproval(ctx context.Context, req GetCodeRequest, a Account) (*secret.SecretRequest, time.Time, error) {
+	sr, err := requireCodeApproval(ctx, req, a, "totp.stream")
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	v, err := vault.GetVault(ctx, sr.VaultID)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if v == nil {
+		return nil, time.Time{}, vault.ErrVaultNotFound
+	}
+
+	closeAt := v.ApprovalPolicy.ExpiresAt(*sr.ApprovedAt)
+	if closeAt.IsZero() {
+		return nil, time.Time{}, ErrNoRevealWindow
+	}
+	return sr, closeAt, nil
+}
+
+// getCodeUpdate returns the code of the account for the period that includes the unix time now, and the code of the
+// period after it
+func getCodeUpdate(a Account, privateKey []byte, now int64) (CodeUpdate, error) {
+	var u CodeUpdate
+	var err error
+
+	u.Current, err = getTOTPCode(a, privateKey, now)
+	if err != nil {
+		return u, err
+	}
+	u.Next, err = getTOTPCode(a, privateKey, u.Current.ExpireAt.Unix())
+	if err != nil {
+		return u, err
+	}
+	return u, nil
+}
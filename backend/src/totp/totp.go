@@ -1,16 +1,17 @@
 package totp
 
 import (
-	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha1"
 	"crypto/sha256"
-	"encoding/base32"
+	"crypto/sha512"
 	"encoding/binary"
 	"fmt"
+	"hash"
 	"io"
 	"math"
 	"time"
@@ -21,6 +22,9 @@ import (
 	"github.com/teejays/clog"
 	"github.com/teejays/n-factor-vault/backend/library/id"
 	"github.com/teejays/n-factor-vault/backend/library/orm"
+
+	"github.com/teejays/n-factor-vault/backend/src/secret"
+	"github.com/teejays/n-factor-vault/backend/src/vault"
 )
 
 func init() {}
@@ -83,11 +87,56 @@ func init() {}
 
 */
 
+var gServiceName = "TOTP Service"
+
 var validate *validator.Validate
 
+// ErrAccountNotFound is returned when a TOTP account does not exist
+var ErrAccountNotFound = fmt.Errorf("totp account not found")
+
+// ErrWrongVault is returned when the secret request used to get a code is for a different vault than the account's
+var ErrWrongVault = fmt.Errorf("secret request is not for the vault of the totp account")
+
 var gDefaultStartUnixTime int64 // defaults to 0
 var gDefaultIntervalInSeconds int64 = 30
 var gDefaultCodeLength = 6
+var gDefaultAlgorithm = AlgorithmSHA1
+
+// gResyncWindow is how many counters after the current one we look at, when resyncing an HOTP account
+var gResyncWindow int64 = 100
+
+// ErrNotHOTP is returned when an operation that only makes sense for HOTP accounts is done on a TOTP account
+var ErrNotHOTP = fmt.Errorf("totp account is not an HOTP account")
+
+// ErrResyncFailed is returned when the codes given to resync an HOTP account don't match any counter in the window
+var ErrResyncFailed = fmt.Errorf("could not find the codes within %d counters of the current one", gResyncWindow)
+
+// AccountType is the kind of one-time passwords an account generates
+type AccountType string
+
+// The supported account types
+const (
+	// AccountTypeTOTP accounts generate time-based codes (RFC 6238)
+	AccountTypeTOTP AccountType = "TOTP"
+	// AccountTypeHOTP accounts generate counter-based codes (RFC 4226)
+	AccountTypeHOTP AccountType = "HOTP"
+)
+
+// Algorithm is the HMAC hash function used to generate the codes of an account
+type Algorithm string
+
+// The algorithms allowed by RFC 6238
+const (
+	AlgorithmSHA1   Algorithm = "SHA1"
+	AlgorithmSHA256 Algorithm = "SHA256"
+	AlgorithmSHA512 Algorithm = "SHA512"
+)
+
+var gAlgorithms = map[Algorithm]func() hash.Hash{
+	AlgorithmSHA1:   sha1.New,
+	AlgorithmSHA256: sha256.New,
+	AlgorithmSHA512: sha512.New,
+}
 
 /* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
 * O R M   M O D E L S
@@ -97,21 +146,52 @@ var gDefaultCodeLength = 6
 func Init() error {
 	validate = validator.New()
 
-	err := orm.RegisterModels(&Account{})
+	mk, err := loadMasterKey()
 	if err != nil {
 		return err
 	}
+	gMasterKey = mk
 
-	return err
+	err = quarantineAccountsWithoutVault(context.Background(), gMasterKey)
+	if err != nil {
+		return err
+	}
+
+	err = orm.RegisterModels(&Account{}, &MemberKey{}, &Combination{}, &Share{}, &CodeEvent{})
+	if err != nil {
+		return err
+	}
+
+	// The accounts protected by threshold combinations should follow the members of their vaults
+	vault.RegisterMembershipHook(syncCombinations)
+	// The accounts of a vault go with it when it's purged
+	vault.RegisterPurgeHook(purgeVaultAccounts)
+
+	return migrateLegacyAccounts(context.Background(), gMasterKey)
 }
 
 // Account represents one TOTP setup for a particular website/service
 type Account struct {
 	orm.BaseModel       `gorm:"EMBEDDED"`
-	Name                string `gorm:"INDEX"`
-	EncryptedPrivateKey []byte `gorm:"NOT NULL"`
-	StartUnixTime       int64
-	IntervalSeconds     int64
+	VaultID             id.ID       `gorm:"INDEX;NOT NULL"` // the vault whose members can get codes for the account
+	Name                string      `gorm:"INDEX"`
+	Type                AccountType `gorm:"NOT NULL;default:'TOTP'"`
+	Issuer              string      // the website, if the account was imported from an otpauth URI
+	Label               string      // the user's account on the website, if imported from an otpauth URI
+	EncryptedPrivateKey []byte      `gorm:"NOT NULL"` // encrypted with the data key of the account
+	WrappedDataKey      []byte      // the data key of the account, encrypted with the master key
+	KeyID               string      // the ID of the master key that wrapped the data key
+	Algorithm           Algorithm   `gorm:"NOT NULL;default:'SHA1'"` // the HMAC hash function
+	Digits              int         `gorm:"NOT NULL;default:6"`      // the length of the codes
+	StartUnixTime       int64       // T0, the time from which we start counting the intervals
+	IntervalSeconds     int64       // the period for which a code is valid
+	Counter             int64       // the counter of the next code, for HOTP accounts
+	Protection          Protection  `gorm:"NOT NULL;default:'MASTER_KEY'"`
+	// PendingReencryption is set when the members of the vault change, and the account needs to be encrypted for new
+	// combinations of members
+	PendingReencryption bool
+
+	privateKey []byte // the private key of a new account protected by combinations, until it's encrypted
 }
 
 // TableName overrides the SQL table name of Account struct
@@ -123,7 +203,8 @@ func (a Account) TableName() string {
 type Code struct {
 	Code     string
 	ValidAt  time.Time
-	ExpireAt time.Time
+	ExpireAt time.Time // zero for HOTP codes, which are valid until they're used
+	Counter  int64     // the counter that an HOTP code was generated for
 }
 
 /* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
@@ -132,41 +213,35 @@ type Code struct {
 
 // CreateAccountRequest is the data required to create a new Account
 type CreateAccountRequest struct {
+	VaultID    id.ID  `validate:"required"`
+	UserID     id.ID  `validate:"required"` // the user creating the account, who should own the vault
 	Name       string `validate:"required"`
 	PrivateKey []byte `validate:"required,min=1"`
+	// URI is an otpauth:// URI, which can be given instead of the private key and the parameters below
+	URI string
+	// Type defaults to TOTP. HOTP accounts start at Counter.
+	Type    AccountType `validate:"omitempty,oneof=TOTP HOTP"`
+	Counter int64       `validate:"min=0"`
+	// Protection defaults to MASTER_KEY. COMBINATIONS needs every member of the vault to have set up a passphrase.
+	Protection Protection `validate:"omitempty,oneof=MASTER_KEY COMBINATIONS"`
+	// The RFC 6238 parameters, as set up by the website. They are optional, and default to SHA1, 6 digits, a 30
+	// second period and a T0 of zero, which is what most websites use.
+	Algorithm       Algorithm `validate:"omitempty,oneof=SHA1 SHA256 SHA512"`
+	Digits          int       `validate:"omitempty,min=6,max=8"`
+	IntervalSeconds int64     `validate:"omitempty,min=1,max=3600"`
+	StartUnixTime   int64     `validate:"min=0"`
 }
 
-// CreateAccount creates a TOTP instance
-func CreateAccount(req CreateAccountRequest) (Account, error) {
-	var a Account
+// CreateAccount creates a TOTP instance in a vault. Only the owners of the vault can do this.
+func CreateAccount(ctx context.Context, req CreateAccountRequest) (Account, error) {
 
-	// Validate the request
-	err := validate.Struct(req)
+	a, err := newAccount(req)
 	if err != nil {
 		return a, err
 	}
 
-	a.Name = req.Name
-
-	// Encrypt the private key
-	// TODO: Make the encryption safer, but for POC this is fine
-	// In order to encrypt, we will need an encryption key. Let's generate this encryption key
-	// using a combination of a stored common key + service name + salt
-
-	// Populate the TOTP instance
-	key := getEncryptionKey(req.Name)
-	encryptedPrivateKey, err := encryptWithKey(key, req.PrivateKey)
-	if err != nil {
-		return a, err
-	}
-	a.EncryptedPrivateKey = encryptedPrivateKey
-
-	a.StartUnixTime = gDefaultStartUnixTime // Assume that we start from timestamp zero, otherwise find what the standard is, or take it from the request
-
-	a.IntervalSeconds = gDefaultIntervalInSeconds // use this as default interval seconds for now, or take it from request
-
 	// Save it in the database
-	err = orm.InsertOne(&a)
+	err = insertAccounts(ctx, req.VaultID, req.UserID, []*Account{&a})
 	if err != nil {
 		return a, err
 	}
@@ -178,13 +253,26 @@ func CreateAccount(req CreateAccountRequest) (Account, error) {
 // GetCodeRequest is the data required to get a code for an account
 type GetCodeRequest struct {
 	AccountID id.ID `validate:"required"`
+	// UserID is the user asking for the code, who should have made the secret request
+	UserID id.ID `validate:"required"`
+	// SecretRequestID is an approved request to access the secrets of the account's vault
+	SecretRequestID id.ID `validate:"required"`
+	ClientIP        string
+	// Passphrase is the user's passphrase, needed for accounts protected by threshold combinations
+	Passphrase string
 }
 
-// GetCode generates a TOTP code for the given TOTP connection
-func GetCode(req GetCodeRequest) (Code, error) {
+// GetCode generates a TOTP code for the given TOTP connection. The user should hold an approved, unexpired secret
+// request for the vault of the account.
+func GetCode(ctx context.Context, req GetCodeRequest) (Code, error) {
 
 	var c Code
 
+	err := validate.Struct(req)
+	if err != nil {
+		return c, err
+	}
+
 	// Get the TOTP instance for this ID
 	var a Account
 	found, err := orm.FindByID(req.AccountID, &a)
@@ -192,41 +280,403 @@ func GetCode(req GetCodeRequest) (Code, error) {
 		return c, err
 	}
 	if !found {
-		return c, errors.New("no account found")
+		return c, ErrAccountNotFound
 	}
 
-	// decrypt the private key of this connection
-	key := getEncryptionKey(a.Name)
-	privateKey, err := decryptWithKey(key, a.EncryptedPrivateKey)
+	// Make sure that the peers of the user have approved them to access the vault
+	sr, err := requireCodeApproval(ctx, req, a, "totp.code")
 	if err != nil {
-		return c, fmt.Errorf("decrypting with key: %v", err)
+		return c, err
 	}
 
-	// generate a TOTP code
-	now := time.Now().Unix()
-	code, err := getTOTPValue(privateKey, a.StartUnixTime, now, a.IntervalSeconds)
+	// decrypt the private key of this connection
+	privateKey, err := openAccount(ctx, a, req.SecretRequestID, req.UserID, req.Passphrase)
 	if err != nil {
-		return c, fmt.Errorf("generating TOTP code: %v", err)
+		return c, err
 	}
-	// Get expiry timestamp
-	c.Code = code
-	numIntervals := int64(math.Ceil(float64(now-a.StartUnixTime) / float64(a.IntervalSeconds)))
-	expireAtInUnix := a.StartUnixTime + numIntervals*a.IntervalSeconds
-	c.ExpireAt = time.Unix(expireAtInUnix, 0)
 
-	// Get start validity timestamp
-	c.ValidAt = c.ExpireAt.Add(-time.Second * time.Duration(a.IntervalSeconds))
+	if a.Type == AccountTypeHOTP {
+		return issueHOTPCode(ctx, req, sr, privateKey)
+	}
+
+	c, err = getTOTPCode(a, privateKey, time.Now().Unix())
+	if err != nil {
+		return c, err
+	}
 
+	// A code is only handed out once its generation is on record
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		return recordCodeEvent(ctx, tx, a, req, sr, getTimeStep(a, c.ValidAt))
+	})
+	if err != nil {
+		return Code{}, err
+	}
 	return c, nil
 }
 
+// ResyncRequest is the data required to resync the counter of an HOTP account
+type ResyncRequest struct {
+	AccountID id.ID `validate:"required"`
+	UserID    id.ID `validate:"required"` // the user resyncing the account, who should own its vault
+	// Codes are consecutive codes generated by the token that the account should be in sync with, oldest first
+	Codes []string `validate:"min=2,max=10,dive,numeric"`
+}
+
+// ResyncAccount moves the counter of an HOTP account forward, to right after the consecutive codes in the request.
+// Only the owners of the account's vault can do this. The counter never moves back, so codes that were issued once
+// are never issued again.
+func ResyncAccount(ctx context.Context, req ResyncRequest) (Account, error) {
+	var a Account
+
+	err := validate.Struct(req)
+	if err != nil {
+		return a, err
+	}
+
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		// Lock the account, so no codes are issued while we resync it
+		exists, err := tx.FindByIDForUpdate(req.AccountID, &a)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrAccountNotFound
+		}
+		if a.Type != AccountTypeHOTP {
+			return ErrNotHOTP
+		}
+		if a.Protection == ProtectionCombinations {
+			return ErrCombinationsNotSupported
+		}
+		err = vault.RequireRoleTx(ctx, tx, a.VaultID, req.UserID, vault.RoleOwner)
+		if err != nil {
+			return err
+		}
+
+		privateKey, err := gMasterKey.open(a)
+		if err != nil {
+			return err
+		}
+		counter, found, err := findHOTPCounter(privateKey, a.Algorithm, a.Digits, a.Counter, req.Codes)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return ErrResyncFailed
+		}
+
+		a.Counter = counter + int64(len(req.Codes))
+		return tx.UpdateColumnsByConditions(map[string]interface{}{"id": a.ID}, map[string]interface{}{"counter": a.Counter}, &Account{})
+	})
+	if err != nil {
+		return a, err
+	}
+
+	return a, nil
+}
+
 /* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
 * H E L P E R S
 * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
-func getEncryptionKey(accountName string) []byte {
-	h := sha256.New()
-	h.Write([]byte(accountName))
-	return h.Sum(nil)
+
+// quarantineAccountsWithoutVault moves the accounts that were created before accounts belonged to vaults, and that no
+// one can be allowed to get the codes of, out of totp_accounts into totp_accounts_quarantine. It then makes vault_id
+// NOT NULL, which it can't be while they are there. Since these accounts predate envelope encryption, it re-encrypts
+// their private keys with the master key first, as well as those of accounts that were quarantined before, so that
+// quarantined accounts can be moved back once they are given a vault. It runs before the model is migrated, and is
+// safe to run more than once.
+func quarantineAccountsWithoutVault(ctx context.Context, mk *masterKey) error {
+	if !orm.HasColumn(&Account{}, "id") {
+		return nil // the table doesn't exist yet, so it is created with vault_id NOT NULL
+	}
+	return orm.WithTx(ctx, func(tx *orm.Tx) error {
+		err := addEnvelopeColumns(tx, "totp_accounts")
+		if err != nil {
+			return err
+		}
+		err = tx.Exec(`ALTER TABLE totp_accounts ADD COLUMN IF NOT EXISTS vault_id text`)
+		if err != nil {
+			return err
+		}
+		var counts []struct{ Count int }
+		err = tx.ScanRaw(&counts, `SELECT COUNT(*) AS count FROM totp_accounts WHERE vault_id IS NULL`)
+		if err != nil {
+			return err
+		}
+		if len(counts) > 0 && counts[0].Count > 0 {
+			clog.Warnf("%s: quarantining %d accounts that don't belong to a vault in totp_accounts_quarantine", gServiceName, counts[0].Count)
+			err = reencryptLegacyRows(tx, "totp_accounts", "vault_id IS NULL", mk)
+			if err != nil {
+				return err
+			}
+			for _, statement := range []string{
+				`CREATE TABLE IF NOT EXISTS totp_accounts_quarantine (LIKE totp_accounts)`,
+				`INSERT INTO totp_accounts_quarantine SELECT * FROM totp_accounts WHERE vault_id IS NULL`,
+				`DELETE FROM totp_accounts WHERE vault_id IS NULL`,
+			} {
+				if err := tx.Exec(statement); err != nil {
+					return err
+				}
+			}
+		}
+		// Accounts quarantined before they were re-encrypted on the way in
+		var quarantine []struct{ Exists bool }
+		err = tx.ScanRaw(&quarantine, `SELECT to_regclass('totp_accounts_quarantine') IS NOT NULL AS exists`)
+		if err != nil {
+			return err
+		}
+		if len(quarantine) > 0 && quarantine[0].Exists {
+			if err := addEnvelopeColumns(tx, "totp_accounts_quarantine"); err != nil {
+				return err
+			}
+			if err := reencryptLegacyRows(tx, "totp_accounts_quarantine", "TRUE", mk); err != nil {
+				return err
+			}
+		}
+		return tx.Exec(`ALTER TABLE totp_accounts ALTER COLUMN vault_id SET NOT NULL`)
+	})
+}
+
+// addEnvelopeColumns adds the columns that envelope encryption needs to the table, which holds accounts, if the model
+// migration hasn't added them yet
+func addEnvelopeColumns(tx *orm.Tx, table string) error {
+	return tx.Exec(`ALTER TABLE ` + table + ` ADD COLUMN IF NOT EXISTS wrapped_data_key bytea, ADD COLUMN IF NOT EXISTS key_id text`)
+}
+
+// reencryptLegacyRows re-encrypts, with the master key, the private keys of the accounts in the table that match the
+// condition and are still encrypted with the legacy key. Unlike migrateLegacyAccounts, it works on the raw rows, so it
+// can be used on tables that don't match the model.
+func reencryptLegacyRows(tx *orm.Tx, table string, condition string, mk *masterKey) error {
+	var rows []struct {
+		ID                  id.ID
+		Name                string
+		EncryptedPrivateKey []byte
+	}
+	err := tx.ScanRaw(&rows, `SELECT id, name, encrypted_private_key FROM `+table+` WHERE (`+condition+`) AND (wrapped_data_key IS NULL OR length(wrapped_data_key) = 0)`)
+	if err != nil {
+		return err
+	}
+	for _, r := range rows {
+		a := Account{Name: r.Name, EncryptedPrivateKey: r.EncryptedPrivateKey}
+		if err := reencryptLegacyAccount(&a, mk); err != nil {
+			return fmt.Errorf("re-encrypting totp account %v in %s: %v", r.ID, table, err)
+		}
+		err := tx.Exec(`UPDATE `+table+` SET encrypted_private_key = ?, wrapped_data_key = ?, key_id = ? WHERE id = ?`, a.EncryptedPrivateKey, a.WrappedDataKey, a.KeyID, r.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeVaultAccounts permanently deletes the accounts of the vault, with their encrypted private keys, combinations and
+// shares, and the history of their codes, as part of the transaction that purges the vault
+func purgeVaultAccounts(ctx context.Context, tx *orm.Tx, vaultID id.ID) error {
+	var accounts []Account
+	_, err := tx.FindByColumn("vault_id", vaultID, &accounts)
+	if err != nil {
+		return err
+	}
+	for _, a := range accounts {
+		var combinations []Combination
+		_, err := tx.Find(map[string]interface{}{"account_id": a.ID}, &combinations)
+		if err != nil {
+			return err
+		}
+		if err := deleteCombinations(tx, combinations); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.HardDeleteByConditions(map[string]interface{}{"vault_id": vaultID}, &CodeEvent{}); err != nil {
+		return err
+	}
+	_, err = tx.HardDeleteByConditions(map[string]interface{}{"vault_id": vaultID}, &Account{})
+	return err
+}
+
+// newAccount validates the request and returns the account that it describes, with the private key encrypted. It does
+// not save the account.
+func newAccount(req CreateAccountRequest) (Account, error) {
+	var a Account
+
+	// Take the private key and the parameters from the URI, if it's given
+	if req.URI != "" {
+		if len(req.PrivateKey) > 0 {
+			return a, fmt.Errorf("either the private key or the otpauth URI should be provided, but not both")
+		}
+		k, err := ParseKeyURI(req.URI)
+		if err != nil {
+			return a, err
+		}
+		req = applyKeyURI(req, k)
+		a.Issuer, a.Label = k.Issuer, k.Label
+	}
+
+	// Validate the request
+	err := validate.Struct(req)
+	if err != nil {
+		return a, err
+	}
+
+	// Make sure that the private key can be decoded, and store it in the canonical form
+	req.PrivateKey, err = normalizeSecret(req.PrivateKey)
+	if err != nil {
+		return a, fmt.Errorf("invalid private key: %v", err)
+	}
+
+	a.VaultID = req.VaultID
+	a.Name = req.Name
+
+	// Encrypt the private key with a new data key, wrapped by the master key, or keep it until it's encrypted for
+	// the combinations of the members
+	a.Protection = req.Protection
+	if a.Protection == "" {
+		a.Protection = ProtectionMasterKey
+	}
+	if a.Protection == ProtectionCombinations {
+		a.EncryptedPrivateKey, a.privateKey = []byte{}, req.PrivateKey
+	} else {
+		a.EncryptedPrivateKey, a.WrappedDataKey, err = gMasterKey.seal(req.PrivateKey)
+		if err != nil {
+			return a, err
+		}
+		a.KeyID = gMasterKey.ID
+	}
+
+	a.Type = req.Type
+	if a.Type == "" {
+		a.Type = AccountTypeTOTP
+	}
+	if a.Type == AccountTypeHOTP {
+		a.Counter = req.Counter
+	}
+	a.Algorithm = req.Algorithm
+	if a.Algorithm == "" {
+		a.Algorithm = gDefaultAlgorithm
+	}
+	a.Digits = req.Digits
+	if a.Digits == 0 {
+		a.Digits = gDefaultCodeLength
+	}
+	a.IntervalSeconds = req.IntervalSeconds
+	if a.IntervalSeconds == 0 {
+		a.IntervalSeconds = gDefaultIntervalInSeconds
+	}
+	a.StartUnixTime = req.StartUnixTime
+	if a.StartUnixTime == 0 {
+		a.StartUnixTime = gDefaultStartUnixTime
+	}
+	if a.StartUnixTime >= time.Now().Unix() {
+		return a, fmt.Errorf("start unix time (T0) should be in the past")
+	}
+
+	return a, nil
+}
+
+// insertAccounts saves the accounts in the vault, in one transaction. The user should own the vault.
+func insertAccounts(ctx context.Context, vaultID, userID id.ID, accounts []*Account) error {
+	v, err := vault.GetVault(ctx, vaultID)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return vault.ErrVaultNotFound
+	}
+	if v.IsArchived() {
+		return vault.ErrVaultArchived
+	}
+
+	return orm.WithTx(ctx, func(tx *orm.Tx) error {
+		err := vault.RequireRoleTx(ctx, tx, vaultID, userID, vault.RoleOwner)
+		if err != nil {
+			return err
+		}
+		for _, a := range accounts {
+			if err := tx.InsertOne(a); err != nil {
+				return err
+			}
+			if a.Protection == ProtectionCombinations {
+				if err := encryptCombinations(ctx, tx, a, a.privateKey); err != nil {
+					return err
+				}
+				a.privateKey = nil
+			}
+		}
+		return nil
+	})
+}
+
+// requireCodeApproval returns the secret request if it approves the user's access to the vault of the account. Denied
+// attempts are recorded as security events of the account.
+func requireCodeApproval(ctx context.Context, req GetCodeRequest, a Account, action string) (*secret.SecretRequest, error) {
+	sr, err := secret.RequireApproval(ctx, secret.GetParams{SecretRequestID: req.SecretRequestID, UserID: req.UserID, ClientIP: req.ClientIP}, action)
+	if err == nil && sr.VaultID != a.VaultID {
+		err = ErrWrongVault
+	}
+	if isDeniedApproval(err) {
+		recordCodeDenied(ctx, a, req, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sr, nil
+}
+
+// issueHOTPCode generates the code for the current counter of an HOTP account, records it and increments the counter,
+// in one transaction. The account is locked while we do so, which makes sure that two concurrent requesters never get
+// the same code.
+func issueHOTPCode(ctx context.Context, req GetCodeRequest, sr *secret.SecretRequest, privateKey []byte) (Code, error) {
+	var c Code
+	err := orm.WithTx(ctx, func(tx *orm.Tx) error {
+		var a Account
+		exists, err := tx.FindByIDForUpdate(req.AccountID, &a)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrAccountNotFound
+		}
+
+		c.Code, err = getHOTPValue(privateKey, a.Algorithm, a.Digits, a.Counter)
+		if err != nil {
+			return fmt.Errorf("generating HOTP code: %v", err)
+		}
+		c.Counter = a.Counter
+		c.ValidAt = time.Now()
+
+		err = recordCodeEvent(ctx, tx, a, req, sr, a.Counter)
+		if err != nil {
+			return err
+		}
+
+		return tx.UpdateColumnsByConditions(map[string]interface{}{"id": a.ID}, map[string]interface{}{"counter": a.Counter + 1}, &Account{})
+	})
+	if err != nil {
+		return Code{}, err
+	}
+	return c, nil
+}
+
+// findHOTPCounter looks for the counter, starting at from and within gResyncWindow of it, from which the HOTP codes of
+// the key match the given consecutive codes
+func findHOTPCounter(privateKey []byte, algorithm Algorithm, digits int, from int64, codes []string) (int64, bool, error) {
+	for counter := from; counter <= from+gResyncWindow; counter++ {
+		matched := true
+		for i, want := range codes {
+			got, err := getHOTPValue(privateKey, algorithm, digits, counter+int64(i))
+			if err != nil {
+				return 0, false, err
+			}
+			if !hmac.Equal([]byte(got), []byte(want)) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return counter, true, nil
+		}
+	}
+	return 0, false, nil
 }
 
 // encryptWithKey takes a key and data, and encrypts it
@@ -253,7 +703,7 @@ func encryptWithKey(key []byte, data []byte) ([]byte, error) {
 	// READ: Understand why 'nonce' is important
 	nonce := make([]byte, gcm.NonceSize())
 	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
-		fmt.Println(err)
+		return nil, err
 	}
 
 	// Use seal function to get the encrypted text
@@ -301,10 +751,30 @@ func decryptWithKey(key []byte, encryptedData []byte) ([]byte, error) {
 
 }
 
+// getTOTPCode generates the TOTP code of the account for the interval that includes the unix time now
+func getTOTPCode(a Account, privateKey []byte, now int64) (Code, error) {
+	var c Code
+
+	code, err := getTOTPValue(privateKey, a.Algorithm, a.Digits, a.StartUnixTime, now, a.IntervalSeconds)
+	if err != nil {
+		return c, fmt.Errorf("generating TOTP code: %v", err)
+	}
+	// Get expiry timestamp: the end of the current interval
+	c.Code = code
+	numIntervals := (now-a.StartUnixTime)/a.IntervalSeconds + 1
+	expireAtInUnix := a.StartUnixTime + numIntervals*a.IntervalSeconds
+	c.ExpireAt = time.Unix(expireAtInUnix, 0)
+
+	// Get start validity timestamp
+	c.ValidAt = c.ExpireAt.Add(-time.Second * time.Duration(a.IntervalSeconds))
+
+	return c, nil
+}
+
 // getTOTPValue generates a TOTP code for the given key
 // How to generate a TOTP value: https://en.wikipedia.org/wiki/Time-based_One-time_Password_algorithm
 // TODO: Use a better written library like https://github.com/pquerna/otp
-func getTOTPValue(privateKey []byte, startUnixTime int64, endUnixTime int64, intervalSeconds int64) (string, error) {
+func getTOTPValue(privateKey []byte, algorithm Algorithm, digits int, startUnixTime int64, endUnixTime int64, intervalSeconds int64) (string, error) {
 
 	if endUnixTime <= startUnixTime {
 		return "", errors.New("could not calculate counter time as end time is less than or equal to start time")
@@ -313,7 +783,14 @@ func getTOTPValue(privateKey []byte, startUnixTime int64, endUnixTime int64, int
 		return "", errors.New("could not calculate counter time as interval is less than 1 second")
 	}
 
-	counter := int64(math.Floor(float64(endUnixTime-startUnixTime) / float64(intervalSeconds)))
+	counter := (endUnixTime - startUnixTime) / intervalSeconds
+	return getHOTPValue(privateKey, algorithm, digits, counter)
+}
+
+// getHOTPValue generates the HOTP code of the key for the counter
+// How to generate an HOTP value: https://tools.ietf.org/html/rfc4226#section-5.3
+func getHOTPValue(privateKey []byte, algorithm Algorithm, digits int, counter int64) (string, error) {
+
 	// we will use counter as the 'message' in our hash function, however counter is an int
 	// so we need to make it into []byte. We can use an ASCII representation of the int - but that
 	// wouldn't work as the 'authenticating' service will probably use the  binary representation of
@@ -321,19 +798,22 @@ func getTOTPValue(privateKey []byte, startUnixTime int64, endUnixTime int64, int
 	buf := make([]byte, 8)
 	binary.BigEndian.PutUint64(buf, uint64(counter))
 
-	// Private Key should be of UPPER CASE
-	privateKey = bytes.ToUpper(privateKey)
-
-	clog.Debugf("%s: getting code using private key: '%s'", "totp", privateKey)
-	secretBytes, err := base32.StdEncoding.DecodeString(string(privateKey))
+	// Private Key is base32 encoded, but might be in lower case or without padding
+	secretBytes, err := decodeSecret(privateKey)
 	if err != nil {
-		return "", fmt.Errorf("encoding private key to base64: %v", err)
+		return "", fmt.Errorf("decoding private key from base32: %v", err)
 	}
 
 	// Get the HMAC
-	clog.Debugf("%s: getting code using secret: '%s'", "totp", secretBytes)
-	mac := hmac.New(sha1.New, secretBytes)
-	clog.Debugf("%s: getting code of counter: '%d'", "totp", counter)
+	if algorithm == "" {
+		algorithm = gDefaultAlgorithm
+	}
+	hashFunc, ok := gAlgorithms[algorithm]
+	if !ok {
+		return "", fmt.Errorf("unsupported algorithm '%s'", algorithm)
+	}
+	clog.Debugf("%s: getting code of counter: '%d'", gServiceName, counter)
+	mac := hmac.New(hashFunc, secretBytes)
 	mac.Write(buf)
 	messageMAC := mac.Sum(nil)
 
@@ -347,8 +827,10 @@ func getTOTPValue(privateKey []byte, startUnixTime int64, endUnixTime int64, int
 		((int(messageMAC[offset+2] & 0xff)) << 8) |
 		(int(messageMAC[offset+3]) & 0xff))
 
-	// TODO: Remove this hard-coding
-	lenCode := gDefaultCodeLength
+	lenCode := digits
+	if lenCode == 0 {
+		lenCode = gDefaultCodeLength
+	}
 	mod := int32(value % int64(math.Pow10(lenCode)))
 
 	// format the mod so it always has lenCode digits
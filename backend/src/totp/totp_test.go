@@ -1,45 +1,74 @@
 package totp
 
 import (
+	"bytes"
+	"context"
+	"encoding/base32"
 	"fmt"
+	"image/png"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/qrcode"
 	"github.com/stretchr/testify/assert"
 	"github.com/teejays/clog"
+	"github.com/teejays/n-factor-vault/backend/library/env"
 	"github.com/teejays/n-factor-vault/backend/library/id"
 	"github.com/teejays/n-factor-vault/backend/library/orm"
+
+	"github.com/teejays/n-factor-vault/backend/src/audit"
+	"github.com/teejays/n-factor-vault/backend/src/org"
+	"github.com/teejays/n-factor-vault/backend/src/secret"
+	"github.com/teejays/n-factor-vault/backend/src/user"
+	"github.com/teejays/n-factor-vault/backend/src/vault"
 )
 
+// gTestMasterKey is the base64 encoded master key used in the tests, unless one is configured
+const gTestMasterKey = "YWCxRMDdY5CUFL3CB+5065qVhL53KA+NBwgqWEM6c4o="
+
 func init() {
 
+	if _, err := env.GetEnvVar(envMasterKey); err != nil {
+		env.SetEnvVarsMust(map[string]string{envMasterKey: gTestMasterKey})
+	}
+
 	err := orm.Init()
 	if err != nil {
 		clog.FatalErr(err)
 	}
 
-	err = Init()
-	if err != nil {
-		clog.FatalErr(err)
+	// The services that TOTP accounts depend on
+	for _, initFunc := range []func() error{audit.Init, user.Init, org.Init, vault.Init, secret.Init, Init} {
+		if err := initFunc(); err != nil {
+			clog.FatalErr(err)
+		}
 	}
 
 }
 
 func TestCreateAccount(t *testing.T) {
 	// Make sure that we empty any table that these tests might populate once the test is over
-	orm.EmptyTestTables(t, &Account{})
-	defer orm.EmptyTestTables(t, &Account{})
+	emptyTestTables(t)
+	defer emptyTestTables(t)
+
+	u, v := createTestVault(t, "Facebook")
 
 	tests := []struct {
-		name    string
-		req     CreateAccountRequest
-		want    Account
-		wantErr bool
+		name       string
+		req        CreateAccountRequest
+		want       Account
+		wantParams Account
+		wantErr    bool
 	}{
 		// TODO: Add test cases.
 		{
 			name: "error if empty account name",
 			req: CreateAccountRequest{
+				VaultID:    v.ID,
+				UserID:     u.ID,
 				Name:       "",
 				PrivateKey: []byte("some secret key"),
 			},
@@ -48,6 +77,8 @@ func TestCreateAccount(t *testing.T) {
 		{
 			name: "error if empty private key",
 			req: CreateAccountRequest{
+				VaultID:    v.ID,
+				UserID:     u.ID,
 				Name:       "Facebook",
 				PrivateKey: []byte(""),
 			},
@@ -56,31 +87,152 @@ func TestCreateAccount(t *testing.T) {
 		{
 			name: "error if nil private key",
 			req: CreateAccountRequest{
+				VaultID:    v.ID,
+				UserID:     u.ID,
 				Name:       "Facebook",
 				PrivateKey: nil,
 			},
 			wantErr: true,
 		},
+		{
+			name: "error if no vault",
+			req: CreateAccountRequest{
+				UserID:     u.ID,
+				Name:       "Facebook",
+				PrivateKey: []byte("ORUGKIDQOJUXMYLUMUQGWZLZ"),
+			},
+			wantErr: true,
+		},
+		{
+			name: "error if the user does not own the vault",
+			req: CreateAccountRequest{
+				VaultID:    v.ID,
+				UserID:     id.GetNewID(),
+				Name:       "Facebook",
+				PrivateKey: []byte("ORUGKIDQOJUXMYLUMUQGWZLZ"),
+			},
+			wantErr: true,
+		},
+		{
+			name: "error if unsupported algorithm",
+			req: CreateAccountRequest{
+				VaultID:    v.ID,
+				UserID:     u.ID,
+				Name:       "Facebook",
+				PrivateKey: []byte("ORUGKIDQOJUXMYLUMUQGWZLZ"),
+				Algorithm:  "MD5",
+			},
+			wantErr: true,
+		},
+		{
+			name: "error if too many digits",
+			req: CreateAccountRequest{
+				VaultID:    v.ID,
+				UserID:     u.ID,
+				Name:       "Facebook",
+				PrivateKey: []byte("ORUGKIDQOJUXMYLUMUQGWZLZ"),
+				Digits:     10,
+			},
+			wantErr: true,
+		},
+		{
+			name: "error if T0 is in the future",
+			req: CreateAccountRequest{
+				VaultID:       v.ID,
+				UserID:        u.ID,
+				Name:          "Facebook",
+				PrivateKey:    []byte("ORUGKIDQOJUXMYLUMUQGWZLZ"),
+				StartUnixTime: time.Now().Add(time.Hour).Unix(),
+			},
+			wantErr: true,
+		},
 		{
 			name: "success if good request",
 			req: CreateAccountRequest{
+				VaultID:    v.ID,
+				UserID:     u.ID,
 				Name:       "Facebook",
 				PrivateKey: []byte("ORUGKIDQOJUXMYLUMUQGWZLZ"), // base32 for "the private key"
 			},
+			wantParams: Account{Algorithm: AlgorithmSHA1, Digits: 6, IntervalSeconds: 30},
+		},
+		{
+			name: "success with custom parameters",
+			req: CreateAccountRequest{
+				VaultID:         v.ID,
+				UserID:          u.ID,
+				Name:            "Twitter",
+				PrivateKey:      []byte("ORUGKIDQOJUXMYLUMUQGWZLZ"),
+				Algorithm:       AlgorithmSHA512,
+				Digits:          8,
+				IntervalSeconds: 60,
+			},
+			wantParams: Account{Algorithm: AlgorithmSHA512, Digits: 8, IntervalSeconds: 60},
+		},
+		{
+			name: "error if both private key and URI",
+			req: CreateAccountRequest{
+				VaultID:    v.ID,
+				UserID:     u.ID,
+				Name:       "GitHub",
+				PrivateKey: []byte("ORUGKIDQOJUXMYLUMUQGWZLZ"),
+				URI:        "otpauth://totp/GitHub:jon?secret=ORUGKIDQOJUXMYLUMUQGWZLZ",
+			},
+			wantErr: true,
+		},
+		{
+			name: "error if invalid URI",
+			req: CreateAccountRequest{
+				VaultID: v.ID,
+				UserID:  u.ID,
+				Name:    "GitHub",
+				URI:     "otpauth://totp/GitHub:jon?issuer=GitHub",
+			},
+			wantErr: true,
+		},
+		{
+			name: "success if HOTP",
+			req: CreateAccountRequest{
+				VaultID:    v.ID,
+				UserID:     u.ID,
+				Name:       "VPN",
+				PrivateKey: []byte("ORUGKIDQOJUXMYLUMUQGWZLZ"),
+				Type:       AccountTypeHOTP,
+				Counter:    42,
+			},
+			wantParams: Account{Type: AccountTypeHOTP, Algorithm: AlgorithmSHA1, Digits: 6, IntervalSeconds: 30, Counter: 42},
+		},
+		{
+			name: "success with URI",
+			req: CreateAccountRequest{
+				VaultID: v.ID,
+				UserID:  u.ID,
+				Name:    "GitHub",
+				URI:     "otpauth://totp/GitHub:jon@email.com?secret=orug-kidq-ojux-myi&algorithm=SHA256&digits=8&period=60",
+			},
+			wantParams: Account{Algorithm: AlgorithmSHA256, Digits: 8, IntervalSeconds: 60},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 
-			got, err := CreateAccount(tt.req)
+			got, err := CreateAccount(context.Background(), tt.req)
 			if tt.wantErr {
 				fmt.Println(err)
 				assert.Error(t, err)
 				return
 			}
 			assert.NoError(t, err)
+			if tt.wantParams.Type == "" {
+				tt.wantParams.Type = AccountTypeTOTP
+			}
+			assert.Equal(t, tt.wantParams.Type, got.Type)
 			assert.Equal(t, tt.req.Name, got.Name)
-			assert.Equal(t, int64(30), got.IntervalSeconds)
+			assert.Equal(t, tt.req.VaultID, got.VaultID)
+			assert.Equal(t, tt.wantParams.Algorithm, got.Algorithm)
+			assert.Equal(t, tt.wantParams.Digits, got.Digits)
+			assert.Equal(t, tt.wantParams.IntervalSeconds, got.IntervalSeconds)
+			assert.Equal(t, tt.wantParams.Counter, got.Counter)
 			assert.Equal(t, int64(0), got.StartUnixTime)
 			assert.NotEqual(t, 0, len(got.EncryptedPrivateKey))
 		})
@@ -119,12 +271,475 @@ func TestEncryptDecrypt(t *testing.T) {
 	}
 }
 
+// TestGetTOTPValue uses the test vectors from Appendix B of RFC 6238
+func TestGetTOTPValue(t *testing.T) {
+	seeds := map[Algorithm]string{
+		AlgorithmSHA1:   "12345678901234567890",
+		AlgorithmSHA256: "12345678901234567890123456789012",
+		AlgorithmSHA512: "1234567890123456789012345678901234567890123456789012345678901234",
+	}
+	tests := []struct {
+		unixTime  int64
+		algorithm Algorithm
+		want      string
+	}{
+		{59, AlgorithmSHA1, "94287082"},
+		{59, AlgorithmSHA256, "46119246"},
+		{59, AlgorithmSHA512, "90693936"},
+		{1111111109, AlgorithmSHA1, "07081804"},
+		{1111111109, AlgorithmSHA256, "68084774"},
+		{1111111109, AlgorithmSHA512, "25091201"},
+		{1111111111, AlgorithmSHA1, "14050471"},
+		{1111111111, AlgorithmSHA256, "67062674"},
+		{1111111111, AlgorithmSHA512, "99943326"},
+		{1234567890, AlgorithmSHA1, "89005924"},
+		{1234567890, AlgorithmSHA256, "91819424"},
+		{1234567890, AlgorithmSHA512, "93441116"},
+		{2000000000, AlgorithmSHA1, "69279037"},
+		{2000000000, AlgorithmSHA256, "90698825"},
+		{2000000000, AlgorithmSHA512, "38618901"},
+		{20000000000, AlgorithmSHA1, "65353130"},
+		{20000000000, AlgorithmSHA256, "77737706"},
+		{20000000000, AlgorithmSHA512, "47863826"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s at %d", tt.algorithm, tt.unixTime), func(t *testing.T) {
+			key := []byte(base32.StdEncoding.EncodeToString([]byte(seeds[tt.algorithm])))
+			got, err := getTOTPValue(key, tt.algorithm, 8, 0, tt.unixTime, 30)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	t.Run("fewer digits are the last digits of the code", func(t *testing.T) {
+		key := []byte(base32.StdEncoding.EncodeToString([]byte(seeds[AlgorithmSHA1])))
+		got, err := getTOTPValue(key, AlgorithmSHA1, 6, 0, 59, 30)
+		assert.NoError(t, err)
+		assert.Equal(t, "287082", got)
+	})
+
+	t.Run("T0 and period shift the counter", func(t *testing.T) {
+		key := []byte(base32.StdEncoding.EncodeToString([]byte(seeds[AlgorithmSHA1])))
+		// With a T0 of 1000 and a 60 second period, 1119 is in the second interval, just like 59 is with the defaults
+		got, err := getTOTPValue(key, AlgorithmSHA1, 8, 1000, 1119, 60)
+		assert.NoError(t, err)
+		assert.Equal(t, "94287082", got)
+	})
+}
+
+func TestGetHOTPValue(t *testing.T) {
+	// Test values from https://tools.ietf.org/html/rfc4226#page-32
+	privateKey := []byte(base32.StdEncoding.EncodeToString([]byte("12345678901234567890")))
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for counter, code := range want {
+		got, err := getHOTPValue(privateKey, AlgorithmSHA1, 6, int64(counter))
+		assert.NoError(t, err)
+		assert.Equal(t, code, got, "counter %d", counter)
+	}
+}
+
+func TestGetCodeUpdate(t *testing.T) {
+	// RFC 6238 test values of SHA1, for the periods starting at 1111111080 and 1111111110
+	a := Account{Algorithm: AlgorithmSHA1, Digits: 8, IntervalSeconds: 30}
+	privateKey := []byte(base32.StdEncoding.EncodeToString([]byte("12345678901234567890")))
+
+	u, err := getCodeUpdate(a, privateKey, 1111111109)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "07081804", u.Current.Code)
+	assert.Equal(t, time.Unix(1111111080, 0), u.Current.ValidAt)
+	assert.Equal(t, time.Unix(1111111110, 0), u.Current.ExpireAt)
+	assert.Equal(t, "14050471", u.Next.Code)
+	assert.Equal(t, u.Current.ExpireAt, u.Next.ValidAt)
+	assert.Equal(t, time.Unix(1111111140, 0), u.Next.ExpireAt)
+}
+
+func TestGetTimeStep(t *testing.T) {
+	b := Account{StartUnixTime: 100, IntervalSeconds: 60}
+	assert.Equal(t, int64(0), getTimeStep(b, time.Unix(159, 0)))
+	assert.Equal(t, int64(1), getTimeStep(b, time.Unix(160, 0)))
+}
+
+func TestFindHOTPCounter(t *testing.T) {
+	privateKey := []byte(base32.StdEncoding.EncodeToString([]byte("12345678901234567890")))
+
+	got, found, err := findHOTPCounter(privateKey, AlgorithmSHA1, 6, 0, []string{"969429", "338314"})
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, int64(3), got)
+
+	// The counter never moves back
+	_, found, err = findHOTPCounter(privateKey, AlgorithmSHA1, 6, 4, []string{"969429", "338314"})
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	// The codes should be consecutive
+	_, found, err = findHOTPCounter(privateKey, AlgorithmSHA1, 6, 0, []string{"969429", "254676"})
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestParseKeyURI(t *testing.T) {
+	tests := []struct {
+		name    string
+		uri     string
+		want    KeyURI
+		wantErr bool
+	}{
+		{
+			name: "issuer in the label",
+			uri:  "otpauth://totp/ACME%20Co:john.doe@email.com?secret=HXDMVJECJJWSRB3HWIZR4IFUGFTMXBOZ",
+			want: KeyURI{Type: AccountTypeTOTP, Issuer: "ACME Co", Label: "john.doe@email.com", Secret: []byte("HXDMVJECJJWSRB3HWIZR4IFUGFTMXBOZ")},
+		},
+		{
+			name: "issuer param takes precedence",
+			uri:  "otpauth://totp/Old:jon?secret=JBSWY3DPEHPK3PXP&issuer=New&algorithm=sha512&digits=8&period=60",
+			want: KeyURI{Type: AccountTypeTOTP, Issuer: "New", Label: "jon", Secret: []byte("JBSWY3DPEHPK3PXP"), Algorithm: AlgorithmSHA512, Digits: 8, IntervalSeconds: 60},
+		},
+		{
+			name: "secret is normalized",
+			uri:  "otpauth://totp/jon?secret=orug%20kidq%20ojux%20myi",
+			want: KeyURI{Type: AccountTypeTOTP, Label: "jon", Secret: []byte("ORUGKIDQOJUXMYI=")},
+		},
+		{
+			name: "hotp",
+			uri:  "otpauth://hotp/VPN:jon?secret=JBSWY3DPEHPK3PXP&counter=7",
+			want: KeyURI{Type: AccountTypeHOTP, Issuer: "VPN", Label: "jon", Secret: []byte("JBSWY3DPEHPK3PXP"), Counter: 7},
+		},
+		{name: "error if not otpauth", uri: "https://totp/jon?secret=JBSWY3DPEHPK3PXP", wantErr: true},
+		{name: "error if hotp without counter", uri: "otpauth://hotp/jon?secret=JBSWY3DPEHPK3PXP", wantErr: true},
+		{name: "error if unknown type", uri: "otpauth://motp/jon?secret=JBSWY3DPEHPK3PXP", wantErr: true},
+		{name: "error if no secret", uri: "otpauth://totp/jon", wantErr: true},
+		{name: "error if secret is not base32", uri: "otpauth://totp/jon?secret=not-base-32!", wantErr: true},
+		{name: "error if unsupported algorithm", uri: "otpauth://totp/jon?secret=JBSWY3DPEHPK3PXP&algorithm=MD5", wantErr: true},
+		{name: "error if digits is not a number", uri: "otpauth://totp/jon?secret=JBSWY3DPEHPK3PXP&digits=six", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseKeyURI(tt.uri)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.want, *got)
+			}
+		})
+	}
+}
+
+func TestDecodeQRCode(t *testing.T) {
+	uri := "otpauth://totp/ACME:jon@email.com?secret=JBSWY3DPEHPK3PXP&issuer=ACME"
+
+	bm, err := qrcode.NewQRCodeWriter().Encode(uri, gozxing.BarcodeFormat_QR_CODE, 256, 256, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = png.Encode(&buf, bm); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := DecodeQRCode(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, uri, got)
+
+	_, err = DecodeQRCode(strings.NewReader("not an image"))
+	assert.Error(t, err)
+}
+
+func TestVerifyCode(t *testing.T) {
+	// The RFC 6238 test value of SHA1 at 59 seconds (time step 1), truncated to 6 digits
+	privateKey := []byte(base32.StdEncoding.EncodeToString([]byte("12345678901234567890")))
+
+	step, err := VerifyCode(privateKey, "287082", time.Unix(59, 0), 1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), step)
+
+	// A clock that is a time step behind is fine, two are not
+	step, err = VerifyCode(privateKey, "287082", time.Unix(89, 0), 1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), step)
+	_, err = VerifyCode(privateKey, "287082", time.Unix(119, 0), 1, 0)
+	assert.Equal(t, ErrInvalidCode, err)
+
+	// A code can't be used twice
+	_, err = VerifyCode(privateKey, "287082", time.Unix(59, 0), 1, 1)
+	assert.Equal(t, ErrCodeReused, err)
+
+	_, err = VerifyCode(privateKey, "123456", time.Unix(59, 0), 1, 0)
+	assert.Equal(t, ErrInvalidCode, err)
+	_, err = VerifyCode(privateKey, "94287082", time.Unix(59, 0), 1, 0)
+	assert.Equal(t, ErrInvalidCode, err)
+}
+
+func TestEncodeQRCode(t *testing.T) {
+	uri := "otpauth://totp/n-factor-vault:jon@email.com?issuer=n-factor-vault&secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	img, err := EncodeQRCode(uri)
+	if !assert.NoError(t, err) {
+		return
+	}
+	got, err := DecodeQRCode(bytes.NewReader(img))
+	assert.NoError(t, err)
+	assert.Equal(t, uri, got)
+
+	k, err := GenerateKey()
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = decodeSecret(k)
+	assert.NoError(t, err)
+}
+
+func TestParseMigrationURI(t *testing.T) {
+	// An export of Google Authenticator
+	keys, err := ParseMigrationURI("otpauth-migration://offline?data=CjEKCkhlbGxvId6tvu8SGEV4YW1wbGU6YWxpY2VAZ29vZ2xlLmNvbRoHRXhhbXBsZSABKAEwAhABGAEgACjr4JKK%2Bv%2F%2F%2F%2F8B")
+	if assert.NoError(t, err) && assert.Len(t, keys, 1) {
+		assert.Equal(t, KeyURI{Type: AccountTypeTOTP, Issuer: "Example", Label: "alice@google.com", Secret: []byte("JBSWY3DPEHPK3PXP"), Algorithm: AlgorithmSHA1, Digits: 6}, keys[0])
+	}
+
+	_, err = ParseMigrationURI("otpauth://totp/jon?secret=JBSWY3DPEHPK3PXP")
+	assert.Error(t, err)
+	_, err = ParseMigrationURI("otpauth-migration://offline?data=bm90IHByb3RvYnVm")
+	assert.Error(t, err)
+}
+
+func TestMigrationURIs(t *testing.T) {
+	defer func(n int) { gMigrationBatchSize = n }(gMigrationBatchSize)
+	gMigrationBatchSize = 2
+
+	keys := []KeyURI{
+		{Type: AccountTypeTOTP, Issuer: "GitHub", Label: "jon", Secret: []byte("JBSWY3DPEHPK3PXP"), Algorithm: AlgorithmSHA1, Digits: 6},
+		{Type: AccountTypeTOTP, Label: "Facebook", Secret: []byte("ORUGKIDQOJUXMYLUMUQGWZLZ"), Algorithm: AlgorithmSHA256, Digits: 8},
+		{Type: AccountTypeHOTP, Issuer: "VPN", Label: "jon", Secret: []byte("GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"), Algorithm: AlgorithmSHA512, Digits: 6, Counter: 42},
+	}
+	uris, err := getMigrationURIs(keys)
+	if !assert.NoError(t, err) || !assert.Len(t, uris, 2) {
+		return
+	}
+
+	var got []KeyURI
+	for _, uri := range uris {
+		k, err := ParseMigrationURI(uri)
+		assert.NoError(t, err)
+		got = append(got, k...)
+	}
+	assert.Equal(t, keys, got)
+}
+
+func TestGetCombinations(t *testing.T) {
+	got := getCombinations([]string{"a", "b", "c", "d"}, 2)
+	assert.Equal(t, [][]string{{"a", "b"}, {"a", "c"}, {"a", "d"}, {"b", "c"}, {"b", "d"}, {"c", "d"}}, got)
+	assert.Equal(t, [][]string{{"a", "b", "c"}}, getCombinations([]string{"a", "b", "c"}, 3))
+	assert.Empty(t, getCombinations([]string{"a"}, 2))
+
+	assert.Equal(t, 6, countCombinations(4, 2, 1000))
+	assert.Equal(t, 184756, countCombinations(20, 10, 1000000))
+	assert.Equal(t, 1001, countCombinations(20, 10, 1000))
+	assert.Equal(t, 0, countCombinations(2, 3, 1000))
+}
+
+func TestSealOpenCombination(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	var privateKeys = make(map[string][]byte)
+	var publicKeys = make(map[string][]byte)
+	for _, m := range []string{"jon", "jane", "jack"} {
+		privateKeys[m], publicKeys[m] = deriveMemberKeyPair(m+"'s passphrase", salt, 1000)
+	}
+
+	// The key pair is derived from the passphrase
+	_, pub := deriveMemberKeyPair("jon's passphrase", salt, 1000)
+	assert.Equal(t, publicKeys["jon"], pub)
+	_, pub = deriveMemberKeyPair("jon's other passphrase", salt, 1000)
+	assert.NotEqual(t, publicKeys["jon"], pub)
+
+	privateKey := []byte("ORUGKIDQOJUXMYLUMUQGWZLZ")
+	c, shares, err := sealCombination(privateKey, []string{"jane", "jon"}, publicKeys)
+	if !assert.NoError(t, err) || !assert.Len(t, shares, 2) {
+		return
+	}
+	assert.NotContains(t, string(c.EncryptedPrivateKey), string(privateKey))
+
+	// Jane contributes her share to jon
+	janes, err := unwrapShare(privateKeys["jane"], shares[0])
+	if !assert.NoError(t, err) {
+		return
+	}
+	contributed, err := wrapShare(publicKeys["jon"], janes)
+	if !assert.NoError(t, err) {
+		return
+	}
+	contributed.FromUserID = "jane"
+
+	got, err := openCombination(c, []Share{shares[1], contributed}, privateKeys["jon"])
+	assert.NoError(t, err)
+	assert.Equal(t, privateKey, got)
+
+	// Jon can't open the combination without jane's share
+	_, err = openCombination(c, []Share{shares[1]}, privateKeys["jon"])
+	assert.Equal(t, ErrNotEnoughShares, err)
+	// Nor can jack unwrap the shares of the others
+	_, err = unwrapShare(privateKeys["jack"], shares[0])
+	assert.Error(t, err)
+}
+
+func TestParseMasterKey(t *testing.T) {
+	mk, err := parseMasterKey(gTestMasterKey + "\n")
+	assert.NoError(t, err)
+	assert.Len(t, mk.Key, gKeySize)
+	assert.Len(t, mk.ID, 16)
+
+	_, err = parseMasterKey("not base64!")
+	assert.Error(t, err)
+	_, err = parseMasterKey("c2hvcnQ=") // "short"
+	assert.Error(t, err)
+}
+
+func TestSealOpen(t *testing.T) {
+	mk, err := parseMasterKey(gTestMasterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey := []byte("ORUGKIDQOJUXMYLUMUQGWZLZ")
+
+	var a = Account{Name: "Facebook", KeyID: mk.ID}
+	a.EncryptedPrivateKey, a.WrappedDataKey, err = mk.seal(privateKey)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(a.EncryptedPrivateKey), string(privateKey))
+
+	got, err := mk.open(a)
+	assert.NoError(t, err)
+	assert.Equal(t, privateKey, got)
+
+	// Every account gets its own data key
+	b := a
+	b.EncryptedPrivateKey, b.WrappedDataKey, err = mk.seal(privateKey)
+	assert.NoError(t, err)
+	assert.NotEqual(t, a.WrappedDataKey, b.WrappedDataKey)
+
+	// The name of the account doesn't help decrypt it anymore
+	_, err = decryptWithKey(getLegacyEncryptionKey(a.Name), a.EncryptedPrivateKey)
+	assert.Error(t, err)
+
+	// Nor does another master key
+	other, err := parseMasterKey("MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = other.open(a)
+	assert.Equal(t, ErrWrongMasterKey, err)
+	a.KeyID = other.ID
+	_, err = other.open(a)
+	assert.Error(t, err)
+}
+
+func TestReencryptLegacyAccount(t *testing.T) {
+	mk, err := parseMasterKey(gTestMasterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey := []byte("ORUGKIDQOJUXMYLUMUQGWZLZ")
+
+	var a = Account{Name: "Facebook"}
+	a.EncryptedPrivateKey, err = encryptWithKey(getLegacyEncryptionKey(a.Name), privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = reencryptLegacyAccount(&a, mk)
+	assert.NoError(t, err)
+	assert.Equal(t, mk.ID, a.KeyID)
+	assert.NotEmpty(t, a.WrappedDataKey)
+
+	got, err := mk.open(a)
+	assert.NoError(t, err)
+	assert.Equal(t, privateKey, got)
+}
+
+func TestInitQuarantinesLegacyAccountsReencrypted(t *testing.T) {
+	emptyTestTables(t)
+	defer emptyTestTables(t)
+
+	privateKey := []byte("ORUGKIDQOJUXMYLUMUQGWZLZ")
+	name := "Legacy"
+	legacyKey := getLegacyEncryptionKey(name)
+	encrypted, err := encryptWithKey(legacyKey, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Seed an account from before accounts belonged to vaults, or were envelope encrypted
+	accountID := id.GetNewID()
+	err = orm.Exec(`ALTER TABLE totp_accounts ALTER COLUMN vault_id DROP NOT NULL`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = orm.Exec(`INSERT INTO totp_accounts (id, created_at, updated_at, name, encrypted_private_key) VALUES (?, now(), now(), ?, ?)`, accountID, name, encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer orm.Exec(`DELETE FROM totp_accounts_quarantine WHERE id = ?`, accountID)
+
+	err = Init()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var rows []struct {
+		EncryptedPrivateKey []byte
+		WrappedDataKey      []byte
+		KeyID               string
+	}
+	err = orm.ScanRaw(&rows, `SELECT encrypted_private_key, wrapped_data_key, key_id FROM totp_accounts_quarantine WHERE id = ?`, accountID)
+	if !assert.NoError(t, err) || !assert.Len(t, rows, 1) {
+		return
+	}
+
+	_, err = decryptWithKey(legacyKey, rows[0].EncryptedPrivateKey)
+	assert.Error(t, err, "the quarantined account still opens with the legacy key")
+
+	got, err := gMasterKey.open(Account{EncryptedPrivateKey: rows[0].EncryptedPrivateKey, WrappedDataKey: rows[0].WrappedDataKey, KeyID: rows[0].KeyID})
+	assert.NoError(t, err)
+	assert.Equal(t, privateKey, got)
+}
+
 func TestGetCode(t *testing.T) {
 
-	orm.EmptyTestTables(t, &Account{})
-	defer orm.EmptyTestTables(t, &Account{})
+	emptyTestTables(t)
+	defer emptyTestTables(t)
 	// Create a new TOTP account so we testgetting it's code
-	a := createTestAccount(t)
+	u, v := createTestVault(t, "Facebook")
+	a := createTestAccount(t, u, v)
+
+	// Requests to access the vault: one that's approved, and one that isn't
+	ctx := context.Background()
+	s, err := secret.Request(ctx, secret.RequestParams{VaultID: v.ID, UserID: u.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := s.SecretRequestID
+	s, err = secret.Request(ctx, secret.RequestParams{VaultID: v.ID, UserID: u.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = secret.UpdateStatus(ctx, secret.UpdateParams{SecretRequestID: s.SecretRequestID, UserID: u.ID, Approval: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	approved := s.SecretRequestID
+
+	// A request for another vault of the user
+	_, other := createTestVault(t, "Twitter")
+	s, err = secret.Request(ctx, secret.RequestParams{VaultID: other.ID, UserID: u.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = secret.UpdateStatus(ctx, secret.UpdateParams{SecretRequestID: s.SecretRequestID, UserID: u.ID, Approval: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherVault := s.SecretRequestID
 
 	type args struct {
 		req GetCodeRequest
@@ -138,13 +753,41 @@ func TestGetCode(t *testing.T) {
 		{
 			name: "successfully get a code for a valid account",
 			args: args{
-				req: GetCodeRequest{AccountID: a.ID},
+				req: GetCodeRequest{AccountID: a.ID, UserID: u.ID, SecretRequestID: approved},
 			},
 		},
 		{
 			name: "error if accountID is invalid",
 			args: args{
-				req: GetCodeRequest{AccountID: id.GetNewID()},
+				req: GetCodeRequest{AccountID: id.GetNewID(), UserID: u.ID, SecretRequestID: approved},
+			},
+			wantErr: true,
+		},
+		{
+			name: "error if no secret request",
+			args: args{
+				req: GetCodeRequest{AccountID: a.ID, UserID: u.ID},
+			},
+			wantErr: true,
+		},
+		{
+			name: "error if the secret request is not approved",
+			args: args{
+				req: GetCodeRequest{AccountID: a.ID, UserID: u.ID, SecretRequestID: pending},
+			},
+			wantErr: true,
+		},
+		{
+			name: "error if the secret request was made by someone else",
+			args: args{
+				req: GetCodeRequest{AccountID: a.ID, UserID: id.GetNewID(), SecretRequestID: approved},
+			},
+			wantErr: true,
+		},
+		{
+			name: "error if the secret request is for another vault",
+			args: args{
+				req: GetCodeRequest{AccountID: a.ID, UserID: u.ID, SecretRequestID: otherVault},
 			},
 			wantErr: true,
 		},
@@ -152,7 +795,7 @@ func TestGetCode(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			now := time.Now()
-			got, err := GetCode(tt.args.req)
+			got, err := GetCode(context.Background(), tt.args.req)
 			if tt.wantErr {
 				assert.Error(t, err)
 				return
@@ -168,15 +811,528 @@ func TestGetCode(t *testing.T) {
 	}
 }
 
-func createTestAccount(t *testing.T) Account {
+func TestHOTP(t *testing.T) {
+	emptyTestTables(t)
+	defer emptyTestTables(t)
+
+	ctx := context.Background()
+	u, v := createTestVault(t, "VPN")
+	a, err := CreateAccount(ctx, CreateAccountRequest{
+		VaultID:    v.ID,
+		UserID:     u.ID,
+		Name:       "VPN",
+		PrivateKey: []byte(base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))),
+		Type:       AccountTypeHOTP,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := secret.Request(ctx, secret.RequestParams{VaultID: v.ID, UserID: u.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = secret.UpdateStatus(ctx, secret.UpdateParams{SecretRequestID: s.SecretRequestID, UserID: u.ID, Approval: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := GetCodeRequest{AccountID: a.ID, UserID: u.ID, SecretRequestID: s.SecretRequestID}
+
+	t.Run("concurrent requesters get different codes", func(t *testing.T) {
+		const n = 5
+		var wg sync.WaitGroup
+		codes := make(chan Code, n)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c, err := GetCode(ctx, req)
+				assert.NoError(t, err)
+				codes <- c
+			}()
+		}
+		wg.Wait()
+		close(codes)
+
+		// RFC 4226 test values for the counters 0 to 4
+		want := map[int64]string{0: "755224", 1: "287082", 2: "359152", 3: "969429", 4: "338314"}
+		seen := map[int64]bool{}
+		for c := range codes {
+			assert.False(t, seen[c.Counter], "counter %d issued twice", c.Counter)
+			seen[c.Counter] = true
+			assert.Equal(t, want[c.Counter], c.Code)
+		}
+		assert.Len(t, seen, n)
+	})
+
+	t.Run("resync", func(t *testing.T) {
+		// The token is at the counters 7 and 8
+		got, err := ResyncAccount(ctx, ResyncRequest{AccountID: a.ID, UserID: u.ID, Codes: []string{"162583", "399871"}})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(9), got.Counter)
+
+		c, err := GetCode(ctx, req)
+		assert.NoError(t, err)
+		assert.Equal(t, "520489", c.Code)
+
+		// The counter never moves back
+		_, err = ResyncAccount(ctx, ResyncRequest{AccountID: a.ID, UserID: u.ID, Codes: []string{"162583", "399871"}})
+		assert.Equal(t, ErrResyncFailed, err)
+
+		// Only the owners of the vault can resync
+		_, err = ResyncAccount(ctx, ResyncRequest{AccountID: a.ID, UserID: id.GetNewID(), Codes: []string{"162583", "399871"}})
+		assert.Error(t, err)
+
+		// TOTP accounts can't be resynced
+		b := createTestAccount(t, u, v)
+		_, err = ResyncAccount(ctx, ResyncRequest{AccountID: b.ID, UserID: u.ID, Codes: []string{"162583", "399871"}})
+		assert.Equal(t, ErrNotHOTP, err)
+	})
+}
+
+func TestStreamCodes(t *testing.T) {
+	emptyTestTables(t)
+	defer emptyTestTables(t)
+
+	ctx := context.Background()
+	u, v := createTestVault(t, "Facebook")
+	a := createTestAccount(t, u, v)
+
+	s, err := secret.Request(ctx, secret.RequestParams{VaultID: v.ID, UserID: u.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := GetCodeRequest{AccountID: a.ID, UserID: u.ID, SecretRequestID: s.SecretRequestID}
+	noop := func(CodeUpdate) error { return nil }
+
+	// The request isn't approved yet
+	err = StreamCodes(ctx, req, noop)
+	assert.Equal(t, secret.ErrNotApproved, err)
+
+	_, err = secret.UpdateStatus(ctx, secret.UpdateParams{SecretRequestID: s.SecretRequestID, UserID: u.ID, Approval: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The stream runs until the client goes away
+	cctx, cancel := context.WithCancel(ctx)
+	var updates []CodeUpdate
+	err = StreamCodes(cctx, req, func(u CodeUpdate) error {
+		updates = append(updates, u)
+		cancel()
+		return nil
+	})
+	assert.Equal(t, context.Canceled, err)
+	if assert.Len(t, updates, 1) {
+		c, err := GetCode(ctx, req)
+		assert.NoError(t, err)
+		assert.Contains(t, []string{updates[0].Current.Code, updates[0].Next.Code}, c.Code)
+		assert.Equal(t, updates[0].Current.ExpireAt, updates[0].Next.ValidAt)
+	}
+
+	// HOTP codes are issued one at a time
+	h, err := CreateAccount(ctx, CreateAccountRequest{VaultID: v.ID, UserID: u.ID, Name: "VPN", URI: "otpauth://hotp/VPN?secret=GEZDGNBVGY3TQOJQ&counter=0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = StreamCodes(ctx, GetCodeRequest{AccountID: h.ID, UserID: u.ID, SecretRequestID: s.SecretRequestID}, noop)
+	assert.Equal(t, ErrStreamNotSupported, err)
+
+	// Under the default policy, the stream ends when the window closes, a couple of seconds from now
+	closeAt := time.Now().Add(2 * time.Second)
+	err = orm.UpdateColumnsByConditions(map[string]interface{}{"id": s.SecretRequestID}, map[string]interface{}{"approved_at": closeAt.Add(-v.ApprovalPolicy.TTL())}, &secret.SecretRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	var sentAt []time.Time
+	err = StreamCodes(tctx, req, func(CodeUpdate) error {
+		sentAt = append(sentAt, time.Now())
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.WithinDuration(t, closeAt, time.Now(), time.Second)
+	for _, at := range sentAt {
+		assert.True(t, at.Before(closeAt), "a code was pushed after the window closed")
+	}
+
+	// Once the window is closed, nothing is pushed
+	err = StreamCodes(ctx, req, func(CodeUpdate) error {
+		t.Error("a code was pushed after the window closed")
+		return nil
+	})
+	assert.Equal(t, secret.ErrApprovalExpired, err)
+}
+
+func TestHistory(t *testing.T) {
+	emptyTestTables(t)
+	defer emptyTestTables(t)
+
+	ctx := context.Background()
+	u, v := createTestVault(t, "Facebook")
+	a := createTestAccount(t, u, v)
+	other, _ := createTestVault(t, "Twitter")
+
+	s, err := secret.Request(ctx, secret.RequestParams{VaultID: v.ID, UserID: u.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := GetCodeRequest{AccountID: a.ID, UserID: u.ID, SecretRequestID: s.SecretRequestID, ClientIP: "10.0.0.1"}
+
+	// Trying to get a code before the approval raises an alert
+	_, err = GetCode(ctx, req)
+	assert.Equal(t, secret.ErrNotApproved, err)
+
+	_, err = secret.UpdateStatus(ctx, secret.UpdateParams{SecretRequestID: s.SecretRequestID, UserID: u.ID, Approval: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := GetCode(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := GetHistory(ctx, GetHistoryRequest{AccountID: a.ID, UserID: u.ID})
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, h.Events, 1) {
+		e := h.Events[0]
+		assert.Equal(t, u.ID, e.UserID)
+		assert.Equal(t, s.SecretRequestID, e.SecretRequestID)
+		assert.Equal(t, "10.0.0.1", e.ClientIP)
+		assert.Equal(t, getTimeStep(a, c.ValidAt), e.TimeStep)
+	}
+	if assert.Len(t, h.Alerts, 1) {
+		assert.Equal(t, AuditActionCodeDenied, h.Alerts[0].Action)
+		assert.Equal(t, u.ID, h.Alerts[0].ActorUserID)
+	}
+
+	// Only the members of the vault can see the history
+	_, err = GetHistory(ctx, GetHistoryRequest{AccountID: a.ID, UserID: other.ID})
+	assert.Equal(t, vault.ErrForbidden, err)
+	_, err = GetHistory(ctx, GetHistoryRequest{AccountID: id.GetNewID(), UserID: u.ID})
+	assert.Equal(t, ErrAccountNotFound, err)
+}
+
+func TestImportExport(t *testing.T) {
+	emptyTestTables(t)
+	defer emptyTestTables(t)
+
+	ctx := context.Background()
+	u, v := createTestVault(t, "Authenticator")
+
+	imported, err := ImportMigration(ctx, ImportMigrationRequest{
+		VaultID: v.ID,
+		UserID:  u.ID,
+		URIs:    []string{"otpauth-migration://offline?data=CjEKCkhlbGxvId6tvu8SGEV4YW1wbGU6YWxpY2VAZ29vZ2xlLmNvbRoHRXhhbXBsZSABKAEwAhABGAEgACjr4JKK%2Bv%2F%2F%2F%2F8B"},
+	})
+	if assert.NoError(t, err) && assert.Len(t, imported, 1) {
+		assert.Equal(t, "Example", imported[0].Name)
+		assert.Equal(t, "alice@google.com", imported[0].Label)
+	}
+
+	// Only the owners of the vault can import
+	_, err = ImportMigration(ctx, ImportMigrationRequest{VaultID: v.ID, UserID: id.GetNewID(), URIs: []string{"otpauth-migration://offline?data=CjEKCkhlbGxvId6tvu8SGEV4YW1wbGU6YWxpY2VAZ29vZ2xlLmNvbRoHRXhhbXBsZSABKAEwAhABGAEgACjr4JKK%2Bv%2F%2F%2F%2F8B"}})
+	assert.Error(t, err)
+
+	// An account that can't be exported in the migration format
+	_, err = CreateAccount(ctx, CreateAccountRequest{VaultID: v.ID, UserID: u.ID, Name: "Bank", PrivateKey: []byte("ORUGKIDQOJUXMYLUMUQGWZLZ"), IntervalSeconds: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Exporting needs an approved request
+	s, err := secret.Request(ctx, secret.RequestParams{VaultID: v.ID, UserID: u.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ExportAccounts(ctx, ExportRequest{VaultID: v.ID, UserID: u.ID, SecretRequestID: s.SecretRequestID})
+	assert.Equal(t, secret.ErrNotApproved, err)
+
+	_, err = secret.UpdateStatus(ctx, secret.UpdateParams{SecretRequestID: s.SecretRequestID, UserID: u.ID, Approval: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := ExportAccounts(ctx, ExportRequest{VaultID: v.ID, UserID: u.ID, SecretRequestID: s.SecretRequestID})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, e.URIs, 2)
+	assert.Contains(t, e.URIs, "otpauth://totp/Example:alice@google.com?algorithm=SHA1&digits=6&issuer=Example&period=30&secret=JBSWY3DPEHPK3PXP")
+	assert.Len(t, e.MigrationURIs, 1)
+	if assert.Len(t, e.Skipped, 1) {
+		assert.Equal(t, "Bank", e.Skipped[0].Name)
+	}
+
+	events, err := audit.GetEventsByEntity(ctx, "vault", v.ID)
+	assert.NoError(t, err)
+	var exported bool
+	for _, ev := range events {
+		exported = exported || ev.Action == AuditActionExported
+	}
+	assert.True(t, exported)
+
+	// The approval closes after the default window, when the vault's policy doesn't set one
+	approvedAt := time.Now().Add(-v.ApprovalPolicy.TTL() - time.Minute)
+	err = orm.UpdateColumnsByConditions(map[string]interface{}{"id": s.SecretRequestID}, map[string]interface{}{"approved_at": approvedAt}, &secret.SecretRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ExportAccounts(ctx, ExportRequest{VaultID: v.ID, UserID: u.ID, SecretRequestID: s.SecretRequestID})
+	assert.Equal(t, secret.ErrApprovalExpired, err)
+}
+
+func TestCombinations(t *testing.T) {
+	emptyTestTables(t)
+	defer emptyTestTables(t)
+	defer func(n int) { gMemberKeyIterations = n }(gMemberKeyIterations)
+	gMemberKeyIterations = 1000
+
+	ctx := context.Background()
+	jon, _ := createTestVault(t, "Placeholder")
+	var users = map[string]user.User{"jon": jon}
+	for _, name := range []string{"jane", "jack", "jill"} {
+		u, err := user.CreateUser(user.CreateUserRequest{Name: name, Email: name + "@email.com", Password: name + "s_secret"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		users[name] = *u
+	}
+	v, err := vault.CreateAndInitializeVault(ctx, vault.CreateAndInitializeVaultRequest{
+		CreateVaultRequest:              vault.CreateVaultRequest{AdminUserID: jon.ID, Name: "Shared"},
+		CreateShamirVaultRequest:        vault.CreateShamirVaultRequest{K: 2},
+		AddMemberByEmailsToVaultRequest: vault.AddMemberByEmailsToVaultRequest{MemberEmails: []string{"jane@email.com", "jack@email.com"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := CreateAccountRequest{VaultID: v.ID, UserID: jon.ID, Name: "Bank", PrivateKey: []byte("ORUGKIDQOJUXMYLUMUQGWZLZ"), Protection: ProtectionCombinations}
+
+	// Every member needs a passphrase
+	_, err = CreateAccount(ctx, req)
+	assert.Equal(t, ErrMemberKeyNotFound, err)
+	for _, name := range []string{"jon", "jane", "jack", "jill"} {
+		_, err := SetMemberKey(ctx, SetMemberKeyRequest{UserID: users[name].ID, Passphrase: name + "'s passphrase"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = SetMemberKey(ctx, SetMemberKeyRequest{UserID: jon.ID, Passphrase: "jon's other passphrase"})
+	assert.Equal(t, ErrMemberKeyExists, err)
+
+	a, err := CreateAccount(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var combinations []Combination
+	_, err = orm.Find(map[string]interface{}{"account_id": a.ID}, &combinations)
+	assert.NoError(t, err)
+	assert.Len(t, combinations, 3) // 3 choose 2
+	assert.Empty(t, a.WrappedDataKey)
+
+	// The number of combinations is capped
+	env.SetEnvVarsMust(map[string]string{envMaxCombinations: "2"})
+	_, err = CreateAccount(ctx, req)
+	assert.Equal(t, ErrTooManyCombinations, err)
+	env.SetEnvVarsMust(map[string]string{envMaxCombinations: "1000"})
+
+	// Jon asks for a code, and everyone approves
+	getApprovedRequest := func() id.ID {
+		s, err := secret.Request(ctx, secret.RequestParams{VaultID: v.ID, UserID: jon.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var vus []vault.VaultUser
+		if _, err := orm.FindByColumn("vault_id", v.ID, &vus); err != nil {
+			t.Fatal(err)
+		}
+		for _, vu := range vus {
+			_, err = secret.UpdateStatus(ctx, secret.UpdateParams{SecretRequestID: s.SecretRequestID, UserID: vu.UserID, Approval: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return s.SecretRequestID
+	}
+	srID := getApprovedRequest()
+	codeReq := GetCodeRequest{AccountID: a.ID, UserID: jon.ID, SecretRequestID: srID, Passphrase: "jon's passphrase"}
+
+	_, err = GetCode(ctx, codeReq)
+	assert.Equal(t, ErrNotEnoughShares, err)
+
+	_, err = ContributeShares(ctx, ContributeSharesRequest{SecretRequestID: srID, UserID: users["jane"].ID, Passphrase: "wrong passphrase"})
+	assert.Equal(t, ErrWrongPassphrase, err)
+	_, err = ContributeShares(ctx, ContributeSharesRequest{SecretRequestID: srID, UserID: users["jill"].ID, Passphrase: "jill's passphrase"})
+	assert.Equal(t, ErrNotApprover, err)
+	n, err := ContributeShares(ctx, ContributeSharesRequest{SecretRequestID: srID, UserID: users["jane"].ID, Passphrase: "jane's passphrase"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n) // jane's share of the combination of jane and jon
+
+	_, err = GetCode(ctx, GetCodeRequest{AccountID: a.ID, UserID: jon.ID, SecretRequestID: srID, Passphrase: "jack's passphrase"})
+	assert.Equal(t, ErrWrongPassphrase, err)
+	c, err := GetCode(ctx, codeReq)
+	assert.NoError(t, err)
+	assert.Len(t, c.Code, 6)
+
+	// When jill joins, the account needs to be encrypted for her too, which happens with the next code
+	err = v.AddUser(ctx, users["jill"].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := orm.FindByID(a.ID, &a)
+	assert.True(t, found)
+	assert.NoError(t, err)
+	assert.True(t, a.PendingReencryption)
+
+	_, err = GetCode(ctx, codeReq)
+	assert.NoError(t, err)
+	combinations = nil
+	_, err = orm.Find(map[string]interface{}{"account_id": a.ID}, &combinations)
+	assert.NoError(t, err)
+	assert.Len(t, combinations, 6) // 4 choose 2
+	_, err = orm.FindByID(a.ID, &a)
+	assert.NoError(t, err)
+	assert.False(t, a.PendingReencryption)
+
+	// Exports need the shares too
+	e, err := ExportAccounts(ctx, ExportRequest{VaultID: v.ID, UserID: jon.ID, SecretRequestID: getApprovedRequest()})
+	assert.NoError(t, err)
+	assert.Empty(t, e.URIs)
+	assert.Len(t, e.Skipped, 2)
+
+	// If the vault needs more approvals, the combinations of two members could decrypt the account with too few of them
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		err := tx.UpdateColumnsByConditions(map[string]interface{}{"vault_id": v.ID}, map[string]interface{}{"k": 3}, &vault.ShamirsVault{})
+		if err != nil {
+			return err
+		}
+		return syncCombinations(ctx, tx, v.ID)
+	})
+	assert.NoError(t, err)
+	combinations = nil
+	_, err = orm.Find(map[string]interface{}{"account_id": a.ID}, &combinations)
+	assert.NoError(t, err)
+	assert.Empty(t, combinations)
+	var shares []Share
+	_, err = orm.FindWhere(&shares, "combination_id IS NOT NULL")
+	assert.NoError(t, err)
+	assert.Empty(t, shares)
+	_, err = orm.FindByID(a.ID, &a)
+	assert.NoError(t, err)
+	assert.True(t, a.PendingReencryption)
+}
+
+func TestPurgeVault(t *testing.T) {
+	emptyTestTables(t)
+	defer emptyTestTables(t)
+	defer func(n int) { gMemberKeyIterations = n }(gMemberKeyIterations)
+	gMemberKeyIterations = 1000
+
+	ctx := context.Background()
+	u, v := createTestVault(t, "Facebook")
+	_, other := createTestVault(t, "Twitter")
+	a := createTestAccount(t, u, v)
+	kept := createTestAccount(t, u, other)
+
+	// An account protected by combinations, and a code from the history of the other
+	_, err := SetMemberKey(ctx, SetMemberKeyRequest{UserID: u.ID, Passphrase: "jon's passphrase"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = CreateAccount(ctx, CreateAccountRequest{VaultID: v.ID, UserID: u.ID, Name: "Bank", PrivateKey: []byte("ORUGKIDQOJUXMYLUMUQGWZLZ"), Protection: ProtectionCombinations})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := secret.Request(ctx, secret.RequestParams{VaultID: v.ID, UserID: u.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = secret.UpdateStatus(ctx, secret.UpdateParams{SecretRequestID: s.SecretRequestID, UserID: u.ID, Approval: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = GetCode(ctx, GetCodeRequest{AccountID: a.ID, UserID: u.ID, SecretRequestID: s.SecretRequestID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Purge the vault, without waiting for the retention period
+	env.SetEnvVarsMust(map[string]string{"VAULT_PURGE_RETENTION_DAYS": "0"})
+	defer env.UnsetEnvVarsMust(map[string]string{"VAULT_PURGE_RETENTION_DAYS": "0"})
+	_, err = vault.ArchiveVault(ctx, vault.VaultActionRequest{VaultID: v.ID, UserID: u.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = vault.DeleteVault(ctx, vault.VaultActionRequest{VaultID: v.ID, UserID: u.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := vault.PurgeDueVaults(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	// Nothing of the vault's accounts is left behind
+	var accounts []Account
+	_, err = orm.FindByColumn("vault_id", v.ID, &accounts)
+	assert.NoError(t, err)
+	assert.Empty(t, accounts)
+	var combinations []Combination
+	_, err = orm.FindWhere(&combinations, "id IS NOT NULL")
+	assert.NoError(t, err)
+	assert.Empty(t, combinations)
+	var shares []Share
+	_, err = orm.FindWhere(&shares, "id IS NOT NULL")
+	assert.NoError(t, err)
+	assert.Empty(t, shares)
+	var events []CodeEvent
+	_, err = orm.FindByColumn("vault_id", v.ID, &events)
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+
+	// The accounts of other vaults are kept
+	found, err := orm.FindByID(kept.ID, &Account{})
+	assert.NoError(t, err)
+	assert.True(t, found)
+}
+
+func createTestAccount(t *testing.T, u user.User, v *vault.Vault) Account {
 	req := CreateAccountRequest{
+		VaultID:    v.ID,
+		UserID:     u.ID,
 		Name:       "Facebook",
 		PrivateKey: []byte("ORUGKIDQOJUXMYLUMUQGWZLZ"), // base32 for "the private key"
 	}
-	a, err := CreateAccount(req)
+	a, err := CreateAccount(context.Background(), req)
 	if err != nil {
 		t.Fatal(err)
 	}
 	clog.Debugf("created a test TOTP account with ID %s", a.ID)
 	return a
 }
+
+// createTestVault creates a vault with the name, owned by a test user
+func createTestVault(t *testing.T, name string) (user.User, *vault.Vault) {
+	u, err := user.GetUserByEmail("jon.doe@email.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.ID.IsEmpty() {
+		created, err := user.CreateUser(user.CreateUserRequest{Name: "Jon Doe", Email: "jon.doe@email.com", Password: "jons_secret"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		u = *created
+	}
+	v, err := vault.CreateVault(context.Background(), vault.CreateVaultRequest{AdminUserID: u.ID, Name: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u, v
+}
+
+func emptyTestTables(t *testing.T) {
+	orm.EmptyTestTables(t, &Account{}, &MemberKey{}, &Combination{}, &Share{}, &CodeEvent{}, &audit.Event{}, &vault.ShamirsVault{}, &secret.SecretRequest{}, &secret.SecretApproval{}, &vault.Vault{}, &vault.VaultUser{}, &user.User{}, &user.Password{})
+}
@@ -0,0 +1,131 @@
+package totp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base32"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"time"
+
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/qrcode"
+)
+
+/* Verifying Codes
+
+Besides generating the codes of the accounts in the vaults, the code generator can verify the codes of an authenticator
+app, e.g. for the second factor of our own logins. The keys are generated here, and use the defaults (SHA1, 6 digits
+and a 30 second period) since every authenticator app supports them.
+
+A code is accepted in the time steps around the current one as well, since the clock of a phone drifts. To stop a code
+from being used twice, VerifyCode returns the time step that the code matched, which the caller should store, and
+codes of that time step or earlier are rejected.
+
+*/
+
+// gGeneratedKeySize is the number of random bytes in a generated private key, as recommended by RFC 4226
+const gGeneratedKeySize = 20
+
+// gQRCodeSize is the width and height, in pixels, of the QR code images that we encode
+const gQRCodeSize = 256
+
+// ErrInvalidCode is returned when a code doesn't match the private key in any of the allowed time steps
+var ErrInvalidCode = fmt.Errorf("code is invalid")
+
+// ErrCodeReused is returned when a code matches a time step that has already been used
+var ErrCodeReused = fmt.Errorf("code has already been used")
+
+// SealedKey is a private key encrypted with envelope encryption under the master key, for keys that are stored
+// outside of the accounts
+type SealedKey struct {
+	EncryptedPrivateKey []byte
+	WrappedDataKey      []byte
+	KeyID               string
+}
+
+// GenerateKey returns a new random private key, base32 encoded
+func GenerateKey() ([]byte, error) {
+	b := make([]byte, gGeneratedKeySize)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return nil, fmt.Errorf("generating private key: %v", err)
+	}
+	return []byte(base32.StdEncoding.EncodeToString(b)), nil
+}
+
+// SealKey encrypts the private key with a new data key, wrapped with the master key
+func SealKey(privateKey []byte) (SealedKey, error) {
+	var k SealedKey
+	if gMasterKey == nil {
+		return k, ErrMasterKeyNotConfigured
+	}
+	var err error
+	k.EncryptedPrivateKey, k.WrappedDataKey, err = gMasterKey.seal(privateKey)
+	if err != nil {
+		return k, err
+	}
+	k.KeyID = gMasterKey.ID
+	return k, nil
+}
+
+// OpenKey decrypts a private key sealed by SealKey
+func OpenKey(k SealedKey) ([]byte, error) {
+	if gMasterKey == nil {
+		return nil, ErrMasterKeyNotConfigured
+	}
+	return gMasterKey.open(Account{EncryptedPrivateKey: k.EncryptedPrivateKey, WrappedDataKey: k.WrappedDataKey, KeyID: k.KeyID})
+}
+
+// VerifyCode checks the code against the TOTP codes of the private key, with the default parameters, for the time
+// step of now and up to skew time steps before and after it. The code should be for a later time step than lastStep,
+// the time step of the last code that was accepted. It returns the time step that the code matched.
+func VerifyCode(privateKey []byte, code string, now time.Time, skew int64, lastStep int64) (int64, error) {
+	if len(code) != gDefaultCodeLength {
+		return 0, ErrInvalidCode
+	}
+
+	current := now.Unix() / gDefaultIntervalInSeconds
+	for step := current - skew; step <= current+skew; step++ {
+		want, err := getHOTPValue(privateKey, gDefaultAlgorithm, gDefaultCodeLength, step)
+		if err != nil {
+			return 0, err
+		}
+		if !hmac.Equal([]byte(want), []byte(code)) {
+			continue
+		}
+		if step <= lastStep {
+			return 0, ErrCodeReused
+		}
+		return step, nil
+	}
+	return 0, ErrInvalidCode
+}
+
+// EncodeQRCode encodes the text, e.g. an otpauth:// URI, as a PNG image of a QR code
+func EncodeQRCode(text string) ([]byte, error) {
+	m, err := qrcode.NewQRCodeWriter().EncodeWithoutHint(text, gozxing.BarcodeFormat_QR_CODE, gQRCodeSize, gQRCodeSize)
+	if err != nil {
+		return nil, fmt.Errorf("encoding QR code: %v", err)
+	}
+
+	img := image.NewGray(image.Rect(0, 0, m.GetWidth(), m.GetHeight()))
+	for y := 0; y < m.GetHeight(); y++ {
+		for x := 0; x < m.GetWidth(); x++ {
+			c := color.White
+			if m.Get(x, y) {
+				c = color.Black
+			}
+			img.Set(x, y, c)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("encoding QR code image: %v", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -1,7 +1,9 @@
 package user
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	"github.com/teejays/clog"
 
@@ -10,6 +12,10 @@ import (
 	"github.com/teejays/n-factor-vault/backend/library/orm"
 )
 
+// ErrNoPassword is returned when getting the password of a user who doesn't have one, e.g. a user who logs in through
+// single sign-on
+var ErrNoPassword = fmt.Errorf("user has no password")
+
 /* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
 * O R M   M O D E L S
 * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
@@ -17,8 +23,14 @@ import (
 // User is the basic user object
 type User struct {
 	orm.BaseModel
-	Name  string
-	Email string
+	Name        string
+	Email       string
+	LastLoginAt *time.Time `json:"last_login_at"` // nil if the user has never logged in, or if LastLoginUnknown
+	// LastLoginUnknown is true for the users who existed before logins were recorded, until they next log in
+	LastLoginUnknown bool `gorm:"NOT NULL;default:false" json:"last_login_unknown"`
+	// ServiceAccount is true for the users that machines (e.g. CI pipelines) act as. They have no email or password,
+	// and authenticate with API keys.
+	ServiceAccount bool `json:"service_account"`
 }
 
 // Password is separate struct for storing user hashed passwords
@@ -30,7 +42,19 @@ type Password struct {
 
 // Init initializes the service so it can connect with the ORM
 func Init() (err error) {
-	return orm.RegisterModels(&User{}, &Password{})
+	// The users who already exist when LastLoginUnknown is added (i.e. the table exists, but not the column) may have
+	// logged in before logins were recorded
+	backfill := orm.HasColumn(&User{}, "id") && !orm.HasColumn(&User{}, "last_login_unknown")
+
+	err = orm.RegisterModels(&User{}, &Password{})
+	if err != nil {
+		return err
+	}
+
+	if backfill {
+		return orm.Exec(`UPDATE users SET last_login_unknown = true WHERE last_login_at IS NULL`)
+	}
+	return nil
 }
 
 /* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
@@ -82,6 +106,40 @@ func CreateUser(req CreateUserRequest) (*User, error) {
 	return &u, nil
 }
 
+// CreateExternalUserTx creates a user who logs in through an external identity provider, e.g. single sign-on, as part
+// of the transaction tx. They have no password.
+func CreateExternalUserTx(ctx context.Context, tx *orm.Tx, name, email string) (*User, error) {
+	var existing User
+	exists, err := tx.FindOne(map[string]interface{}{"email": email}, &existing)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, fmt.Errorf("an account with this email already exists")
+	}
+
+	var u User
+	u.Name = name
+	u.Email = email
+	err = tx.InsertOne(&u)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// CreateServiceAccountUserTx creates the user that a service account acts as, as part of the transaction tx
+func CreateServiceAccountUserTx(ctx context.Context, tx *orm.Tx, name string) (*User, error) {
+	var u User
+	u.Name = name
+	u.ServiceAccount = true
+	err := tx.InsertOne(&u)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
 // GetUsers returns an slice of users given the userIDs passed
 func GetUsers(ids ...id.ID) ([]User, error) {
 	var users []User
@@ -120,6 +178,12 @@ func GetUserByEmail(email string) (User, error) {
 	return getUserByEmail(email)
 }
 
+// RecordLogin sets the time that the user last logged in to now
+func RecordLogin(u User) error {
+	now := time.Now()
+	return orm.UpdateColumnsByConditions(map[string]interface{}{"id": u.ID}, map[string]interface{}{"last_login_at": now, "last_login_unknown": false}, &User{})
+}
+
 func getUserByEmail(email string) (User, error) {
 	var u User
 	exists, err := orm.FindByColumn("email", email, &u)
@@ -149,8 +213,8 @@ func getPasswordForUser(u User) (Password, error) {
 		return pass, err
 	}
 	if !exists {
-		// This means a user exists but no corresponding password hash, which should never happen
-		panic(fmt.Sprintf("no password entry for user %s found", u.ID))
+		// Users who log in through an external identity provider, and service accounts, have no password
+		return pass, ErrNoPassword
 	}
 
 	return pass, nil
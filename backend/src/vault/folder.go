@@ -0,0 +1,664 @@
+package vault
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/teejays/clog"
+
+	"github.com/teejays/n-factor-vault/backend/library/id"
+	"github.com/teejays/n-factor-vault/backend/library/orm"
+
+	"github.com/teejays/n-factor-vault/backend/src/audit"
+)
+
+// ErrFolderNotFound is returned when the folder does not exist, or the user does not have access to it
+var ErrFolderNotFound = fmt.Errorf("folder not found")
+
+// gMaxFolderDepth is the maximum number of levels in the folder tree
+var gMaxFolderDepth = 32
+
+// Audit actions for folders, and for vaults moving between them
+const (
+	auditEntityTypeFolder           = "folder"
+	AuditActionFolderMemberSet      = "folder.member_set"
+	AuditActionFolderMemberRemoved  = "folder.member_removed"
+	AuditActionFolderPolicyUpdated  = "folder.approval_policy_updated"
+	AuditActionMoved                = "vault.moved"
+	AuditActionApprovalPolicyUpdate = "vault.approval_policy_updated"
+)
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* O R M   M O D E L S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// Folder groups vaults, and other folders, into a tree. The members, roles and approval policy set on a folder are
+// inherited by everything below it, and can be overridden at any level down the tree, including by the vaults.
+type Folder struct {
+	orm.BaseModel  `gorm:"embedded"`
+	OrgID          *id.ID                 `gorm:"index" json:"org_id"`                                  // empty for personal folders
+	ParentID       *id.ID                 `gorm:"unique_index:idx_folder_parent_name" json:"parent_id"` // empty for top level folders
+	Name           string                 `gorm:"unique_index:idx_folder_parent_name" json:"name"`
+	ApprovalPolicy ApprovalPolicyOverride `gorm:"embedded;embedded_prefix:approval_override_" json:"approval_policy"`
+	Members        []FolderMember         `json:"members"` // the roles set at this level
+	// Computed when the folder is fetched
+	EffectiveApprovalPolicy ApprovalPolicy    `gorm:"-" json:"effective_approval_policy"`
+	EffectiveMembers        []EffectiveMember `gorm:"-" json:"effective_members"`
+}
+
+// FolderMember sets the role of a user on a folder, and so on everything below it. RoleNone can be used to stop a user
+// from inheriting a role from the folders above.
+type FolderMember struct {
+	orm.BaseModel `gorm:"embedded"`
+	FolderID      id.ID `gorm:"unique_index:idx_folder_user" json:"folder_id"`
+	UserID        id.ID `gorm:"unique_index:idx_folder_user" json:"user_id"`
+	Role          Role  `gorm:"NOT NULL" json:"role"`
+}
+
+// ApprovalPolicyOverride is an approval policy set at one level of the folder tree. Empty fields are inherited from
+// the level above.
+type ApprovalPolicyOverride struct {
+	TTLMinutes *int `json:"ttlMinutes"`
+}
+
+// EffectiveMember is a user who has a role on a vault or a folder, and how they got it
+type EffectiveMember struct {
+	UserID     id.ID `json:"user_id"`
+	Role       Role  `json:"role"`
+	FromTeam   bool  `json:"from_team"`
+	FromFolder bool  `json:"from_folder"`
+}
+
+// EffectivePermissions are the members and the approval policy that apply to a vault after inheritance
+type EffectivePermissions struct {
+	VaultID        id.ID             `json:"vault_id"`
+	FolderID       *id.ID            `json:"folder_id"`
+	ApprovalPolicy ApprovalPolicy    `json:"approvalPolicy"`
+	Members        []EffectiveMember `json:"members"`
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* M E T H O D S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// CreateFolderRequest are the parameters that are passed when creating a folder
+type CreateFolderRequest struct {
+	UserID         id.ID                  `json:"-"`
+	OrgID          *id.ID                 `json:"orgId"`    // only for top level folders, sub-folders belong to the org of their parent
+	ParentID       *id.ID                 `json:"parentId"` // empty for a top level folder
+	Name           string                 `json:"name"`
+	ApprovalPolicy ApprovalPolicyOverride `json:"approvalPolicy"`
+}
+
+// FolderMemberRequest are the parameters for setting, or removing, the role of a user on a folder
+type FolderMemberRequest struct {
+	FolderID     id.ID `json:"-"`
+	UserID       id.ID `json:"-"` // the user making the request
+	MemberUserID id.ID `json:"-"`
+	Role         Role  `json:"role"`
+}
+
+// SetFolderPolicyRequest are the parameters for setting the approval policy of a folder
+type SetFolderPolicyRequest struct {
+	FolderID       id.ID                  `json:"-"`
+	UserID         id.ID                  `json:"-"`
+	ApprovalPolicy ApprovalPolicyOverride `json:"approvalPolicy"`
+}
+
+// MoveVaultRequest are the parameters for moving a vault to another folder
+type MoveVaultRequest struct {
+	VaultID  id.ID  `json:"-"`
+	UserID   id.ID  `json:"-"`
+	FolderID *id.ID `json:"folderId"` // empty to move the vault out of all folders
+}
+
+// SetApprovalPolicyRequest are the parameters for overriding the approval policy of a vault
+type SetApprovalPolicyRequest struct {
+	VaultID        id.ID                  `json:"-"`
+	UserID         id.ID                  `json:"-"`
+	ApprovalPolicy ApprovalPolicyOverride `json:"approvalPolicy"`
+}
+
+// CreateFolder creates a new folder. The user creating a top level folder becomes its owner, while sub-folders can be
+// created by anyone who owns the parent folder.
+func CreateFolder(ctx context.Context, req CreateFolderRequest) (*Folder, error) {
+	clog.Debugf("%s: CreateFolder(): name %s", gServiceName, req.Name)
+
+	if req.UserID.IsEmpty() {
+		return nil, fmt.Errorf("userID is empty")
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		return nil, fmt.Errorf("name is empty")
+	}
+	if err := req.ApprovalPolicy.validate(); err != nil {
+		return nil, err
+	}
+
+	f := Folder{
+		OrgID:          req.OrgID,
+		ParentID:       req.ParentID,
+		Name:           strings.TrimSpace(req.Name),
+		ApprovalPolicy: req.ApprovalPolicy,
+	}
+
+	err := orm.WithTx(ctx, func(tx *orm.Tx) error {
+		if f.ParentID == nil {
+			// Only members of an organization can create folders in it
+			if f.OrgID != nil {
+				if err := requireOrgMember(ctx, tx, *f.OrgID, req.UserID); err != nil {
+					return err
+				}
+			}
+			f.Members = []FolderMember{{UserID: req.UserID, Role: RoleOwner}}
+			return tx.InsertOne(&f)
+		}
+
+		chain, err := getFolderChain(ctx, tx, *f.ParentID)
+		if err != nil {
+			return err
+		}
+		if len(chain) >= gMaxFolderDepth {
+			return fmt.Errorf("folders cannot be nested more than %d levels deep", gMaxFolderDepth)
+		}
+		parent := chain[len(chain)-1]
+		if f.OrgID != nil && (parent.OrgID == nil || *parent.OrgID != *f.OrgID) {
+			return fmt.Errorf("folder must belong to the organization of its parent folder")
+		}
+		f.OrgID = parent.OrgID
+		if err = requireFolderRole(chain, req.UserID, RoleOwner); err != nil {
+			return err
+		}
+		return tx.InsertOne(&f)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+// GetFolder returns the folder, with the roles set on it and its effective members and approval policy. The user needs
+// to have a role on the folder.
+func GetFolder(ctx context.Context, folderID, userID id.ID) (*Folder, error) {
+	var f Folder
+	err := orm.WithTx(ctx, func(tx *orm.Tx) error {
+		chain, err := getFolderChain(ctx, tx, folderID)
+		if err != nil {
+			return err
+		}
+		if err = requireFolderRole(chain, userID, RoleMember); err != nil {
+			return ErrFolderNotFound
+		}
+		f = *chain[len(chain)-1]
+		f.EffectiveApprovalPolicy = effectiveApprovalPolicy(chain, nil)
+
+		members := effectiveFolderMembers(chain)
+		f.EffectiveMembers = []EffectiveMember{}
+		for userID, role := range members {
+			f.EffectiveMembers = append(f.EffectiveMembers, EffectiveMember{UserID: userID, Role: role, FromFolder: true})
+		}
+		sort.Slice(f.EffectiveMembers, func(i, j int) bool { return f.EffectiveMembers[i].UserID < f.EffectiveMembers[j].UserID })
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// SetFolderMember sets the role of a user on the folder, overriding any role they inherit from the folders above. All
+// the vaults in the folder, and its sub-folders, are updated. Only the owners of the folder can do this.
+func SetFolderMember(ctx context.Context, req FolderMemberRequest) (*Folder, error) {
+	clog.Debugf("%s: SetFolderMember(): folder %v, user %v, role %s", gServiceName, req.FolderID, req.MemberUserID, req.Role)
+
+	if req.MemberUserID.IsEmpty() {
+		return nil, fmt.Errorf("member userID is empty")
+	}
+	if req.Role != RoleOwner && req.Role != RoleMember && req.Role != RoleNone {
+		return nil, fmt.Errorf("invalid role '%s'", req.Role)
+	}
+
+	return mutateFolderAsOwner(ctx, req.FolderID, req.UserID, func(tx *orm.Tx, f *Folder) (string, string, error) {
+		if f.OrgID != nil && req.Role != RoleNone {
+			if err := requireOrgMember(ctx, tx, *f.OrgID, req.MemberUserID); err != nil {
+				return "", "", err
+			}
+		}
+
+		var fm FolderMember
+		exists, err := tx.FindOne(map[string]interface{}{"folder_id": f.ID, "user_id": req.MemberUserID}, &fm)
+		if err != nil {
+			return "", "", err
+		}
+		if exists {
+			err = tx.UpdateColumnsByConditions(map[string]interface{}{"id": fm.ID}, map[string]interface{}{"role": req.Role}, &FolderMember{})
+		} else {
+			fm = FolderMember{FolderID: f.ID, UserID: req.MemberUserID, Role: req.Role}
+			err = tx.InsertOne(&fm)
+		}
+		if err != nil {
+			return "", "", err
+		}
+
+		return AuditActionFolderMemberSet, fmt.Sprintf("user %v: %s", req.MemberUserID, req.Role), nil
+	})
+}
+
+// RemoveFolderMember removes the role set for the user on the folder, so they inherit their role from the folders
+// above (if any). Only the owners of the folder can do this.
+func RemoveFolderMember(ctx context.Context, req FolderMemberRequest) (*Folder, error) {
+	clog.Debugf("%s: RemoveFolderMember(): folder %v, user %v", gServiceName, req.FolderID, req.MemberUserID)
+
+	return mutateFolderAsOwner(ctx, req.FolderID, req.UserID, func(tx *orm.Tx, f *Folder) (string, string, error) {
+		n, err := tx.HardDeleteByConditions(map[string]interface{}{"folder_id": f.ID, "user_id": req.MemberUserID}, &FolderMember{})
+		if err != nil {
+			return "", "", err
+		}
+		if n == 0 {
+			return "", "", fmt.Errorf("user %v does not have a role set on folder %v", req.MemberUserID, f.ID)
+		}
+		return AuditActionFolderMemberRemoved, fmt.Sprintf("user %v", req.MemberUserID), nil
+	})
+}
+
+// SetFolderPolicy sets the approval policy of the folder. All the vaults in the folder, and its sub-folders, are
+// updated. Only the owners of the folder can do this.
+func SetFolderPolicy(ctx context.Context, req SetFolderPolicyRequest) (*Folder, error) {
+	clog.Debugf("%s: SetFolderPolicy(): folder %v", gServiceName, req.FolderID)
+
+	if err := req.ApprovalPolicy.validate(); err != nil {
+		return nil, err
+	}
+
+	return mutateFolderAsOwner(ctx, req.FolderID, req.UserID, func(tx *orm.Tx, f *Folder) (string, string, error) {
+		f.ApprovalPolicy = req.ApprovalPolicy
+		err := tx.UpdateColumnsByConditions(map[string]interface{}{"id": f.ID}, map[string]interface{}{"approval_override_ttl_minutes": req.ApprovalPolicy.TTLMinutes}, &Folder{})
+		return AuditActionFolderPolicyUpdated, req.ApprovalPolicy.String(), err
+	})
+}
+
+// DeleteFolder deletes an empty folder. Only the owners of the folder can do this.
+func DeleteFolder(ctx context.Context, folderID, userID id.ID) error {
+	clog.Debugf("%s: DeleteFolder(): folder %v", gServiceName, folderID)
+
+	return orm.WithTx(ctx, func(tx *orm.Tx) error {
+		chain, err := getFolderChain(ctx, tx, folderID)
+		if err != nil {
+			return err
+		}
+		if err = requireFolderRole(chain, userID, RoleOwner); err != nil {
+			return err
+		}
+
+		var children []Folder
+		if _, err = tx.FindByColumn("parent_id", folderID, &children); err != nil {
+			return err
+		}
+		var vaults []Vault
+		if _, err = tx.FindByColumn("folder_id", folderID, &vaults); err != nil {
+			return err
+		}
+		if len(children) > 0 || len(vaults) > 0 {
+			return fmt.Errorf("folder is not empty")
+		}
+
+		if _, err = tx.HardDeleteByConditions(map[string]interface{}{"folder_id": folderID}, &FolderMember{}); err != nil {
+			return err
+		}
+		_, err = tx.HardDeleteByConditions(map[string]interface{}{"id": folderID}, &Folder{})
+		return err
+	})
+}
+
+// MoveVault moves the vault into another folder, or out of all folders, and re-evaluates its effective members and
+// approval policy. The user needs to own the vault, and have a role on the folder that the vault is moved into.
+func MoveVault(ctx context.Context, req MoveVaultRequest) (*Vault, error) {
+	clog.Debugf("%s: MoveVault(): vault %v, folder %v", gServiceName, req.VaultID, req.FolderID)
+
+	return mutateVaultAsOwner(ctx, req.VaultID, req.UserID, func(tx *orm.Tx, v *Vault) (string, string, error) {
+		if v.IsArchived() {
+			return "", "", ErrVaultArchived
+		}
+		if sameFolder(v.FolderID, req.FolderID) {
+			return "", "", nil
+		}
+		if req.FolderID != nil {
+			if err := requireFolderAccess(ctx, tx, v, *req.FolderID, req.UserID); err != nil {
+				return "", "", err
+			}
+		}
+
+		from := folderIDString(v.FolderID)
+		v.FolderID = req.FolderID
+		err := tx.UpdateColumnsByConditions(map[string]interface{}{"id": v.ID}, map[string]interface{}{"folder_id": req.FolderID}, &Vault{})
+		if err != nil {
+			return "", "", err
+		}
+		if err = evaluateVault(ctx, tx, v); err != nil {
+			return "", "", err
+		}
+
+		return AuditActionMoved, fmt.Sprintf("folder: %s -> %s", from, folderIDString(v.FolderID)), nil
+	})
+}
+
+// SetApprovalPolicy overrides the approval policy that the vault inherits from its folders. Empty fields are
+// inherited. Only the owners of the vault can do this.
+func SetApprovalPolicy(ctx context.Context, req SetApprovalPolicyRequest) (*Vault, error) {
+	clog.Debugf("%s: SetApprovalPolicy(): vault %v", gServiceName, req.VaultID)
+
+	if err := req.ApprovalPolicy.validate(); err != nil {
+		return nil, err
+	}
+
+	return mutateVaultAsOwner(ctx, req.VaultID, req.UserID, func(tx *orm.Tx, v *Vault) (string, string, error) {
+		if v.IsArchived() {
+			return "", "", ErrVaultArchived
+		}
+		v.ApprovalPolicyOverride = req.ApprovalPolicy
+		err := tx.UpdateColumnsByConditions(map[string]interface{}{"id": v.ID}, map[string]interface{}{"approval_override_ttl_minutes": req.ApprovalPolicy.TTLMinutes}, &Vault{})
+		if err != nil {
+			return "", "", err
+		}
+		if err = syncVaultPolicy(ctx, tx, v); err != nil {
+			return "", "", err
+		}
+		return AuditActionApprovalPolicyUpdate, req.ApprovalPolicy.String(), nil
+	})
+}
+
+// GetEffectivePermissions returns the members, with their roles, and the approval policy that apply to the vault
+// after inheritance. The user needs to be a member of the vault.
+func GetEffectivePermissions(ctx context.Context, vaultID, userID id.ID) (*EffectivePermissions, error) {
+	var ep *EffectivePermissions
+	err := orm.WithTx(ctx, func(tx *orm.Tx) error {
+		var v Vault
+		exists, err := tx.FindOne(map[string]interface{}{"id": vaultID}, &v)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrVaultNotFound
+		}
+
+		var vus []VaultUser
+		if _, err = tx.FindByColumn("vault_id", vaultID, &vus); err != nil {
+			return err
+		}
+		ep = &EffectivePermissions{VaultID: v.ID, FolderID: v.FolderID, ApprovalPolicy: v.ApprovalPolicy, Members: []EffectiveMember{}}
+		var isMember bool
+		for _, vu := range vus {
+			isMember = isMember || vu.UserID == userID
+			ep.Members = append(ep.Members, EffectiveMember{UserID: vu.UserID, Role: vu.Role, FromTeam: vu.FromTeam, FromFolder: vu.FromFolder})
+		}
+		if !isMember {
+			return ErrForbidden
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ep, nil
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* H E L P E R S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// folderMutationFunc changes the (locked) folder f inside tx, and returns the audit action and details for the change
+type folderMutationFunc func(tx *orm.Tx, f *Folder) (action string, details string, err error)
+
+// mutateFolderAsOwner locks the folder, makes sure that the user owns it, applies fn to it, re-evaluates all the vaults
+// below it and audits the change, all inside a single transaction
+func mutateFolderAsOwner(ctx context.Context, folderID, userID id.ID, fn folderMutationFunc) (*Folder, error) {
+	var f Folder
+	err := orm.WithTx(ctx, func(tx *orm.Tx) error {
+		exists, err := tx.FindByIDForUpdate(folderID, &f)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrFolderNotFound
+		}
+		chain, err := getFolderChain(ctx, tx, folderID)
+		if err != nil {
+			return err
+		}
+		if err = requireFolderRole(chain, userID, RoleOwner); err != nil {
+			return err
+		}
+
+		action, details, err := fn(tx, &f)
+		if err != nil {
+			return err
+		}
+
+		// A folder can't be left without an owner, otherwise nobody could manage it anymore
+		chain[len(chain)-1] = &f
+		if _, err = tx.FindByColumn("folder_id", f.ID, &f.Members); err != nil {
+			return err
+		}
+		var hasOwner bool
+		for _, role := range effectiveFolderMembers(chain) {
+			hasOwner = hasOwner || role == RoleOwner
+		}
+		if !hasOwner {
+			return fmt.Errorf("folder %v needs to have at least one owner", f.ID)
+		}
+
+		if err = evaluateFolderVaults(ctx, tx, f.ID); err != nil {
+			return err
+		}
+
+		return audit.Record(ctx, tx, audit.RecordRequest{
+			ActorUserID: userID,
+			Action:      action,
+			EntityType:  auditEntityTypeFolder,
+			EntityID:    f.ID,
+			Details:     details,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// getFolderChain returns the folder and all of its ancestors, with their members, starting from the top level folder
+func getFolderChain(ctx context.Context, tx *orm.Tx, folderID id.ID) ([]*Folder, error) {
+	var chain []*Folder
+	next := &folderID
+	for next != nil {
+		if len(chain) > gMaxFolderDepth {
+			return nil, fmt.Errorf("folder %v is nested more than %d levels deep", folderID, gMaxFolderDepth)
+		}
+		var f Folder
+		exists, err := tx.FindOne(map[string]interface{}{"id": *next}, &f)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, ErrFolderNotFound
+		}
+		if _, err = tx.FindByColumn("folder_id", f.ID, &f.Members); err != nil {
+			return nil, err
+		}
+		chain = append([]*Folder{&f}, chain...)
+		next = f.ParentID
+	}
+	return chain, nil
+}
+
+// effectiveFolderMembers returns the role of every user on the last folder of the chain. The role set closest to the
+// folder wins, and RoleNone removes the role inherited from above.
+func effectiveFolderMembers(chain []*Folder) map[id.ID]Role {
+	var members = make(map[id.ID]Role)
+	for _, f := range chain {
+		for _, fm := range f.Members {
+			if fm.Role == RoleNone {
+				delete(members, fm.UserID)
+				continue
+			}
+			members[fm.UserID] = fm.Role
+		}
+	}
+	return members
+}
+
+// effectiveApprovalPolicy applies the approval policies of the chain of folders, and then the vault's own (if any),
+// on top of the default policy
+func effectiveApprovalPolicy(chain []*Folder, vaultOverride *ApprovalPolicyOverride) ApprovalPolicy {
+	var p ApprovalPolicy
+	for _, f := range chain {
+		p = f.ApprovalPolicy.apply(p)
+	}
+	if vaultOverride != nil {
+		p = vaultOverride.apply(p)
+	}
+	return p
+}
+
+// requireFolderRole returns ErrForbidden if the user does not have at least the role on the last folder of the chain
+func requireFolderRole(chain []*Folder, userID id.ID, role Role) error {
+	got, ok := effectiveFolderMembers(chain)[userID]
+	if !ok {
+		return ErrForbidden
+	}
+	if role == RoleOwner && got != RoleOwner {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// requireFolderAccess makes sure that the vault can be placed in the folder by the user: the folder should belong to
+// the vault's organization, and the user should have a role on it
+func requireFolderAccess(ctx context.Context, tx *orm.Tx, v *Vault, folderID, userID id.ID) error {
+	chain, err := getFolderChain(ctx, tx, folderID)
+	if err != nil {
+		return err
+	}
+	f := chain[len(chain)-1]
+	if (f.OrgID == nil) != (v.OrgID == nil) || (f.OrgID != nil && *f.OrgID != *v.OrgID) {
+		return fmt.Errorf("vault and folder %v should belong to the same organization", folderID)
+	}
+	return requireFolderRole(chain, userID, RoleMember)
+}
+
+// evaluateFolderVaults re-evaluates the effective members and approval policy of all the vaults in the folder and
+// its sub-folders
+func evaluateFolderVaults(ctx context.Context, tx *orm.Tx, folderID id.ID) error {
+	var queue = []id.ID{folderID}
+	var seen = make(map[id.ID]bool)
+	for len(queue) > 0 {
+		fid := queue[0]
+		queue = queue[1:]
+		if seen[fid] {
+			continue
+		}
+		seen[fid] = true
+
+		var vaults []Vault
+		if _, err := tx.FindByColumn("folder_id", fid, &vaults); err != nil {
+			return err
+		}
+		for _, v := range vaults {
+			// Lock the vault, so membership changes for the same vault happen one after the other
+			exists, err := tx.FindByIDForUpdate(v.ID, &v)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				continue
+			}
+			if err = evaluateVault(ctx, tx, &v); err != nil {
+				return fmt.Errorf("evaluating vault %v: %v", v.ID, err)
+			}
+		}
+
+		var children []Folder
+		if _, err := tx.FindByColumn("parent_id", fid, &children); err != nil {
+			return err
+		}
+		for _, c := range children {
+			queue = append(queue, c.ID)
+		}
+	}
+	return nil
+}
+
+// evaluateVault syncs the members and the approval policy of the vault with what it inherits from its folders and
+// teams, and reloads its members
+func evaluateVault(ctx context.Context, tx *orm.Tx, v *Vault) error {
+	if err := syncVaultMembers(ctx, tx, v); err != nil {
+		return err
+	}
+	if err := syncVaultPolicy(ctx, tx, v); err != nil {
+		return err
+	}
+	v.VaultUsers = nil
+	_, err := tx.FindByColumn("vault_id", v.ID, &v.VaultUsers)
+	return err
+}
+
+// syncVaultPolicy sets the effective approval policy of the vault from its folders and its own override
+func syncVaultPolicy(ctx context.Context, tx *orm.Tx, v *Vault) error {
+	var chain []*Folder
+	if v.FolderID != nil {
+		var err error
+		chain, err = getFolderChain(ctx, tx, *v.FolderID)
+		if err != nil {
+			return err
+		}
+	}
+	p := effectiveApprovalPolicy(chain, &v.ApprovalPolicyOverride)
+	if p == v.ApprovalPolicy {
+		return nil
+	}
+	v.ApprovalPolicy = p
+	return tx.UpdateColumnsByConditions(map[string]interface{}{"id": v.ID}, map[string]interface{}{"approval_ttl_minutes": p.TTLMinutes}, &Vault{})
+}
+
+// apply returns the policy p with the fields that are set in o overridden
+func (o ApprovalPolicyOverride) apply(p ApprovalPolicy) ApprovalPolicy {
+	if o.TTLMinutes != nil {
+		p.TTLMinutes = *o.TTLMinutes
+	}
+	return p
+}
+
+func (o ApprovalPolicyOverride) validate() error {
+	if o.TTLMinutes != nil && *o.TTLMinutes < 0 {
+		return fmt.Errorf("approval TTL cannot be negative")
+	}
+	return nil
+}
+
+func (o ApprovalPolicyOverride) String() string {
+	if o.TTLMinutes == nil {
+		return "ttl_minutes: inherited"
+	}
+	return fmt.Sprintf("ttl_minutes: %d", *o.TTLMinutes)
+}
+
+// override returns an override that sets all the fields of the policy
+func (p ApprovalPolicy) override() ApprovalPolicyOverride {
+	ttl := p.TTLMinutes
+	return ApprovalPolicyOverride{TTLMinutes: &ttl}
+}
+
+func sameFolder(a, b *id.ID) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func folderIDString(folderID *id.ID) string {
+	if folderID == nil {
+		return "none"
+	}
+	return string(*folderID)
+}
@@ -0,0 +1,89 @@
+package vault
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/teejays/n-factor-vault/backend/library/id"
+)
+
+func TestEffectiveFolderMembers(t *testing.T) {
+	jon, jane, jack := id.GetNewID(), id.GetNewID(), id.GetNewID()
+
+	root := &Folder{Members: []FolderMember{{UserID: jon, Role: RoleOwner}, {UserID: jane, Role: RoleMember}}}
+	child := &Folder{Members: []FolderMember{{UserID: jane, Role: RoleOwner}, {UserID: jack, Role: RoleMember}}}
+	grandchild := &Folder{Members: []FolderMember{{UserID: jon, Role: RoleNone}}}
+
+	t.Run("roles are inherited", func(t *testing.T) {
+		assert.Equal(t, map[id.ID]Role{jon: RoleOwner, jane: RoleMember}, effectiveFolderMembers([]*Folder{root}))
+	})
+
+	t.Run("the role closest to the folder wins", func(t *testing.T) {
+		got := effectiveFolderMembers([]*Folder{root, child})
+		assert.Equal(t, map[id.ID]Role{jon: RoleOwner, jane: RoleOwner, jack: RoleMember}, got)
+	})
+
+	t.Run("role NONE stops the inheritance", func(t *testing.T) {
+		got := effectiveFolderMembers([]*Folder{root, child, grandchild})
+		assert.Equal(t, map[id.ID]Role{jane: RoleOwner, jack: RoleMember}, got)
+	})
+}
+
+func TestEffectiveApprovalPolicy(t *testing.T) {
+	ttl := func(n int) *int { return &n }
+
+	root := &Folder{ApprovalPolicy: ApprovalPolicyOverride{TTLMinutes: ttl(60)}}
+	child := &Folder{}
+	grandchild := &Folder{ApprovalPolicy: ApprovalPolicyOverride{TTLMinutes: ttl(15)}}
+
+	tests := []struct {
+		name     string
+		chain    []*Folder
+		override *ApprovalPolicyOverride
+		want     ApprovalPolicy
+	}{
+		{
+			name: "default policy if nothing is set",
+			want: ApprovalPolicy{},
+		},
+		{
+			name:  "inherited from the folder above",
+			chain: []*Folder{root, child},
+			want:  ApprovalPolicy{TTLMinutes: 60},
+		},
+		{
+			name:  "overridden by a folder below",
+			chain: []*Folder{root, child, grandchild},
+			want:  ApprovalPolicy{TTLMinutes: 15},
+		},
+		{
+			name:     "overridden by the vault",
+			chain:    []*Folder{root, child, grandchild},
+			override: &ApprovalPolicyOverride{TTLMinutes: ttl(0)},
+			want:     ApprovalPolicy{TTLMinutes: 0},
+		},
+		{
+			name:     "empty vault override inherits",
+			chain:    []*Folder{root},
+			override: &ApprovalPolicyOverride{},
+			want:     ApprovalPolicy{TTLMinutes: 60},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, effectiveApprovalPolicy(tt.chain, tt.override))
+		})
+	}
+}
+
+func TestRequireFolderRole(t *testing.T) {
+	owner, member, stranger := id.GetNewID(), id.GetNewID(), id.GetNewID()
+	chain := []*Folder{{Members: []FolderMember{{UserID: owner, Role: RoleOwner}, {UserID: member, Role: RoleMember}}}}
+
+	assert.NoError(t, requireFolderRole(chain, owner, RoleOwner))
+	assert.NoError(t, requireFolderRole(chain, owner, RoleMember))
+	assert.NoError(t, requireFolderRole(chain, member, RoleMember))
+	assert.Equal(t, ErrForbidden, requireFolderRole(chain, member, RoleOwner))
+	assert.Equal(t, ErrForbidden, requireFolderRole(chain, stranger, RoleMember))
+}
@@ -0,0 +1,319 @@
+package vault
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/teejays/clog"
+
+	"github.com/teejays/n-factor-vault/backend/library/id"
+	"github.com/teejays/n-factor-vault/backend/library/orm"
+
+	"github.com/teejays/n-factor-vault/backend/src/org"
+)
+
+// gDefaultInactiveDays is the number of days after which a member who hasn't logged in is considered inactive
+var gDefaultInactiveDays = 30
+
+// HealthRequest are the parameters for getting the health report of a vault
+type HealthRequest struct {
+	VaultID id.ID
+	UserID  id.ID
+	// InactiveDays is the number of days after which a member who hasn't logged in is considered inactive. Zero means
+	// default.
+	InactiveDays int
+}
+
+// OrgHealthRequest are the parameters for getting the health reports of all the vaults of an organization
+type OrgHealthRequest struct {
+	OrgID        id.ID
+	UserID       id.ID
+	InactiveDays int
+	// UnhealthyOnly, if set, leaves out the vaults that are healthy
+	UnhealthyOnly bool
+}
+
+// Health is a report of whether a vault is still operable, and what needs attention
+type Health struct {
+	VaultID id.ID  `json:"vault_id"`
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	// Issues are human-readable descriptions of what makes the vault unhealthy
+	Issues []string `json:"issues"`
+	// K is the number of members needed to access the secrets of the vault, and KReachable is true if there are at
+	// least that many active members
+	K             int  `json:"k"`
+	ActiveMembers int  `json:"active_members"`
+	KReachable    bool `json:"k_reachable"`
+	// InactiveMembers are the members who haven't logged in for InactiveDays
+	InactiveMembers []MemberActivity `json:"inactive_members"`
+	// NeverLoggedIn are the members who have been added to the vault but have never logged in
+	NeverLoggedIn []MemberActivity `json:"never_logged_in"`
+	// UnknownActivity are the members who haven't logged in since logins started being recorded, so we can't tell
+	// whether they are active. They don't count as active members, but aren't an issue on their own either.
+	UnknownActivity []MemberActivity `json:"unknown_activity"`
+	// StaleItems are the item fields that have not been rotated within their rotation policy
+	StaleItems []StaleItem `json:"stale_items"`
+	// OutstandingRequests are the secret requests that are still awaiting approval. They do not make a vault unhealthy.
+	OutstandingRequests []OutstandingRequest `json:"outstanding_requests"`
+}
+
+// OrgHealth is the rollup of the health reports of the vaults of an organization
+type OrgHealth struct {
+	OrgID          id.ID     `json:"org_id"`
+	TotalVaults    int       `json:"total_vaults"`
+	UnhealthyCount int       `json:"unhealthy_count"`
+	Vaults         []*Health `json:"vaults"`
+}
+
+// MemberActivity is a vault member, with when they last logged in
+type MemberActivity struct {
+	UserID      id.ID      `json:"user_id"`
+	Name        string     `json:"name"`
+	Email       string     `json:"email"`
+	Role        Role       `json:"role"`
+	LastLoginAt *time.Time `json:"last_login_at"`
+}
+
+// StaleItem is an item field which is overdue for rotation
+type StaleItem struct {
+	Name          string    `json:"name"`
+	RotationDays  int       `json:"rotation_days"`
+	LastRotatedAt time.Time `json:"last_rotated_at"`
+}
+
+// OutstandingRequest is a secret request that is awaiting approval
+type OutstandingRequest struct {
+	SecretRequestID  id.ID     `json:"secret_request_id"`
+	UserID           id.ID     `json:"user_id"`
+	CreatedAt        time.Time `json:"created_at"`
+	PendingApprovers []id.ID   `json:"pending_approvers"`
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* M E T H O D S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// GetHealth returns the health report of the vault. Any member of the vault can see it.
+func GetHealth(ctx context.Context, req HealthRequest) (*Health, error) {
+	clog.Debugf("%s: GetHealth(): vault %v", gServiceName, req.VaultID)
+
+	inactiveDays, err := getInactiveDays(req.InactiveDays)
+	if err != nil {
+		return nil, err
+	}
+
+	var h *Health
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		var v Vault
+		exists, err := tx.FindOne(map[string]interface{}{"id": req.VaultID}, &v)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrVaultNotFound
+		}
+		var vu VaultUser
+		exists, err = tx.FindOne(map[string]interface{}{"vault_id": v.ID, "user_id": req.UserID}, &vu)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrForbidden
+		}
+
+		h, err = getHealth(ctx, tx, &v, inactiveDays, time.Now())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// GetOrgHealth returns the health reports of all the vaults, that are not archived, in the organization. Only the
+// admins of the organization can see it.
+func GetOrgHealth(ctx context.Context, req OrgHealthRequest) (*OrgHealth, error) {
+	clog.Debugf("%s: GetOrgHealth(): org %v", gServiceName, req.OrgID)
+
+	inactiveDays, err := getInactiveDays(req.InactiveDays)
+	if err != nil {
+		return nil, err
+	}
+
+	var oh = OrgHealth{OrgID: req.OrgID, Vaults: []*Health{}}
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		err := org.RequireRoleTx(ctx, tx, req.OrgID, req.UserID, org.RoleAdmin)
+		if err != nil {
+			return err
+		}
+
+		var vs []Vault
+		_, err = tx.FindWhere(&vs, "org_id = ? AND archived_at IS NULL", req.OrgID)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		for i := range vs {
+			h, err := getHealth(ctx, tx, &vs[i], inactiveDays, now)
+			if err != nil {
+				return fmt.Errorf("vault %v: %v", vs[i].ID, err)
+			}
+			oh.TotalVaults++
+			if !h.Healthy {
+				oh.UnhealthyCount++
+			} else if req.UnhealthyOnly {
+				continue
+			}
+			oh.Vaults = append(oh.Vaults, h)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &oh, nil
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* H E L P E R S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// memberActivityRow is a row of the query that gets the members of a vault with their last login
+type memberActivityRow struct {
+	UserID           id.ID
+	Name             string
+	Email            string
+	Role             Role
+	LastLoginAt      *time.Time
+	LastLoginUnknown bool
+}
+
+// outstandingRequestRow is a row of the query that gets the secret requests of a vault awaiting approval
+type outstandingRequestRow struct {
+	ID               id.ID
+	UserID           id.ID
+	CreatedAt        time.Time
+	PendingApprovers pq.StringArray
+}
+
+// getHealth fetches everything needed to assess the health of vault v. The users, secrets and secret_requests tables
+// belong to other services, but we read them here so the report takes a handful of queries.
+func getHealth(ctx context.Context, tx *orm.Tx, v *Vault, inactiveDays int, now time.Time) (*Health, error) {
+	var sv ShamirsVault
+	_, err := tx.FindOne(map[string]interface{}{"vault_id": v.ID}, &sv)
+	if err != nil {
+		return nil, err
+	}
+
+	var members []memberActivityRow
+	err = tx.ScanRaw(&members, `SELECT vault_users.user_id, vault_users.role, users.name, users.email, users.last_login_at, users.last_login_unknown
+FROM vault_users
+INNER JOIN users ON users.id = vault_users.user_id AND users.deleted_at IS NULL
+WHERE vault_users.vault_id = ? AND vault_users.deleted_at IS NULL
+ORDER BY users.name`, v.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The secret of the vault was last rotated when it was last written, or when the vault was created if it has
+	// never been written
+	var rotated []struct{ UpdatedAt *time.Time }
+	err = tx.ScanRaw(&rotated, `SELECT MAX(updated_at) AS updated_at FROM secrets WHERE vault_id = ? AND deleted_at IS NULL`, v.ID)
+	if err != nil {
+		return nil, err
+	}
+	lastRotatedAt := v.CreatedAt
+	if len(rotated) > 0 && rotated[0].UpdatedAt != nil {
+		lastRotatedAt = *rotated[0].UpdatedAt
+	}
+
+	var requests []outstandingRequestRow
+	err = tx.ScanRaw(&requests, `SELECT secret_requests.id, secret_requests.user_id, secret_requests.created_at,
+ARRAY(SELECT secret_approvals.user_id FROM secret_approvals WHERE secret_approvals.secret_request_id = secret_requests.id AND secret_approvals.deleted_at IS NULL AND secret_approvals.approved = false ORDER BY secret_approvals.user_id) AS pending_approvers
+FROM secret_requests
+WHERE secret_requests.vault_id = ? AND secret_requests.deleted_at IS NULL AND secret_requests.approved = false
+ORDER BY secret_requests.created_at`, v.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return assessHealth(v, sv.K, members, lastRotatedAt, requests, inactiveDays, now), nil
+}
+
+// assessHealth builds the health report of vault v, that needs k members to access its secrets
+func assessHealth(v *Vault, k int, members []memberActivityRow, lastRotatedAt time.Time, requests []outstandingRequestRow, inactiveDays int, now time.Time) *Health {
+	var h = Health{
+		VaultID:             v.ID,
+		Name:                v.Name,
+		K:                   k,
+		Issues:              []string{},
+		InactiveMembers:     []MemberActivity{},
+		NeverLoggedIn:       []MemberActivity{},
+		UnknownActivity:     []MemberActivity{},
+		StaleItems:          []StaleItem{},
+		OutstandingRequests: []OutstandingRequest{},
+	}
+
+	cutoff := now.Add(-time.Duration(inactiveDays) * 24 * time.Hour)
+	for _, m := range members {
+		ma := MemberActivity{UserID: m.UserID, Name: m.Name, Email: m.Email, Role: m.Role, LastLoginAt: m.LastLoginAt}
+		switch {
+		case m.LastLoginAt == nil && m.LastLoginUnknown:
+			h.UnknownActivity = append(h.UnknownActivity, ma)
+		case m.LastLoginAt == nil:
+			h.NeverLoggedIn = append(h.NeverLoggedIn, ma)
+		case m.LastLoginAt.Before(cutoff):
+			h.InactiveMembers = append(h.InactiveMembers, ma)
+		default:
+			h.ActiveMembers++
+		}
+	}
+	h.KReachable = h.ActiveMembers >= k
+
+	for _, f := range v.ItemSchema {
+		if f.RotationDays <= 0 {
+			continue
+		}
+		if now.Sub(lastRotatedAt) > time.Duration(f.RotationDays)*24*time.Hour {
+			h.StaleItems = append(h.StaleItems, StaleItem{Name: f.Name, RotationDays: f.RotationDays, LastRotatedAt: lastRotatedAt})
+		}
+	}
+
+	for _, r := range requests {
+		or := OutstandingRequest{SecretRequestID: r.ID, UserID: r.UserID, CreatedAt: r.CreatedAt, PendingApprovers: []id.ID{}}
+		for _, a := range r.PendingApprovers {
+			or.PendingApprovers = append(or.PendingApprovers, id.ID(a))
+		}
+		h.OutstandingRequests = append(h.OutstandingRequests, or)
+	}
+
+	if !h.KReachable {
+		h.Issues = append(h.Issues, fmt.Sprintf("only %d of the %d members needed to access the vault are active", h.ActiveMembers, k))
+	}
+	if n := len(h.InactiveMembers); n > 0 {
+		h.Issues = append(h.Issues, fmt.Sprintf("%d members have not logged in for %d days", n, inactiveDays))
+	}
+	if n := len(h.NeverLoggedIn); n > 0 {
+		h.Issues = append(h.Issues, fmt.Sprintf("%d members have never logged in", n))
+	}
+	for _, si := range h.StaleItems {
+		h.Issues = append(h.Issues, fmt.Sprintf("item '%s' has not been rotated in %d days", si.Name, si.RotationDays))
+	}
+	h.Healthy = len(h.Issues) == 0
+
+	return &h
+}
+
+func getInactiveDays(days int) (int, error) {
+	if days < 0 {
+		return 0, fmt.Errorf("inactive days cannot be negative")
+	}
+	if days == 0 {
+		return gDefaultInactiveDays, nil
+	}
+	return days, nil
+}
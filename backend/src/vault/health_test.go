@@ -0,0 +1,81 @@
+package vault
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/teejays/n-factor-vault/backend/library/id"
+)
+
+func TestAssessHealth(t *testing.T) {
+	now := time.Date(2019, time.June, 10, 12, 0, 0, 0, time.UTC)
+	daysAgo := func(n int) *time.Time {
+		t := now.Add(-time.Duration(n) * 24 * time.Hour)
+		return &t
+	}
+	jon, jane, jack := id.GetNewID(), id.GetNewID(), id.GetNewID()
+
+	v := &Vault{
+		Name: "Facebook",
+		ItemSchema: ItemSchema{
+			{Name: "username", Type: ItemFieldText},
+			{Name: "password", Type: ItemFieldPassword, RotationDays: 90},
+			{Name: "api key", Type: ItemFieldPassword, RotationDays: 365},
+		},
+	}
+
+	t.Run("healthy vault", func(t *testing.T) {
+		members := []memberActivityRow{{UserID: jon, LastLoginAt: daysAgo(1)}, {UserID: jane, LastLoginAt: daysAgo(29)}}
+		h := assessHealth(v, 2, members, *daysAgo(10), nil, 30, now)
+		assert.True(t, h.Healthy)
+		assert.True(t, h.KReachable)
+		assert.Equal(t, 2, h.ActiveMembers)
+		assert.Empty(t, h.Issues)
+		assert.Empty(t, h.StaleItems)
+	})
+
+	t.Run("unhealthy vault", func(t *testing.T) {
+		members := []memberActivityRow{{UserID: jon, LastLoginAt: daysAgo(1)}, {UserID: jane, LastLoginAt: daysAgo(31)}, {UserID: jack}}
+		requests := []outstandingRequestRow{{ID: id.GetNewID(), UserID: jon, PendingApprovers: pq.StringArray{string(jane)}}}
+		h := assessHealth(v, 2, members, *daysAgo(100), requests, 30, now)
+
+		assert.False(t, h.Healthy)
+		assert.False(t, h.KReachable)
+		assert.Equal(t, 1, h.ActiveMembers)
+		if assert.Len(t, h.InactiveMembers, 1) {
+			assert.Equal(t, jane, h.InactiveMembers[0].UserID)
+		}
+		if assert.Len(t, h.NeverLoggedIn, 1) {
+			assert.Equal(t, jack, h.NeverLoggedIn[0].UserID)
+		}
+		if assert.Len(t, h.StaleItems, 1) {
+			assert.Equal(t, "password", h.StaleItems[0].Name)
+		}
+		if assert.Len(t, h.OutstandingRequests, 1) {
+			assert.Equal(t, []id.ID{jane}, h.OutstandingRequests[0].PendingApprovers)
+		}
+		assert.Len(t, h.Issues, 4)
+	})
+
+	t.Run("members who haven't logged in since logins were recorded are neither active nor pending", func(t *testing.T) {
+		members := []memberActivityRow{{UserID: jon, LastLoginAt: daysAgo(1)}, {UserID: jane, LastLoginUnknown: true}}
+		h := assessHealth(v, 1, members, now, nil, 30, now)
+		assert.True(t, h.Healthy)
+		assert.Equal(t, 1, h.ActiveMembers)
+		assert.Empty(t, h.NeverLoggedIn)
+		if assert.Len(t, h.UnknownActivity, 1) {
+			assert.Equal(t, jane, h.UnknownActivity[0].UserID)
+		}
+	})
+
+	t.Run("outstanding requests alone do not make a vault unhealthy", func(t *testing.T) {
+		members := []memberActivityRow{{UserID: jon, LastLoginAt: daysAgo(1)}}
+		requests := []outstandingRequestRow{{ID: id.GetNewID(), UserID: jon}}
+		h := assessHealth(v, 1, members, now, requests, 30, now)
+		assert.True(t, h.Healthy)
+		assert.Len(t, h.OutstandingRequests, 1)
+	})
+}
@@ -0,0 +1,308 @@
+package vault
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/teejays/clog"
+
+	"github.com/teejays/n-factor-vault/backend/library/env"
+	"github.com/teejays/n-factor-vault/backend/library/id"
+	"github.com/teejays/n-factor-vault/backend/library/orm"
+
+	"github.com/teejays/n-factor-vault/backend/src/audit"
+)
+
+// ErrVaultNotFound is returned when the vault being acted upon does not exist
+var ErrVaultNotFound = fmt.Errorf("vault not found")
+
+// ErrVaultArchived is returned when attempting to change an archived (read-only) vault
+var ErrVaultArchived = fmt.Errorf("vault is archived")
+
+// ErrForbidden is returned when the user does not have the role required for the action on the vault
+var ErrForbidden = fmt.Errorf("user does not have the required role on the vault")
+
+// gDefaultPurgeRetentionDays is the number of days we wait after a vault is deleted before we permanently purge it.
+// It can be overridden by the VAULT_PURGE_RETENTION_DAYS env variable.
+var gDefaultPurgeRetentionDays = 30
+
+// Audit actions for the vault lifecycle
+const (
+	auditEntityType          = "vault"
+	AuditActionUpdated       = "vault.updated"
+	AuditActionArchived      = "vault.archived"
+	AuditActionRestored      = "vault.restored"
+	AuditActionPurgeSchedule = "vault.purge_scheduled"
+	AuditActionPurged        = "vault.purged"
+)
+
+// PurgeHookFunc is called, as part of the purge transaction, when a vault is permanently deleted. It allows other
+// services to delete the data they hold for the vault.
+type PurgeHookFunc func(ctx context.Context, tx *orm.Tx, vaultID id.ID) error
+
+var gPurgeHooks []PurgeHookFunc
+
+// RegisterPurgeHook registers f to be called whenever a vault is purged
+func RegisterPurgeHook(f PurgeHookFunc) {
+	gPurgeHooks = append(gPurgeHooks, f)
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* M E T H O D S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// UpdateVaultRequest are the parameters that are passed when updating a vault. Empty fields are left unchanged.
+type UpdateVaultRequest struct {
+	VaultID     id.ID  `json:"-"`
+	UserID      id.ID  `json:"-"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// VaultActionRequest are the parameters for actions on a vault that need nothing but the vault and the acting user
+type VaultActionRequest struct {
+	VaultID id.ID
+	UserID  id.ID
+}
+
+// UpdateVault changes the name and/or the description of the vault
+func UpdateVault(ctx context.Context, req UpdateVaultRequest) (*Vault, error) {
+	clog.Debugf("%s: UpdateVault(): vault %v", gServiceName, req.VaultID)
+
+	name := strings.TrimSpace(req.Name)
+	description := strings.TrimSpace(req.Description)
+	if name == "" && description == "" {
+		return nil, fmt.Errorf("nothing to update: name and description are empty")
+	}
+
+	return mutateVaultAsOwner(ctx, req.VaultID, req.UserID, func(tx *orm.Tx, v *Vault) (string, string, error) {
+		if v.IsArchived() {
+			return "", "", ErrVaultArchived
+		}
+		var changes []string
+		var cols = make(map[string]interface{})
+		if name != "" && name != v.Name {
+			changes = append(changes, fmt.Sprintf("name: %q -> %q", v.Name, name))
+			cols["name"] = name
+			v.Name = name
+		}
+		if description != "" && description != v.Description {
+			changes = append(changes, fmt.Sprintf("description: %q -> %q", v.Description, description))
+			cols["description"] = description
+			v.Description = description
+		}
+		if len(cols) == 0 {
+			return "", "", nil
+		}
+		err := tx.UpdateColumnsByConditions(map[string]interface{}{"id": v.ID}, cols, &Vault{})
+		return AuditActionUpdated, strings.Join(changes, "; "), err
+	})
+}
+
+// ArchiveVault puts the vault in a read-only state. Archived vaults cannot be changed, and no new requests for
+// their secrets can be made.
+func ArchiveVault(ctx context.Context, req VaultActionRequest) (*Vault, error) {
+	clog.Debugf("%s: ArchiveVault(): vault %v", gServiceName, req.VaultID)
+
+	return mutateVaultAsOwner(ctx, req.VaultID, req.UserID, func(tx *orm.Tx, v *Vault) (string, string, error) {
+		if v.IsArchived() {
+			return "", "", ErrVaultArchived
+		}
+		now := time.Now()
+		v.ArchivedAt = &now
+		err := tx.UpdateColumnsByConditions(map[string]interface{}{"id": v.ID}, map[string]interface{}{"archived_at": now}, &Vault{})
+		return AuditActionArchived, "", err
+	})
+}
+
+// RestoreVault takes an archived vault out of its read-only state. If the vault was scheduled to be purged,
+// the purge is cancelled.
+func RestoreVault(ctx context.Context, req VaultActionRequest) (*Vault, error) {
+	clog.Debugf("%s: RestoreVault(): vault %v", gServiceName, req.VaultID)
+
+	return mutateVaultAsOwner(ctx, req.VaultID, req.UserID, func(tx *orm.Tx, v *Vault) (string, string, error) {
+		if !v.IsArchived() {
+			return "", "", fmt.Errorf("vault is not archived")
+		}
+		details := ""
+		if v.PurgeAt != nil {
+			details = fmt.Sprintf("cancelled purge scheduled for %s", v.PurgeAt.Format(time.RFC3339))
+		}
+		v.ArchivedAt = nil
+		v.PurgeAt = nil
+		err := tx.UpdateColumnsByConditions(map[string]interface{}{"id": v.ID}, map[string]interface{}{"archived_at": nil, "purge_at": nil}, &Vault{})
+		return AuditActionRestored, details, err
+	})
+}
+
+// DeleteVault schedules an archived vault to be permanently purged once the retention period is over. Until then,
+// the vault can still be restored.
+func DeleteVault(ctx context.Context, req VaultActionRequest) (*Vault, error) {
+	clog.Debugf("%s: DeleteVault(): vault %v", gServiceName, req.VaultID)
+
+	return mutateVaultAsOwner(ctx, req.VaultID, req.UserID, func(tx *orm.Tx, v *Vault) (string, string, error) {
+		if !v.IsArchived() {
+			return "", "", fmt.Errorf("vault needs to be archived before it can be deleted")
+		}
+		if v.PurgeAt != nil {
+			return "", "", fmt.Errorf("vault is already scheduled to be purged at %s", v.PurgeAt.Format(time.RFC3339))
+		}
+		purgeAt := time.Now().Add(getPurgeRetention())
+		v.PurgeAt = &purgeAt
+		err := tx.UpdateColumnsByConditions(map[string]interface{}{"id": v.ID}, map[string]interface{}{"purge_at": purgeAt}, &Vault{})
+		return AuditActionPurgeSchedule, fmt.Sprintf("purge scheduled for %s", purgeAt.Format(time.RFC3339)), err
+	})
+}
+
+// PurgeDueVaults permanently deletes all the vaults whose purge time has passed. It returns the number of vaults purged.
+func PurgeDueVaults(ctx context.Context) (int, error) {
+	var vaults []Vault
+	_, err := orm.FindWhere(&vaults, "purge_at IS NOT NULL AND purge_at <= ?", time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, v := range vaults {
+		err := orm.WithTx(ctx, func(tx *orm.Tx) error {
+			return purgeVault(ctx, tx, v)
+		})
+		if err != nil {
+			return n, fmt.Errorf("purging vault %v: %v", v.ID, err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// RunPurger purges due vaults every interval, until the ctx is done. It blocks, so it should be run in a go routine.
+func RunPurger(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := PurgeDueVaults(ctx)
+		if err != nil {
+			clog.Errorf("%s: purging due vaults: %v", gServiceName, err)
+		}
+		if n > 0 {
+			clog.Infof("%s: purged %d vaults", gServiceName, n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RequireRoleTx returns ErrForbidden if the user does not have the role on the vault
+func RequireRoleTx(ctx context.Context, tx *orm.Tx, vaultID, userID id.ID, role Role) error {
+	return requireRole(ctx, tx, vaultID, userID, role)
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* H E L P E R S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// vaultMutationFunc changes the (locked) vault v inside tx, and returns the audit action and details for the change.
+// An empty action means that nothing was changed.
+type vaultMutationFunc func(tx *orm.Tx, v *Vault) (action string, details string, err error)
+
+// mutateVaultAsOwner locks the vault, makes sure that the user owns it, applies fn to it and audits the change, all
+// inside a single transaction.
+func mutateVaultAsOwner(ctx context.Context, vaultID, userID id.ID, fn vaultMutationFunc) (*Vault, error) {
+	var v Vault
+	err := orm.WithTx(ctx, func(tx *orm.Tx) error {
+		exists, err := tx.FindByIDForUpdate(vaultID, &v)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrVaultNotFound
+		}
+
+		err = requireRole(ctx, tx, vaultID, userID, RoleOwner)
+		if err != nil {
+			return err
+		}
+
+		action, details, err := fn(tx, &v)
+		if err != nil {
+			return err
+		}
+		if action == "" {
+			return nil
+		}
+
+		return audit.Record(ctx, tx, audit.RecordRequest{
+			ActorUserID: userID,
+			Action:      action,
+			EntityType:  auditEntityType,
+			EntityID:    vaultID,
+			Details:     details,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// requireRole returns ErrForbidden if the user does not have the role on the vault
+func requireRole(ctx context.Context, tx *orm.Tx, vaultID, userID id.ID, role Role) error {
+	var vu VaultUser
+	exists, err := tx.FindOne(map[string]interface{}{"vault_id": vaultID, "user_id": userID}, &vu)
+	if err != nil {
+		return err
+	}
+	if !exists || vu.Role != role {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// purgeVault permanently deletes the vault and everything associated with it
+func purgeVault(ctx context.Context, tx *orm.Tx, v Vault) error {
+	clog.Warnf("%s: purging vault %v (%s)", gServiceName, v.ID, v.Name)
+
+	for _, hook := range gPurgeHooks {
+		if err := hook(ctx, tx, v.ID); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.HardDeleteByConditions(map[string]interface{}{"vault_id": v.ID}, &ShamirsVault{}); err != nil {
+		return err
+	}
+	if _, err := tx.HardDeleteByConditions(map[string]interface{}{"vault_id": v.ID}, &VaultTag{}); err != nil {
+		return err
+	}
+	if _, err := tx.HardDeleteByConditions(map[string]interface{}{"vault_id": v.ID}, &VaultTeam{}); err != nil {
+		return err
+	}
+	if _, err := tx.HardDeleteByConditions(map[string]interface{}{"vault_id": v.ID}, &VaultUser{}); err != nil {
+		return err
+	}
+	if _, err := tx.HardDeleteByConditions(map[string]interface{}{"id": v.ID}, &Vault{}); err != nil {
+		return err
+	}
+
+	// The vault is gone, but the audit trail stays
+	return audit.Record(ctx, tx, audit.RecordRequest{
+		Action:     AuditActionPurged,
+		EntityType: auditEntityType,
+		EntityID:   v.ID,
+		Details:    fmt.Sprintf("name: %q", v.Name),
+	})
+}
+
+func getPurgeRetention() time.Duration {
+	days := gDefaultPurgeRetentionDays
+	if n, err := env.GetEnvVarInt("VAULT_PURGE_RETENTION_DAYS"); err == nil && n >= 0 {
+		days = n
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
@@ -0,0 +1,345 @@
+package vault
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/teejays/clog"
+
+	"github.com/teejays/n-factor-vault/backend/library/go-api"
+	"github.com/teejays/n-factor-vault/backend/library/id"
+	"github.com/teejays/n-factor-vault/backend/library/orm"
+
+	"github.com/teejays/n-factor-vault/backend/src/audit"
+)
+
+// ErrIPNotAllowed is returned when the vault is accessed from an IP that is not in its allowlist
+var ErrIPNotAllowed = fmt.Errorf("vault cannot be accessed from this IP address")
+
+// ErrOutsideTimeWindow is returned when the vault is accessed outside of its allowed time windows
+var ErrOutsideTimeWindow = fmt.Errorf("vault cannot be accessed at this time")
+
+// Audit actions for access restrictions
+const (
+	AuditActionRestrictionsUpdated = "vault.access_restrictions_updated"
+	AuditActionAccessDenied        = "vault.access_denied"
+)
+
+// gWeekdays maps the day names used in time windows to their time.Weekday
+var gWeekdays = map[string]time.Weekday{
+	"SUN": time.Sunday,
+	"MON": time.Monday,
+	"TUE": time.Tuesday,
+	"WED": time.Wednesday,
+	"THU": time.Thursday,
+	"FRI": time.Friday,
+	"SAT": time.Saturday,
+}
+
+// AccessRestrictions limit where from, and when, the secrets of a vault can be requested, approved and revealed.
+// Empty restrictions allow everything.
+type AccessRestrictions struct {
+	AllowedCIDRs pq.StringArray `gorm:"type:text[]" json:"allowedCidrs"` // e.g. the office VPN range 10.8.0.0/16
+	TimeWindows  TimeWindows    `gorm:"type:jsonb" json:"timeWindows"`   // access is allowed if any of the windows is open
+
+	// The AllowedCIDRs are parsed once, when the restrictions are cleaned or loaded, rather than on every access
+	loaded      bool
+	allowedNets []*net.IPNet
+	loadErr     error // an allowed CIDR that can't be parsed, which denies all access
+}
+
+// TimeWindows is a list of time windows, stored as JSON
+type TimeWindows []TimeWindow
+
+// TimeWindow is a recurring window of time, in a time zone, e.g. 09:00 to 18:00 on weekdays in America/New_York
+type TimeWindow struct {
+	Days     []string `json:"days"`     // MON, TUE... SUN. Empty means every day.
+	Start    string   `json:"start"`    // HH:MM, inclusive
+	End      string   `json:"end"`      // HH:MM, exclusive. If it's before Start, the window ends on the next day.
+	TimeZone string   `json:"timeZone"` // IANA time zone name, defaults to UTC
+}
+
+// Value implements the driver.Valuer interface, so the windows are stored as JSON
+func (tws TimeWindows) Value() (driver.Value, error) {
+	if tws == nil {
+		tws = TimeWindows{}
+	}
+	return jsonValue(tws)
+}
+
+// Scan implements the sql.Scanner interface, so the windows can be read from their JSON column
+func (tws *TimeWindows) Scan(src interface{}) error {
+	if src == nil {
+		*tws = TimeWindows{}
+		return nil
+	}
+	return scanJSON(src, tws)
+}
+
+// SetAccessRestrictionsRequest are the parameters for replacing the access restrictions of a vault
+type SetAccessRestrictionsRequest struct {
+	VaultID            id.ID              `json:"-"`
+	UserID             id.ID              `json:"-"`
+	AccessRestrictions AccessRestrictions `json:"accessRestrictions"`
+}
+
+// CheckAccessRequest are the parameters for checking whether a user can access the secrets of a vault
+type CheckAccessRequest struct {
+	Vault    *Vault
+	UserID   id.ID
+	ClientIP string
+	Action   string // what the user is trying to do e.g. secret.request, used for the security event
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* M E T H O D S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// SetAccessRestrictions replaces the access restrictions of the vault. Only the owners of the vault can do this.
+func SetAccessRestrictions(ctx context.Context, req SetAccessRestrictionsRequest) (*Vault, error) {
+	clog.Debugf("%s: SetAccessRestrictions(): vault %v", gServiceName, req.VaultID)
+
+	ar, err := cleanAccessRestrictions(req.AccessRestrictions)
+	if err != nil {
+		return nil, err
+	}
+
+	return mutateVaultAsOwner(ctx, req.VaultID, req.UserID, func(tx *orm.Tx, v *Vault) (string, string, error) {
+		if v.IsArchived() {
+			return "", "", ErrVaultArchived
+		}
+		v.AccessRestrictions = ar
+		cols := map[string]interface{}{"access_allowed_cidrs": ar.AllowedCIDRs, "access_time_windows": ar.TimeWindows}
+		err := tx.UpdateColumnsByConditions(map[string]interface{}{"id": v.ID}, cols, &Vault{})
+		return AuditActionRestrictionsUpdated, ar.String(), err
+	})
+}
+
+// AccessHookFunc is called whenever the secrets of a vault are accessed, after the vault's access restrictions allow
+// it. It allows other services to deny the access too, e.g. for an API key that isn't scoped to the vault.
+type AccessHookFunc func(ctx context.Context, req CheckAccessRequest) error
+
+var gAccessHooks []AccessHookFunc
+
+// RegisterAccessHook registers f to be called whenever the secrets of a vault are accessed
+func RegisterAccessHook(f AccessHookFunc) {
+	gAccessHooks = append(gAccessHooks, f)
+}
+
+// CheckAccess returns ErrIPNotAllowed or ErrOutsideTimeWindow if the vault's access restrictions do not allow the
+// access right now, or the error of an access hook that denies it. Denied attempts are recorded as security events.
+func CheckAccess(ctx context.Context, req CheckAccessRequest) error {
+	err := req.Vault.AccessRestrictions.Check(req.ClientIP, time.Now())
+	for i := 0; err == nil && i < len(gAccessHooks); i++ {
+		err = gAccessHooks[i](ctx, req)
+	}
+	if err == nil {
+		return nil
+	}
+
+	rerr := audit.RecordSecurityEvent(ctx, audit.RecordRequest{
+		ActorUserID: req.UserID,
+		Action:      AuditActionAccessDenied,
+		EntityType:  auditEntityType,
+		EntityID:    req.Vault.ID,
+		ClientIP:    req.ClientIP,
+		Details:     fmt.Sprintf("%s: %v", req.Action, err),
+	})
+	if rerr != nil {
+		clog.Errorf("%s: could not record security event: %v", gServiceName, rerr)
+	}
+	return err
+}
+
+// AfterFind is called by the ORM when a vault is read, and parses its access restrictions
+func (v *Vault) AfterFind() error {
+	if err := v.AccessRestrictions.load(); err != nil {
+		clog.Errorf("%s: invalid access restrictions on vault %v, denying all access: %v", gServiceName, v.ID, err)
+	}
+	return nil
+}
+
+// Check returns an error if access from the ip at time t is not allowed by the restrictions
+func (ar AccessRestrictions) Check(ip string, t time.Time) error {
+	if len(ar.AllowedCIDRs) > 0 {
+		if !ar.loaded {
+			ar.load() // e.g. restrictions of a vault that was scanned from a raw query
+		}
+		if ar.loadErr != nil {
+			return ErrIPNotAllowed
+		}
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return ErrIPNotAllowed
+		}
+		var allowed bool
+		for _, n := range ar.allowedNets {
+			if n.Contains(parsed) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return ErrIPNotAllowed
+		}
+	}
+
+	if len(ar.TimeWindows) > 0 {
+		var open bool
+		for _, tw := range ar.TimeWindows {
+			if tw.contains(t) {
+				open = true
+				break
+			}
+		}
+		if !open {
+			return ErrOutsideTimeWindow
+		}
+	}
+
+	return nil
+}
+
+func (ar AccessRestrictions) String() string {
+	var windows []string
+	for _, tw := range ar.TimeWindows {
+		windows = append(windows, tw.String())
+	}
+	return fmt.Sprintf("allowed_cidrs: %v; time_windows: %v", []string(ar.AllowedCIDRs), windows)
+}
+
+func (tw TimeWindow) String() string {
+	days := "every day"
+	if len(tw.Days) > 0 {
+		days = strings.Join(tw.Days, ",")
+	}
+	return fmt.Sprintf("%s %s-%s %s", days, tw.Start, tw.End, tw.TimeZone)
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* H E L P E R S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// load parses the allowed CIDRs of the restrictions. A CIDR that can't be parsed, which would have been rejected when
+// the restrictions were set, is returned, and denies all access rather than being skipped.
+func (ar *AccessRestrictions) load() error {
+	ar.loaded, ar.allowedNets, ar.loadErr = true, nil, nil
+	for _, c := range ar.AllowedCIDRs {
+		n, err := api.ParseCIDR(c)
+		if err != nil {
+			ar.allowedNets, ar.loadErr = nil, err
+			return err
+		}
+		ar.allowedNets = append(ar.allowedNets, n)
+	}
+	return nil
+}
+
+// contains returns true if t falls inside the time window
+func (tw TimeWindow) contains(t time.Time) bool {
+	loc, err := time.LoadLocation(tw.TimeZone)
+	if err != nil {
+		clog.Errorf("%s: invalid time zone %q in time window: %v", gServiceName, tw.TimeZone, err)
+		return false
+	}
+	start, err := parseClock(tw.Start)
+	if err != nil {
+		return false
+	}
+	end, err := parseClock(tw.End)
+	if err != nil {
+		return false
+	}
+
+	lt := t.In(loc)
+	now := lt.Hour()*60 + lt.Minute()
+	day := lt.Weekday()
+
+	var in bool
+	switch {
+	case start < end:
+		in = now >= start && now < end
+	case now >= start:
+		// The window goes past midnight, and we're in the part before midnight
+		in = true
+	case now < end:
+		// The window goes past midnight, and we're in the part after midnight, so it opened the day before
+		in = true
+		day = (day + 6) % 7
+	}
+	if !in {
+		return false
+	}
+
+	if len(tw.Days) == 0 {
+		return true
+	}
+	for _, d := range tw.Days {
+		if gWeekdays[d] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// parseClock parses HH:MM into the number of minutes since midnight
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time '%s', it should be in the HH:MM format", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// cleanAccessRestrictions validates and normalizes the restrictions: single IPs become CIDR ranges, days are
+// upper-cased, and the time zone defaults to UTC
+func cleanAccessRestrictions(ar AccessRestrictions) (AccessRestrictions, error) {
+	var cleaned = AccessRestrictions{AllowedCIDRs: pq.StringArray{}, TimeWindows: TimeWindows{}}
+
+	for _, c := range ar.AllowedCIDRs {
+		n, err := api.ParseCIDR(c)
+		if err != nil {
+			return cleaned, err
+		}
+		cleaned.AllowedCIDRs = append(cleaned.AllowedCIDRs, n.String())
+		cleaned.allowedNets = append(cleaned.allowedNets, n)
+	}
+	cleaned.loaded = true
+
+	for _, tw := range ar.TimeWindows {
+		start, err := parseClock(tw.Start)
+		if err != nil {
+			return cleaned, err
+		}
+		end, err := parseClock(tw.End)
+		if err != nil {
+			return cleaned, err
+		}
+		if start == end {
+			return cleaned, fmt.Errorf("time window cannot start and end at the same time")
+		}
+		if tw.TimeZone == "" {
+			tw.TimeZone = "UTC"
+		}
+		if _, err := time.LoadLocation(tw.TimeZone); err != nil {
+			return cleaned, fmt.Errorf("invalid time zone '%s'", tw.TimeZone)
+		}
+		var days []string
+		for _, d := range tw.Days {
+			d = strings.ToUpper(strings.TrimSpace(d))
+			if _, ok := gWeekdays[d]; !ok {
+				return cleaned, fmt.Errorf("invalid day '%s', it should be one of MON, TUE, WED, THU, FRI, SAT or SUN", d)
+			}
+			days = append(days, d)
+		}
+		tw.Days = days
+		cleaned.TimeWindows = append(cleaned.TimeWindows, tw)
+	}
+
+	return cleaned, nil
+}
@@ -0,0 +1,125 @@
+package vault
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessRestrictionsCheck(t *testing.T) {
+	// Monday 10 June 2019, 14:30 UTC
+	monday := time.Date(2019, time.June, 10, 14, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		ar   AccessRestrictions
+		ip   string
+		t    time.Time
+		want error
+	}{
+		{
+			name: "no restrictions",
+			ip:   "203.0.113.7",
+			t:    monday,
+		},
+		{
+			name: "IP in the allowlist",
+			ar:   AccessRestrictions{AllowedCIDRs: pq.StringArray{"192.168.0.0/16", "203.0.113.0/24"}},
+			ip:   "203.0.113.7",
+			t:    monday,
+		},
+		{
+			name: "IP not in the allowlist",
+			ar:   AccessRestrictions{AllowedCIDRs: pq.StringArray{"10.8.0.0/16"}},
+			ip:   "203.0.113.7",
+			t:    monday,
+			want: ErrIPNotAllowed,
+		},
+		{
+			name: "unknown IP with an allowlist",
+			ar:   AccessRestrictions{AllowedCIDRs: pq.StringArray{"10.8.0.0/16"}},
+			t:    monday,
+			want: ErrIPNotAllowed,
+		},
+		{
+			name: "inside a time window",
+			ar:   AccessRestrictions{TimeWindows: TimeWindows{{Days: []string{"MON"}, Start: "09:00", End: "18:00", TimeZone: "UTC"}}},
+			t:    monday,
+		},
+		{
+			name: "outside all time windows",
+			ar: AccessRestrictions{TimeWindows: TimeWindows{
+				{Days: []string{"TUE"}, Start: "09:00", End: "18:00", TimeZone: "UTC"},
+				{Days: []string{"MON"}, Start: "15:00", End: "18:00", TimeZone: "UTC"},
+			}},
+			t:    monday,
+			want: ErrOutsideTimeWindow,
+		},
+		{
+			name: "time window in another time zone",
+			ar:   AccessRestrictions{TimeWindows: TimeWindows{{Start: "09:00", End: "10:00", TimeZone: "America/New_York"}}},
+			t:    monday, // 10:30 in New York
+			want: ErrOutsideTimeWindow,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.ar.Check(tt.ip, tt.t))
+		})
+	}
+}
+
+func TestTimeWindowContains(t *testing.T) {
+	// A night shift window, that opens on Friday evening
+	tw := TimeWindow{Days: []string{"FRI"}, Start: "22:00", End: "06:00", TimeZone: "Europe/London"}
+
+	// 14 June 2019 is a Friday, and London is at UTC+1
+	assert.True(t, tw.contains(time.Date(2019, time.June, 14, 21, 0, 0, 0, time.UTC)), "Friday 22:00 in London")
+	assert.True(t, tw.contains(time.Date(2019, time.June, 15, 4, 59, 0, 0, time.UTC)), "Saturday 05:59 in London")
+	assert.False(t, tw.contains(time.Date(2019, time.June, 15, 5, 0, 0, 0, time.UTC)), "Saturday 06:00 in London")
+	assert.False(t, tw.contains(time.Date(2019, time.June, 14, 4, 0, 0, 0, time.UTC)), "Friday 05:00 in London")
+	assert.False(t, tw.contains(time.Date(2019, time.June, 15, 21, 0, 0, 0, time.UTC)), "Saturday 22:00 in London")
+}
+
+func TestCleanAccessRestrictions(t *testing.T) {
+	ar, err := cleanAccessRestrictions(AccessRestrictions{
+		AllowedCIDRs: pq.StringArray{" 203.0.113.7", "10.8.1.2/16", "2001:db8::1"},
+		TimeWindows:  TimeWindows{{Days: []string{"mon", "Fri "}, Start: "09:00", End: "18:00"}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, pq.StringArray{"203.0.113.7/32", "10.8.0.0/16", "2001:db8::1/128"}, ar.AllowedCIDRs)
+	assert.Equal(t, TimeWindows{{Days: []string{"MON", "FRI"}, Start: "09:00", End: "18:00", TimeZone: "UTC"}}, ar.TimeWindows)
+
+	invalid := []AccessRestrictions{
+		{AllowedCIDRs: pq.StringArray{"office"}},
+		{AllowedCIDRs: pq.StringArray{"10.0.0.0/33"}},
+		{TimeWindows: TimeWindows{{Start: "9am", End: "18:00"}}},
+		{TimeWindows: TimeWindows{{Start: "09:00", End: "09:00"}}},
+		{TimeWindows: TimeWindows{{Start: "09:00", End: "18:00", TimeZone: "Mars/Olympus_Mons"}}},
+		{TimeWindows: TimeWindows{{Days: []string{"MONDAY"}, Start: "09:00", End: "18:00"}}},
+	}
+	for _, ar := range invalid {
+		_, err := cleanAccessRestrictions(ar)
+		assert.Error(t, err, ar.String())
+	}
+
+	// The cleaned CIDRs are parsed once, so checks don't parse them again
+	assert.True(t, ar.loaded)
+	assert.Len(t, ar.allowedNets, 3)
+}
+
+func TestAccessRestrictionsLoad(t *testing.T) {
+	// A vault read from the database has its CIDRs parsed when it's loaded
+	v := Vault{AccessRestrictions: AccessRestrictions{AllowedCIDRs: pq.StringArray{"10.8.0.0/16"}}}
+	assert.NoError(t, v.AfterFind())
+	assert.True(t, v.AccessRestrictions.loaded)
+	assert.NoError(t, v.AccessRestrictions.Check("10.8.1.2", time.Now()))
+
+	// A CIDR that can't be parsed denies all access, instead of being skipped
+	v = Vault{AccessRestrictions: AccessRestrictions{AllowedCIDRs: pq.StringArray{"10.8.0.0/16", "office"}}}
+	assert.NoError(t, v.AfterFind())
+	assert.Error(t, v.AccessRestrictions.loadErr)
+	assert.Equal(t, ErrIPNotAllowed, v.AccessRestrictions.Check("10.8.1.2", time.Now()))
+}
@@ -0,0 +1,354 @@
+package vault
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/teejays/clog"
+
+	"github.com/teejays/n-factor-vault/backend/library/id"
+	"github.com/teejays/n-factor-vault/backend/library/orm"
+)
+
+// AuditActionTagsUpdated is the audit action for changing the tags of a vault
+const AuditActionTagsUpdated = "vault.tags_updated"
+
+var gDefaultListLimit = 50
+var gMaxListLimit = 200
+
+// VaultTag is a label attached to a vault, which can be used to filter vaults
+type VaultTag struct {
+	orm.BaseModel `gorm:"embedded"`
+	VaultID       id.ID  `gorm:"unique_index:idx_vault_tag" json:"vault_id"`
+	Tag           string `gorm:"unique_index:idx_vault_tag;index" json:"tag"`
+}
+
+// initSearch creates the index used for full-text search on vault names and descriptions
+func initSearch() error {
+	return orm.Exec(`CREATE INDEX IF NOT EXISTS idx_vaults_fts ON vaults USING GIN (` + gFullTextDocument + `)`)
+}
+
+// gFullTextDocument is the SQL expression that we search when doing a full-text search on vaults. The index
+// and the query should use the exact same expression.
+const gFullTextDocument = `to_tsvector('simple', coalesce(vaults.name, '') || ' ' || coalesce(vaults.description, ''))`
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* M E T H O D S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// SetTagsRequest are the parameters for replacing the tags of a vault
+type SetTagsRequest struct {
+	VaultID id.ID    `json:"-"`
+	UserID  id.ID    `json:"-"`
+	Tags    []string `json:"tags"`
+}
+
+// SetTags replaces the tags of the vault. Only the owners of the vault can do this.
+func SetTags(ctx context.Context, req SetTagsRequest) (*Vault, error) {
+	tags, err := cleanTags(req.Tags)
+	if err != nil {
+		return nil, err
+	}
+
+	return mutateVaultAsOwner(ctx, req.VaultID, req.UserID, func(tx *orm.Tx, v *Vault) (string, string, error) {
+		if v.IsArchived() {
+			return "", "", ErrVaultArchived
+		}
+		_, err := tx.HardDeleteByConditions(map[string]interface{}{"vault_id": v.ID}, &VaultTag{})
+		if err != nil {
+			return "", "", err
+		}
+		for _, tag := range tags {
+			vt := VaultTag{VaultID: v.ID, Tag: tag}
+			if err := tx.InsertOne(&vt); err != nil {
+				return "", "", err
+			}
+		}
+		v.Tags = tags
+		return AuditActionTagsUpdated, fmt.Sprintf("tags: %v", tags), nil
+	})
+}
+
+// ListVaultsRequest are the parameters for searching the vaults that a user is a part of. All the filters are optional.
+type ListVaultsRequest struct {
+	UserID id.ID
+	// Query does a full-text search on the vault name and description
+	Query string
+	// Tags filters for vaults that have all of the tags
+	Tags []string
+	// Role filters for vaults where the user has this role
+	Role Role
+	// FolderID filters for vaults directly inside the folder
+	FolderID *id.ID
+	// HasPendingRequests, if set, filters for vaults that do (or do not) have secret requests awaiting approval
+	HasPendingRequests *bool
+	// Sort is the field to sort by: name, created_at or updated_at. Prefix it with '-' to sort in descending order.
+	Sort string
+	// Cursor is the NextCursor returned by the previous page. Leave empty to get the first page.
+	Cursor string
+	// Limit is the max number of vaults to return. Zero means default.
+	Limit int
+}
+
+// VaultPage is a single page of vaults
+type VaultPage struct {
+	Vaults []*Vault
+	// NextCursor can be passed to get the next page. It is empty if this is the last page.
+	NextCursor string
+}
+
+// ListVaults returns a page of vaults that the user is a part of, matching the filters in the request. It fetches the
+// vaults, with their tags, using a single query.
+func ListVaults(ctx context.Context, req ListVaultsRequest) (*VaultPage, error) {
+	clog.Debugf("%s: ListVaults(): req:\n%+v", gServiceName, req)
+
+	limit := req.Limit
+	if limit == 0 {
+		limit = gDefaultListLimit
+	}
+	if limit < 0 || limit > gMaxListLimit {
+		return nil, fmt.Errorf("limit should be between 1 and %d", gMaxListLimit)
+	}
+
+	query, args, sf, err := buildListVaultsQuery(req, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []vaultRow
+	err = orm.ScanRaw(&rows, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var page = VaultPage{Vaults: []*Vault{}}
+	for i := range rows {
+		if i == limit {
+			// We fetched one more than the limit, so we know there's another page
+			page.NextCursor, err = encodeCursor(sf, page.Vaults[len(page.Vaults)-1])
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+		v := rows[i].Vault
+		v.Tags = []string(rows[i].Tags)
+		if v.Tags == nil {
+			v.Tags = []string{}
+		}
+		page.Vaults = append(page.Vaults, &v)
+	}
+
+	return &page, nil
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* H E L P E R S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// vaultRow is a row returned by the list vaults query
+type vaultRow struct {
+	Vault
+	Tags pq.StringArray
+}
+
+// sortField is a field that vaults can be sorted by
+type sortField struct {
+	Column string
+	Desc   bool
+}
+
+var gSortColumns = map[string]bool{
+	"name":       true,
+	"created_at": true,
+	"updated_at": true,
+}
+
+func parseSort(s string) (sortField, error) {
+	var sf sortField
+	s = strings.TrimSpace(s)
+	if s == "" {
+		s = "name"
+	}
+	if strings.HasPrefix(s, "-") {
+		sf.Desc = true
+		s = s[1:]
+	}
+	if !gSortColumns[s] {
+		return sf, fmt.Errorf("cannot sort by '%s'", s)
+	}
+	sf.Column = s
+	return sf, nil
+}
+
+// cursor holds the position of the last vault of a page, which is where the next page starts. It includes the
+// sort field so a cursor can't be used with a different sort order.
+type cursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    id.ID  `json:"id"`
+}
+
+func (sf sortField) String() string {
+	if sf.Desc {
+		return "-" + sf.Column
+	}
+	return sf.Column
+}
+
+func encodeCursor(sf sortField, v *Vault) (string, error) {
+	c := cursor{Sort: sf.String(), ID: v.ID}
+	switch sf.Column {
+	case "name":
+		c.Value = v.Name
+	case "created_at":
+		c.Value = v.CreatedAt.UTC().Format(time.RFC3339Nano)
+	case "updated_at":
+		c.Value = v.UpdatedAt.UTC().Format(time.RFC3339Nano)
+	default:
+		return "", fmt.Errorf("cannot create a cursor for sort field %s", sf.Column)
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCursor(sf sortField, s string) (cursor, error) {
+	var c cursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, fmt.Errorf("invalid cursor")
+	}
+	err = json.Unmarshal(data, &c)
+	if err != nil {
+		return c, fmt.Errorf("invalid cursor")
+	}
+	if c.Sort != sf.String() {
+		return c, fmt.Errorf("cursor was created for a different sort order")
+	}
+	if c.ID.IsEmpty() {
+		return c, fmt.Errorf("invalid cursor")
+	}
+	if sf.Column != "name" {
+		if _, err := time.Parse(time.RFC3339Nano, c.Value); err != nil {
+			return c, fmt.Errorf("invalid cursor")
+		}
+	}
+	return c, nil
+}
+
+// buildListVaultsQuery builds the SQL query, and its args, for the list vaults request. The query fetches one more row
+// than the limit, so we can tell if there is a next page.
+func buildListVaultsQuery(req ListVaultsRequest, limit int) (string, []interface{}, sortField, error) {
+	sf, err := parseSort(req.Sort)
+	if err != nil {
+		return "", nil, sf, err
+	}
+	if req.UserID.IsEmpty() {
+		return "", nil, sf, fmt.Errorf("userID is empty")
+	}
+
+	var where []string
+	var args []interface{}
+
+	// The tags are aggregated in the same query, so we don't need another query per vault
+	q := `SELECT vaults.*, ARRAY(SELECT vault_tags.tag FROM vault_tags WHERE vault_tags.vault_id = vaults.id AND vault_tags.deleted_at IS NULL ORDER BY vault_tags.tag) AS tags
+FROM vaults
+INNER JOIN vault_users ON vault_users.vault_id = vaults.id AND vault_users.deleted_at IS NULL AND vault_users.user_id = ?`
+	args = append(args, req.UserID)
+
+	where = append(where, "vaults.deleted_at IS NULL")
+
+	if strings.TrimSpace(req.Query) != "" {
+		where = append(where, gFullTextDocument+" @@ plainto_tsquery('simple', ?)")
+		args = append(args, strings.TrimSpace(req.Query))
+	}
+
+	if req.Role != "" {
+		if req.Role != RoleOwner && req.Role != RoleMember {
+			return "", nil, sf, fmt.Errorf("invalid role '%s'", req.Role)
+		}
+		where = append(where, "vault_users.role = ?")
+		args = append(args, req.Role)
+	}
+
+	if req.FolderID != nil {
+		where = append(where, "vaults.folder_id = ?")
+		args = append(args, *req.FolderID)
+	}
+
+	if len(req.Tags) > 0 {
+		tags, err := cleanTags(req.Tags)
+		if err != nil {
+			return "", nil, sf, err
+		}
+		where = append(where, "(SELECT COUNT(DISTINCT vault_tags.tag) FROM vault_tags WHERE vault_tags.vault_id = vaults.id AND vault_tags.deleted_at IS NULL AND vault_tags.tag IN (?)) = ?")
+		args = append(args, tags, len(tags))
+	}
+
+	if req.HasPendingRequests != nil {
+		// Pending requests are the secret requests (see the secret service) that haven't been approved yet
+		pending := "EXISTS (SELECT 1 FROM secret_requests WHERE secret_requests.vault_id = vaults.id AND secret_requests.deleted_at IS NULL AND secret_requests.approved = false)"
+		if !*req.HasPendingRequests {
+			pending = "NOT " + pending
+		}
+		where = append(where, pending)
+	}
+
+	dir, cmp := "ASC", ">"
+	if sf.Desc {
+		dir, cmp = "DESC", "<"
+	}
+
+	if req.Cursor != "" {
+		c, err := decodeCursor(sf, req.Cursor)
+		if err != nil {
+			return "", nil, sf, err
+		}
+		where = append(where, fmt.Sprintf("(vaults.%s, vaults.id) %s (?, ?)", sf.Column, cmp))
+		if sf.Column == "name" {
+			args = append(args, c.Value)
+		} else {
+			t, _ := time.Parse(time.RFC3339Nano, c.Value)
+			args = append(args, t)
+		}
+		args = append(args, c.ID)
+	}
+
+	q += "\nWHERE " + strings.Join(where, " AND ")
+	q += fmt.Sprintf("\nORDER BY vaults.%s %s, vaults.id %s", sf.Column, dir, dir)
+	q += "\nLIMIT ?"
+	args = append(args, limit+1)
+
+	return q, args, sf, nil
+}
+
+// cleanTags lower-cases, trims, de-duplicates and sorts the tags
+func cleanTags(tags []string) ([]string, error) {
+	var seen = make(map[string]bool)
+	var cleaned = []string{}
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			return nil, fmt.Errorf("tag cannot be empty")
+		}
+		if len(t) > 64 {
+			return nil, fmt.Errorf("tag '%s' is longer than 64 characters", t)
+		}
+		if seen[t] {
+			continue
+		}
+		seen[t] = true
+		cleaned = append(cleaned, t)
+	}
+	sort.Strings(cleaned)
+	return cleaned, nil
+}
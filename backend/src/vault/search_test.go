@@ -0,0 +1,134 @@
+package vault
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/teejays/n-factor-vault/backend/library/id"
+)
+
+func TestParseSort(t *testing.T) {
+	tests := []struct {
+		name    string
+		sort    string
+		want    sortField
+		wantErr bool
+	}{
+		{name: "defaults to name", sort: "", want: sortField{Column: "name"}},
+		{name: "ascending", sort: "created_at", want: sortField{Column: "created_at"}},
+		{name: "descending", sort: "-updated_at", want: sortField{Column: "updated_at", Desc: true}},
+		{name: "error if column is not sortable", sort: "description", wantErr: true},
+		{name: "error if column is an sql injection", sort: "name; DROP TABLE vaults", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSort(tt.sort)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestEncodeDecodeCursor(t *testing.T) {
+	v := &Vault{Name: "Facebook"}
+	v.ID = id.GetNewID()
+	v.CreatedAt = time.Date(2019, 7, 1, 10, 30, 0, 123, time.UTC)
+
+	t.Run("round trip by name", func(t *testing.T) {
+		sf := sortField{Column: "name"}
+		s, err := encodeCursor(sf, v)
+		assert.NoError(t, err)
+		c, err := decodeCursor(sf, s)
+		assert.NoError(t, err)
+		assert.Equal(t, "Facebook", c.Value)
+		assert.Equal(t, v.ID, c.ID)
+	})
+
+	t.Run("round trip by created_at descending", func(t *testing.T) {
+		sf := sortField{Column: "created_at", Desc: true}
+		s, err := encodeCursor(sf, v)
+		assert.NoError(t, err)
+		c, err := decodeCursor(sf, s)
+		assert.NoError(t, err)
+		got, err := time.Parse(time.RFC3339Nano, c.Value)
+		assert.NoError(t, err)
+		assert.True(t, v.CreatedAt.Equal(got))
+	})
+
+	t.Run("error if cursor is used with a different sort", func(t *testing.T) {
+		s, err := encodeCursor(sortField{Column: "name"}, v)
+		assert.NoError(t, err)
+		_, err = decodeCursor(sortField{Column: "name", Desc: true}, s)
+		assert.Error(t, err)
+	})
+
+	t.Run("error if cursor is garbage", func(t *testing.T) {
+		_, err := decodeCursor(sortField{Column: "name"}, "not-a-cursor")
+		assert.Error(t, err)
+	})
+}
+
+func TestCleanTags(t *testing.T) {
+	got, err := cleanTags([]string{" Prod", "infra", "prod "})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"infra", "prod"}, got)
+
+	_, err = cleanTags([]string{"prod", " "})
+	assert.Error(t, err)
+}
+
+func TestBuildListVaultsQuery(t *testing.T) {
+	userID := id.GetNewID()
+	folderID := id.GetNewID()
+	pending := true
+
+	t.Run("error if userID is empty", func(t *testing.T) {
+		_, _, _, err := buildListVaultsQuery(ListVaultsRequest{}, 10)
+		assert.Error(t, err)
+	})
+
+	t.Run("error if role is invalid", func(t *testing.T) {
+		_, _, _, err := buildListVaultsQuery(ListVaultsRequest{UserID: userID, Role: "ADMIN"}, 10)
+		assert.Error(t, err)
+	})
+
+	t.Run("all filters", func(t *testing.T) {
+		req := ListVaultsRequest{
+			UserID:             userID,
+			Query:              "shared account",
+			Tags:               []string{"prod", "Infra"},
+			Role:               RoleOwner,
+			FolderID:           &folderID,
+			HasPendingRequests: &pending,
+			Sort:               "-name",
+		}
+		q, args, sf, err := buildListVaultsQuery(req, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, sortField{Column: "name", Desc: true}, sf)
+		assert.Contains(t, q, "plainto_tsquery")
+		assert.Contains(t, q, "vault_users.role = ?")
+		assert.Contains(t, q, "vaults.folder_id = ?")
+		assert.Contains(t, q, "EXISTS (SELECT 1 FROM secret_requests")
+		assert.NotContains(t, q, "NOT EXISTS")
+		assert.Contains(t, q, "ORDER BY vaults.name DESC, vaults.id DESC")
+		assert.Equal(t, []interface{}{userID, "shared account", RoleOwner, folderID, []string{"infra", "prod"}, 2, 11}, args)
+	})
+
+	t.Run("cursor continues after the last vault", func(t *testing.T) {
+		v := &Vault{Name: "Facebook"}
+		v.ID = id.GetNewID()
+		c, err := encodeCursor(sortField{Column: "name"}, v)
+		assert.NoError(t, err)
+
+		q, args, _, err := buildListVaultsQuery(ListVaultsRequest{UserID: userID, Cursor: c}, 10)
+		assert.NoError(t, err)
+		assert.Contains(t, q, "(vaults.name, vaults.id) > (?, ?)")
+		assert.Equal(t, []interface{}{userID, "Facebook", v.ID, 11}, args)
+	})
+}
@@ -0,0 +1,291 @@
+package vault
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/teejays/clog"
+
+	"github.com/teejays/n-factor-vault/backend/library/id"
+	"github.com/teejays/n-factor-vault/backend/library/orm"
+
+	"github.com/teejays/n-factor-vault/backend/src/org"
+)
+
+// AuditActionTeamAdded is the audit action for adding a team to a vault
+const AuditActionTeamAdded = "vault.team_added"
+
+// AuditActionTeamRemoved is the audit action for removing a team from a vault
+const AuditActionTeamRemoved = "vault.team_removed"
+
+// ErrTeamNotInVault is returned when removing a team that is not a part of the vault
+var ErrTeamNotInVault = fmt.Errorf("team is not a part of the vault")
+
+// ErrTooFewMembers is returned when a change in the members of a vault would leave it with fewer members than the
+// number of approvals (K) that it requires, which would lock its secrets away for good
+var ErrTooFewMembers = fmt.Errorf("vault would have fewer members than the number of approvals it requires")
+
+// VaultTeam represents the mapping between a vault and the org teams that are a part of it. All the members of
+// the team are members of the vault.
+type VaultTeam struct {
+	orm.BaseModel `gorm:"embedded"`
+	VaultID       id.ID `gorm:"unique_index:idx_vault_team" json:"vault_id"`
+	TeamID        id.ID `gorm:"unique_index:idx_vault_team;index" json:"team_id"`
+}
+
+// AddTeamToVaultRequest are the parameters for adding a team to a vault
+type AddTeamToVaultRequest struct {
+	VaultID id.ID `json:"-"`
+	UserID  id.ID `json:"-"` // the user making the request
+	TeamID  id.ID `json:"teamId"`
+}
+
+// RemoveTeamFromVaultRequest are the parameters for removing a team from a vault
+type RemoveTeamFromVaultRequest struct {
+	VaultID id.ID
+	UserID  id.ID // the user making the request
+	TeamID  id.ID
+}
+
+// AddTeamToVault makes all the members of the team members of the vault. Any later changes in the team's
+// membership also flow through to the vault. Only the owners of the vault can do this.
+func AddTeamToVault(ctx context.Context, req AddTeamToVaultRequest) (*Vault, error) {
+	clog.Debugf("%s: AddTeamToVault(): vault %v, team %v", gServiceName, req.VaultID, req.TeamID)
+
+	if req.TeamID.IsEmpty() {
+		return nil, fmt.Errorf("teamID is empty")
+	}
+
+	t, err := org.GetTeam(ctx, req.TeamID)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return nil, org.ErrTeamNotFound
+	}
+
+	return mutateVaultAsOwner(ctx, req.VaultID, req.UserID, func(tx *orm.Tx, v *Vault) (string, string, error) {
+		if v.IsArchived() {
+			return "", "", ErrVaultArchived
+		}
+		// Only teams of the vault's org can be a part of it
+		if v.OrgID == nil || *v.OrgID != t.OrgID {
+			return "", "", fmt.Errorf("team %v does not belong to the organization of the vault", t.ID)
+		}
+
+		vt := VaultTeam{VaultID: v.ID, TeamID: t.ID}
+		err := tx.InsertOne(&vt)
+		if err != nil {
+			return "", "", err
+		}
+
+		err = evaluateVault(ctx, tx, v)
+		if err != nil {
+			return "", "", err
+		}
+
+		return AuditActionTeamAdded, fmt.Sprintf("team: %q", t.Name), nil
+	})
+}
+
+// RemoveTeamFromVault removes the team from the vault. Its members stop being members of the vault, unless they are
+// members directly, through another team, or through a folder. Only the owners of the vault can do this.
+func RemoveTeamFromVault(ctx context.Context, req RemoveTeamFromVaultRequest) (*Vault, error) {
+	clog.Debugf("%s: RemoveTeamFromVault(): vault %v, team %v", gServiceName, req.VaultID, req.TeamID)
+
+	if req.TeamID.IsEmpty() {
+		return nil, fmt.Errorf("teamID is empty")
+	}
+
+	return mutateVaultAsOwner(ctx, req.VaultID, req.UserID, func(tx *orm.Tx, v *Vault) (string, string, error) {
+		if v.IsArchived() {
+			return "", "", ErrVaultArchived
+		}
+
+		n, err := tx.HardDeleteByConditions(map[string]interface{}{"vault_id": v.ID, "team_id": req.TeamID}, &VaultTeam{})
+		if err != nil {
+			return "", "", err
+		}
+		if n == 0 {
+			return "", "", ErrTeamNotInVault
+		}
+
+		err = evaluateVault(ctx, tx, v)
+		if err != nil {
+			return "", "", err
+		}
+
+		return AuditActionTeamRemoved, fmt.Sprintf("team: %v", req.TeamID), nil
+	})
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* H E L P E R S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// syncTeamVaults syncs the members of all the vaults that the team is a part of. It is registered as an org team
+// membership hook.
+func syncTeamVaults(ctx context.Context, tx *orm.Tx, teamID id.ID) error {
+	var vts []VaultTeam
+	_, err := tx.FindByColumn("team_id", teamID, &vts)
+	if err != nil {
+		return err
+	}
+	for _, vt := range vts {
+		// Lock the vault, so membership changes for the same vault happen one after the other
+		var v Vault
+		exists, err := tx.FindByIDForUpdate(vt.VaultID, &v)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		err = syncVaultMembers(ctx, tx, &v)
+		if err != nil {
+			return fmt.Errorf("syncing members of vault %v: %v", v.ID, err)
+		}
+	}
+	return nil
+}
+
+// syncVaultMembers makes sure that the vault's inherited members, i.e. the members of its teams and the users with a
+// role on its folders, are members of the vault with the right role, and that users who no longer inherit a role are
+// removed. The direct members of the vault are left as they are, since a role set on the vault itself overrides any
+// inherited one. It then syncs the Shamir's config, and runs the membership hooks.
+func syncVaultMembers(ctx context.Context, tx *orm.Tx, v *Vault) error {
+	var vus []VaultUser
+	_, err := tx.FindByColumn("vault_id", v.ID, &vus)
+	if err != nil {
+		return err
+	}
+	var vts []VaultTeam
+	_, err = tx.FindByColumn("vault_id", v.ID, &vts)
+	if err != nil {
+		return err
+	}
+
+	// Get everyone who should be a member through a folder, with the role they get from it
+	var inherited = make(map[id.ID]*VaultUser)
+	if v.FolderID != nil {
+		chain, err := getFolderChain(ctx, tx, *v.FolderID)
+		if err != nil {
+			return err
+		}
+		for userID, role := range effectiveFolderMembers(chain) {
+			inherited[userID] = &VaultUser{Role: role, FromFolder: true}
+		}
+	}
+
+	// Get everyone who should be a member through a team
+	for _, vt := range vts {
+		ids, err := org.GetTeamMemberIDsTx(ctx, tx, vt.TeamID)
+		if err != nil {
+			return err
+		}
+		for _, userID := range ids {
+			if ivu, ok := inherited[userID]; ok {
+				ivu.FromTeam = true
+				continue
+			}
+			inherited[userID] = &VaultUser{Role: RoleMember, FromTeam: true}
+		}
+	}
+
+	// Update or remove the users who were members only because of a team or a folder
+	var current = make(map[id.ID]bool)
+	for _, vu := range vus {
+		current[vu.UserID] = true
+		if !vu.FromTeam && !vu.FromFolder {
+			continue
+		}
+		ivu, ok := inherited[vu.UserID]
+		if !ok {
+			clog.Debugf("%s: removing inherited member %v from vault %v", gServiceName, vu.UserID, v.ID)
+			_, err := tx.HardDeleteByConditions(map[string]interface{}{"id": vu.ID}, &VaultUser{})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if ivu.Role != vu.Role || ivu.FromTeam != vu.FromTeam || ivu.FromFolder != vu.FromFolder {
+			cols := map[string]interface{}{"role": ivu.Role, "from_team": ivu.FromTeam, "from_folder": ivu.FromFolder}
+			err := tx.UpdateColumnsByConditions(map[string]interface{}{"id": vu.ID}, cols, &VaultUser{})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Add the inherited members who aren't a part of the vault yet
+	for userID, ivu := range inherited {
+		if current[userID] {
+			continue
+		}
+		clog.Debugf("%s: adding inherited member %v to vault %v", gServiceName, userID, v.ID)
+		vu := VaultUser{VaultID: v.ID, UserID: userID, Role: ivu.Role, FromTeam: ivu.FromTeam, FromFolder: ivu.FromFolder}
+		err := tx.InsertOne(&vu)
+		if err != nil {
+			return err
+		}
+	}
+
+	return membersChanged(ctx, tx, v.ID)
+}
+
+// membersChanged syncs the Shamir's config with the members of the vault, and lets the other services know that the
+// members have changed
+func membersChanged(ctx context.Context, tx *orm.Tx, vaultID id.ID) error {
+	err := syncShamirsN(ctx, tx, vaultID)
+	if err != nil {
+		return err
+	}
+	for _, hook := range gMembershipHooks {
+		if err := hook(ctx, tx, vaultID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncShamirsN sets the total number of share holders (N) in the vault's Shamir's config to the number of its members.
+// It returns ErrTooFewMembers if the vault loses members and would be left with fewer than K of them. It does nothing
+// if the vault has not been initialized.
+func syncShamirsN(ctx context.Context, tx *orm.Tx, vaultID id.ID) error {
+	var sc ShamirsVault
+	exists, err := tx.FindOne(map[string]interface{}{"vault_id": vaultID}, &sc)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+
+	var vus []VaultUser
+	_, err = tx.FindByColumn("vault_id", vaultID, &vus)
+	if err != nil {
+		return err
+	}
+	n := len(vus)
+	if n == sc.N {
+		return nil
+	}
+	if n < sc.N && n < sc.K {
+		clog.Warnf("%s: vault %v would have %d members, which is less than the %d approvals it requires", gServiceName, vaultID, n, sc.K)
+		return ErrTooFewMembers
+	}
+
+	return tx.UpdateColumnsByConditions(map[string]interface{}{"id": sc.ID}, map[string]interface{}{"n": n}, &ShamirsVault{})
+}
+
+// requireOrgMember returns an error if the user is not a member of the organization
+func requireOrgMember(ctx context.Context, tx *orm.Tx, orgID, userID id.ID) error {
+	isMember, err := org.IsMemberTx(ctx, tx, orgID, userID)
+	if err != nil {
+		return err
+	}
+	if !isMember {
+		return fmt.Errorf("user %v is not a member of the organization %v", userID, orgID)
+	}
+	return nil
+}
@@ -0,0 +1,488 @@
+package vault
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/teejays/clog"
+
+	"github.com/teejays/n-factor-vault/backend/library/env"
+	"github.com/teejays/n-factor-vault/backend/library/id"
+	"github.com/teejays/n-factor-vault/backend/library/json"
+	"github.com/teejays/n-factor-vault/backend/library/orm"
+
+	"github.com/teejays/n-factor-vault/backend/src/audit"
+	"github.com/teejays/n-factor-vault/backend/src/org"
+	"github.com/teejays/n-factor-vault/backend/src/user"
+)
+
+// ErrTemplateNotFound is returned when the template does not exist, or the user does not have access to it
+var ErrTemplateNotFound = fmt.Errorf("vault template not found")
+
+// AuditActionCloned is the audit action for creating a vault by cloning another one
+const AuditActionCloned = "vault.cloned"
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* O R M   M O D E L S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// VaultTemplate is a named blueprint for creating similar vaults. It captures the members and their roles, the
+// threshold (K), the approval policy and the item schema, but never any secrets.
+type VaultTemplate struct {
+	orm.BaseModel  `gorm:"embedded"`
+	OrgID          *id.ID                `gorm:"unique_index:idx_template_org_name" json:"org_id"` // empty for personal templates
+	OwnerUserID    id.ID                 `gorm:"unique_index:idx_template_name_owner" json:"owner_user_id"`
+	Name           string                `gorm:"unique_index:idx_template_name_owner,idx_template_org_name" json:"name"`
+	Description    string                `json:"description"`
+	K              int                   `json:"k"`
+	ApprovalPolicy ApprovalPolicy        `gorm:"embedded;embedded_prefix:approval_" json:"approval_policy"`
+	ItemSchema     ItemSchema            `gorm:"type:jsonb" json:"item_schema"`
+	Members        []VaultTemplateMember `json:"members"`
+}
+
+// VaultTemplateMember is a user who is added, with the role, to every vault created from the template
+type VaultTemplateMember struct {
+	orm.BaseModel   `gorm:"embedded"`
+	VaultTemplateID id.ID `gorm:"unique_index:idx_template_user" json:"vault_template_id"`
+	UserID          id.ID `gorm:"unique_index:idx_template_user" json:"user_id"`
+	Role            Role  `gorm:"NOT NULL;default:'MEMBER'" json:"role"`
+}
+
+// gDefaultApprovalTTLMinutes is how long an approved request can be used to reveal the secret, when the approval
+// policy doesn't say. It can be configured with APPROVAL_DEFAULT_TTL_MINUTES.
+var gDefaultApprovalTTLMinutes = 15
+
+// ApprovalPolicy configures how approvals of requests for the vault's secrets behave
+type ApprovalPolicy struct {
+	TTLMinutes int `json:"ttlMinutes"` // how long an approved request can be used to reveal the secret, zero means the default
+}
+
+// TTL returns how long an approval can be used under the policy. Approvals never last forever: a policy without a TTL
+// gets the default one.
+func (p ApprovalPolicy) TTL() time.Duration {
+	minutes := p.TTLMinutes
+	if minutes <= 0 {
+		minutes = getDefaultApprovalTTLMinutes()
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// IsExpired returns true if an approval given at approvedAt can no longer be used under the policy
+func (p ApprovalPolicy) IsExpired(approvedAt time.Time) bool {
+	return time.Since(approvedAt) > p.TTL()
+}
+
+// ExpiresAt returns when an approval given at approvedAt can no longer be used under the policy
+func (p ApprovalPolicy) ExpiresAt(approvedAt time.Time) time.Time {
+	return approvedAt.Add(p.TTL())
+}
+
+func getDefaultApprovalTTLMinutes() int {
+	if n, err := env.GetEnvVarInt("APPROVAL_DEFAULT_TTL_MINUTES"); err == nil && n > 0 {
+		return n
+	}
+	return gDefaultApprovalTTLMinutes
+}
+
+// ItemSchema describes the fields of the items stored in a vault, e.g. username, password and a TOTP secret
+type ItemSchema []ItemField
+
+// ItemField is a single field of the items stored in a vault
+type ItemField struct {
+	Name         string        `json:"name"`
+	Type         ItemFieldType `json:"type"`
+	Required     bool          `json:"required"`
+	RotationDays int           `json:"rotationDays,omitempty"` // if set, the value should be rotated at least this often
+}
+
+// ItemFieldType is the kind of value that an item field holds
+type ItemFieldType string
+
+// The types of item fields
+const (
+	ItemFieldText     ItemFieldType = "TEXT"
+	ItemFieldPassword ItemFieldType = "PASSWORD"
+	ItemFieldTOTP     ItemFieldType = "TOTP"
+	ItemFieldURL      ItemFieldType = "URL"
+	ItemFieldNote     ItemFieldType = "NOTE"
+)
+
+var gItemFieldTypes = map[ItemFieldType]bool{
+	ItemFieldText:     true,
+	ItemFieldPassword: true,
+	ItemFieldTOTP:     true,
+	ItemFieldURL:      true,
+	ItemFieldNote:     true,
+}
+
+// Value implements the driver.Valuer interface, so the schema is stored as JSON
+func (s ItemSchema) Value() (driver.Value, error) {
+	if s == nil {
+		s = ItemSchema{}
+	}
+	return jsonValue(s)
+}
+
+// Scan implements the sql.Scanner interface, so the schema can be read from its JSON column
+func (s *ItemSchema) Scan(src interface{}) error {
+	if src == nil {
+		*s = ItemSchema{}
+		return nil
+	}
+	return scanJSON(src, s)
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* M E T H O D S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// CreateTemplateRequest are the parameters that are passed when creating a vault template
+type CreateTemplateRequest struct {
+	UserID         id.ID                   `json:"-"`
+	OrgID          *id.ID                  `json:"orgId"` // optional: the organization whose members can use the template
+	Name           string                  `json:"name"`
+	Description    string                  `json:"description"`
+	K              int                     `json:"k"`
+	ApprovalPolicy ApprovalPolicy          `json:"approvalPolicy"`
+	ItemSchema     ItemSchema              `json:"itemSchema"`
+	Members        []TemplateMemberRequest `json:"members"`
+}
+
+// TemplateMemberRequest is a member, identified by their email, of a template that is being created
+type TemplateMemberRequest struct {
+	Email string `json:"email"`
+	Role  Role   `json:"role"` // defaults to MEMBER
+}
+
+// CloneVaultRequest are the parameters for cloning a vault
+type CloneVaultRequest struct {
+	VaultID     id.ID  `json:"-"`
+	UserID      id.ID  `json:"-"`
+	Name        string `json:"name"`
+	Description string `json:"description"` // defaults to the description of the vault being cloned
+}
+
+// CreateTemplate creates a new vault template. Personal templates can only be used by the user who created them,
+// while the templates of an organization can be used by all of its members.
+func CreateTemplate(ctx context.Context, req CreateTemplateRequest) (*VaultTemplate, error) {
+	clog.Debugf("%s: CreateTemplate(): name %s", gServiceName, req.Name)
+
+	if req.UserID.IsEmpty() {
+		return nil, fmt.Errorf("userID is empty")
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		return nil, fmt.Errorf("name is empty")
+	}
+	if req.K < 2 {
+		return nil, fmt.Errorf("minimum number of approvals required should be greater than 1")
+	}
+	if len(req.Members) < req.K {
+		return nil, fmt.Errorf("number of members should be greater than or equal to the minimum number of approvals required")
+	}
+	if err := validateItemSchema(req.ItemSchema); err != nil {
+		return nil, err
+	}
+	if req.ApprovalPolicy.TTLMinutes < 0 {
+		return nil, fmt.Errorf("approval TTL cannot be negative")
+	}
+
+	t := VaultTemplate{
+		OrgID:          req.OrgID,
+		OwnerUserID:    req.UserID,
+		Name:           strings.TrimSpace(req.Name),
+		Description:    strings.TrimSpace(req.Description),
+		K:              req.K,
+		ApprovalPolicy: req.ApprovalPolicy,
+		ItemSchema:     req.ItemSchema,
+	}
+
+	// Resolve the members before we start writing anything
+	var seen = make(map[id.ID]bool)
+	for _, m := range req.Members {
+		role := m.Role
+		if role == "" {
+			role = RoleMember
+		}
+		if role != RoleOwner && role != RoleMember {
+			return nil, fmt.Errorf("invalid role '%s'", m.Role)
+		}
+		u, err := user.GetUserByEmail(m.Email)
+		if err != nil {
+			return nil, err
+		}
+		if u.ID.IsEmpty() {
+			return nil, fmt.Errorf("no user with email %s found", m.Email)
+		}
+		if seen[u.ID] {
+			return nil, fmt.Errorf("user with email %s is listed more than once", m.Email)
+		}
+		seen[u.ID] = true
+		t.Members = append(t.Members, VaultTemplateMember{UserID: u.ID, Role: role})
+	}
+
+	err := orm.WithTx(ctx, func(tx *orm.Tx) error {
+		// Templates of an organization should follow its settings, and only include its members
+		if t.OrgID != nil {
+			if err := requireOrgMember(ctx, tx, *t.OrgID, t.OwnerUserID); err != nil {
+				return err
+			}
+			o, err := org.GetOrg(ctx, *t.OrgID)
+			if err != nil {
+				return err
+			}
+			if o == nil {
+				return org.ErrOrgNotFound
+			}
+			if t.K < o.MinK {
+				return fmt.Errorf("minimum number of approvals required should be at least %d for vaults of %s", o.MinK, o.Name)
+			}
+			for _, m := range t.Members {
+				if err := requireOrgMember(ctx, tx, *t.OrgID, m.UserID); err != nil {
+					return err
+				}
+			}
+		}
+		// Inserting the template also inserts its members
+		return tx.InsertOne(&t)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// GetTemplate returns the template, with its members, if the user has access to it
+func GetTemplate(ctx context.Context, templateID, userID id.ID) (*VaultTemplate, error) {
+	var t *VaultTemplate
+	err := orm.WithTx(ctx, func(tx *orm.Tx) error {
+		var err error
+		t, err = getTemplate(ctx, tx, templateID, userID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// GetTemplatesByUser returns all the templates that the user can use: their personal templates, and the templates
+// of the organizations they are a member of
+func GetTemplatesByUser(ctx context.Context, userID id.ID) ([]*VaultTemplate, error) {
+	clog.Debugf("%s: GetTemplatesByUser(): user %v", gServiceName, userID)
+
+	var ts []VaultTemplate
+	// The org_users table belongs to the org service
+	_, err := orm.FindWhere(&ts, "(owner_user_id = ? AND org_id IS NULL) OR org_id IN (SELECT org_id FROM org_users WHERE user_id = ? AND accepted AND deleted_at IS NULL)", userID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var templates = []*VaultTemplate{}
+	for i := range ts {
+		_, err := orm.FindByColumn("vault_template_id", ts[i].ID, &ts[i].Members)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, &ts[i])
+	}
+	return templates, nil
+}
+
+// CloneVault creates a new vault with the same structure as an existing one: its organization, folder, members and their
+// roles, teams, tags, threshold, approval policy, item schema and access restrictions. The secrets of the vault are not copied. Only the
+// owners of a vault can clone it, and they own the clone.
+func CloneVault(ctx context.Context, req CloneVaultRequest) (*Vault, error) {
+	clog.Debugf("%s: CloneVault(): vault %v", gServiceName, req.VaultID)
+
+	var clone *Vault
+	err := orm.WithTx(ctx, func(tx *orm.Tx) error {
+		var src Vault
+		exists, err := tx.FindByID(req.VaultID, &src)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrVaultNotFound
+		}
+		err = requireRole(ctx, tx, src.ID, req.UserID, RoleOwner)
+		if err != nil {
+			return err
+		}
+
+		var tags []VaultTag
+		if _, err = tx.FindByColumn("vault_id", src.ID, &tags); err != nil {
+			return err
+		}
+		description := req.Description
+		if strings.TrimSpace(description) == "" {
+			description = src.Description
+		}
+		cvr := CreateVaultRequest{
+			AdminUserID:        req.UserID,
+			OrgID:              src.OrgID,
+			Name:               req.Name,
+			Description:        description,
+			FolderID:           src.FolderID,
+			ApprovalPolicy:     src.ApprovalPolicyOverride,
+			ItemSchema:         src.ItemSchema,
+			AccessRestrictions: src.AccessRestrictions,
+		}
+		for _, t := range tags {
+			cvr.Tags = append(cvr.Tags, t.Tag)
+		}
+		clone, err = createVault(ctx, tx, cvr)
+		if err != nil {
+			return fmt.Errorf("creating vault: %v", err)
+		}
+
+		// The Shamir's config is created before the members are added, so N is synced with them
+		var sc ShamirsVault
+		exists, err = tx.FindOne(map[string]interface{}{"vault_id": src.ID}, &sc)
+		if err != nil {
+			return err
+		}
+		if exists {
+			csc := ShamirsVault{VaultID: clone.ID, K: sc.K, N: len(clone.VaultUsers)}
+			if err = tx.InsertOne(&csc); err != nil {
+				return err
+			}
+		}
+
+		// Copy the direct members. The members who are a part of the vault through a team or a folder are added
+		// when the vault is evaluated.
+		var vus []VaultUser
+		if _, err = tx.FindByColumn("vault_id", src.ID, &vus); err != nil {
+			return err
+		}
+		for _, vu := range vus {
+			if vu.FromTeam || vu.FromFolder || vu.UserID == req.UserID {
+				continue
+			}
+			if clone.OrgID != nil {
+				isMember, err := org.IsMemberTx(ctx, tx, *clone.OrgID, vu.UserID)
+				if err != nil {
+					return err
+				}
+				if !isMember {
+					clog.Warnf("%s: not cloning member %v of vault %v since they are no longer a part of the organization", gServiceName, vu.UserID, src.ID)
+					continue
+				}
+			}
+			_, err := addVaultUser(ctx, tx, clone.ID, vu.UserID, vu.Role)
+			if err != nil {
+				return err
+			}
+		}
+
+		var vts []VaultTeam
+		if _, err = tx.FindByColumn("vault_id", src.ID, &vts); err != nil {
+			return err
+		}
+		for _, vt := range vts {
+			cvt := VaultTeam{VaultID: clone.ID, TeamID: vt.TeamID}
+			if err = tx.InsertOne(&cvt); err != nil {
+				return err
+			}
+		}
+		// This also syncs N with all the members
+		if err = evaluateVault(ctx, tx, clone); err != nil {
+			return err
+		}
+
+		return audit.Record(ctx, tx, audit.RecordRequest{
+			ActorUserID: req.UserID,
+			Action:      AuditActionCloned,
+			EntityType:  auditEntityType,
+			EntityID:    clone.ID,
+			Details:     fmt.Sprintf("cloned from vault %v (%q)", src.ID, src.Name),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return clone, nil
+}
+
+/* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
+* H E L P E R S
+* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
+
+// getTemplate returns the template, with its members, or ErrTemplateNotFound if the user does not have access to it
+func getTemplate(ctx context.Context, tx *orm.Tx, templateID, userID id.ID) (*VaultTemplate, error) {
+	var t VaultTemplate
+	exists, err := tx.FindOne(map[string]interface{}{"id": templateID}, &t)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrTemplateNotFound
+	}
+
+	if t.OrgID == nil && t.OwnerUserID != userID {
+		return nil, ErrTemplateNotFound
+	}
+	if t.OrgID != nil {
+		isMember, err := org.IsMemberTx(ctx, tx, *t.OrgID, userID)
+		if err != nil {
+			return nil, err
+		}
+		if !isMember {
+			return nil, ErrTemplateNotFound
+		}
+	}
+
+	_, err = tx.FindByColumn("vault_template_id", t.ID, &t.Members)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// jsonValue returns v as JSON, to be stored in a JSON column. It's encoded like our API responses, so the stored keys
+// are snake_case.
+func jsonValue(v interface{}) (driver.Value, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// scanJSON reads the value of a JSON column into v
+func scanJSON(src interface{}, v interface{}) error {
+	switch s := src.(type) {
+	case []byte:
+		return json.Unmarshal(s, v)
+	case string:
+		return json.Unmarshal([]byte(s), v)
+	default:
+		return fmt.Errorf("cannot scan %T into %T", src, v)
+	}
+}
+
+// validateItemSchema makes sure that the fields of the schema have unique names and known types
+func validateItemSchema(s ItemSchema) error {
+	var seen = make(map[string]bool)
+	for _, f := range s {
+		name := strings.TrimSpace(f.Name)
+		if name == "" {
+			return fmt.Errorf("item field name is empty")
+		}
+		if seen[strings.ToLower(name)] {
+			return fmt.Errorf("item field '%s' is defined more than once", name)
+		}
+		seen[strings.ToLower(name)] = true
+		if !gItemFieldTypes[f.Type] {
+			return fmt.Errorf("item field '%s' has an invalid type '%s'", name, f.Type)
+		}
+		if f.RotationDays < 0 {
+			return fmt.Errorf("item field '%s' has a negative rotation_days", name)
+		}
+	}
+	return nil
+}
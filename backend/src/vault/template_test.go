@@ -0,0 +1,127 @@
+package vault
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/teejays/n-factor-vault/backend/library/env"
+)
+
+func TestApprovalPolicyIsExpired(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     ApprovalPolicy
+		approvedAt time.Time
+		want       bool
+	}{
+		{
+			name:       "no TTL expires after the default",
+			policy:     ApprovalPolicy{},
+			approvedAt: time.Now().Add(-time.Duration(gDefaultApprovalTTLMinutes+1) * time.Minute),
+			want:       true,
+		},
+		{
+			name:       "no TTL within the default",
+			policy:     ApprovalPolicy{},
+			approvedAt: time.Now().Add(-time.Duration(gDefaultApprovalTTLMinutes-1) * time.Minute),
+			want:       false,
+		},
+		{
+			name:       "approval within the TTL",
+			policy:     ApprovalPolicy{TTLMinutes: 30},
+			approvedAt: time.Now().Add(-10 * time.Minute),
+			want:       false,
+		},
+		{
+			name:       "approval older than the TTL",
+			policy:     ApprovalPolicy{TTLMinutes: 30},
+			approvedAt: time.Now().Add(-31 * time.Minute),
+			want:       true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.policy.IsExpired(tt.approvedAt))
+		})
+	}
+}
+
+func TestApprovalPolicyExpiresAt(t *testing.T) {
+	approvedAt := time.Now()
+	assert.Equal(t, approvedAt.Add(30*time.Minute), ApprovalPolicy{TTLMinutes: 30}.ExpiresAt(approvedAt))
+	assert.Equal(t, approvedAt.Add(time.Duration(gDefaultApprovalTTLMinutes)*time.Minute), ApprovalPolicy{}.ExpiresAt(approvedAt))
+
+	// The default can be configured
+	env.SetEnvVarsMust(map[string]string{"APPROVAL_DEFAULT_TTL_MINUTES": "5"})
+	defer env.UnsetEnvVarsMust(map[string]string{"APPROVAL_DEFAULT_TTL_MINUTES": ""})
+	assert.Equal(t, approvedAt.Add(5*time.Minute), ApprovalPolicy{}.ExpiresAt(approvedAt))
+}
+
+func TestValidateItemSchema(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  ItemSchema
+		wantErr string
+	}{
+		{
+			name:   "empty schema",
+			schema: nil,
+		},
+		{
+			name: "valid schema",
+			schema: ItemSchema{
+				{Name: "username", Type: ItemFieldText, Required: true},
+				{Name: "password", Type: ItemFieldPassword, Required: true},
+				{Name: "totp", Type: ItemFieldTOTP},
+			},
+		},
+		{
+			name:    "empty field name",
+			schema:  ItemSchema{{Name: " ", Type: ItemFieldText}},
+			wantErr: "item field name is empty",
+		},
+		{
+			name:    "duplicate field names",
+			schema:  ItemSchema{{Name: "Password", Type: ItemFieldPassword}, {Name: "password", Type: ItemFieldText}},
+			wantErr: "item field 'password' is defined more than once",
+		},
+		{
+			name:    "invalid field type",
+			schema:  ItemSchema{{Name: "pin", Type: "NUMBER"}},
+			wantErr: "item field 'pin' has an invalid type 'NUMBER'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateItemSchema(tt.schema)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestItemSchemaValueScan(t *testing.T) {
+	s := ItemSchema{{Name: "password", Type: ItemFieldPassword, Required: true}}
+
+	v, err := s.Value()
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"name":"password","type":"PASSWORD","required":true}]`, v)
+
+	var got ItemSchema
+	assert.NoError(t, got.Scan([]byte(v.(string))))
+	assert.Equal(t, s, got)
+
+	// A nil schema is stored as an empty list, and a NULL column is read as one
+	v, err = ItemSchema(nil).Value()
+	assert.NoError(t, err)
+	assert.Equal(t, "[]", v)
+	assert.NoError(t, got.Scan(nil))
+	assert.Equal(t, ItemSchema{}, got)
+
+	assert.Error(t, got.Scan(42))
+}
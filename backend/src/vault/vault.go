@@ -7,6 +7,7 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/teejays/clog"
 
@@ -14,11 +15,16 @@ import (
 	"github.com/teejays/n-factor-vault/backend/library/orm"
 	"github.com/teejays/n-factor-vault/backend/library/util"
 
+	"github.com/teejays/n-factor-vault/backend/src/org"
 	"github.com/teejays/n-factor-vault/backend/src/user"
 )
 
 var gServiceName = "Vault Service"
 
+// ErrServiceAccountMember is returned when adding the user of a service account to a vault. Service accounts get to
+// the vault's secrets through the scopes of their API keys, not as members.
+var ErrServiceAccountMember = fmt.Errorf("service accounts cannot be members of a vault")
+
 /* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
 * O R M   M O D E L S
 * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
@@ -27,11 +33,25 @@ var gServiceName = "Vault Service"
 // TODO: a vault should have hasMany relation with user.User
 // DECISION: do we want to explicitly have hasMany relations across tables?
 type Vault struct {
-	orm.BaseModel `gorm:"embedded"`
-	Name          string      `gorm:"unique_index:idx_name_admin" json:"name"`
-	Description   string      `json:"description"`
-	AdminUserID   id.ID       `gorm:"unique_index:idx_name_admin" json:"admin_user_id"`
-	VaultUsers    []VaultUser `json:"vault_users"`
+	orm.BaseModel          `gorm:"embedded"`
+	OrgID                  *id.ID                 `gorm:"unique_index:idx_vault_org_name" json:"org_id"` // empty for personal vaults
+	Name                   string                 `gorm:"unique_index:idx_vault_org_name" json:"name"`   // unique per admin for personal vaults, see initNameIndexes
+	Description            string                 `json:"description"`
+	AdminUserID            id.ID                  `json:"admin_user_id"`
+	VaultUsers             []VaultUser            `json:"vault_users"`
+	Tags                   []string               `gorm:"-" json:"tags"`                                                               // populated from VaultTag, only when listing vaults
+	ArchivedAt             *time.Time             `json:"archived_at"`                                                                 // archived vaults are read-only
+	PurgeAt                *time.Time             `gorm:"index" json:"purge_at"`                                                       // if set, the vault will be permanently deleted at this time
+	FolderID               *id.ID                 `gorm:"index" json:"folder_id"`                                                      // empty if the vault isn't in a folder
+	ApprovalPolicy         ApprovalPolicy         `gorm:"embedded;embedded_prefix:approval_" json:"approval_policy"`                   // the effective policy, after inheritance
+	ApprovalPolicyOverride ApprovalPolicyOverride `gorm:"embedded;embedded_prefix:approval_override_" json:"approval_policy_override"` // the policy set on the vault itself
+	ItemSchema             ItemSchema             `gorm:"type:jsonb" json:"item_schema"`
+	AccessRestrictions     AccessRestrictions     `gorm:"embedded;embedded_prefix:access_" json:"access_restrictions"`
+}
+
+// IsArchived returns true if the vault has been archived, in which case it should be treated as read-only
+func (v Vault) IsArchived() bool {
+	return v.ArchivedAt != nil
 }
 
 // VaultUser represents the mapping between vault and users that are a part of it. This is not exported
@@ -42,8 +62,23 @@ type VaultUser struct {
 	VaultID       id.ID     `gorm:"unique_index:idx_vault_user" json:"vault_id"`
 	UserID        id.ID     `gorm:"unique_index:idx_vault_user" json:"user_id"`
 	User          user.User `json:"user"`
+	Role          Role      `gorm:"NOT NULL;default:'MEMBER'" json:"role"`
+	FromTeam      bool      `json:"from_team"`   // true if the user is a member because they're in one of the vault's teams
+	FromFolder    bool      `json:"from_folder"` // true if the user is a member because they have a role on the vault's folder
 }
 
+// Role represents the access level that a user has on a vault
+type Role string
+
+const (
+	// RoleOwner can manage the vault itself e.g. rename, archive or delete it
+	RoleOwner Role = "OWNER"
+	// RoleMember can request and approve access to the vault's secrets
+	RoleMember Role = "MEMBER"
+	// RoleNone can only be set on folders, to stop a user from inheriting a role from the folders above
+	RoleNone Role = "NONE"
+)
+
 // ShamirsVault represents the encryption structure of a vault
 type ShamirsVault struct {
 	orm.BaseModel `gorm:"embedded"`
@@ -54,14 +89,52 @@ type ShamirsVault struct {
 
 // Init initializes the service so it can connect with the ORM
 func Init() error {
-	return orm.RegisterModels(&Vault{}, &VaultUser{}, &ShamirsVault{})
+	err := orm.RegisterModels(&Vault{}, &VaultUser{}, &ShamirsVault{}, &VaultTeam{}, &VaultTag{}, &VaultTemplate{}, &VaultTemplateMember{}, &Folder{}, &FolderMember{})
+	if err != nil {
+		return err
+	}
+
+	err = initNameIndexes()
+	if err != nil {
+		return err
+	}
+
+	err = initSearch()
+	if err != nil {
+		return err
+	}
+
+	err = migrateOwnerRoles()
+	if err != nil {
+		return err
+	}
+
+	// When the members of a team change, the vaults that the team is a part of should change with it
+	org.RegisterTeamMembershipHook(syncTeamVaults)
+
+	return nil
+}
+
+// MembershipHookFunc is called, as part of the same transaction, whenever the members of a vault change. It allows
+// other services (e.g. TOTP accounts encrypted for the members of the vault) to keep in sync with the members.
+type MembershipHookFunc func(ctx context.Context, tx *orm.Tx, vaultID id.ID) error
+
+var gMembershipHooks []MembershipHookFunc
+
+// RegisterMembershipHook registers f to be called whenever the members of a vault change
+func RegisterMembershipHook(f MembershipHookFunc) {
+	gMembershipHooks = append(gMembershipHooks, f)
 }
 
 /* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
 * M E T H O D S
 * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
 
+// CreateAndInitializeVaultRequest are the parameters that are passed when creating and initializing a vault. If
+// TemplateID is set, the vault gets the members, threshold, approval policy and item schema of the template. The
+// members in the request are added on top of the template's, and a non-zero K overrides the template's.
 type CreateAndInitializeVaultRequest struct {
+	TemplateID *id.ID
 	CreateVaultRequest
 	CreateShamirVaultRequest
 	AddMemberByEmailsToVaultRequest
@@ -74,9 +147,15 @@ type AddMemberByEmailsToVaultRequest struct {
 
 // CreateVaultRequest are the parameters that are passed when creating a vault
 type CreateVaultRequest struct {
-	AdminUserID id.ID
-	Name        string
-	Description string
+	AdminUserID        id.ID
+	OrgID              *id.ID // optional: the organization that the vault belongs to
+	Name               string
+	Description        string
+	Tags               []string
+	FolderID           *id.ID                 // optional: the folder to create the vault in
+	ApprovalPolicy     ApprovalPolicyOverride // optional: overrides the approval policy inherited from the folder
+	ItemSchema         ItemSchema
+	AccessRestrictions AccessRestrictions // optional: limits where from, and when, the vault's secrets can be accessed
 }
 
 type CreateShamirVaultRequest struct {
@@ -86,12 +165,30 @@ type CreateShamirVaultRequest struct {
 }
 
 type AddUserToVaultRequest struct {
-	VaultID id.ID `json:"vault_id"`
-	UserID  id.ID `json:"user_id"`
+	VaultID     id.ID `json:"vaultId"`
+	UserID      id.ID `json:"userId"`
+	ActorUserID id.ID `json:"-"` // the user adding them, who should own the vault
 }
 
 // CreateVault creates a new vault with the current authenticated user as the admin
 func CreateVault(ctx context.Context, req CreateVaultRequest) (*Vault, error) {
+	var v *Vault
+	err := orm.WithTx(ctx, func(tx *orm.Tx) error {
+		var err error
+		v, err = createVault(ctx, tx, req)
+		if err != nil {
+			return err
+		}
+		// Apply what the vault inherits from its folder
+		return evaluateVault(ctx, tx, v)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func createVault(ctx context.Context, tx *orm.Tx, req CreateVaultRequest) (*Vault, error) {
 	clog.Debugf("vault: creating vault %s", req.Name)
 	var err error
 
@@ -105,61 +202,89 @@ func CreateVault(ctx context.Context, req CreateVaultRequest) (*Vault, error) {
 	if req.AdminUserID.IsEmpty() {
 		return nil, fmt.Errorf("admin userID is empty")
 	}
+	if err = validateItemSchema(req.ItemSchema); err != nil {
+		return nil, err
+	}
+	if err = req.ApprovalPolicy.validate(); err != nil {
+		return nil, err
+	}
+	restrictions, err := cleanAccessRestrictions(req.AccessRestrictions)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only members of an organization can create vaults in it
+	if req.OrgID != nil {
+		if err = requireOrgMember(ctx, tx, *req.OrgID, req.AdminUserID); err != nil {
+			return nil, err
+		}
+	}
 
 	// Create a vault instance
 	v := Vault{
-		Name:        req.Name,
-		Description: req.Description,
-		AdminUserID: req.AdminUserID,
+		OrgID:                  req.OrgID,
+		Name:                   req.Name,
+		Description:            req.Description,
+		AdminUserID:            req.AdminUserID,
+		FolderID:               req.FolderID,
+		ApprovalPolicyOverride: req.ApprovalPolicy,
+		ItemSchema:             req.ItemSchema,
+		AccessRestrictions:     restrictions,
+	}
+
+	// Vaults can only be created in folders that the user has a role on
+	if v.FolderID != nil {
+		if err = requireFolderAccess(ctx, tx, &v, *v.FolderID, req.AdminUserID); err != nil {
+			return nil, err
+		}
 	}
 
-	// Set the vault-user for the user creating this vault.
+	// Set the vault-user for the user creating this vault. The creator owns the vault.
 	vu := VaultUser{
 		UserID: v.AdminUserID,
+		Role:   RoleOwner,
 	}
 	v.VaultUsers = []VaultUser{vu}
 
+	tags, err := cleanTags(req.Tags)
+	if err != nil {
+		return nil, err
+	}
+
 	// Save the Vault, which will be generate the VaultID
-	err = orm.InsertOne(&v)
+	err = tx.InsertOne(&v)
 	if err != nil {
 		return nil, err
 	}
 
+	for _, tag := range tags {
+		vt := VaultTag{VaultID: v.ID, Tag: tag}
+		if err = tx.InsertOne(&vt); err != nil {
+			return nil, err
+		}
+	}
+	v.Tags = tags
+
 	return &v, nil
 }
 
-// CreateAndInitializeVault creates a new vault with the current authenticated user as the admin
+// CreateAndInitializeVault creates a new vault with the current authenticated user as the admin, adds the members
+// to it and sets up its Shamir's config. Either all of it happens, or nothing does.
 func CreateAndInitializeVault(ctx context.Context, req CreateAndInitializeVaultRequest) (*Vault, error) {
 	clog.Debugf("vault: creating vault %s", req.Name)
 	var err error
 
-	// Create Vault instance
-	v, err := CreateVault(ctx, req.CreateVaultRequest)
-	if err != nil {
-		return nil, fmt.Errorf("creating vault: %v", err)
-	}
-
-	// Validate: Minimum Number of Approvals should be greater than 1
-	if req.K < 2 {
-		return nil, fmt.Errorf("minimum number of approvals required should be greater than 1")
-	}
-
 	// Validate: Member emails should be unique
 	errs := util.ValidateUniqueStrings(req.MemberEmails)
 	if len(errs) > 0 {
 		return nil, fmt.Errorf("%v", errs)
 	}
-	// Validate: Number of members should not be less than K
-	if len(req.MemberEmails) < req.K {
-		return nil, fmt.Errorf("number of members should be less than or equal to the minimum number of approvals required")
-	}
-
-	// TODO: Everything in here should happen in a single transaction
 
-	// Create vault users for the existing users on this vault
+	// Get the User object corresponding to each email and make sure that the user exists, before we
+	// start writing anything
+	var members []memberWithRole
+	var seen = make(map[id.ID]bool)
 	for _, email := range req.MemberEmails {
-		// Get the User object corresponding to the email and make sure that the user exists
-		// If it does, add it to the users for the vault
 		u, err := user.GetUserByEmail(email)
 		if err != nil {
 			return nil, err
@@ -167,24 +292,102 @@ func CreateAndInitializeVault(ctx context.Context, req CreateAndInitializeVaultR
 		if u.ID.IsEmpty() {
 			return nil, fmt.Errorf("no user with email %s found", email)
 		}
-		vu := VaultUser{UserID: u.ID}
-		v.VaultUsers = append(v.VaultUsers, vu)
+		members = append(members, memberWithRole{UserID: u.ID, Role: RoleMember})
+		seen[u.ID] = true
 	}
 
-	// Save the Vault, which will add the members
-	err = orm.Save(v)
-	if err != nil {
-		return nil, err
+	// Apply the template, if any
+	if req.TemplateID != nil {
+		t, err := GetTemplate(ctx, *req.TemplateID, req.AdminUserID)
+		if err != nil {
+			return nil, err
+		}
+		if req.OrgID == nil {
+			req.OrgID = t.OrgID
+		}
+		if (t.OrgID == nil) != (req.OrgID == nil) || (t.OrgID != nil && *t.OrgID != *req.OrgID) {
+			return nil, fmt.Errorf("vault template %v cannot be used for vaults of this organization", t.ID)
+		}
+		if req.K == 0 {
+			req.K = t.K
+		}
+		req.ApprovalPolicy = t.ApprovalPolicy.override()
+		req.ItemSchema = t.ItemSchema
+		if strings.TrimSpace(req.Description) == "" {
+			req.Description = t.Description
+		}
+		for _, m := range t.Members {
+			// The creator of the vault is already its owner
+			if seen[m.UserID] || m.UserID == req.AdminUserID {
+				continue
+			}
+			members = append(members, memberWithRole{UserID: m.UserID, Role: m.Role})
+			seen[m.UserID] = true
+		}
 	}
 
-	// Create the instance to store the Shamir's config fot this vault
-	var sc = ShamirsVault{
-		N:       len(v.VaultUsers),
-		K:       req.K,
-		VaultID: v.ID,
+	// Validate: Minimum Number of Approvals should be greater than 1
+	if req.K < 2 {
+		return nil, fmt.Errorf("minimum number of approvals required should be greater than 1")
 	}
+	// Validate: Number of members should not be less than K
+	if len(members) < req.K {
+		return nil, fmt.Errorf("number of members should be less than or equal to the minimum number of approvals required")
+	}
+
+	var v *Vault
+	err = orm.WithTx(ctx, func(tx *orm.Tx) error {
+		var err error
 
-	err = orm.InsertOne(&sc)
+		// Create Vault instance
+		v, err = createVault(ctx, tx, req.CreateVaultRequest)
+		if err != nil {
+			return fmt.Errorf("creating vault: %v", err)
+		}
+
+		// Vaults of an organization should follow the org settings
+		if v.OrgID != nil {
+			o, err := org.GetOrg(ctx, *v.OrgID)
+			if err != nil {
+				return err
+			}
+			if o == nil {
+				return org.ErrOrgNotFound
+			}
+			if req.K < o.MinK {
+				return fmt.Errorf("minimum number of approvals required should be at least %d for vaults of %s", o.MinK, o.Name)
+			}
+		}
+
+		// Create vault users for the members of this vault
+		for _, m := range members {
+			if v.OrgID != nil {
+				if err = requireOrgMember(ctx, tx, *v.OrgID, m.UserID); err != nil {
+					return err
+				}
+			}
+			vu, err := addVaultUser(ctx, tx, v.ID, m.UserID, m.Role)
+			if err != nil {
+				return err
+			}
+			v.VaultUsers = append(v.VaultUsers, *vu)
+		}
+
+		// Create the instance to store the Shamir's config fot this vault
+		var sc = ShamirsVault{
+			N:       len(v.VaultUsers),
+			K:       req.K,
+			VaultID: v.ID,
+		}
+
+		err = tx.InsertOne(&sc)
+		if err != nil {
+			return err
+		}
+
+		// Apply what the vault inherits from its folder. This also syncs N with the inherited members.
+		return evaluateVault(ctx, tx, v)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -218,79 +421,127 @@ func GetVault(ctx context.Context, id id.ID) (*Vault, error) {
 func GetVaultsByUser(ctx context.Context, userID id.ID) ([]*Vault, error) {
 	clog.Debugf("%s: GetVaultsByUsers(): user %v", gServiceName, userID)
 
-	// Get all the vaultIDs associated with the user
-	VaultUsers, err := getVaultUsersByUserID(ctx, userID)
-	if err != nil {
-		return nil, fmt.Errorf("could not get VaultUsers by userID: %v", err)
-	}
-
-	// Get all the associated vaults for those vaultIDs
 	var vaults = []*Vault{}
-	for _, vu := range VaultUsers {
-		v, err := GetVault(ctx, vu.VaultID)
+	var req = ListVaultsRequest{UserID: userID, Limit: gMaxListLimit}
+	for {
+		page, err := ListVaults(ctx, req)
 		if err != nil {
 			return nil, err
 		}
-		vaults = append(vaults, v)
+		vaults = append(vaults, page.Vaults...)
+		if page.NextCursor == "" {
+			break
+		}
+		req.Cursor = page.NextCursor
 	}
+
 	clog.Debugf("%s: GetVaultsByUsers(): user %v: returning:\n%+v", gServiceName, userID, vaults)
 	return vaults, nil
 }
 
+// AddUserToVault adds the user to the vault, and updates the vault's Shamir's config to account for the new member.
+// Requires the owner role.
 func AddUserToVault(ctx context.Context, req AddUserToVaultRequest) (*Vault, error) {
 	clog.Debugf("%s: AddUserToVault(ctx, req): req:\n%+v", gServiceName, req)
 
-	// TODO: Make sure that the user making a request to add someone to a vault
-	// actually has rights/access to add someone to this vault
-	// i.e. at least check that the user is a part of the vault itself
-
-	// Get the vault
-	v, err := GetVault(ctx, req.VaultID)
-	if err != nil {
-		return nil, err
-	}
-	// Add user to the vault
-	err = v.AddUser(ctx, req.UserID)
+	var v Vault
+	err := orm.WithTx(ctx, func(tx *orm.Tx) error {
+		// Get the vault (this locks the vault row until the transaction is done)
+		exists, err := tx.FindByIDForUpdate(req.VaultID, &v)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrVaultNotFound
+		}
+		if err := requireRole(ctx, tx, v.ID, req.ActorUserID, RoleOwner); err != nil {
+			return err
+		}
+		if v.IsArchived() {
+			return ErrVaultArchived
+		}
+		// Add user to the vault
+		return v.addUser(ctx, tx, req.UserID)
+	})
 	if err != nil {
 		return nil, err
 	}
-	return v, nil
+	return &v, nil
 }
 
 // AddUser adds a new user to the vault
 func (v *Vault) AddUser(ctx context.Context, userID id.ID) error {
-	// TODO: Check if user doesn't exist currently
+	return orm.WithTx(ctx, func(tx *orm.Tx) error {
+		return v.addUser(ctx, tx, userID)
+	})
+}
+
+func (v *Vault) addUser(ctx context.Context, tx *orm.Tx, userID id.ID) error {
+	u, err := user.GetUser(userID)
+	if err != nil {
+		return err
+	}
+	if u.ID.IsEmpty() {
+		return fmt.Errorf("no user found with id %v", userID)
+	}
+	if u.ServiceAccount {
+		return ErrServiceAccountMember
+	}
+
+	// Only members of an organization can be a part of its vaults
+	if v.OrgID != nil {
+		if err := requireOrgMember(ctx, tx, *v.OrgID, userID); err != nil {
+			return err
+		}
+	}
+
+	// Make sure that the user isn't already a part of the vault. If they are a part of it through a team or a folder,
+	// they become a direct member.
+	var existing VaultUser
+	exists, err := tx.FindOne(map[string]interface{}{"vault_id": v.ID, "user_id": userID}, &existing)
+	if err != nil {
+		return err
+	}
+	if exists && !existing.FromTeam && !existing.FromFolder {
+		return fmt.Errorf("user %v is already a member of vault %v", userID, v.ID)
+	}
+	if exists {
+		return tx.UpdateColumnsByConditions(map[string]interface{}{"id": existing.ID}, map[string]interface{}{"from_team": false, "from_folder": false}, &VaultUser{})
+	}
 
 	// Create a new VaultUser and add to Vault
-	var vu = VaultUser{
-		UserID:  userID,
-		VaultID: v.ID,
-	}
-	v.VaultUsers = append(v.VaultUsers, vu)
-
-	// // add a new vault user
-	// vu, err := addVaultUser(ctx, v.ID, userID)
-	// if err != nil {
-	// 	return err
-	// }
-	// // if successfully added VaultUser to the database, append it to this vault users
-	// u, err := user.GetUser(vu.UserID)
-	// if err != nil {
-	// 	return err
-	// }
-	// v.Users = append(v.Users, u)
-
-	err := orm.Save(v)
+	vu, err := addVaultUser(ctx, tx, v.ID, userID, RoleMember)
 	if err != nil {
 		return fmt.Errorf("could not save: %v", err)
 	}
-	return nil
+	v.VaultUsers = append(v.VaultUsers, *vu)
+
+	// Keep the total number of share holders in sync
+	return membersChanged(ctx, tx, v.ID)
 }
 
 /* * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * *
 * H E L P E R S
 * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * * */
 
+// initNameIndexes makes the names of personal vaults unique per admin. Org vaults are left out, since their names are
+// unique within the org, and an admin should be able to use the same name in different orgs. This replaces the
+// idx_name_admin index that older versions created over all vaults.
+func initNameIndexes() error {
+	err := orm.Exec(`DROP INDEX IF EXISTS idx_name_admin`)
+	if err != nil {
+		return err
+	}
+	return orm.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_vault_personal_name_admin ON vaults (name, admin_user_id) WHERE org_id IS NULL`)
+}
+
+// migrateOwnerRoles makes the admins of vaults created before roles existed the owners of their vaults. The role column
+// was added with MEMBER as its default, which would otherwise leave those vaults without an owner.
+func migrateOwnerRoles() error {
+	return orm.Exec(`UPDATE vault_users SET role = ? FROM vaults
+		WHERE vault_users.vault_id = vaults.id AND vault_users.user_id = vaults.admin_user_id AND vault_users.role <> ?`, RoleOwner, RoleOwner)
+}
+
 func GetVaultUsersByVaultID(ctx context.Context, vaultID id.ID) ([]*VaultUser, error) {
 	clog.Debugf("%s: GetVaultUsersByVaultID(): vaultID %v", gServiceName, vaultID)
 
@@ -302,22 +553,14 @@ func GetVaultUsersByVaultID(ctx context.Context, vaultID id.ID) ([]*VaultUser, e
 	return VaultUsers, nil
 }
 
-func getVaultUsersByUserID(ctx context.Context, userID id.ID) ([]*VaultUser, error) {
-	clog.Debugf("%s: getVaultUsersByUserID(): userID %v", gServiceName, userID)
-
-	var VaultUsers []*VaultUser
-	var whereConds = map[string]interface{}{
-		"user_id": userID,
-	}
-	_, err := orm.Find(whereConds, &VaultUsers)
-	if err != nil {
-		return nil, err
-	}
-	return VaultUsers, nil
+// memberWithRole is a user who is to be added to a vault with the role
+type memberWithRole struct {
+	UserID id.ID
+	Role   Role
 }
 
-func addVaultUser(ctx context.Context, vaultID, userID id.ID) (*VaultUser, error) {
-	clog.Debugf("%s: addUserToVault(): vaultID <%v> | userID <%v>", gServiceName, userID)
+func addVaultUser(ctx context.Context, tx *orm.Tx, vaultID, userID id.ID, role Role) (*VaultUser, error) {
+	clog.Debugf("%s: addVaultUser(): vaultID <%v> | userID <%v> | role <%v>", gServiceName, vaultID, userID, role)
 
 	if userID.IsEmpty() {
 		return nil, fmt.Errorf("userID is empty")
@@ -330,11 +573,12 @@ func addVaultUser(ctx context.Context, vaultID, userID id.ID) (*VaultUser, error
 	var vu = VaultUser{
 		VaultID: vaultID,
 		UserID:  userID,
+		Role:    role,
 		// TODO: There should be some concept of confirming users into a vault. One they are invited
 		// or request to join, and once they accept or the request is approved, the should be confirmed.
 	}
 
-	err := orm.InsertOne(&vu)
+	err := tx.InsertOne(&vu)
 	if err != nil {
 		return nil, err
 	}